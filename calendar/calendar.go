@@ -0,0 +1,86 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event is a meeting in an iCalendar file. Events with the same UID replace each other in calendars,
+// the one with the greatest Sequence wins
+type Event struct {
+	UID      string
+	Sequence int64
+	// Stamp is when the event is created
+	Stamp       time.Time
+	Start       time.Time
+	Duration    time.Duration
+	Summary     string
+	Description string
+	// URL is an optional link to the call
+	URL string
+	// Cancelled events remove the meeting from calendars
+	Cancelled bool
+}
+
+const (
+	timeLayout = "20060102T150405Z"
+	// lines longer than maxLineLength octets are folded
+	maxLineLength = 75
+)
+
+// ICS returns the iCalendar file with the event, see RFC 5545
+func (e Event) ICS() []byte {
+	method, status := "REQUEST", "CONFIRMED"
+	if e.Cancelled {
+		method, status = "CANCEL", "CANCELLED"
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Random Coffee//Meetings//RU",
+		"METHOD:" + method,
+		"BEGIN:VEVENT",
+		"UID:" + e.UID,
+		fmt.Sprintf("SEQUENCE:%d", e.Sequence),
+		"DTSTAMP:" + e.Stamp.UTC().Format(timeLayout),
+		"DTSTART:" + e.Start.UTC().Format(timeLayout),
+		"DTEND:" + e.Start.Add(e.Duration).UTC().Format(timeLayout),
+		"SUMMARY:" + escape(e.Summary),
+		"DESCRIPTION:" + escape(e.Description),
+		"STATUS:" + status,
+	}
+	if e.URL != "" {
+		lines = append(lines, "URL:"+e.URL, "LOCATION:"+escape(e.URL))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var result strings.Builder
+	for _, line := range lines {
+		result.WriteString(fold(line))
+		result.WriteString("\r\n")
+	}
+	return []byte(result.String())
+}
+
+func escape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+// fold splits the line into lines of at most maxLineLength octets without breaking characters,
+// continuation lines start with a space
+func fold(line string) string {
+	var result strings.Builder
+	length := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if length+size > maxLineLength {
+			result.WriteString("\r\n ")
+			length = 1
+		}
+		result.WriteRune(r)
+		length += size
+	}
+	return result.String()
+}
@@ -0,0 +1,55 @@
+package calendar_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"yandexschooldating/calendar"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventICS(t *testing.T) {
+	event := calendar.Event{
+		UID:         "1-2@randomcoffee",
+		Sequence:    3,
+		Stamp:       time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC),
+		Start:       time.Date(2020, 7, 7, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60)),
+		Duration:    time.Hour,
+		Summary:     "Random Coffee с @bob",
+		Description: "Встреча с @bob, которая будет во вторник; ссылка:\nhttps://example.com",
+		URL:         "https://example.com",
+	}
+	require.Equal(t, strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Random Coffee//Meetings//RU",
+		"METHOD:REQUEST",
+		"BEGIN:VEVENT",
+		"UID:1-2@randomcoffee",
+		"SEQUENCE:3",
+		"DTSTAMP:20200705T042000Z",
+		"DTSTART:20200707T090000Z",
+		"DTEND:20200707T100000Z",
+		"SUMMARY:Random Coffee с @bob",
+		`DESCRIPTION:Встреча с @bob\, которая будет во вто`,
+		` рник\; ссылка:\nhttps://example.com`,
+		"STATUS:CONFIRMED",
+		"URL:https://example.com",
+		"LOCATION:https://example.com",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n"), string(event.ICS()))
+
+	event.Cancelled = true
+	event.URL = ""
+	ics := string(event.ICS())
+	require.Contains(t, ics, "\r\nMETHOD:CANCEL\r\n")
+	require.Contains(t, ics, "\r\nSTATUS:CANCELLED\r\n")
+	require.NotContains(t, ics, "URL:")
+	for _, line := range strings.Split(ics, "\r\n") {
+		require.LessOrEqual(t, len(line), 75)
+	}
+}
@@ -1,9 +1,29 @@
 package clock
 
-import "time"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
+// Clock tells the time and makes timers, so that tests control both
 type Clock interface {
 	Now() time.Time
+	// AfterFunc calls f once the duration elapses, like time.AfterFunc
+	AfterFunc(d time.Duration, f func()) *Timer
+	// NewTimer sends the time on the channel of the timer once the duration elapses, like time.NewTimer
+	NewTimer(d time.Duration) *Timer
+}
+
+// Timer is a timer of a Clock. C is nil for timers made by AfterFunc
+type Timer struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+// Stop prevents the timer from firing. It returns false if the timer has already fired or been stopped
+func (t *Timer) Stop() bool {
+	return t.stop()
 }
 
 type realClock struct{}
@@ -14,10 +34,106 @@ func NewRealClock() Clock {
 
 func (realClock) Now() time.Time { return time.Now() }
 
+func (realClock) AfterFunc(d time.Duration, f func()) *Timer {
+	return &Timer{stop: time.AfterFunc(d, f).Stop}
+}
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	timer := time.NewTimer(d)
+	return &Timer{C: timer.C, stop: timer.Stop}
+}
+
+// Fake stands still until Advance or Set move it. Timers fire only then, even if they are already due,
+// one by one in the order of their deadlines. AfterFunc callbacks are called synchronously,
+// so they must not block on whoever moves the clock
 type Fake struct {
+	// Current may be assigned directly, which does not fire timers
 	Current time.Time
+	mutex   sync.Mutex
+	timers  []*fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	// f is nil for timers made by NewTimer
+	f func()
+	c chan time.Time
 }
 
 func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	return f.Current
 }
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) *Timer {
+	return f.add(&fakeTimer{f: fn}, d)
+}
+
+func (f *Fake) NewTimer(d time.Duration) *Timer {
+	timer := &fakeTimer{c: make(chan time.Time, 1)}
+	result := f.add(timer, d)
+	result.C = timer.c
+	return result
+}
+
+func (f *Fake) add(timer *fakeTimer, d time.Duration) *Timer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	timer.when = f.Current.Add(d)
+	f.timers = append(f.timers, timer)
+	return &Timer{stop: func() bool { return f.remove(timer) }}
+}
+
+func (f *Fake) remove(timer *fakeTimer) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, t := range f.timers {
+		if t == timer {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward and fires the timers that become due
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to the given time and fires the timers due by then.
+// Timers made by the fired callbacks fire as well if they are due
+func (f *Fake) Set(now time.Time) {
+	for {
+		timer := f.popDue(now)
+		if timer == nil {
+			return
+		}
+		if timer.f != nil {
+			timer.f()
+		} else {
+			timer.c <- timer.when
+		}
+	}
+}
+
+// popDue removes and returns the earliest timer due by now, moving the clock to its deadline.
+// When no timers are due, it moves the clock to now and returns nil
+func (f *Fake) popDue(now time.Time) *fakeTimer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	sort.SliceStable(f.timers, func(i, j int) bool { return f.timers[i].when.Before(f.timers[j].when) })
+	if len(f.timers) == 0 || f.timers[0].when.After(now) {
+		if now.After(f.Current) {
+			f.Current = now
+		}
+		return nil
+	}
+	timer := f.timers[0]
+	f.timers = f.timers[1:]
+	if timer.when.After(f.Current) {
+		f.Current = timer.when
+	}
+	return timer
+}
@@ -0,0 +1,57 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"yandexschooldating/clock"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+	fake := &clock.Fake{Current: start}
+
+	var fired []string
+	fake.AfterFunc(2*time.Second, func() {
+		fired = append(fired, "second")
+		require.Equal(t, start.Add(2*time.Second), fake.Now())
+		// a timer made by a callback fires during the same Advance when it is due
+		fake.AfterFunc(time.Second, func() { fired = append(fired, "third") })
+	})
+	fake.AfterFunc(time.Second, func() { fired = append(fired, "first") })
+	stopped := fake.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	require.True(t, stopped.Stop())
+	require.False(t, stopped.Stop())
+
+	timer := fake.NewTimer(5 * time.Second)
+	fake.Advance(0)
+	require.Empty(t, fired)
+
+	fake.Advance(4 * time.Second)
+	require.Equal(t, []string{"first", "second", "third"}, fired)
+	require.Equal(t, start.Add(4*time.Second), fake.Now())
+	require.Empty(t, timer.C)
+
+	fake.Set(start.Add(time.Hour))
+	require.Equal(t, start.Add(5*time.Second), <-timer.C)
+	require.False(t, timer.Stop())
+	require.Equal(t, start.Add(time.Hour), fake.Now())
+
+	// already due timers wait for the clock to move
+	fake.AfterFunc(-time.Second, func() { fired = append(fired, "due") })
+	require.Len(t, fired, 3)
+	fake.Advance(0)
+	require.Len(t, fired, 4)
+}
+
+func TestRealClock(t *testing.T) {
+	real := clock.NewRealClock()
+	fired := make(chan struct{})
+	real.AfterFunc(time.Millisecond, func() { close(fired) })
+	<-fired
+	timer := real.NewTimer(time.Millisecond)
+	<-timer.C
+	require.True(t, real.AfterFunc(time.Hour, func() {}).Stop())
+}
@@ -4,79 +4,190 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"yandexschooldating/clock"
 	"yandexschooldating/config"
+	"yandexschooldating/feedback"
 	"yandexschooldating/match"
+	"yandexschooldating/matcher"
+	"yandexschooldating/matchrun"
 	"yandexschooldating/messagestrings"
+	"yandexschooldating/proposal"
 	"yandexschooldating/reminder"
+	"yandexschooldating/state"
+	"yandexschooldating/transport"
 	"yandexschooldating/user"
 	"yandexschooldating/util"
 
 	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// markups are stored in the user state by these names
+const (
+	removeMarkupName                         = "removeMarkup"
+	citiesKeyboardName                       = "citiesKeyboard"
+	remindStopMeetingsKeyboardName           = "remindStopMeetingsKeyboard"
+	remindChangeTimeStopMeetingsKeyboardName = "remindChangeTimeStopMeetingsKeyboard"
+	activateKeyboardName                     = "activateKeyboard"
+	settingsKeyboardName                     = "settingsKeyboard"
+	interestsKeyboardName                    = "interestsKeyboard"
+)
+
+// meetingTimeLayout is the format of time slots and of times shown to the admin
+const meetingTimeLayout = "02.01 15:04"
+
+// timeSlotLayout is the format of time slots in the buttons data, the year keeps passed slots in the past
+const timeSlotLayout = "02.01.2006 15:04"
+
+// time slots are offered for the next timeSlotDays days at timeSlotHours
+const timeSlotDays = 3
+
+var timeSlotHours = []int{12, 19}
+
+// the admin sees at most failuresShown reminders not delivered during failuresLookBack
+const (
+	failuresShown    = 20
+	failuresLookBack = 7 * 24 * time.Hour
+)
+
+// the admin sees cyclesShown latest matching cycles
+const cyclesShown = 10
+
+var errorReply = "Произошла ужасная ошибка, напиши @" + config.AdminUser
+
 type userState struct {
-	waitingForCity bool
-	waitingForDate bool
-	lastMarkup     interface{}
+	dialog dialogState
+}
+
+type StateStore interface {
+	FindState(ctx context.Context, userID int) (*state.State, error)
+	SaveState(ctx context.Context, state state.State) error
+}
+
+type UserDAO interface {
+	FindActiveUsers(ctx context.Context) ([]user.User, error)
+	FindUserByID(ctx context.Context, ID int) (*user.User, error)
+	FindUserByChatID(ctx context.Context, chatID int64) (*user.User, error)
+	UpsertUser(ctx context.Context, ID int, username, city string, chatID int64, active bool) error
+	UpdateActiveStatus(ctx context.Context, ID int, active bool) error
+	UpdateRemoteFirst(ctx context.Context, ID int, remoteFirst bool) error
+	UpdateReliability(ctx context.Context, ID int, reliability user.Reliability) error
+	UpdateProfile(ctx context.Context, ID int, profile user.Profile) error
+}
+
+type ReminderDAO interface {
+	AddReminder(ctx context.Context, matchID primitive.ObjectID, kind reminder.Kind, reminderTime time.Time, chatID int64, text string) error
+	EnsureReminder(ctx context.Context, ID primitive.ObjectID, matchID primitive.ObjectID, kind reminder.Kind, reminderTime time.Time, chatID int64, text string) error
+	CancelReminders(ctx context.Context, matchID primitive.ObjectID, kinds ...reminder.Kind) error
+	UpdateStatus(ctx context.Context, ID primitive.ObjectID, status reminder.Status, reason string) error
+	FindFailed(ctx context.Context, since time.Time) ([]reminder.Reminder, error)
 }
 
 type MatchDAO interface {
 	FindCurrentMatchForUserID(ctx context.Context, userID int) (*match.Match, error)
-	AddMatch(ctx context.Context, firstID, secondID int) error
+	FindMatchByID(ctx context.Context, ID primitive.ObjectID) (*match.Match, error)
+	AddMatch(ctx context.Context, firstID, secondID int, otherIDs ...int) error
+	SaveMatch(ctx context.Context, match match.Match) error
 	UpdateMatchTime(ctx context.Context, ID int, time time.Time) error
-	IncrementMatchingCycle()
+	MatchingCycle() int
+	StartMatchingCycle(ctx context.Context, cycle match.Cycle) error
+	FindCycles(ctx context.Context, limit int) ([]match.Cycle, error)
 	BreakMatchForUser(ctx context.Context, userID int) error
 	GetAllMatchedUsers(ctx context.Context) ([]int, error)
+	FindRecentMatches(ctx context.Context, lookBack int) ([]match.Match, error)
+}
+
+type RunStore interface {
+	SaveRun(ctx context.Context, run matchrun.Run) error
+	FindUnfinishedRun(ctx context.Context) (*matchrun.Run, error)
+	FindScheduledRun(ctx context.Context, schedule string, scheduledUnixTime int64) (*matchrun.Run, error)
+	FinishRun(ctx context.Context, ID primitive.ObjectID) error
+}
+
+type ProposalStore interface {
+	FindProposal(ctx context.Context, matchID primitive.ObjectID) (*proposal.Proposal, error)
+	SaveProposal(ctx context.Context, proposal proposal.Proposal) error
+	DeleteProposal(ctx context.Context, matchID primitive.ObjectID) error
+}
+
+type FeedbackStore interface {
+	FindFeedback(ctx context.Context, matchID primitive.ObjectID, userID int) (*feedback.Feedback, error)
+	FindLatestFeedback(ctx context.Context, userID int) (*feedback.Feedback, error)
+	FindFeedbackSince(ctx context.Context, matchingCycle int) ([]feedback.Feedback, error)
+	SaveFeedback(ctx context.Context, feedback feedback.Feedback) error
 }
 
 type CoffeeBot struct {
-	userDAO     *user.DAO
+	userDAO     UserDAO
 	matchDAO    MatchDAO
-	reminderDAO *reminder.DAO
+	reminderDAO ReminderDAO
+	stateStore  StateStore
+	runStore    RunStore
+	proposals   ProposalStore
+	feedback    FeedbackStore
 
-	clock clock.Clock
+	clock   clock.Clock
+	matcher matcher.Matcher
 
-	removeMarkup                         interface{}
-	citiesKeyboard                       interface{}
-	remindStopMeetingsKeyboard           interface{}
-	remindChangeTimeStopMeetingsKeyboard interface{}
-	activateKeyboard                     interface{}
+	markups map[string]*transport.Keyboard
+	dialog  map[dialogState]stateDefinition
 
+	// state holds the states of the users involved in the current request, see loadStates and saveStates
 	state map[int]*userState
 }
 
 type BotReply struct {
 	ChatID int64
 	Text   string
-	Markup interface{}
+	Markup *transport.Keyboard
+	// Document is sent with the Text as its caption when set
+	Document *transport.Document
 }
 
 func NewCoffeeBot(
-	userDAO *user.DAO,
+	userDAO UserDAO,
 	matchDAO MatchDAO,
-	reminderDAO *reminder.DAO,
+	reminderDAO ReminderDAO,
+	stateStore StateStore,
+	runStore RunStore,
+	proposals ProposalStore,
+	feedback FeedbackStore,
 	clock clock.Clock,
-	removeMarkup interface{},
-	citiesKeyboard interface{},
-	remindStopMeetingsKeyboard interface{},
-	remindChangeTimeStopMeetingsKeyboard interface{},
-	activateKeyboard interface{},
+	matcher matcher.Matcher,
+	removeMarkup *transport.Keyboard,
+	citiesKeyboard *transport.Keyboard,
+	remindStopMeetingsKeyboard *transport.Keyboard,
+	remindChangeTimeStopMeetingsKeyboard *transport.Keyboard,
+	activateKeyboard *transport.Keyboard,
+	settingsKeyboard *transport.Keyboard,
+	interestsKeyboard *transport.Keyboard,
 ) *CoffeeBot {
 	return &CoffeeBot{
-		userDAO:                              userDAO,
-		matchDAO:                             matchDAO,
-		reminderDAO:                          reminderDAO,
-		clock:                                clock,
-		removeMarkup:                         removeMarkup,
-		citiesKeyboard:                       citiesKeyboard,
-		remindStopMeetingsKeyboard:           remindStopMeetingsKeyboard,
-		remindChangeTimeStopMeetingsKeyboard: remindChangeTimeStopMeetingsKeyboard,
-		activateKeyboard:                     activateKeyboard,
-		state:                                make(map[int]*userState),
+		userDAO:     userDAO,
+		matchDAO:    matchDAO,
+		reminderDAO: reminderDAO,
+		stateStore:  stateStore,
+		runStore:    runStore,
+		proposals:   proposals,
+		feedback:    feedback,
+		clock:       clock,
+		matcher:     matcher,
+		markups: map[string]*transport.Keyboard{
+			removeMarkupName:                         removeMarkup,
+			citiesKeyboardName:                       citiesKeyboard,
+			remindStopMeetingsKeyboardName:           remindStopMeetingsKeyboard,
+			remindChangeTimeStopMeetingsKeyboardName: remindChangeTimeStopMeetingsKeyboard,
+			activateKeyboardName:                     activateKeyboard,
+			settingsKeyboardName:                     settingsKeyboard,
+			interestsKeyboardName:                    interestsKeyboard,
+		},
+		dialog: newDialog(),
+		state:  make(map[int]*userState),
 	}
 }
 
@@ -91,22 +202,109 @@ func (b *CoffeeBot) findUserByID(ctx context.Context, ID int) (*user.User, error
 	return user, nil
 }
 
-func formatMatchMessageWithTime(thisUser *user.User, otherUser *user.User, meetingTime time.Time) string {
-	message := "Встреча с @" + otherUser.Username + " будет " + meetingTime.In(util.GetLocationForCityOrUTC(thisUser.City)).Format("02 January в 15:04 MST")
-	if thisUser.City != otherUser.City {
+func (b *CoffeeBot) findUsersByIDs(ctx context.Context, IDs []int) ([]user.User, error) {
+	var users []user.User
+	for _, ID := range IDs {
+		user, err := b.findUserByID(ctx, ID)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, nil
+}
+
+// without returns a copy of users without the i-th one
+func without(users []user.User, i int) []user.User {
+	return append(append([]user.User(nil), users[:i]...), users[i+1:]...)
+}
+
+// formatUsernames returns "@first", "@first и @second" or "@first, @second и @third"
+func formatUsernames(users []user.User) string {
+	var result string
+	for i, user := range users {
+		switch {
+		case i == 0:
+		case i == len(users)-1:
+			result += " и "
+		default:
+			result += ", "
+		}
+		result += "@" + user.Username
+	}
+	return result
+}
+
+func formatMeetingTime(city string, meetingTime time.Time) string {
+	return meetingTime.In(util.GetLocationForCityOrUTC(city)).Format("02 January в 15:04 MST")
+}
+
+// formatMatchMessageWithTime also tells the city and the local meeting time of every partner from another city
+func formatMatchMessageWithTime(thisUser *user.User, partners []user.User, meetingTime time.Time) string {
+	message := "Встреча с " + formatUsernames(partners) + " будет " + formatMeetingTime(thisUser.City, meetingTime)
+	sameCity := false
+	for _, partner := range partners {
+		if partner.City == thisUser.City {
+			sameCity = true
+		} else {
+			message += fmt.Sprintf(". У @%s (%s) это %s", partner.Username, partner.City, formatMeetingTime(partner.City, meetingTime))
+		}
+	}
+	if !sameCity {
 		message = "Встречи в твоём городе не нашлось. " + message
 	}
 	return message
 }
 
+// formatFailures lists the last failuresShown reminders, one per line
+func formatFailures(reminders []reminder.Reminder) string {
+	if len(reminders) > failuresShown {
+		reminders = reminders[len(reminders)-failuresShown:]
+	}
+	var lines []string
+	for _, r := range reminders {
+		line := fmt.Sprintf("%s UTC, chat %d, %s: %s", time.Unix(r.UnixTime, 0).UTC().Format(meetingTimeLayout), r.ChatID, r.Status, r.Text)
+		if r.Error != "" {
+			line += " (" + r.Error + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatCycles(cycles []match.Cycle) string {
+	var lines []string
+	for _, cycle := range cycles {
+		schedule := "by hand"
+		if cycle.Schedule != "" {
+			schedule = fmt.Sprintf("%q", cycle.Schedule)
+		}
+		lines = append(lines, fmt.Sprintf("#%d %s UTC, %s: %d participants, %d matches, %d unpaired",
+			cycle.Number, cycle.StartTime.UTC().Format(meetingTimeLayout), schedule, len(cycle.Participants), len(cycle.Groups), len(cycle.Unpaired)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatProfileSummary(user *user.User) string {
+	status := messagestrings.NotParticipatingStatus
+	if user.Active {
+		status = messagestrings.ParticipatingStatus
+	}
+	format := messagestrings.LiveFormat
+	if user.RemoteFirst {
+		format = messagestrings.OnlineFormat
+	}
+	return fmt.Sprintf(messagestrings.ProfileSummaryTemplate, user.Username, user.City, status, format)
+}
+
 func (b *CoffeeBot) getMatchOrNoMeetingsReply(ctx context.Context, userID int, chatID int64) (*match.Match, []BotReply, error) {
 	match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, userID)
 	if err != nil {
 		return nil, nil, err
 	}
 	if match == nil {
-		b.setLastMarkup(userID, b.remindStopMeetingsKeyboard)
-		return nil, []BotReply{{chatID, messagestrings.NoMeetingsThisWeek, b.getLastMarkup(userID)}}, nil
+		b.setState(userID, idleState)
+		return nil, []BotReply{{chatID, messagestrings.NoMeetingsThisWeek, b.keyboard(userID), nil}}, nil
 	}
 	return match, nil, nil
 }
@@ -117,8 +315,8 @@ func (b *CoffeeBot) replyInactiveUser(ctx context.Context, userID int, chatID in
 		return nil, err
 	}
 	if !user.Active {
-		b.setLastMarkup(userID, b.activateKeyboard)
-		return []BotReply{{chatID, messagestrings.InactiveUser, b.getLastMarkup(userID)}}, nil
+		b.setState(userID, inactiveState)
+		return []BotReply{{chatID, messagestrings.InactiveUser, b.keyboard(userID), nil}}, nil
 	}
 	return nil, nil
 }
@@ -153,334 +351,959 @@ func (b *CoffeeBot) addMatchAndGetMatchReplies(ctx context.Context, firstUser *u
 	if err != nil {
 		return nil, err
 	}
-	b.setLastMarkup(firstUser.ID, b.remindStopMeetingsKeyboard)
-	b.setLastMarkup(secondUser.ID, b.remindStopMeetingsKeyboard)
+	err = b.loadStates(ctx, firstUser.ID, secondUser.ID)
+	if err != nil {
+		return nil, err
+	}
+	b.setPartnerState(firstUser.ID, idleState)
+	b.setPartnerState(secondUser.ID, idleState)
 	return []BotReply{
-		{firstUser.ChatID, formatMeetingMessage(secondUser.Username), b.getLastMarkup(firstUser.ID)},
-		{secondUser.ChatID, formatMeetingMessage(firstUser.Username), b.getLastMarkup(secondUser.ID)},
+		{firstUser.ChatID, formatMeetingMessage([]user.User{*secondUser}), b.keyboard(firstUser.ID), nil},
+		{secondUser.ChatID, formatMeetingMessage([]user.User{*firstUser}), b.keyboard(secondUser.ID), nil},
 	}, nil
 }
 
+// CallbackReply is the result of pressing an inline button
+type CallbackReply struct {
+	// Answer is shown to the user who pressed the button when not empty
+	Answer string
+	// EditedText replaces the text of the message with the button and removes its inline keyboard when not empty
+	EditedText string
+	Replies    []BotReply
+}
+
 func (b *CoffeeBot) ProcessMessage(ctx context.Context, userID int, username string, chatID int64, text string) ([]BotReply, error) {
-	if b.state[userID] == nil {
-		b.state[userID] = &userState{lastMarkup: b.remindStopMeetingsKeyboard}
+	var replies []BotReply
+	err := b.withStates(ctx, userID, func() error {
+		var err error
+		replies, err = b.processMessage(ctx, message{userID: userID, username: username, chatID: chatID, text: text})
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return replies, nil
+}
 
-	if len(username) == 0 {
-		return []BotReply{{chatID, messagestrings.SorryNoUsername, b.removeMarkup}}, nil
+// ProcessCallback handles a press of an inline button with the data in format action:argument
+func (b *CoffeeBot) ProcessCallback(ctx context.Context, userID int, username string, chatID int64, data string) (*CallbackReply, error) {
+	var reply *CallbackReply
+	err := b.withStates(ctx, userID, func() error {
+		var err error
+		reply, err = b.processCallback(ctx, message{userID: userID, username: username, chatID: chatID}, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return reply, nil
+}
 
-	// TODO: update username
+// withStates runs process between loading the state of the user and saving all the states changed by it
+func (b *CoffeeBot) withStates(ctx context.Context, userID int, process func() error) error {
+	err := b.loadStates(ctx, userID)
+	if err != nil {
+		return err
+	}
+	err = process()
+	saveErr := b.saveStates(ctx)
+	if err != nil {
+		return err
+	}
+	return saveErr
+}
 
-	switch text {
-	case "/start":
-		b.state[userID].waitingForCity = true
-		return []BotReply{{chatID, messagestrings.GreetingAskCity, b.citiesKeyboard}}, nil
-	case messagestrings.RemindMe:
-		replies, err := b.replyInactiveUser(ctx, userID, chatID)
-		if err != nil || replies != nil {
-			return replies, err
+// HandleUpdate replies to a message or a button press received by the transport
+func (b *CoffeeBot) HandleUpdate(ctx context.Context, t transport.Transport, update transport.Update) error {
+	if update.CallbackID != "" {
+		return b.handleCallback(ctx, t, update)
+	}
+	replies, err := b.ProcessMessage(ctx, update.UserID, update.Username, update.ChatID, update.Text)
+	if err != nil {
+		log.Printf("can't get reply %+v", err)
+		replies = []BotReply{{ChatID: update.ChatID, Text: errorReply}}
+	}
+	for i, reply := range replies {
+		message := transport.Message{ChatID: reply.ChatID, Text: reply.Text, Keyboard: reply.Markup, Document: reply.Document}
+		if i == 0 && reply.ChatID == update.ChatID {
+			message.ReplyToMessageID = update.MessageID
 		}
-		match, replies, err := b.getMatchOrNoMeetingsReply(ctx, userID, chatID)
-		if err != nil || replies != nil {
-			return replies, err
+		err = t.Send(message)
+		if err != nil {
+			return errorx.Decorate(err, "can't send message to %d", reply.ChatID)
 		}
-		otherUser, err := b.findUserByID(ctx, match.SecondID)
+	}
+	return nil
+}
+
+// HandleUnreachableChat stops meetings for the user who blocked the bot and rematches their partner
+func (b *CoffeeBot) HandleUnreachableChat(ctx context.Context, t transport.Transport, chatID int64) error {
+	user, err := b.userDAO.FindUserByChatID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	if user == nil || !user.Active {
+		return nil
+	}
+	log.Printf("user %s (id=%d) is unreachable, stopping their meetings", user.Username, user.ID)
+	var replies []BotReply
+	err = b.withStates(ctx, user.ID, func() error {
+		b.setState(user.ID, inactiveState)
+		match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, user.ID)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		err = b.recordRefusal(ctx, user.ID, match)
+		if err != nil {
+			return err
+		}
+		replies, err = b.leaveMeetings(ctx, user.ID, user.Username)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return sendReplies(t, replies)
+}
+
+// reminderDeliveryRecorder is a transport that records the outcome of the delivery of reminders itself, like outbox.Queue
+type reminderDeliveryRecorder interface {
+	RecordsReminderDelivery() bool
+}
+
+// SendReminder sends a reminder that is due and records whether it was sent.
+// Reminders sent through a reminderDeliveryRecorder are only marked as queued
+func (b *CoffeeBot) SendReminder(ctx context.Context, t transport.Transport, r reminder.Reminder) error {
+	status, reason := reminder.Sent, ""
+	if recorder, ok := t.(reminderDeliveryRecorder); ok && recorder.RecordsReminderDelivery() {
+		status = reminder.Queued
+	}
+	message := transport.Message{ChatID: r.ChatID, Text: r.Text, ReminderID: r.ID}
+	if r.Kind == reminder.Feedback {
+		message.Keyboard = feedbackKeyboard(r.MatchID)
+	}
+	sendErr := t.Send(message)
+	if sendErr != nil {
+		status, reason = reminder.Failed, sendErr.Error()
+	}
+	err := b.reminderDAO.UpdateStatus(ctx, r.ID, status, reason)
+	if sendErr != nil {
+		return errorx.Decorate(sendErr, "can't send reminder %s", r.ID.Hex())
+	}
+	return err
+}
+
+func sendReplies(t transport.Transport, replies []BotReply) error {
+	for _, reply := range replies {
+		err := t.Send(transport.Message{ChatID: reply.ChatID, Text: reply.Text, Keyboard: reply.Markup, Document: reply.Document})
+		if err != nil {
+			return errorx.Decorate(err, "can't send message to %d", reply.ChatID)
 		}
+	}
+	return nil
+}
+
+func (b *CoffeeBot) handleCallback(ctx context.Context, t transport.Transport, update transport.Update) error {
+	reply, err := b.ProcessCallback(ctx, update.UserID, update.Username, update.ChatID, update.CallbackData)
+	if err != nil {
+		log.Printf("can't process callback %+v", err)
+		reply = &CallbackReply{Answer: errorReply}
+	}
+	err = t.AnswerCallback(update.CallbackID, reply.Answer)
+	if err != nil {
+		return errorx.Decorate(err, "can't answer callback %s", update.CallbackID)
+	}
+	if reply.EditedText != "" {
+		err = t.Send(transport.Message{ChatID: update.ChatID, Text: reply.EditedText, EditMessageID: update.MessageID})
+		if err != nil {
+			return errorx.Decorate(err, "can't edit message %d", update.MessageID)
+		}
+	}
+	return sendReplies(t, reply.Replies)
+}
+
+func (b *CoffeeBot) start(_ context.Context, message message) ([]BotReply, error) {
+	b.setState(message.userID, waitingForCityState)
+	return []BotReply{{message.chatID, messagestrings.GreetingAskCity, b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) saveCity(ctx context.Context, message message) ([]BotReply, error) {
+	b.setState(message.userID, idleState)
+	city := message.text
+	err := b.userDAO.UpsertUser(ctx, message.userID, message.username, city, message.chatID, true)
+	if err != nil {
+		return nil, err
+	}
+	return []BotReply{{message.chatID, messagestrings.Welcome, b.keyboard(message.userID), nil}}, nil
+}
+
+// findMatchWithPartners returns the current match of an active user or the replies explaining why there is none
+func (b *CoffeeBot) findMatchWithPartners(ctx context.Context, message message) (*match.Match, []user.User, []BotReply, error) {
+	replies, err := b.replyInactiveUser(ctx, message.userID, message.chatID)
+	if err != nil || replies != nil {
+		return nil, nil, replies, err
+	}
+	match, replies, err := b.getMatchOrNoMeetingsReply(ctx, message.userID, message.chatID)
+	if err != nil || replies != nil {
+		return nil, nil, replies, err
+	}
+	partners, err := b.findUsersByIDs(ctx, match.PartnerIDs())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return match, partners, nil, nil
+}
+
+func (b *CoffeeBot) askForMeetingTime(thisUser *user.User, partners []user.User, chatID int64) []BotReply {
+	reply := fmt.Sprintf(messagestrings.AskMeetingTimeTemplate, formatUsernames(partners))
+	_, ok := config.CitiesLocation[thisUser.City]
+	if !ok {
+		reply += ". Поскольку мы не знаем часового пояса для твоего города, время должно быть в формате UTC"
+	}
+	b.setState(thisUser.ID, waitingForDateState)
+	return []BotReply{{chatID, reply, b.timeSlotsKeyboard(thisUser.City), nil}}
+}
+
+// timeSlotsKeyboard offers popular meeting times for the next few days, a slot is saved like a typed time
+func (b *CoffeeBot) timeSlotsKeyboard(city string) *transport.Keyboard {
+	now := b.clock.Now().In(util.GetLocationForCityOrUTC(city))
+	var rows [][]transport.Button
+	for day := 1; day <= timeSlotDays; day++ {
+		date := now.AddDate(0, 0, day)
+		var row []transport.Button
+		for _, hour := range timeSlotHours {
+			slot := time.Date(date.Year(), date.Month(), date.Day(), hour, 0, 0, 0, date.Location())
+			row = append(row, transport.Button{
+				Text: slot.Format(meetingTimeLayout),
+				Data: timeSlotAction + callbackSeparator + slot.Format(timeSlotLayout),
+			})
+		}
+		rows = append(rows, row)
+	}
+	return transport.NewInlineKeyboard(rows...)
+}
+
+func (b *CoffeeBot) remindMe(ctx context.Context, message message) ([]BotReply, error) {
+	match, partners, replies, err := b.findMatchWithPartners(ctx, message)
+	if err != nil || replies != nil {
+		return replies, err
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := b.findProposal(ctx, match.ID)
+	if err != nil {
+		return nil, err
+	}
+	if match.MeetingTime == nil && pending == nil {
+		return b.askForMeetingTime(thisUser, partners, message.chatID), nil
+	}
+	if match.MeetingTime == nil && pending.ProposerID == thisUser.ID {
+		// the user may add more times while waiting for the answer
+		replies = []BotReply{b.proposalSentReply(thisUser, partners, pending)}
+		return append(replies, b.askForMeetingTime(thisUser, partners, message.chatID)...), nil
+	}
+
+	if match.MeetingTime != nil {
+		b.setState(message.userID, meetingScheduledState)
+		reply := formatMatchMessageWithTime(thisUser, partners, *match.MeetingTime)
+		replies = append(replies, BotReply{message.chatID, reply, b.keyboard(message.userID), nil})
+	} else {
+		b.setState(message.userID, idleState)
+	}
+	if pending != nil {
+		replies = append(replies, b.pendingProposalReply(thisUser, partners, pending)...)
+	}
+	return replies, nil
+}
+
+// pendingProposalReply reminds the proposer about the sent times or offers them to a partner of the proposer
+func (b *CoffeeBot) pendingProposalReply(thisUser *user.User, partners []user.User, pending *proposal.Proposal) []BotReply {
+	if pending.ProposerID == thisUser.ID {
+		return []BotReply{b.proposalSentReply(thisUser, partners, pending)}
+	}
+	for i := range partners {
+		if partners[i].ID == pending.ProposerID {
+			return []BotReply{b.proposalReply(thisUser, &partners[i], pending)}
+		}
+	}
+	return nil
+}
+
+func (b *CoffeeBot) changeTime(ctx context.Context, message message) ([]BotReply, error) {
+	_, partners, replies, err := b.findMatchWithPartners(ctx, message)
+	if err != nil || replies != nil {
+		return replies, err
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	return b.askForMeetingTime(thisUser, partners, message.chatID), nil
+}
+
+// enterMeetingTime interprets the typed time and asks the user to confirm it
+func (b *CoffeeBot) enterMeetingTime(ctx context.Context, message message) ([]BotReply, error) {
+	b.setState(message.userID, idleState)
+	_, _, replies, err := b.findMatchWithPartners(ctx, message)
+	if err != nil || replies != nil {
+		return replies, err
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(message.userID, waitingForDateState)
+	meetingTime, ok := parseMeetingTime(message.text, b.clock.Now().In(util.GetLocationForCityOrUTC(thisUser.City)))
+	if !ok {
+		log.Printf("error parsing date %s", message.text)
+		return []BotReply{{message.chatID, messagestrings.CouldNotParseTime, b.keyboard(message.userID), nil}}, nil
+	}
+	if !meetingTime.After(b.clock.Now()) {
+		return []BotReply{{message.chatID, messagestrings.TimeInThePast, b.keyboard(message.userID), nil}}, nil
+	}
+	b.setState(message.userID, confirmingDateState)
+	unixTime := strconv.FormatInt(meetingTime.Unix(), 10)
+	keyboard := transport.NewInlineKeyboard([]transport.Button{
+		{Text: messagestrings.ConfirmTime, Data: confirmTimeAction + callbackSeparator + unixTime},
+		{Text: messagestrings.RejectTime, Data: rejectTimeAction + callbackSeparator + unixTime},
+	})
+	reply := fmt.Sprintf(messagestrings.ConfirmTimeTemplate, formatMeetingTime(thisUser.City, meetingTime))
+	return []BotReply{{message.chatID, reply, keyboard, nil}}, nil
+}
+
+// proposeMeetingTime offers the time to the partners of the user. The times proposed by the user are collected
+// until a partner accepts one of them, a proposal of a partner is replaced, so that the user counter-proposes
+func (b *CoffeeBot) proposeMeetingTime(ctx context.Context, message message, meetingTime time.Time) ([]BotReply, error) {
+	userID := message.userID
+	b.setState(userID, idleState)
+	match, partners, replies, err := b.findMatchWithPartners(ctx, message)
+	if err != nil || replies != nil {
+		return replies, err
+	}
+	thisUser, err := b.findUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !meetingTime.After(b.clock.Now()) {
+		b.setState(userID, waitingForDateState)
+		return []BotReply{{thisUser.ChatID, messagestrings.TimeInThePast, b.keyboard(userID), nil}}, nil
+	}
+	current, err := b.findProposal(ctx, match.ID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.ProposerID != userID {
+		current = &proposal.Proposal{MatchID: match.ID, ProposerID: userID}
+	}
+	if !current.Has(meetingTime) {
+		current.Times = append(current.Times, meetingTime)
+		sort.Slice(current.Times, func(i, j int) bool { return current.Times[i].Before(current.Times[j]) })
+	}
+	err = b.proposals.SaveProposal(ctx, *current)
+	if err != nil {
+		return nil, err
+	}
+
+	if match.MeetingTime != nil {
+		b.setState(userID, meetingScheduledState)
+	}
+	replies = []BotReply{b.proposalSentReply(thisUser, partners, current)}
+	for i := range partners {
+		replies = append(replies, b.proposalReply(&partners[i], thisUser, current))
+	}
+	return replies, nil
+}
+
+// findProposal returns the proposal of the match without the times that have passed, or nil if no time is left
+func (b *CoffeeBot) findProposal(ctx context.Context, matchID primitive.ObjectID) (*proposal.Proposal, error) {
+	found, err := b.proposals.FindProposal(ctx, matchID)
+	if err != nil || found == nil {
+		return nil, err
+	}
+	var upcoming []time.Time
+	for _, proposed := range found.Times {
+		if proposed.After(b.clock.Now()) {
+			upcoming = append(upcoming, proposed)
+		}
+	}
+	if len(upcoming) == 0 {
+		return nil, nil
+	}
+	found.Times = upcoming
+	return found, nil
+}
+
+// formatProposedTimes lists the times in the city of the reader
+func formatProposedTimes(city string, times []time.Time) string {
+	var formatted []string
+	for _, proposed := range times {
+		formatted = append(formatted, formatMeetingTime(city, proposed))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// proposalSentReply tells the proposer which times wait for an answer
+func (b *CoffeeBot) proposalSentReply(proposer *user.User, partners []user.User, proposal *proposal.Proposal) BotReply {
+	text := fmt.Sprintf(messagestrings.ProposalSentTemplate, formatUsernames(partners), formatProposedTimes(proposer.City, proposal.Times))
+	return BotReply{proposer.ChatID, text, b.keyboard(proposer.ID), nil}
+}
+
+// proposalReply offers a partner of the proposer to accept one of the proposed times or to propose another one
+func (b *CoffeeBot) proposalReply(partner *user.User, proposer *user.User, proposal *proposal.Proposal) BotReply {
+	var rows [][]transport.Button
+	for _, proposed := range proposal.Times {
+		rows = append(rows, []transport.Button{{
+			Text: formatMeetingTime(partner.City, proposed),
+			Data: acceptTimeAction + callbackSeparator + strconv.FormatInt(proposed.Unix(), 10),
+		}})
+	}
+	rows = append(rows, []transport.Button{{
+		Text: messagestrings.CounterPropose,
+		Data: counterProposeAction + callbackSeparator + proposal.MatchID.Hex(),
+	}})
+	text := fmt.Sprintf(messagestrings.ProposalTemplate, proposer.Username)
+	return BotReply{partner.ChatID, text, transport.NewInlineKeyboard(rows...), nil}
+}
+
+// saveMeetingTime stores the accepted meeting time of the match and reminds everyone about the meeting.
+// The first participant is the one who accepted the time
+func (b *CoffeeBot) saveMeetingTime(ctx context.Context, match *match.Match, participants []user.User, meetingTime time.Time) ([]BotReply, error) {
+	err := b.loadStates(ctx, match.PartnerIDs()...)
+	if err != nil {
+		return nil, err
+	}
+	err = b.matchDAO.UpdateMatchTime(ctx, match.FirstID, meetingTime)
+	if err != nil {
+		return nil, err
+	}
+	err = b.reminderDAO.CancelReminders(ctx, match.ID, reminder.Meeting, reminder.Feedback)
+	if err != nil {
+		return nil, err
+	}
+	err = b.proposals.DeleteProposal(ctx, match.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	b.setState(match.FirstID, meetingScheduledState)
+	for _, ID := range match.PartnerIDs() {
+		b.setPartnerState(ID, meetingScheduledState)
+	}
+	return b.addMeetingReminders(ctx, match, participants, meetingTime)
+}
 
-		thisUser, err := b.findUserByID(ctx, userID)
+// addMeetingReminders reminds the participants of the match about the meeting, asks them how it went afterwards
+// and returns the replies with the meeting details and the calendar invitations
+func (b *CoffeeBot) addMeetingReminders(ctx context.Context, match *match.Match, participants []user.User, meetingTime time.Time) ([]BotReply, error) {
+	var replies []BotReply
+	reminderTime := meetingTime.Add(-1 * config.NotifyBefore)
+	for i, participant := range participants {
+		message := formatMatchMessageWithTime(&participant, without(participants, i), meetingTime)
+		err := b.reminderDAO.AddReminder(ctx, match.ID, reminder.Meeting, meetingTime, participant.ChatID, message)
 		if err != nil {
 			return nil, err
 		}
-		var reply string
-		if match.MeetingTime == nil {
-			reply = fmt.Sprintf("У тебя встреча с @%s. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04", otherUser.Username)
-			_, ok := config.CitiesLocation[thisUser.City]
-			if !ok {
-				reply += ". Поскольку мы не знаем часового пояса для твоего города, время должно быть в формате UTC"
-			}
-			b.state[userID].waitingForDate = true
-			b.setLastMarkup(userID, b.removeMarkup)
-		} else {
-			reply = formatMatchMessageWithTime(thisUser, otherUser, *match.MeetingTime)
-			b.setLastMarkup(userID, b.remindChangeTimeStopMeetingsKeyboard)
-		}
-		return []BotReply{{chatID, reply, b.getLastMarkup(userID)}}, nil
-	case "MakeMatches":
-		if username == config.AdminUser {
-			err := b.MakeMatches(ctx, b.clock.Now().Add(10*time.Second))
-			var reply string
-			if err == nil {
-				reply = "MakeMatches succeeded"
-			} else {
-				reply = "MakeMatches error: " + err.Error()
+		if reminderTime.Sub(b.clock.Now()).Minutes() >= 1 {
+			err = b.reminderDAO.AddReminder(ctx, match.ID, reminder.Meeting, reminderTime, participant.ChatID, message)
+			if err != nil {
+				return nil, err
 			}
-			return []BotReply{{chatID, reply, b.getLastMarkup(userID)}}, nil
-		}
-	case messagestrings.StopMeetings:
-		reply, err := b.replyInactiveUser(ctx, userID, chatID)
-		if err != nil || reply != nil {
-			return reply, err
 		}
-		err = b.userDAO.UpdateActiveStatus(ctx, userID, false)
+		question := formatFeedbackQuestion(without(participants, i))
+		err = b.reminderDAO.AddReminder(ctx, match.ID, reminder.Feedback, meetingTime.Add(config.FeedbackDelay), participant.ChatID, question)
 		if err != nil {
 			return nil, err
 		}
-		b.setLastMarkup(userID, b.activateKeyboard)
-		replies := []BotReply{{chatID, messagestrings.InactiveUser, b.getLastMarkup(userID)}}
-		log.Printf("extra logging for stop meetings: user %s (id=%d) decided to stop", username, userID)
-		match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, userID)
+		invitation := b.invitation(match, &participant, without(participants, i), meetingTime)
+		replies = append(replies, BotReply{participant.ChatID, message, b.keyboard(participant.ID), invitation})
+	}
+	return replies, nil
+}
+
+func (b *CoffeeBot) makeMatchesCommand(ctx context.Context, message message) ([]BotReply, error) {
+	if message.username != config.AdminUser {
+		return b.defaultReply(ctx, message)
+	}
+	reminderTime := b.clock.Now().Add(10 * time.Second)
+	err := b.makeMatches(ctx, "", time.Time{}, func(user.User) time.Time { return reminderTime })
+	var reply string
+	if err == nil {
+		reply = "MakeMatches succeeded"
+	} else {
+		reply = "MakeMatches error: " + err.Error()
+	}
+	return []BotReply{{message.chatID, reply, b.keyboard(message.userID), nil}}, nil
+}
+
+// failuresCommand shows the admin the reminders that were not delivered recently
+func (b *CoffeeBot) failuresCommand(ctx context.Context, message message) ([]BotReply, error) {
+	if message.username != config.AdminUser {
+		return b.defaultReply(ctx, message)
+	}
+	reminders, err := b.reminderDAO.FindFailed(ctx, b.clock.Now().Add(-failuresLookBack))
+	if err != nil {
+		return nil, err
+	}
+	reply := "No failed reminders"
+	if len(reminders) > 0 {
+		reply = formatFailures(reminders)
+	}
+	return []BotReply{{message.chatID, reply, b.keyboard(message.userID), nil}}, nil
+}
+
+// cyclesCommand shows the admin the latest matching cycles
+func (b *CoffeeBot) cyclesCommand(ctx context.Context, message message) ([]BotReply, error) {
+	if message.username != config.AdminUser {
+		return b.defaultReply(ctx, message)
+	}
+	cycles, err := b.matchDAO.FindCycles(ctx, cyclesShown)
+	if err != nil {
+		return nil, err
+	}
+	reply := "No matching cycles"
+	if len(cycles) > 0 {
+		reply = formatCycles(cycles)
+	}
+	return []BotReply{{message.chatID, reply, b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) stopMeetings(ctx context.Context, message message) ([]BotReply, error) {
+	reply, err := b.replyInactiveUser(ctx, message.userID, message.chatID)
+	if err != nil || reply != nil {
+		return reply, err
+	}
+	b.setState(message.userID, inactiveState)
+	match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	err = b.recordRefusal(ctx, message.userID, match)
+	if err != nil {
+		return nil, err
+	}
+	replies := []BotReply{{message.chatID, messagestrings.InactiveUser, b.keyboard(message.userID), b.cancellation(match, message.userID)}}
+	partnerReplies, err := b.leaveMeetings(ctx, message.userID, message.username)
+	if err != nil {
+		return nil, err
+	}
+	return append(replies, partnerReplies...), nil
+}
+
+// leaveMeetings makes the user inactive and finds a replacement for their partner
+// or lets the rest of the group know. It returns the replies to the partners
+func (b *CoffeeBot) leaveMeetings(ctx context.Context, userID int, username string) ([]BotReply, error) {
+	err := b.userDAO.UpdateActiveStatus(ctx, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	var replies []BotReply
+	log.Printf("extra logging for stop meetings: user %s (id=%d) decided to stop", username, userID)
+	match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("extra logging for stop meetings: match for that user %+v", match)
+	if match == nil {
+		return replies, nil
+	}
+	log.Printf("extra logging for stop meetings: that is not nil")
+	partners, err := b.findUsersByIDs(ctx, match.PartnerIDs())
+	if err != nil {
+		return nil, err
+	}
+	err = b.loadStates(ctx, match.PartnerIDs()...)
+	if err != nil {
+		return nil, err
+	}
+	err = b.reminderDAO.CancelReminders(ctx, match.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(partners) > 1 {
+		log.Printf("extra logging for stop meetings: the rest of the group keeps meeting")
+		err = b.matchDAO.BreakMatchForUser(ctx, userID)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("extra logging for stop meetings: match for that user %+v", match)
-		if match != nil {
-			log.Printf("extra logging for stop meetings: that is not nil")
-			otherUser, err := b.findUserByID(ctx, match.SecondID)
+		for i, partner := range partners {
+			replies = append(replies, BotReply{
+				ChatID: partner.ChatID,
+				Text:   fmt.Sprintf(messagestrings.PartnerLeftGroupTemplate, username, formatUsernames(without(partners, i))),
+				Markup: b.keyboard(partner.ID),
+			})
+		}
+		if match.MeetingTime != nil && match.MeetingTime.After(b.clock.Now()) {
+			restMatch, err := b.matchDAO.FindCurrentMatchForUserID(ctx, partners[0].ID)
 			if err != nil {
 				return nil, err
 			}
-			var replacementUserID *int
-			if match.MeetingTime == nil || match.MeetingTime.Sub(b.clock.Now()).Seconds() > 0 {
-				log.Printf("extra logging for stop meetings: trying to find replacement")
-				replacementUserID, err = b.findActiveUserIDWithoutMatch(ctx)
-				if err != nil {
-					return nil, err
-				}
-				text := messagestrings.PartnerRefused
-				if replacementUserID != nil {
-					log.Printf("extra logging for stop meetings: replacement found %d", *replacementUserID)
-					text += ". Но мы нашли для тебя другую пару"
-				} else {
-					log.Printf("extra logging for stop meetings: replacement not found")
-					b.setLastMarkup(otherUser.ID, b.remindStopMeetingsKeyboard)
-				}
-				replies = append(replies, BotReply{
-					ChatID: otherUser.ChatID,
-					Text:   text,
-					Markup: b.getLastMarkup(otherUser.ID),
-				})
-			} else {
-				log.Printf("extra logging for stop meetings: not trying to find replacement")
+			if restMatch == nil {
+				return nil, errorx.IllegalState.New("the rest of the match for user %d is lost", userID)
 			}
-			err = b.matchDAO.BreakMatchForUser(ctx, userID)
+			meetingReplies, err := b.addMeetingReminders(ctx, restMatch, partners, *match.MeetingTime)
 			if err != nil {
 				return nil, err
 			}
-			if replacementUserID != nil {
-				log.Printf("extra logging for stop meetings: creating replacement match")
-				matchReplies, err := b.addMatchAndGetMatchReplies(ctx, otherUser, *replacementUserID)
-				if err != nil {
-					return nil, err
-				}
-				replies = append(replies, matchReplies...)
-			}
+			replies = append(replies, meetingReplies...)
 		}
 		return replies, nil
-	case messagestrings.Activate:
-		user, err := b.findUserByID(ctx, userID)
+	}
+	otherUser := &partners[0]
+	var replacementUserID *int
+	if match.MeetingTime == nil || match.MeetingTime.Sub(b.clock.Now()).Seconds() > 0 {
+		log.Printf("extra logging for stop meetings: trying to find replacement")
+		replacementUserID, err = b.findActiveUserIDWithoutMatch(ctx)
 		if err != nil {
 			return nil, err
 		}
-		if user.Active {
-			return []BotReply{{chatID, messagestrings.AlreadyActive, b.getLastMarkup(userID)}}, nil
+		text := messagestrings.PartnerRefused
+		if replacementUserID != nil {
+			log.Printf("extra logging for stop meetings: replacement found %d", *replacementUserID)
+			text += ". Но мы нашли для тебя другую пару"
+		} else {
+			log.Printf("extra logging for stop meetings: replacement not found")
+			b.setPartnerState(otherUser.ID, idleState)
 		}
-		otherUserID, err := b.findActiveUserIDWithoutMatch(ctx)
+		replies = append(replies, BotReply{
+			ChatID:   otherUser.ChatID,
+			Text:     text,
+			Markup:   b.keyboard(otherUser.ID),
+			Document: b.cancellation(match, otherUser.ID),
+		})
+	} else {
+		log.Printf("extra logging for stop meetings: not trying to find replacement")
+	}
+	err = b.matchDAO.BreakMatchForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if replacementUserID != nil {
+		log.Printf("extra logging for stop meetings: creating replacement match")
+		matchReplies, err := b.addMatchAndGetMatchReplies(ctx, otherUser, *replacementUserID)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("extra logging for activate: otherUserID %+v", otherUserID)
-		err = b.userDAO.UpdateActiveStatus(ctx, userID, true)
+		replies = append(replies, matchReplies...)
+	}
+	return replies, nil
+}
+
+func (b *CoffeeBot) activate(ctx context.Context, message message) ([]BotReply, error) {
+	userID := message.userID
+	thisUser, err := b.findUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if thisUser.Active {
+		return []BotReply{{message.chatID, messagestrings.AlreadyActive, b.keyboard(userID), nil}}, nil
+	}
+	if !thisUser.Reliability.PausedForMatch.IsZero() {
+		// the user came back, disputing the no-show later does not activate them again
+		thisUser, err = b.updateReliability(ctx, userID, func(reliability *user.Reliability) { reliability.PausedForMatch = primitive.NilObjectID })
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("extra logging for activate: user %d set to active", userID)
-		b.setLastMarkup(userID, b.remindStopMeetingsKeyboard)
-		replies := []BotReply{{chatID, messagestrings.NowActive, b.getLastMarkup(userID)}}
-		if otherUserID != nil {
-			log.Printf("extra logging for activate: other user ID is not nil but %d", *otherUserID)
-			matchReplies, err := b.addMatchAndGetMatchReplies(ctx, user, *otherUserID)
-			if err != nil {
-				return nil, err
-			}
-			replies = append(replies, matchReplies...)
-		} else {
-			log.Printf("extra logging for activate: other user ID is nil")
-		}
-		return replies, nil
-	default:
-		switch {
-		case b.state[userID].waitingForCity:
-			b.state[userID].waitingForCity = false
-			city := text
-			err := b.userDAO.UpsertUser(ctx, userID, username, city, chatID, true)
-			if err != nil {
-				return nil, err
-			}
-			b.setLastMarkup(userID, b.remindStopMeetingsKeyboard)
-			return []BotReply{{chatID, messagestrings.Welcome, b.getLastMarkup(userID)}}, nil
-		case b.state[userID].waitingForDate:
-			b.state[userID].waitingForDate = false
-			replies, err := b.replyInactiveUser(ctx, userID, chatID)
-			if err != nil || replies != nil {
-				return replies, err
-			}
-			match, reply, err := b.getMatchOrNoMeetingsReply(ctx, userID, chatID)
-			if err != nil || reply != nil {
-				return reply, err
-			}
-			thisUser, err := b.findUserByID(ctx, userID)
-			if err != nil {
-				return nil, err
-			}
-			parsedTime, err := time.ParseInLocation("02.01 15:04", text, util.GetLocationForCityOrUTC(thisUser.City))
-			if err == nil {
-				meetingTime := time.Date(
-					b.clock.Now().Year(),
-					parsedTime.Month(),
-					parsedTime.Day(),
-					parsedTime.Hour(),
-					parsedTime.Minute(),
-					parsedTime.Second(),
-					0,
-					parsedTime.Location(),
-				)
-				err = b.matchDAO.UpdateMatchTime(ctx, userID, meetingTime)
-				if err != nil {
-					return nil, err
-				}
-
-				b.setLastMarkup(userID, b.remindChangeTimeStopMeetingsKeyboard)
-				b.setLastMarkup(match.SecondID, b.remindChangeTimeStopMeetingsKeyboard)
-
-				if int(meetingTime.Sub(b.clock.Now()).Seconds()) <= 1 {
-					return []BotReply{{thisUser.ChatID, messagestrings.TimeInThePast, b.getLastMarkup(userID)}}, nil
-				}
-
-				otherUser, err := b.findUserByID(ctx, match.SecondID)
-				if err != nil {
-					return nil, err
-				}
-
-				thisMessage := formatMatchMessageWithTime(thisUser, otherUser, meetingTime)
-				otherMessage := formatMatchMessageWithTime(otherUser, thisUser, meetingTime)
-
-				err = b.reminderDAO.AddReminder(ctx, meetingTime, thisUser.ChatID, thisMessage)
-				if err != nil {
-					return nil, err
-				}
-				err = b.reminderDAO.AddReminder(ctx, meetingTime, otherUser.ChatID, otherMessage)
-				if err != nil {
-					return nil, err
-				}
-
-				reminderTime := meetingTime.Add(-1 * config.NotifyBefore)
-				if reminderTime.Sub(b.clock.Now()).Minutes() >= 1 {
-					err = b.reminderDAO.AddReminder(ctx, reminderTime, thisUser.ChatID, thisMessage)
-					if err != nil {
-						return nil, err
-					}
-					err = b.reminderDAO.AddReminder(ctx, reminderTime, otherUser.ChatID, otherMessage)
-					if err != nil {
-						return nil, err
-					}
-				}
-				return []BotReply{
-					{thisUser.ChatID, thisMessage, b.getLastMarkup(thisUser.ID)},
-					{otherUser.ChatID, otherMessage, b.getLastMarkup(otherUser.ID)},
-				}, nil
-			} else {
-				log.Printf("error parsing date %s", text)
-				b.setLastMarkup(userID, b.remindStopMeetingsKeyboard)
-				return []BotReply{{chatID, messagestrings.CouldNotParseTime, b.getLastMarkup(userID)}}, nil
-			}
-		}
 	}
-	return []BotReply{{chatID, messagestrings.DefaultReply, b.getLastMarkup(userID)}}, nil
+	return b.reactivate(ctx, thisUser, messagestrings.NowActive)
 }
 
-func (b *CoffeeBot) makeMatchesForList(ctx context.Context, reminderTime time.Time, users []user.User) error {
-	for i := 0; i+1 < len(users); i += 2 {
-		err := b.matchDAO.AddMatch(ctx, users[i].ID, users[i+1].ID)
-		if err != nil {
-			return err
-		}
-		b.setLastMarkup(users[i].ID, b.remindStopMeetingsKeyboard)
-		b.setLastMarkup(users[i+1].ID, b.remindStopMeetingsKeyboard)
-		err = b.reminderDAO.AddReminder(ctx, reminderTime, users[i].ChatID, formatMeetingMessage(users[i+1].Username))
-		if err != nil {
-			return err
-		}
-		err = b.reminderDAO.AddReminder(ctx, reminderTime, users[i+1].ChatID, formatMeetingMessage(users[i].Username))
+// reactivate makes the inactive user active and matches them with a user left without a pair if there is one
+func (b *CoffeeBot) reactivate(ctx context.Context, user *user.User, text string) ([]BotReply, error) {
+	userID := user.ID
+	otherUserID, err := b.findActiveUserIDWithoutMatch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("extra logging for activate: otherUserID %+v", otherUserID)
+	err = b.userDAO.UpdateActiveStatus(ctx, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("extra logging for activate: user %d set to active", userID)
+	b.setState(userID, idleState)
+	replies := []BotReply{{user.ChatID, text, b.keyboard(userID), nil}}
+	if otherUserID != nil {
+		log.Printf("extra logging for activate: other user ID is not nil but %d", *otherUserID)
+		matchReplies, err := b.addMatchAndGetMatchReplies(ctx, user, *otherUserID)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		replies = append(replies, matchReplies...)
+	} else {
+		log.Printf("extra logging for activate: other user ID is nil")
 	}
-	return nil
+	return replies, nil
 }
 
-func formatMeetingMessage(username string) string {
-	return fmt.Sprintf(messagestrings.ThisWeekMeetingTemplate, username)
+func (b *CoffeeBot) settings(ctx context.Context, message message) ([]BotReply, error) {
+	user, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(message.userID, settingsState)
+	text := formatProfileSummary(user) + "\n\n" + messagestrings.ChooseMeetingFormat + "\n\n" + messagestrings.EditProfileHint
+	return []BotReply{{message.chatID, text, b.keyboard(message.userID), nil}}, nil
 }
 
+func (b *CoffeeBot) updateMeetingFormat(ctx context.Context, message message) ([]BotReply, error) {
+	err := b.userDAO.UpdateRemoteFirst(ctx, message.userID, message.text == messagestrings.PreferOnline)
+	if err != nil {
+		return nil, err
+	}
+	user, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Active {
+		b.setState(message.userID, idleState)
+	} else {
+		b.setState(message.userID, inactiveState)
+	}
+	return []BotReply{{message.chatID, messagestrings.SettingsSaved + "\n\n" + formatProfileSummary(user), b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) defaultReply(_ context.Context, message message) ([]BotReply, error) {
+	return []BotReply{{message.chatID, messagestrings.DefaultReply, b.keyboard(message.userID), nil}}, nil
+}
+
+// formatMeetingMessage announces the match with the partners and tells what they wrote in their profiles
+func formatMeetingMessage(partners []user.User) string {
+	text := fmt.Sprintf(messagestrings.ThisWeekMeetingTemplate, formatUsernames(partners))
+	for _, partner := range partners {
+		if !partner.Profile.IsEmpty() {
+			text += "\n\n" + fmt.Sprintf(messagestrings.PartnerProfileTemplate, partner.Username, formatProfile(partner.Profile))
+		}
+	}
+	return text
+}
+
+// MakeMatches makes matches and announces them to everyone at reminderTime
 func (b *CoffeeBot) MakeMatches(ctx context.Context, reminderTime time.Time) error {
-	log.Printf("starting MakeMatches with reminderTime %s", reminderTime.String())
-	activeUsers, err := b.userDAO.FindActiveUsers(ctx)
+	return b.makeMatchesAndSaveStates(ctx, "", time.Time{}, func(user.User) time.Time { return reminderTime })
+}
+
+// MakeWeeklyMatches makes the matches of the scheduled run and announces them
+// at config.AnnouncementHour of the run day in the city of every user.
+// A run that has already finished is not repeated, even if saving its time in the schedule failed
+func (b *CoffeeBot) MakeWeeklyMatches(ctx context.Context, runTime time.Time) error {
+	run, err := b.runStore.FindScheduledRun(ctx, config.MatchingSchedule, runTime.Unix())
 	if err != nil {
 		return err
 	}
+	if run != nil && run.State == matchrun.Finished {
+		log.Printf("matching run %s at %s is already finished", run.ID.Hex(), runTime)
+		return nil
+	}
+	return b.makeMatchesAndSaveStates(ctx, config.MatchingSchedule, runTime, func(u user.User) time.Time { return b.announcementTime(runTime, u.City) })
+}
 
-	rand.Shuffle(len(activeUsers), func(i, j int) { activeUsers[i], activeUsers[j] = activeUsers[j], activeUsers[i] })
+func (b *CoffeeBot) announcementTime(runTime time.Time, city string) time.Time {
+	day := runTime.In(config.ScheduleLocation)
+	announcementTime := time.Date(day.Year(), day.Month(), day.Day(), config.AnnouncementHour, 0, 0, 0, util.GetLocationForCityOrUTC(city))
+	// the hour has already passed in cities far to the east or if the run was late
+	if now := b.clock.Now(); announcementTime.Before(now) {
+		return now
+	}
+	return announcementTime
+}
 
-	cities := make(map[string][]user.User)
-	var leftovers []user.User
-	for _, user := range activeUsers {
-		if user.RemoteFirst {
-			leftovers = append(leftovers, user)
-		} else {
-			cities[user.City] = append(cities[user.City], user)
-		}
+// ResumeMatchingRun finishes the matching run interrupted by an error or a restart, if there is one
+func (b *CoffeeBot) ResumeMatchingRun(ctx context.Context) error {
+	run, err := b.runStore.FindUnfinishedRun(ctx)
+	if err != nil || run == nil {
+		return err
+	}
+	log.Printf("resuming matching run %s", run.ID.Hex())
+	err = b.applyRun(ctx, *run)
+	saveErr := b.saveStates(ctx)
+	if err != nil {
+		return err
 	}
+	return saveErr
+}
 
-	b.matchDAO.IncrementMatchingCycle()
+func (b *CoffeeBot) makeMatchesAndSaveStates(ctx context.Context, schedule string, scheduled time.Time, announcementTime func(user.User) time.Time) error {
+	err := b.makeMatches(ctx, schedule, scheduled, announcementTime)
+	saveErr := b.saveStates(ctx)
+	if err != nil {
+		return err
+	}
+	return saveErr
+}
 
-	for _, users := range cities {
-		err = b.makeMatchesForList(ctx, reminderTime, users)
+// makeMatches resumes the unfinished matching run if there is one, otherwise it plans a new run, then applies it.
+// schedule is the spec of the schedule that started the run at the scheduled time, empty if it was started by hand
+func (b *CoffeeBot) makeMatches(ctx context.Context, schedule string, scheduled time.Time, announcementTime func(user.User) time.Time) error {
+	run, err := b.runStore.FindUnfinishedRun(ctx)
+	if err != nil {
+		return err
+	}
+	if run != nil {
+		log.Printf("resuming matching run %s", run.ID.Hex())
+	} else {
+		run, err = b.planMatches(ctx, schedule, scheduled, announcementTime)
 		if err != nil {
 			return err
 		}
-		if len(users)%2 == 1 {
-			leftovers = append(leftovers, users[len(users)-1])
+	}
+	return b.applyRun(ctx, *run)
+}
+
+// planMatches computes the matches of the next matching cycle and their announcements and saves them as a planned run
+func (b *CoffeeBot) planMatches(ctx context.Context, schedule string, scheduled time.Time, announcementTime func(user.User) time.Time) (*matchrun.Run, error) {
+	log.Printf("planning matches")
+	activeUsers, err := b.userDAO.FindActiveUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recentMatches, err := b.findRecentMeetings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, unpaired := b.matcher.Match(activeUsers, match.NewHistory(recentMatches))
+
+	run := matchrun.Run{
+		ID:            primitive.NewObjectID(),
+		MatchingCycle: b.matchDAO.MatchingCycle() + 1,
+		State:         matchrun.Planned,
+		StartUnixTime: b.clock.Now().Unix(),
+		Schedule:      schedule,
+	}
+	if !scheduled.IsZero() {
+		run.ScheduledUnixTime = scheduled.Unix()
+	}
+	for _, activeUser := range activeUsers {
+		run.Participants = append(run.Participants, activeUser.ID)
+	}
+	announce := func(matchID primitive.ObjectID, member user.User, text string) {
+		run.Announcements = append(run.Announcements, matchrun.Announcement{
+			ReminderID: primitive.NewObjectID(),
+			MatchID:    matchID,
+			UserID:     member.ID,
+			ChatID:     member.ChatID,
+			UnixTime:   announcementTime(member).Unix(),
+			Text:       text,
+		})
+	}
+	for _, group := range groups {
+		planned := matchrun.Group{MatchID: primitive.NewObjectID()}
+		for i, member := range group {
+			planned.UserIDs = append(planned.UserIDs, member.ID)
+			announce(planned.MatchID, member, formatMeetingMessage(without(group, i)))
 		}
+		run.Groups = append(run.Groups, planned)
+	}
+	for _, lastUser := range unpaired {
+		announce(primitive.NilObjectID, lastUser, messagestrings.CouldNotFindMatch)
 	}
 
-	rand.Shuffle(len(leftovers), func(i, j int) { leftovers[i], leftovers[j] = leftovers[j], leftovers[i] })
+	err = b.runStore.SaveRun(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
 
-	err = b.makeMatchesForList(ctx, reminderTime, leftovers)
+// isFree is true for an active user without a current match other than matchID.
+// Users of a resumed run may have left or got another match since the run was planned
+func (b *CoffeeBot) isFree(ctx context.Context, userID int, matchID primitive.ObjectID) (bool, error) {
+	user, err := b.userDAO.FindUserByID(ctx, userID)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if len(leftovers)%2 == 1 {
-		lastUser := leftovers[len(leftovers)-1]
-		b.setLastMarkup(lastUser.ID, b.remindStopMeetingsKeyboard)
-		return b.reminderDAO.AddReminder(ctx, reminderTime, lastUser.ChatID, messagestrings.CouldNotFindMatch)
+	if user == nil || !user.Active {
+		return false, nil
 	}
-	return nil
+	current, err := b.matchDAO.FindCurrentMatchForUserID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return current == nil || current.ID == matchID, nil
 }
 
-func (b *CoffeeBot) setLastMarkup(userID int, markup interface{}) {
-	if b.state[userID] == nil {
-		b.state[userID] = &userState{lastMarkup: markup}
-	} else {
-		b.state[userID].lastMarkup = markup
+// applyRun makes the matches of the run and schedules their announcements. Every step can be repeated safely.
+// Groups with members who are no longer free are skipped, their other members are told there is no match for them
+func (b *CoffeeBot) applyRun(ctx context.Context, run matchrun.Run) error {
+	cycle := match.Cycle{
+		Number:       run.MatchingCycle,
+		StartTime:    time.Unix(run.StartUnixTime, 0),
+		Schedule:     run.Schedule,
+		Participants: run.Participants,
+	}
+	for _, group := range run.Groups {
+		cycle.Groups = append(cycle.Groups, group.UserIDs)
+	}
+	for _, announcement := range run.Announcements {
+		if announcement.MatchID.IsZero() {
+			cycle.Unpaired = append(cycle.Unpaired, announcement.UserID)
+		}
+	}
+	err := b.matchDAO.StartMatchingCycle(ctx, cycle)
+	if err != nil {
+		return err
+	}
+	skipped := make(map[primitive.ObjectID]bool)
+	for _, group := range run.Groups {
+		for _, userID := range group.UserIDs {
+			free, err := b.isFree(ctx, userID, group.MatchID)
+			if err != nil {
+				return err
+			}
+			if !free {
+				log.Printf("skipping group %s of matching run %s: user %d is not free", group.MatchID.Hex(), run.ID.Hex(), userID)
+				skipped[group.MatchID] = true
+				break
+			}
+		}
+		if skipped[group.MatchID] {
+			continue
+		}
+		callRoom, err := match.NewCallRoom()
+		if err != nil {
+			return err
+		}
+		err = b.matchDAO.SaveMatch(ctx, match.Match{
+			ID:            group.MatchID,
+			FirstID:       group.UserIDs[0],
+			SecondID:      group.UserIDs[1],
+			OtherIDs:      group.UserIDs[2:],
+			MatchUnixTime: run.StartUnixTime,
+			MatchingCycle: run.MatchingCycle,
+			CallRoom:      callRoom,
+		})
+		if err != nil {
+			return err
+		}
 	}
-}
 
-func (b *CoffeeBot) getLastMarkup(userID int) interface{} {
-	if b.state[userID] == nil {
-		b.state[userID] = &userState{lastMarkup: b.remindStopMeetingsKeyboard}
+	now := b.clock.Now()
+	for _, announcement := range run.Announcements {
+		if announcement.MatchID.IsZero() || skipped[announcement.MatchID] {
+			free, err := b.isFree(ctx, announcement.UserID, primitive.NilObjectID)
+			if err != nil {
+				return err
+			}
+			if !free {
+				continue
+			}
+			announcement.MatchID, announcement.Text = primitive.NilObjectID, messagestrings.CouldNotFindMatch
+		}
+		err := b.loadStates(ctx, announcement.UserID)
+		if err != nil {
+			return err
+		}
+		b.setPartnerState(announcement.UserID, idleState)
+		// the announcements of a resumed run may be late
+		announcementTime := time.Unix(announcement.UnixTime, 0)
+		if announcementTime.Before(now) {
+			announcementTime = now
+		}
+		err = b.reminderDAO.EnsureReminder(ctx, announcement.ReminderID, announcement.MatchID, reminder.Announcement, announcementTime, announcement.ChatID, announcement.Text)
+		if err != nil {
+			return err
+		}
 	}
-	return b.state[userID].lastMarkup
+	return b.runStore.FinishRun(ctx, run.ID)
 }
@@ -2,8 +2,10 @@ package coffeebot_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -11,14 +13,21 @@ import (
 	"yandexschooldating/clock"
 	"yandexschooldating/coffeebot"
 	"yandexschooldating/config"
+	"yandexschooldating/feedback"
 	"yandexschooldating/match"
+	"yandexschooldating/matcher"
+	"yandexschooldating/matchrun"
 	"yandexschooldating/messagestrings"
+	"yandexschooldating/outbox"
+	"yandexschooldating/proposal"
 	"yandexschooldating/reminder"
+	"yandexschooldating/state"
+	"yandexschooldating/transport"
 	"yandexschooldating/user"
 	"yandexschooldating/util"
 
 	"github.com/stretchr/testify/require"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -28,9 +37,32 @@ func requireSingleReplyText(t *testing.T, replies []coffeebot.BotReply, expected
 	require.Equal(t, expectedText, replies[0].Text)
 }
 
+// enterMeetingTime types the time and confirms how the bot understood it, returning the replies to the confirmation
+func enterMeetingTime(t *testing.T, ctx context.Context, bot *coffeebot.CoffeeBot, userID int, username string, text string) []coffeebot.BotReply {
+	replies, err := bot.ProcessMessage(ctx, userID, username, int64(userID), text)
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	require.NotNil(t, replies[0].Markup)
+	callback, err := bot.ProcessCallback(ctx, userID, username, int64(userID), replies[0].Markup.Rows[0][0].Data)
+	require.NoError(t, err)
+	return callback.Replies
+}
+
+// agreeOnMeetingTime proposes the typed time and lets a partner accept it, returning the replies to the acceptance.
+// The partner is found by the chat of the proposal, chats of test users have the IDs of the users
+func agreeOnMeetingTime(t *testing.T, ctx context.Context, bot *coffeebot.CoffeeBot, userID int, username string, text string) []coffeebot.BotReply {
+	replies := enterMeetingTime(t, ctx, bot, userID, username, text)
+	require.GreaterOrEqual(t, len(replies), 2)
+	proposal := replies[len(replies)-1]
+	require.Equal(t, fmt.Sprintf(messagestrings.ProposalTemplate, username), proposal.Text)
+	callback, err := bot.ProcessCallback(ctx, int(proposal.ChatID), "partner", proposal.ChatID, proposal.Markup.Rows[0][0].Data)
+	require.NoError(t, err)
+	return callback.Replies
+}
+
 type fakeMatchDAO struct {
-	addMatchCalls int
-	matchingCycle int
+	saveMatchCalls int
+	matchingCycle  int
 }
 
 func (f *fakeMatchDAO) BreakMatchForUser(context.Context, int) error {
@@ -41,12 +73,24 @@ func (f *fakeMatchDAO) GetAllMatchedUsers(context.Context) ([]int, error) {
 	panic("unimplemented")
 }
 
+func (f *fakeMatchDAO) FindRecentMatches(context.Context, int) ([]match.Match, error) {
+	return nil, nil
+}
+
 func (f *fakeMatchDAO) FindCurrentMatchForUserID(context.Context, int) (*match.Match, error) {
+	return nil, nil
+}
+
+func (f *fakeMatchDAO) FindMatchByID(context.Context, primitive.ObjectID) (*match.Match, error) {
+	panic("unimplemented")
+}
+
+func (f *fakeMatchDAO) AddMatch(context.Context, int, int, ...int) error {
 	panic("unimplemented")
 }
 
-func (f *fakeMatchDAO) AddMatch(context.Context, int, int) error {
-	f.addMatchCalls++
+func (f *fakeMatchDAO) SaveMatch(context.Context, match.Match) error {
+	f.saveMatchCalls++
 	return nil
 }
 
@@ -54,8 +98,45 @@ func (f *fakeMatchDAO) UpdateMatchTime(context.Context, int, time.Time) error {
 	panic("unimplemented")
 }
 
-func (f *fakeMatchDAO) IncrementMatchingCycle() {
-	f.matchingCycle++
+func (f *fakeMatchDAO) MatchingCycle() int {
+	return f.matchingCycle
+}
+
+func (f *fakeMatchDAO) StartMatchingCycle(_ context.Context, cycle match.Cycle) error {
+	f.matchingCycle = cycle.Number
+	return nil
+}
+
+func (f *fakeMatchDAO) FindCycles(context.Context, int) ([]match.Cycle, error) {
+	panic("unimplemented")
+}
+
+// failingReminderDAO fails to add reminders once failAfter of them are added, like the storage going away in the middle of a matching run
+type failingReminderDAO struct {
+	coffeebot.ReminderDAO
+	failAfter int
+}
+
+func (f *failingReminderDAO) EnsureReminder(ctx context.Context, ID primitive.ObjectID, matchID primitive.ObjectID, kind reminder.Kind, reminderTime time.Time, chatID int64, text string) error {
+	if f.failAfter == 0 {
+		return errors.New("connection lost")
+	}
+	f.failAfter--
+	return f.ReminderDAO.EnsureReminder(ctx, ID, matchID, kind, reminderTime, chatID, text)
+}
+
+// failingMatchDAO fails to save matches once failAfter of them are saved
+type failingMatchDAO struct {
+	coffeebot.MatchDAO
+	failAfter int
+}
+
+func (f *failingMatchDAO) SaveMatch(ctx context.Context, match match.Match) error {
+	if f.failAfter == 0 {
+		return errors.New("connection lost")
+	}
+	f.failAfter--
+	return f.MatchDAO.SaveMatch(ctx, match)
 }
 
 func randSeq() string {
@@ -70,21 +151,31 @@ func randSeq() string {
 type testContext struct {
 	database    string
 	client      *mongo.Client
-	userDAO     *user.DAO
+	userDAO     coffeebot.UserDAO
 	clock       clock.Clock
 	matchDAO    coffeebot.MatchDAO
 	queue       chan reminder.Reminder
-	reminderDAO *reminder.DAO
+	reminderDAO coffeebot.ReminderDAO
+	stateStore  coffeebot.StateStore
+	runStore    coffeebot.RunStore
+	proposals   coffeebot.ProposalStore
+	feedback    coffeebot.FeedbackStore
 	bot         *coffeebot.CoffeeBot
 
-	removeMarkup                         int
-	citiesKeyboard                       int
-	remindStopMeetingsKeyboard           int
-	remindChangeTimeStopMeetingsKeyboard int
-	activateKeyboard                     int
+	removeMarkup                         transport.Keyboard
+	citiesKeyboard                       transport.Keyboard
+	remindStopMeetingsKeyboard           transport.Keyboard
+	remindChangeTimeStopMeetingsKeyboard transport.Keyboard
+	activateKeyboard                     transport.Keyboard
+	settingsKeyboard                     transport.Keyboard
+	interestsKeyboard                    transport.Keyboard
 }
 
+// newTestContext returns a context over a new mongo database. With -short the context is in memory and does not need mongo
 func newTestContext(ctx context.Context) testContext {
+	if testing.Short() {
+		return newMemoryTestContext()
+	}
 	testDatabase := "test_coffeebot" + randSeq()
 	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
 	if err != nil {
@@ -94,43 +185,112 @@ func newTestContext(ctx context.Context) testContext {
 	return testContext{database: testDatabase, client: client}
 }
 
-func (m *testContext) init(ctx context.Context, clock clock.Clock) func() {
-	m.removeMarkup = 1
-	m.citiesKeyboard = 2
-	m.remindStopMeetingsKeyboard = 3
-	m.remindChangeTimeStopMeetingsKeyboard = 4
-	m.activateKeyboard = 5
-
-	m.userDAO = user.NewDAO(m.client, m.database)
+// newMemoryTestContext returns a context that keeps everything in memory and does not need mongo
+func newMemoryTestContext() testContext {
+	return testContext{}
+}
 
-	m.clock = clock
-	m.matchDAO = match.NewDAO(m.client, m.database, m.clock)
-	err := m.matchDAO.(*match.DAO).InitializeMatchingCycle(ctx)
-	if err != nil {
-		panic(err)
-	}
-	m.queue = make(chan reminder.Reminder)
-	m.reminderDAO = reminder.NewDAO(m.client, m.database, m.queue, m.clock)
-	err = m.reminderDAO.PopulateReminderQueue(ctx)
-	if err != nil {
-		panic(err)
-	}
-	m.bot = coffeebot.NewCoffeeBot(
+// newBot returns a bot over the same storage, like the bot after a restart
+func (m *testContext) newBot() *coffeebot.CoffeeBot {
+	return coffeebot.NewCoffeeBot(
 		m.userDAO,
 		m.matchDAO,
 		m.reminderDAO,
+		m.stateStore,
+		m.runStore,
+		m.proposals,
+		m.feedback,
 		m.clock,
+		matcher.NewWeighted(m.clock, false),
 		&m.removeMarkup,
 		&m.citiesKeyboard,
 		&m.remindStopMeetingsKeyboard,
 		&m.remindChangeTimeStopMeetingsKeyboard,
 		&m.activateKeyboard,
+		&m.settingsKeyboard,
+		&m.interestsKeyboard,
 	)
+}
+
+func (m *testContext) init(ctx context.Context, clock clock.Clock) func() {
+	m.removeMarkup = *transport.RemoveKeyboard()
+	m.citiesKeyboard = *transport.NewKeyboard([]string{"cities"})
+	m.remindStopMeetingsKeyboard = *transport.NewKeyboard([]string{"remind", "stop"})
+	m.remindChangeTimeStopMeetingsKeyboard = *transport.NewKeyboard([]string{"remind", "change time", "stop"})
+	m.activateKeyboard = *transport.NewKeyboard([]string{"activate"})
+	m.settingsKeyboard = *transport.NewKeyboard([]string{"settings"})
+	m.interestsKeyboard = *transport.NewKeyboard(config.InterestTags, []string{messagestrings.InterestsDone})
+
+	m.clock = clock
+	// clock.Fake delivers reminders synchronously, the buffer keeps them until the test takes them
+	m.queue = make(chan reminder.Reminder, 100)
+	if m.client == nil {
+		m.userDAO = user.NewMemoryDAO()
+		m.matchDAO = match.NewMemoryDAO(m.clock)
+		m.reminderDAO = reminder.NewMemoryDAO(m.queue, m.clock)
+		m.stateStore = state.NewMemoryDAO(m.clock)
+		m.runStore = matchrun.NewMemoryDAO()
+		m.proposals = proposal.NewMemoryDAO()
+		m.feedback = feedback.NewMemoryDAO()
+	} else {
+		m.userDAO = user.NewDAO(m.client, m.database)
+		m.matchDAO = match.NewDAO(m.client, m.database, m.clock)
+		err := m.matchDAO.(*match.DAO).InitializeMatchingCycle(ctx)
+		if err != nil {
+			panic(err)
+		}
+		reminderDAO := reminder.NewDAO(m.client, m.database, m.queue, m.clock)
+		err = reminderDAO.PopulateReminderQueue(ctx)
+		if err != nil {
+			panic(err)
+		}
+		m.reminderDAO = reminderDAO
+		m.stateStore = state.NewDAO(m.client, m.database, m.clock)
+		m.runStore = matchrun.NewDAO(m.client, m.database)
+		m.proposals = proposal.NewDAO(m.client, m.database)
+		m.feedback = feedback.NewDAO(m.client, m.database)
+	}
+	m.bot = m.newBot()
+	if m.client == nil {
+		return func() {}
+	}
 	return func() { util.DropTestDatabaseOrPanic(ctx, m.client, m.database) }
 }
 
+// restart replaces the bot and the reminder timers like a restart of the bot, the stored data is kept
+func (m *testContext) restart(ctx context.Context) {
+	if m.client != nil {
+		m.init(ctx, m.clock)
+		return
+	}
+	m.queue = make(chan reminder.Reminder, 100)
+	reminderDAO := m.reminderDAO.(*reminder.MemoryDAO).Restarted(m.queue, m.clock)
+	err := reminderDAO.PopulateReminderQueue(ctx)
+	if err != nil {
+		panic(err)
+	}
+	m.reminderDAO = reminderDAO
+	m.bot = m.newBot()
+}
+
+// takeReminders requires exactly n reminders to be due and sends them like the main loop does,
+// so that they are not delivered again after a restart
+func (m *testContext) takeReminders(t *testing.T, n int) []reminder.Reminder {
+	require.Len(t, m.queue, n)
+	var result []reminder.Reminder
+	for i := 0; i < n; i++ {
+		r := <-m.queue
+		require.NoError(t, m.bot.SendReminder(context.Background(), transport.NewMemory(), r))
+		result = append(result, r)
+	}
+	return result
+}
+
 func TestCoffeeBot(t *testing.T) {
 	ctx := context.Background()
+	if testing.Short() {
+		t.Log("short mode: the chat tests run in memory, the mongo variants are skipped")
+	}
 
 	t.Run("Chat test with 4 London users, 4 Moscow users and 2 users from obscure places", func(t *testing.T) {
 		fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
@@ -174,17 +334,16 @@ func TestCoffeeBot(t *testing.T) {
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(3*time.Second))
 		require.NoError(t, err)
 
-		start := time.Now()
-		tick := <-test.queue
-		elapsed := time.Since(start).Seconds()
-		fakeClock.Current = fakeClock.Current.Add(10 * time.Second)
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, 2.0, elapsed)
-		require.LessOrEqual(t, elapsed, 4.0)
+		fakeClock.Advance(2 * time.Second)
+		test.takeReminders(t, 0)
+		fakeClock.Advance(8 * time.Second)
+		tick := test.takeReminders(t, 1)[0]
 		require.Equal(t, int64(1), tick.ChatID)
 		require.Equal(t, messagestrings.CouldNotFindMatch, tick.Text)
 
-		require.Equal(t, mongo.ErrNoDocuments, test.client.Database(test.database).Collection("matches").FindOne(ctx, bson.M{}).Err())
+		matches, err := test.matchDAO.FindRecentMatches(ctx, 100)
+		require.NoError(t, err)
+		require.Empty(t, matches)
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "jack", 2, "/start")
 		require.NoError(t, err)
@@ -252,43 +411,23 @@ func TestCoffeeBot(t *testing.T) {
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(3*time.Second))
 		require.NoError(t, err)
 
-		var reminders []reminder.Reminder
-		start = time.Now()
-
-		for i := 0; i < 10; i++ {
-			reminders = append(reminders, <-test.queue)
-		}
-
-		elapsed = time.Since(start).Seconds()
-		fakeClock.Current = fakeClock.Current.Add(10 * time.Second)
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, 2.0, elapsed)
-		require.LessOrEqual(t, elapsed, 4.0)
+		fakeClock.Advance(2 * time.Second)
+		test.takeReminders(t, 0)
+		fakeClock.Advance(8 * time.Second)
+		reminders := test.takeReminders(t, 10)
 		for _, i := range reminders {
 			require.NotEqual(t, messagestrings.CouldNotFindMatch, i.Text)
 		}
 
-		count, err := test.client.Database(test.database).Collection("matches").CountDocuments(ctx, bson.M{})
-		if err != nil {
-			panic(err)
-		}
-		require.Equal(t, int64(5), count)
+		matches, err = test.matchDAO.FindRecentMatches(ctx, 100)
+		require.NoError(t, err)
+		require.Len(t, matches, 5)
 
 		moscow := map[int]bool{1: true, 2: true, 3: true, 4: true}
 		london := map[int]bool{5: true, 6: true, 7: true, 8: true}
 
 		checkMatches := func() {
-			cursor, err := test.client.Database(test.database).Collection("matches").Find(ctx, bson.M{})
-			if err != nil {
-				panic(err)
-			}
-			for cursor.Next(ctx) {
-				var m match.Match
-				err = cursor.Decode(&m)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Printf("%+v\n", m)
+			for _, m := range matches {
 				require.Equal(t, moscow[m.FirstID], moscow[m.SecondID])
 				require.Equal(t, london[m.FirstID], london[m.SecondID])
 				require.Equal(t, m.FirstID == 9, m.SecondID == 10)
@@ -296,40 +435,32 @@ func TestCoffeeBot(t *testing.T) {
 		}
 		checkMatches()
 
-		fakeClock.Current = fakeClock.Current.Add(1 * time.Second)
-		test.init(ctx, &fakeClock)
-		require.True(t, util.IsChannelEmpty(test.queue))
+		fakeClock.Advance(time.Second)
+		test.restart(ctx)
+		fakeClock.Advance(0)
+		test.takeReminders(t, 0)
 
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(5*time.Second))
 		require.NoError(t, err)
 
-		start = time.Now()
-
-		test.init(ctx, &fakeClock)
-
-		for i := 0; i < 10; i++ {
-			reminders = append(reminders, <-test.queue)
-		}
+		test.restart(ctx)
 
-		elapsed = time.Since(start).Seconds()
-		fakeClock.Current = fakeClock.Current.Add(5 * time.Second)
-		require.LessOrEqual(t, 3.0, elapsed)
-		require.LessOrEqual(t, elapsed, 7.0)
-		require.True(t, util.IsChannelEmpty(test.queue))
+		fakeClock.Advance(4 * time.Second)
+		test.takeReminders(t, 0)
+		fakeClock.Advance(time.Second)
+		reminders = append(reminders, test.takeReminders(t, 10)...)
 		for _, i := range reminders {
 			require.NotEqual(t, messagestrings.CouldNotFindMatch, i.Text)
 		}
 
-		count, err = test.client.Database(test.database).Collection("matches").CountDocuments(ctx, bson.M{})
-		if err != nil {
-			panic(err)
-		}
-		require.Equal(t, int64(10), count)
+		matches, err = test.matchDAO.FindRecentMatches(ctx, 100)
+		require.NoError(t, err)
+		require.Len(t, matches, 10)
 		checkMatches()
 
 		replies, err = test.bot.ProcessMessage(ctx, 9, "druzhko", 9, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 9, "У тебя встреча с @msch. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04. Поскольку мы не знаем часового пояса для твоего города, время должно быть в формате UTC")
+		requireSingleReplyText(t, replies, 9, "У тебя встреча с @msch. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04. Поскольку мы не знаем часового пояса для твоего города, время должно быть в формате UTC")
 
 		replies, err = test.bot.ProcessMessage(ctx, 9, "druzhko", 9, "ОО:ОО АА.АА")
 		require.NoError(t, err)
@@ -337,25 +468,24 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 9, "druzhko", 9, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 9, "У тебя встреча с @msch. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04. Поскольку мы не знаем часового пояса для твоего города, время должно быть в формате UTC")
+		requireSingleReplyText(t, replies, 9, "У тебя встреча с @msch. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04. Поскольку мы не знаем часового пояса для твоего города, время должно быть в формате UTC")
 
-		replies, err = test.bot.ProcessMessage(ctx, 9, "druzhko", 9, "05.07 6:00")
-		require.NoError(t, err)
+		replies = agreeOnMeetingTime(t, ctx, test.bot, 9, "druzhko", "05.07 6:00")
 		require.Len(t, replies, 2)
 		require.NotEqual(t, messagestrings.CouldNotFindMatch, replies[0].Text)
 		require.NotEqual(t, messagestrings.CouldNotFindMatch, replies[1].Text)
 		if replies[0].ChatID == 9 {
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @msch будет 05 July в 06:00 UTC", replies[0].Text)
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @druzhko будет 05 July в 06:00 UTC", replies[1].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @msch будет 05 July в 06:00 UTC. У @msch (Рыбинск) это 05 July в 06:00 UTC", replies[0].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @druzhko будет 05 July в 06:00 UTC. У @druzhko (Шахты) это 05 July в 06:00 UTC", replies[1].Text)
 		} else {
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @druzhko будет 05 July в 06:00 UTC", replies[0].Text)
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @msch будет 05 July в 06:00 UTC", replies[1].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @druzhko будет 05 July в 06:00 UTC. У @druzhko (Шахты) это 05 July в 06:00 UTC", replies[0].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @msch будет 05 July в 06:00 UTC. У @msch (Рыбинск) это 05 July в 06:00 UTC", replies[1].Text)
 		}
 
 		_, err = test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.RemindMe)
 		require.NoError(t, err)
 
-		replies, err = test.bot.ProcessMessage(ctx, 1, "john", 1, "04.07 6:00")
+		replies, err = test.bot.ProcessMessage(ctx, 1, "john", 1, "04.07.2020 6:00")
 		require.NoError(t, err)
 		requireSingleReplyText(t, replies, 1, messagestrings.TimeInThePast)
 	})
@@ -381,20 +511,14 @@ func TestCoffeeBot(t *testing.T) {
 
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(1*time.Second))
 		require.NoError(t, err)
-		start := time.Now()
-		<-test.queue
-		<-test.queue
-		elapsed := time.Since(start).Seconds()
-		fakeClock.Current = fakeClock.Current.Add(1 * time.Second)
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, elapsed, 2.0)
+		fakeClock.Advance(time.Second)
+		test.takeReminders(t, 2)
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
-		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "05.07 9:00")
-		require.NoError(t, err)
+		replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "vance", "05.07 9:00")
 		require.Len(t, replies, 2)
 		if replies[0].ChatID == 1 {
 			require.Equal(t, "Встреча с @vance будет 05 July в 09:00 +03", replies[0].Text)
@@ -404,19 +528,16 @@ func TestCoffeeBot(t *testing.T) {
 			require.Equal(t, "Встреча с @vance будет 05 July в 09:00 +03", replies[1].Text)
 		}
 
-		start = time.Now()
-
 		replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.RemindMe)
 		require.NoError(t, err)
 		requireSingleReplyText(t, replies, 1, "Встреча с @vance будет 05 July в 09:00 +03")
 		require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, replies[0].Markup)
 
-		tick1 := <-test.queue
-		tick2 := <-test.queue
-		elapsed = time.Since(start).Seconds()
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, 2.0, elapsed)
-		require.LessOrEqual(t, elapsed, 4.0)
+		fakeClock.Advance(2 * time.Second)
+		test.takeReminders(t, 0)
+		fakeClock.Advance(time.Second)
+		ticks := test.takeReminders(t, 2)
+		tick1, tick2 := ticks[0], ticks[1]
 		require.True(t, (tick1.Text == "Встреча с @vikki будет 05 July в 09:00 +03" && tick2.Text == "Встреча с @vance будет 05 July в 09:00 +03") || (tick2.Text == "Встреча с @vikki будет 05 July в 09:00 +03" && tick1.Text == "Встреча с @vance будет 05 July в 09:00 +03"))
 	})
 
@@ -441,37 +562,35 @@ func TestCoffeeBot(t *testing.T) {
 
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(1*time.Second))
 		require.NoError(t, err)
-		start := time.Now()
-		<-test.queue
-		<-test.queue
-		elapsed := time.Since(start).Seconds()
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, elapsed, 2.0)
+		fakeClock.Advance(time.Second)
+		test.takeReminders(t, 2)
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "sasha", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @riazanovskiy. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @riazanovskiy. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
-		replies, err = test.bot.ProcessMessage(ctx, 2, "sasha", 2, "07.11 9:00")
-		require.NoError(t, err)
+		replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "sasha", "07.11 9:00")
 		require.Len(t, replies, 2)
 		if replies[0].ChatID == 1 {
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @sasha будет 07 November в 06:00 GMT", replies[0].Text)
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @riazanovskiy будет 07 November в 09:00 MSK", replies[1].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @sasha будет 07 November в 06:00 GMT. У @sasha (Москва) это 07 November в 09:00 MSK", replies[0].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @riazanovskiy будет 07 November в 09:00 MSK. У @riazanovskiy (Лондон) это 07 November в 06:00 GMT", replies[1].Text)
 		} else {
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @riazanovskiy будет 07 November в 09:00 MSK", replies[0].Text)
-			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @sasha будет 07 November в 06:00 GMT", replies[1].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @riazanovskiy будет 07 November в 09:00 MSK. У @riazanovskiy (Лондон) это 07 November в 06:00 GMT", replies[0].Text)
+			require.Equal(t, "Встречи в твоём городе не нашлось. Встреча с @sasha будет 07 November в 06:00 GMT. У @sasha (Москва) это 07 November в 09:00 MSK", replies[1].Text)
 		}
 
 		replies, err = test.bot.ProcessMessage(ctx, 1, "riazanovskiy", 1, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 1, "Встречи в твоём городе не нашлось. Встреча с @sasha будет 07 November в 06:00 GMT")
+		requireSingleReplyText(t, replies, 1, "Встречи в твоём городе не нашлось. Встреча с @sasha будет 07 November в 06:00 GMT. У @sasha (Москва) это 07 November в 09:00 MSK")
 		require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, replies[0].Markup)
 	})
 
 	t.Run("Broken client", func(t *testing.T) {
 		// yes this is remarkably stupid
 		fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+		if testing.Short() {
+			t.Skip("needs mongo to break the client")
+		}
 		test := newTestContext(ctx)
 		test.init(ctx, &fakeClock)
 
@@ -524,7 +643,7 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "jack", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @john. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @john. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
 		err = test.client.Disconnect(ctx)
 		if err != nil {
@@ -550,12 +669,19 @@ func TestCoffeeBot(t *testing.T) {
 			test.userDAO,
 			&fakeMatches,
 			test.reminderDAO,
+			test.stateStore,
+			test.runStore,
+			test.proposals,
+			test.feedback,
 			&fakeClock,
+			matcher.NewWeighted(&fakeClock, false),
 			&test.removeMarkup,
 			&test.citiesKeyboard,
 			&test.remindStopMeetingsKeyboard,
 			&test.remindChangeTimeStopMeetingsKeyboard,
 			&test.activateKeyboard,
+			&test.settingsKeyboard,
+			&test.interestsKeyboard,
 		)
 
 		replies, err := test.bot.ProcessMessage(ctx, 9, "druzhko", 9, "/start")
@@ -579,7 +705,7 @@ func TestCoffeeBot(t *testing.T) {
 		replies, err = test.bot.ProcessMessage(ctx, 2128506, config.AdminUser, 2128506, "MakeMatches")
 		require.NoError(t, err)
 		requireSingleReplyText(t, replies, 2128506, "MakeMatches succeeded")
-		require.Equal(t, 1, fakeMatches.addMatchCalls)
+		require.Equal(t, 1, fakeMatches.saveMatchCalls)
 		require.Equal(t, 1, fakeMatches.matchingCycle)
 	})
 
@@ -608,7 +734,7 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "jack", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @john. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @john. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
 		replies, err = test.bot.ProcessMessage(ctx, 3, "fedor", 3, "/start")
 		require.NoError(t, err)
@@ -669,16 +795,23 @@ func TestCoffeeBot(t *testing.T) {
 			test.userDAO,
 			&fakeMatches,
 			test.reminderDAO,
+			test.stateStore,
+			test.runStore,
+			test.proposals,
+			test.feedback,
 			&fakeClock,
+			matcher.NewWeighted(&fakeClock, false),
 			&test.removeMarkup,
 			&test.citiesKeyboard,
 			&test.remindStopMeetingsKeyboard,
 			&test.remindChangeTimeStopMeetingsKeyboard,
 			&test.activateKeyboard,
+			&test.settingsKeyboard,
+			&test.interestsKeyboard,
 		)
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(1*time.Second))
 		require.NoError(t, err)
-		require.Equal(t, 0, fakeMatches.addMatchCalls)
+		require.Equal(t, 0, fakeMatches.saveMatchCalls)
 	})
 
 	t.Run("Stop meetings with match", func(t *testing.T) {
@@ -702,17 +835,12 @@ func TestCoffeeBot(t *testing.T) {
 
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(1*time.Second))
 		require.NoError(t, err)
-		start := time.Now()
-		<-test.queue
-		<-test.queue
-		elapsed := time.Since(start).Seconds()
-		fakeClock.Current = fakeClock.Current.Add(1 * time.Second)
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, elapsed, 2.0)
+		fakeClock.Advance(time.Second)
+		test.takeReminders(t, 2)
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
 		replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.StopMeetings)
 		require.NoError(t, err)
@@ -762,14 +890,8 @@ func TestCoffeeBot(t *testing.T) {
 
 		err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(1*time.Second))
 		require.NoError(t, err)
-		start := time.Now()
-		<-test.queue
-		<-test.queue
-		<-test.queue
-		elapsed := time.Since(start).Seconds()
-		fakeClock.Current = fakeClock.Current.Add(1 * time.Second)
-		require.True(t, util.IsChannelEmpty(test.queue))
-		require.LessOrEqual(t, elapsed, 2.0)
+		fakeClock.Advance(time.Second)
+		test.takeReminders(t, 3)
 
 		replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, messagestrings.RemindMe)
 		require.NoError(t, err)
@@ -786,7 +908,7 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 3, "У тебя встреча с @vance. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 3, "У тебя встреча с @vance. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
 		replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, "aaaaa")
 		require.NoError(t, err)
@@ -794,7 +916,7 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @nancy. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @nancy. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 	})
 
 	t.Run("Activate", func(t *testing.T) {
@@ -850,10 +972,9 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
-		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "05.07 7:30")
-		require.NoError(t, err)
+		replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "vance", "05.07 7:30")
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.StopMeetings)
 		require.NoError(t, err)
@@ -867,10 +988,11 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
-		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "05.07 5:00")
-		require.NoError(t, err)
+		// the partner is not told about leaving after the meeting has passed
+		replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "vance", "05.07 7:25")
+		fakeClock.Advance(10 * time.Minute)
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.StopMeetings)
 		require.NoError(t, err)
@@ -898,7 +1020,7 @@ func TestCoffeeBot(t *testing.T) {
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
 		require.NoError(t, err)
-		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи в формате число.месяц часы:минуты, например 02.01 15:04")
+		requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
 
 		replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.StopMeetings)
 		require.NoError(t, err)
@@ -909,6 +1031,153 @@ func TestCoffeeBot(t *testing.T) {
 		requireSingleReplyText(t, replies, 2, messagestrings.NowActive)
 	})
 
+	t.Run("No repeated partners", func(t *testing.T) {
+		fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+		test := newTestContext(ctx)
+		defer test.init(ctx, &fakeClock)()
+
+		usernames := map[int]string{1: "vikki", 2: "vance", 3: "nancy", 4: "john"}
+		for id, username := range usernames {
+			replies, err := test.bot.ProcessMessage(ctx, id, username, int64(id), "/start")
+			require.NoError(t, err)
+			requireSingleReplyText(t, replies, int64(id), messagestrings.GreetingAskCity)
+			replies, err = test.bot.ProcessMessage(ctx, id, username, int64(id), "Минск")
+			require.NoError(t, err)
+			requireSingleReplyText(t, replies, int64(id), messagestrings.Welcome)
+		}
+
+		partners := make(map[int]map[int]bool)
+		for week := 0; week < 3; week++ {
+			err := test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour))
+			require.NoError(t, err)
+			fakeClock.Current = fakeClock.Current.AddDate(0, 0, 7)
+
+			for id := range usernames {
+				m, err := test.matchDAO.FindCurrentMatchForUserID(ctx, id)
+				require.NoError(t, err)
+				require.NotNil(t, m)
+				if partners[id] == nil {
+					partners[id] = make(map[int]bool)
+				}
+				require.False(t, partners[id][m.SecondID])
+				partners[id][m.SecondID] = true
+			}
+		}
+	})
+
+	t.Run("Triad", func(t *testing.T) {
+		fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+		test := newTestContext(ctx)
+		defer test.init(ctx, &fakeClock)()
+		test.bot = coffeebot.NewCoffeeBot(
+			test.userDAO,
+			test.matchDAO,
+			test.reminderDAO,
+			test.stateStore,
+			test.runStore,
+			test.proposals,
+			test.feedback,
+			&fakeClock,
+			matcher.NewWeighted(&fakeClock, true),
+			&test.removeMarkup,
+			&test.citiesKeyboard,
+			&test.remindStopMeetingsKeyboard,
+			&test.remindChangeTimeStopMeetingsKeyboard,
+			&test.activateKeyboard,
+			&test.settingsKeyboard,
+			&test.interestsKeyboard,
+		)
+
+		usernames := map[int]string{1: "vikki", 2: "vance", 3: "nancy"}
+		for id, username := range usernames {
+			replies, err := test.bot.ProcessMessage(ctx, id, username, int64(id), "/start")
+			require.NoError(t, err)
+			requireSingleReplyText(t, replies, int64(id), messagestrings.GreetingAskCity)
+			replies, err = test.bot.ProcessMessage(ctx, id, username, int64(id), "Минск")
+			require.NoError(t, err)
+			requireSingleReplyText(t, replies, int64(id), messagestrings.Welcome)
+		}
+
+		err := test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour))
+		require.NoError(t, err)
+
+		m, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 2)
+		require.NoError(t, err)
+		require.NotNil(t, m)
+		require.Equal(t, 2, m.FirstID)
+		require.ElementsMatch(t, []int{1, 3}, m.PartnerIDs())
+
+		replies, err := test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
+		require.NoError(t, err)
+		require.Len(t, replies, 1)
+		require.True(t, strings.HasPrefix(replies[0].Text, "У тебя встреча с @"))
+		require.Contains(t, replies[0].Text, "@vikki")
+		require.Contains(t, replies[0].Text, " и ")
+		require.Contains(t, replies[0].Text, "@nancy")
+
+		replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "vance", "05.07 9:00")
+		require.Len(t, replies, 3)
+		for _, reply := range replies {
+			require.True(t, strings.HasPrefix(reply.Text, "Встреча с @"))
+			require.True(t, strings.HasSuffix(reply.Text, " будет 05 July в 09:00 +03"))
+		}
+
+		replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.StopMeetings)
+		require.NoError(t, err)
+		require.Len(t, replies, 5)
+		require.Equal(t, messagestrings.InactiveUser, replies[0].Text)
+		for _, reply := range replies[1:3] {
+			require.True(t, strings.HasPrefix(reply.Text, "@vikki отказался от встречи, но встреча с @"))
+		}
+		// the rest of the group gets the meeting details and the invitations without the user who left
+		require.ElementsMatch(t, []int64{2, 3}, []int64{replies[3].ChatID, replies[4].ChatID})
+		for _, reply := range replies[3:] {
+			require.True(t, strings.HasPrefix(reply.Text, "Встреча с @"))
+			require.NotContains(t, reply.Text, "@vikki")
+			require.NotNil(t, reply.Document)
+		}
+
+		replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, messagestrings.RemindMe)
+		require.NoError(t, err)
+		requireSingleReplyText(t, replies, 3, "Встреча с @vance будет 05 July в 09:00 +03")
+	})
+
+	t.Run("Settings", func(t *testing.T) {
+		test := newTestContext(ctx)
+		defer test.init(ctx, clock.NewRealClock())()
+
+		_, err := test.bot.ProcessMessage(ctx, 1, "john", 1, "/start")
+		require.NoError(t, err)
+		_, err = test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.Minsk)
+		require.NoError(t, err)
+
+		replies, err := test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.Settings)
+		require.NoError(t, err)
+		requireSingleReplyText(t, replies, 1, "Твой профиль:\nЮзернейм: @john\nГород: Минск\nУчастие: участвуешь\nФормат встреч: предпочитаешь встречи вживую в своём городе\n\n"+messagestrings.ChooseMeetingFormat+"\n\n"+messagestrings.EditProfileHint)
+		require.Equal(t, &test.settingsKeyboard, replies[0].Markup)
+
+		replies, err = test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.PreferOnline)
+		require.NoError(t, err)
+		requireSingleReplyText(t, replies, 1, messagestrings.SettingsSaved+"\n\nТвой профиль:\nЮзернейм: @john\nГород: Минск\nУчастие: участвуешь\nФормат встреч: предпочитаешь онлайн, пару подберём из любого города")
+		require.Equal(t, &test.remindStopMeetingsKeyboard, replies[0].Markup)
+
+		_, err = test.bot.ProcessMessage(ctx, 1, "john", 1, "/start")
+		require.NoError(t, err)
+		_, err = test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.Moscow)
+		require.NoError(t, err)
+		john, err := test.userDAO.FindUserByID(ctx, 1)
+		require.NoError(t, err)
+		require.True(t, john.RemoteFirst)
+		require.Equal(t, messagestrings.Moscow, john.City)
+
+		_, err = test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.StopMeetings)
+		require.NoError(t, err)
+		replies, err = test.bot.ProcessMessage(ctx, 1, "john", 1, messagestrings.PreferLive)
+		require.NoError(t, err)
+		requireSingleReplyText(t, replies, 1, messagestrings.SettingsSaved+"\n\nТвой профиль:\nЮзернейм: @john\nГород: Москва\nУчастие: не участвуешь\nФормат встреч: предпочитаешь встречи вживую в своём городе")
+		require.Equal(t, &test.activateKeyboard, replies[0].Markup)
+	})
+
 	t.Run("Remote-first matches", func(t *testing.T) {
 		// this test can fail spuriously
 		// I am truly sorry
@@ -945,9 +1214,9 @@ func TestCoffeeBot(t *testing.T) {
 		require.NoError(t, err)
 		requireSingleReplyText(t, replies, 6, messagestrings.Welcome)
 
-		updateResult, err := test.client.Database(test.database).Collection("users").UpdateMany(ctx, bson.M{}, bson.M{"$set": bson.M{user.UserBSON.RemoteFirst: true}})
-		require.NoError(t, err)
-		require.Equal(t, int64(4), updateResult.ModifiedCount)
+		for _, userID := range []int{1, 2, 5, 6} {
+			require.NoError(t, test.userDAO.UpdateRemoteFirst(ctx, userID, true))
+		}
 
 		ok := false
 		for i := 0; i < 10; i++ {
@@ -968,3 +1237,1278 @@ func TestCoffeeBot(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestCoffeeBotInMemory(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 5, 59, 56, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	replies, err := test.bot.ProcessMessage(ctx, 1, "vikki", 1, "/start")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.GreetingAskCity)
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, "Минск")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.Welcome)
+
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "/start")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.GreetingAskCity)
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "Минск")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.Welcome)
+
+	err = test.bot.MakeMatches(ctx, fakeClock.Now().Add(1*time.Second))
+	require.NoError(t, err)
+	fakeClock.Advance(time.Second)
+	ticks := test.takeReminders(t, 2)
+	tick1, tick2 := ticks[0], ticks[1]
+	require.ElementsMatch(t, []string{"На этой неделе у тебя встреча с @vikki", "На этой неделе у тебя встреча с @vance"}, []string{tick1.Text, tick2.Text})
+
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
+
+	replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "vance", "05.07 9:00")
+	require.Len(t, replies, 2)
+	require.Equal(t, "Встреча с @vance будет 05 July в 09:00 +03", replies[0].Text)
+	require.Equal(t, "Встреча с @vikki будет 05 July в 09:00 +03", replies[1].Text)
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, "Встреча с @vance будет 05 July в 09:00 +03")
+	require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, replies[0].Markup)
+
+	fakeClock.Advance(3 * time.Second)
+	ticks = test.takeReminders(t, 2)
+	tick1, tick2 = ticks[0], ticks[1]
+	require.ElementsMatch(t, []string{"Встреча с @vikki будет 05 July в 09:00 +03", "Встреча с @vance будет 05 July в 09:00 +03"}, []string{tick1.Text, tick2.Text})
+
+	replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, "/start")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 3, messagestrings.GreetingAskCity)
+	replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, "Лондон")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 3, messagestrings.Welcome)
+
+	fakeClock.Current = time.Date(2020, 7, 5, 4, 0, 0, 0, time.UTC)
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.StopMeetings)
+	require.NoError(t, err)
+	require.Len(t, replies, 4)
+	require.Equal(t, messagestrings.InactiveUser, replies[0].Text)
+	require.Equal(t, messagestrings.PartnerRefused+". Но мы нашли для тебя другую пару", replies[1].Text)
+	require.Equal(t, "На этой неделе у тебя встреча с @nancy", replies[2].Text)
+	require.Equal(t, "На этой неделе у тебя встреча с @vance", replies[3].Text)
+
+	replies, err = test.bot.ProcessMessage(ctx, 3, "nancy", 3, messagestrings.RemindMe)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 3, "У тебя встреча с @vance. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.Activate)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.NowActive)
+}
+
+func TestCoffeeBotReschedule(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 5, 59, 56, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	for _, ID := range []int{1, 2} {
+		_, err := test.bot.ProcessMessage(ctx, ID, fmt.Sprintf("user%d", ID), int64(ID), "/start")
+		require.NoError(t, err)
+		_, err = test.bot.ProcessMessage(ctx, ID, fmt.Sprintf("user%d", ID), int64(ID), "Минск")
+		require.NoError(t, err)
+	}
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Second)))
+	fakeClock.Advance(time.Second)
+	test.takeReminders(t, 2)
+
+	_, err := test.bot.ProcessMessage(ctx, 1, "user1", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	replies := agreeOnMeetingTime(t, ctx, test.bot, 1, "user1", "05.07 9:00")
+	require.Len(t, replies, 2)
+
+	// the reminders about the old time are cancelled
+	_, err = test.bot.ProcessMessage(ctx, 2, "user2", 2, messagestrings.ChangeTime)
+	require.NoError(t, err)
+	replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "user2", "05.07 9:01")
+	require.Len(t, replies, 2)
+	fakeClock.Advance(time.Hour)
+	ticks := test.takeReminders(t, 2)
+	require.ElementsMatch(t, []string{"Встреча с @user1 будет 05 July в 09:01 +03", "Встреча с @user2 будет 05 July в 09:01 +03"}, []string{ticks[0].Text, ticks[1].Text})
+
+	// the reminders of a broken match are cancelled
+	_, err = test.bot.ProcessMessage(ctx, 2, "user2", 2, messagestrings.ChangeTime)
+	require.NoError(t, err)
+	replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "user2", "05.07 12:00")
+	require.Len(t, replies, 2)
+	replies, err = test.bot.ProcessMessage(ctx, 1, "user1", 1, messagestrings.StopMeetings)
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+	require.Equal(t, messagestrings.PartnerRefused, replies[1].Text)
+	fakeClock.Advance(24 * time.Hour)
+	test.takeReminders(t, 0)
+}
+
+func TestCoffeeBotRestart(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 5, 59, 56, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	replies, err := test.bot.ProcessMessage(ctx, 1, "vikki", 1, "/start")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.GreetingAskCity)
+
+	test.bot = test.newBot()
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, "Минск")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.Welcome)
+
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "/start")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.GreetingAskCity)
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "Минск")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.Welcome)
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.StopMeetings)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.InactiveUser)
+
+	test.bot = test.newBot()
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, "лапки")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.DefaultReply)
+	require.Equal(t, &test.activateKeyboard, replies[0].Markup)
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "vikki", 1, messagestrings.Activate)
+	require.NoError(t, err)
+	require.Len(t, replies, 3)
+	require.Equal(t, "На этой неделе у тебя встреча с @vikki", replies[2].Text)
+
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, "У тебя встреча с @vikki. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
+	require.True(t, replies[0].Markup.Inline)
+
+	test.bot = test.newBot()
+	fakeClock.Current = fakeClock.Current.Add(config.DialogStateTTL)
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, "06.07 9:00")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.DefaultReply)
+	require.Equal(t, &test.remindStopMeetingsKeyboard, replies[0].Markup)
+
+	replies, err = test.bot.ProcessMessage(ctx, 2, "vance", 2, messagestrings.RemindMe)
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	test.bot = test.newBot()
+	fakeClock.Current = fakeClock.Current.Add(config.DialogStateTTL / 2)
+	replies = agreeOnMeetingTime(t, ctx, test.bot, 2, "vance", "07.07 9:00")
+	require.Len(t, replies, 2)
+	require.Equal(t, "Встреча с @vikki будет 07 July в 09:00 +03", replies[1].Text)
+	require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, replies[0].Markup)
+	require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, replies[1].Markup)
+}
+
+func TestCoffeeBotOverTransport(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+
+	say := func(userID int, username string, text string) (transport.Update, []transport.Message) {
+		sent := messenger.Receive(userID, username, text)
+		update := <-messenger.Updates()
+		require.Equal(t, sent, update)
+		require.NoError(t, test.bot.HandleUpdate(ctx, messenger, update))
+		return update, messenger.TakeSent()
+	}
+
+	update, sent := say(1, "alice", "/start")
+	require.Equal(t, []transport.Message{{
+		ChatID:           1,
+		Text:             messagestrings.GreetingAskCity,
+		Keyboard:         &test.citiesKeyboard,
+		ReplyToMessageID: update.MessageID,
+	}}, sent)
+
+	_, sent = say(1, "alice", messagestrings.Minsk)
+	require.Len(t, sent, 1)
+	require.Equal(t, messagestrings.Welcome, sent[0].Text)
+	require.Equal(t, &test.remindStopMeetingsKeyboard, sent[0].Keyboard)
+
+	say(2, "bob", "/start")
+	say(2, "bob", messagestrings.Minsk)
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Second)))
+	require.NoError(t, test.matchDAO.UpdateMatchTime(ctx, 1, fakeClock.Now().Add(24*time.Hour)))
+
+	update, sent = say(2, "bob", messagestrings.StopMeetings)
+	require.Len(t, sent, 2)
+	require.Equal(t, int64(2), sent[0].ChatID)
+	require.Equal(t, update.MessageID, sent[0].ReplyToMessageID)
+	require.Equal(t, &test.activateKeyboard, sent[0].Keyboard)
+	require.Equal(t, int64(1), sent[1].ChatID)
+	require.Zero(t, sent[1].ReplyToMessageID)
+	// the scheduled meeting is removed from the calendars of both
+	for _, message := range sent {
+		require.NotNil(t, message.Document)
+		require.Contains(t, string(message.Document.Content), "\r\nMETHOD:CANCEL\r\n")
+	}
+
+	_, sent = say(3, "stranger", messagestrings.RemindMe)
+	require.Len(t, sent, 1)
+	require.Contains(t, sent[0].Text, config.AdminUser)
+	require.Nil(t, sent[0].Keyboard)
+}
+
+func TestCoffeeBotTimeSlots(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+
+	handle := func(sent transport.Update) {
+		update := <-messenger.Updates()
+		require.Equal(t, sent, update)
+		require.NoError(t, test.bot.HandleUpdate(ctx, messenger, update))
+	}
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+
+	handle(messenger.Receive(1, "alice", messagestrings.RemindMe))
+	sent := messenger.TakeSent()
+	require.Len(t, sent, 1)
+	keyboard := sent[0].Keyboard
+	require.NotNil(t, keyboard)
+	require.True(t, keyboard.Inline)
+	require.Len(t, keyboard.Rows, 3)
+	require.Equal(t, []transport.Button{{Text: "06.07 12:00", Data: "time:06.07.2020 12:00"}, {Text: "06.07 19:00", Data: "time:06.07.2020 19:00"}}, keyboard.Rows[0])
+	require.Equal(t, "08.07 19:00", keyboard.Rows[2][1].Text)
+
+	// several slots may be proposed from the same message
+	const promptMessageID = 42
+	press := messenger.Press(1, "alice", promptMessageID, keyboard.Rows[0][1].Data)
+	handle(press)
+	require.Equal(t, []transport.CallbackAnswer{{CallbackID: press.CallbackID, Text: fmt.Sprintf(messagestrings.ProposedTimeTemplate, "06.07 19:00")}}, messenger.TakeAnswers())
+	sent = messenger.TakeSent()
+	require.Len(t, sent, 2)
+	require.Equal(t, "Предложили @bob время встречи: 06 July в 19:00 +03. Когда время выберут, придёт сообщение", sent[0].Text)
+	require.Equal(t, int64(2), sent[1].ChatID)
+	require.Equal(t, fmt.Sprintf(messagestrings.ProposalTemplate, "alice"), sent[1].Text)
+
+	press = messenger.Press(1, "alice", promptMessageID, keyboard.Rows[1][0].Data)
+	handle(press)
+	require.Len(t, messenger.TakeAnswers(), 1)
+	sent = messenger.TakeSent()
+	require.Len(t, sent, 2)
+	require.Equal(t, "Предложили @bob время встречи: 06 July в 19:00 +03, 07 July в 12:00 +03. Когда время выберут, придёт сообщение", sent[0].Text)
+	proposal := sent[1].Keyboard
+	require.True(t, proposal.Inline)
+	require.Len(t, proposal.Rows, 3)
+	require.Equal(t, "06 July в 19:00 +03", proposal.Rows[0][0].Text)
+	require.Equal(t, "07 July в 12:00 +03", proposal.Rows[1][0].Text)
+	require.Equal(t, messagestrings.CounterPropose, proposal.Rows[2][0].Text)
+
+	// only the accepted time is stored
+	match, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 1)
+	require.NoError(t, err)
+	require.Nil(t, match.MeetingTime)
+
+	const proposalMessageID = 43
+	press = messenger.Press(2, "bob", proposalMessageID, proposal.Rows[1][0].Data)
+	handle(press)
+	require.Equal(t, []transport.CallbackAnswer{{CallbackID: press.CallbackID}}, messenger.TakeAnswers())
+	sent = messenger.TakeSent()
+	require.Len(t, sent, 3)
+	require.Equal(t, transport.Message{ChatID: 2, Text: fmt.Sprintf(messagestrings.ChosenTimeTemplate, "07 July в 12:00 +03"), EditMessageID: proposalMessageID}, sent[0])
+	require.Equal(t, "Встреча с @alice будет 07 July в 12:00 +03", sent[1].Text)
+	require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, sent[1].Keyboard)
+	require.Equal(t, int64(1), sent[2].ChatID)
+
+	match, err = test.matchDAO.FindCurrentMatchForUserID(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, match.MeetingTime.Equal(time.Date(2020, 7, 7, 9, 0, 0, 0, time.UTC)))
+
+	press = messenger.Press(2, "bob", proposalMessageID, proposal.Rows[0][0].Data)
+	handle(press)
+	require.Equal(t, []transport.CallbackAnswer{{CallbackID: press.CallbackID, Text: messagestrings.ButtonExpired}}, messenger.TakeAnswers())
+	require.Empty(t, messenger.TakeSent())
+
+	press = messenger.Press(1, "alice", promptMessageID, "unknown")
+	handle(press)
+	require.Equal(t, []transport.CallbackAnswer{{CallbackID: press.CallbackID, Text: messagestrings.ButtonExpired}}, messenger.TakeAnswers())
+}
+
+func TestCoffeeBotMeetingProposals(t *testing.T) {
+	ctx := context.Background()
+	// Sunday, 07:20 in Minsk
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+
+	_, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	replies := enterMeetingTime(t, ctx, test.bot, 1, "alice", "завтра в 19")
+	require.Len(t, replies, 2)
+
+	// pending proposals are shown to both partners
+	replies, err = test.bot.ProcessMessage(ctx, 2, "bob", 2, messagestrings.RemindMe)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, fmt.Sprintf(messagestrings.ProposalTemplate, "alice"))
+	require.Len(t, replies[0].Markup.Rows, 2)
+	require.Equal(t, "06 July в 19:00 +03", replies[0].Markup.Rows[0][0].Text)
+	aliceProposal := replies[0].Markup
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+	require.Equal(t, "Предложили @bob время встречи: 06 July в 19:00 +03. Когда время выберут, придёт сообщение", replies[0].Text)
+	require.True(t, replies[1].Markup.Inline)
+
+	// one cannot accept their own proposal
+	callback, err := test.bot.ProcessCallback(ctx, 1, "alice", 1, aliceProposal.Rows[0][0].Data)
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.ButtonExpired, callback.Answer)
+
+	callback, err = test.bot.ProcessCallback(ctx, 2, "bob", 2, counterProposeData(t, aliceProposal))
+	require.NoError(t, err)
+	requireSingleReplyText(t, callback.Replies, 2, "У тебя встреча с @alice. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
+	replies = enterMeetingTime(t, ctx, test.bot, 2, "bob", "06.07 20:00")
+	require.Len(t, replies, 2)
+	require.Equal(t, int64(1), replies[1].ChatID)
+	require.Equal(t, fmt.Sprintf(messagestrings.ProposalTemplate, "bob"), replies[1].Text)
+	bobProposal := replies[1].Markup
+
+	// the counter-proposal replaces the proposal
+	callback, err = test.bot.ProcessCallback(ctx, 2, "bob", 2, aliceProposal.Rows[0][0].Data)
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.ButtonExpired, callback.Answer)
+	callback, err = test.bot.ProcessCallback(ctx, 1, "alice", 1, bobProposal.Rows[0][0].Data)
+	require.NoError(t, err)
+	require.Len(t, callback.Replies, 2)
+	require.Equal(t, "Встреча с @bob будет 06 July в 20:00 +03", callback.Replies[0].Text)
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, "Встреча с @bob будет 06 July в 20:00 +03")
+
+	// a new proposal keeps the accepted time until it is accepted itself
+	_, err = test.bot.ProcessMessage(ctx, 2, "bob", 2, messagestrings.ChangeTime)
+	require.NoError(t, err)
+	replies = enterMeetingTime(t, ctx, test.bot, 2, "bob", "07.07 20:00")
+	require.Len(t, replies, 2)
+	require.Equal(t, &test.remindChangeTimeStopMeetingsKeyboard, replies[0].Markup)
+	replies, err = test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+	require.Equal(t, "Встреча с @bob будет 06 July в 20:00 +03", replies[0].Text)
+	require.Equal(t, fmt.Sprintf(messagestrings.ProposalTemplate, "bob"), replies[1].Text)
+
+	callback, err = test.bot.ProcessCallback(ctx, 2, "bob", 2, "counter:"+primitive.NewObjectID().Hex())
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.ButtonExpired, callback.Answer)
+}
+
+// counterProposeData returns the data of the last button of a proposal, which asks for another time
+func counterProposeData(t *testing.T, proposal *transport.Keyboard) string {
+	button := proposal.Rows[len(proposal.Rows)-1][0]
+	require.Equal(t, messagestrings.CounterPropose, button.Text)
+	return button.Data
+}
+
+func TestCoffeeBotUnreachableChat(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+	queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(&fakeClock), nil, &fakeClock)
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 3, "carol", messagestrings.Minsk, 3, true))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+
+	messenger.FailNext(1, transport.Blocked.New("Forbidden: bot was blocked by the user"))
+	require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "reminder"}))
+	_, err := queue.Deliver(ctx)
+	require.NoError(t, err)
+	require.Empty(t, messenger.TakeSent())
+
+	chatID := <-queue.Unreachable()
+	require.Equal(t, int64(1), chatID)
+	require.NoError(t, test.bot.HandleUnreachableChat(ctx, queue, chatID))
+
+	alice, err := test.userDAO.FindUserByID(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, alice.Active)
+	aliceState, err := test.stateStore.FindState(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "inactive", aliceState.Dialog)
+
+	match, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int{2, 3}, match.UserIDs())
+
+	_, err = queue.Deliver(ctx)
+	require.NoError(t, err)
+	sent := messenger.TakeSent()
+	require.Len(t, sent, 3)
+	require.Equal(t, int64(2), sent[0].ChatID)
+	require.Equal(t, messagestrings.PartnerRefused+". Но мы нашли для тебя другую пару", sent[0].Text)
+	require.Equal(t, "На этой неделе у тебя встреча с @carol", sent[1].Text)
+	require.Equal(t, int64(3), sent[2].ChatID)
+
+	require.NoError(t, test.bot.HandleUnreachableChat(ctx, queue, chatID))
+	require.NoError(t, test.bot.HandleUnreachableChat(ctx, queue, 404))
+	_, err = queue.Deliver(ctx)
+	require.NoError(t, err)
+	require.Empty(t, messenger.TakeSent())
+}
+
+func TestCoffeeBotReminderStatus(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 5, 59, 56, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Second)))
+	fakeClock.Advance(time.Second)
+	require.Len(t, test.queue, 2)
+	first := <-test.queue
+	second := <-test.queue
+
+	require.NoError(t, test.bot.SendReminder(ctx, messenger, first))
+	messenger.FailNext(second.ChatID, transport.Transient.New("connection reset"))
+	require.Error(t, test.bot.SendReminder(ctx, messenger, second))
+	require.Len(t, messenger.TakeSent(), 1)
+
+	replies, err := test.bot.ProcessMessage(ctx, 3, "carol", 3, "Failures")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 3, messagestrings.DefaultReply)
+
+	replies, err = test.bot.ProcessMessage(ctx, 4, config.AdminUser, 4, "Failures")
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	require.Equal(t, fmt.Sprintf("05.07 05:59 UTC, chat %d, failed: %s (transport.transient: connection reset)", second.ChatID, second.Text), replies[0].Text)
+
+	fakeClock.Current = fakeClock.Current.AddDate(0, 0, 8)
+	replies, err = test.bot.ProcessMessage(ctx, 4, config.AdminUser, 4, "Failures")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 4, "No failed reminders")
+}
+
+func TestCoffeeBotReminderStatusThroughQueue(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 5, 59, 56, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+	queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(&fakeClock), test.reminderDAO, &fakeClock)
+	failures := func() string {
+		replies, err := test.bot.ProcessMessage(ctx, 4, config.AdminUser, 4, "Failures")
+		require.NoError(t, err)
+		require.Len(t, replies, 1)
+		return replies[0].Text
+	}
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Second)))
+	fakeClock.Advance(time.Second)
+	require.Len(t, test.queue, 2)
+	reminders := []reminder.Reminder{<-test.queue, <-test.queue}
+
+	// the queue only accepts the reminders, failures are known after the delivery
+	messenger.FailNext(reminders[1].ChatID, transport.Blocked.New("Forbidden: bot was blocked by the user"))
+	require.NoError(t, test.bot.SendReminder(ctx, queue, reminders[0]))
+	require.NoError(t, test.bot.SendReminder(ctx, queue, reminders[1]))
+	require.Equal(t, "No failed reminders", failures())
+
+	_, err := queue.Deliver(ctx)
+	require.NoError(t, err)
+	sent := messenger.TakeSent()
+	require.Len(t, sent, 1)
+	require.Equal(t, reminders[0].ChatID, sent[0].ChatID)
+	require.Equal(t, fmt.Sprintf("05.07 05:59 UTC, chat %d, failed: %s (transport.blocked: Forbidden: bot was blocked by the user)",
+		reminders[1].ChatID, reminders[1].Text), failures())
+}
+
+func TestCoffeeBotWeeklyAnnouncements(t *testing.T) {
+	ctx := context.Background()
+	// the run is scheduled for Monday midnight in Moscow, but happens three hours late
+	runTime := time.Date(2020, 7, 6, 0, 0, 0, 0, config.ScheduleLocation)
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 6, 3, 0, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Moscow, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Novosibirsk, 2, true))
+	require.NoError(t, test.bot.MakeWeeklyMatches(ctx, runTime))
+
+	// it is already 10:00 in Novosibirsk
+	fakeClock.Advance(0)
+	reminders := test.takeReminders(t, 1)
+	require.Equal(t, int64(2), reminders[0].ChatID)
+	require.Equal(t, fakeClock.Now().Unix(), reminders[0].UnixTime)
+
+	fakeClock.Set(time.Date(2020, 7, 6, 8, 59, 59, 0, config.ScheduleLocation))
+	test.takeReminders(t, 0)
+	fakeClock.Advance(time.Second)
+	reminders = test.takeReminders(t, 1)
+	require.Equal(t, int64(1), reminders[0].ChatID)
+}
+
+func TestCoffeeBotResumeMatchingRun(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	for id := 1; id <= 5; id++ {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, id, fmt.Sprintf("user%d", id), messagestrings.Minsk, int64(id), true))
+	}
+	reminderDAO := test.reminderDAO
+	test.reminderDAO = &failingReminderDAO{ReminderDAO: reminderDAO, failAfter: 2}
+	test.bot = test.newBot()
+	require.Error(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+	require.Equal(t, 1, test.matchDAO.MatchingCycle())
+
+	// the announcements are late after the restart, so they are sent right away
+	fakeClock.Current = fakeClock.Current.Add(2 * time.Hour)
+	test.reminderDAO = reminderDAO
+	test.bot = test.newBot()
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+	require.Equal(t, 1, test.matchDAO.MatchingCycle())
+	matched, err := test.matchDAO.GetAllMatchedUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, matched, 4)
+
+	fakeClock.Advance(0)
+	reminders := test.takeReminders(t, 5)
+	chats := make(map[int64]bool)
+	for _, r := range reminders {
+		chats[r.ChatID] = true
+	}
+	require.Len(t, chats, 5)
+
+	// the next run is a new matching cycle
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+	require.Equal(t, 2, test.matchDAO.MatchingCycle())
+	fakeClock.Advance(time.Hour)
+	test.takeReminders(t, 5)
+}
+
+func TestCoffeeBotResumeMatchingRunWithChangedUsers(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	for id := 1; id <= 4; id++ {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, id, fmt.Sprintf("user%d", id), messagestrings.Minsk, int64(id), true))
+	}
+	matchDAO := test.matchDAO
+	test.matchDAO = &failingMatchDAO{MatchDAO: matchDAO}
+	test.bot = test.newBot()
+	require.Error(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+	run, err := test.runStore.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, run)
+	require.Len(t, run.Groups, 2)
+
+	// before the run is resumed, user 1 leaves and user 3 gets another partner
+	require.NoError(t, test.userDAO.UpdateActiveStatus(ctx, 1, false))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 5, "user5", messagestrings.Minsk, 5, true))
+	require.NoError(t, matchDAO.AddMatch(ctx, 3, 5))
+
+	test.matchDAO = matchDAO
+	test.bot = test.newBot()
+	require.NoError(t, test.bot.ResumeMatchingRun(ctx))
+	unfinished, err := test.runStore.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.Nil(t, unfinished)
+
+	texts := make(map[int64]string)
+	fakeClock.Advance(time.Hour)
+	for _, r := range test.takeReminders(t, len(test.queue)) {
+		texts[r.ChatID] = r.Text
+	}
+	require.NotContains(t, texts, int64(1))
+	require.NotContains(t, texts, int64(3))
+	for _, group := range run.Groups {
+		saved, err := test.matchDAO.FindMatchByID(ctx, group.MatchID)
+		require.NoError(t, err)
+		conflicting := false
+		for _, userID := range group.UserIDs {
+			conflicting = conflicting || userID == 1 || userID == 3
+		}
+		if conflicting {
+			require.Nil(t, saved)
+		} else {
+			require.NotNil(t, saved)
+		}
+		for _, userID := range group.UserIDs {
+			if userID == 1 || userID == 3 {
+				continue
+			}
+			if conflicting {
+				require.Equal(t, messagestrings.CouldNotFindMatch, texts[int64(userID)])
+			} else {
+				require.True(t, strings.HasPrefix(texts[int64(userID)], "На этой неделе у тебя встреча с @"))
+			}
+		}
+	}
+	current, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 3)
+	require.NoError(t, err)
+	require.Equal(t, []int{5}, current.PartnerIDs())
+
+	// the next run is not blocked
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+	require.Equal(t, 2, test.matchDAO.MatchingCycle())
+}
+
+func TestCoffeeBotResumeMatchingRunAtStartup(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	for id := 1; id <= 5; id++ {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, id, fmt.Sprintf("user%d", id), messagestrings.Minsk, int64(id), true))
+	}
+	// nothing to resume
+	require.NoError(t, test.bot.ResumeMatchingRun(ctx))
+	require.Equal(t, 0, test.matchDAO.MatchingCycle())
+
+	reminderDAO := test.reminderDAO
+	test.reminderDAO = &failingReminderDAO{ReminderDAO: reminderDAO, failAfter: 2}
+	test.bot = test.newBot()
+	require.Error(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+	require.Error(t, test.bot.ResumeMatchingRun(ctx))
+
+	test.reminderDAO = reminderDAO
+	test.bot = test.newBot()
+	require.NoError(t, test.bot.ResumeMatchingRun(ctx))
+	require.Equal(t, 1, test.matchDAO.MatchingCycle())
+	matched, err := test.matchDAO.GetAllMatchedUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, matched, 4)
+	fakeClock.Advance(time.Hour)
+	test.takeReminders(t, 5)
+
+	// the finished run is not resumed again
+	require.NoError(t, test.bot.ResumeMatchingRun(ctx))
+	require.Equal(t, 1, test.matchDAO.MatchingCycle())
+	fakeClock.Advance(time.Hour)
+	test.takeReminders(t, 0)
+}
+
+func TestCoffeeBotRepeatedWeeklyRun(t *testing.T) {
+	ctx := context.Background()
+	runTime := time.Date(2020, 7, 6, 0, 0, 0, 0, config.ScheduleLocation)
+	fakeClock := clock.Fake{Current: runTime}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	for id := 1; id <= 2; id++ {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, id, fmt.Sprintf("user%d", id), messagestrings.Moscow, int64(id), true))
+	}
+	require.NoError(t, test.bot.MakeWeeklyMatches(ctx, runTime))
+	require.Equal(t, 1, test.matchDAO.MatchingCycle())
+
+	// the schedule could not save the finished run, so after a restart it reports the same run as missed
+	fakeClock.Current = fakeClock.Current.Add(time.Hour)
+	require.NoError(t, test.bot.MakeWeeklyMatches(ctx, runTime))
+	require.Equal(t, 1, test.matchDAO.MatchingCycle())
+
+	require.NoError(t, test.bot.MakeWeeklyMatches(ctx, runTime.AddDate(0, 0, 7)))
+	require.Equal(t, 2, test.matchDAO.MatchingCycle())
+}
+
+func TestCoffeeBotCycles(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 21, 0, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	replies, err := test.bot.ProcessMessage(ctx, 4, config.AdminUser, 4, "Cycles")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 4, "No matching cycles")
+
+	for id := 1; id <= 3; id++ {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, id, fmt.Sprintf("user%d", id), messagestrings.Minsk, int64(id), true))
+	}
+	require.NoError(t, test.bot.MakeWeeklyMatches(ctx, fakeClock.Now()))
+	require.NoError(t, test.userDAO.UpdateActiveStatus(ctx, 3, false))
+	fakeClock.Current = fakeClock.Current.Add(time.Hour)
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now().Add(time.Hour)))
+
+	cycles, err := test.matchDAO.FindCycles(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, cycles, 2)
+	require.Equal(t, 2, cycles[0].Number)
+	require.ElementsMatch(t, []int{1, 2}, cycles[0].Participants)
+	require.Len(t, cycles[0].Groups, 1)
+	require.ElementsMatch(t, []int{1, 2}, cycles[0].Groups[0])
+	require.Nil(t, cycles[0].Unpaired)
+	require.Equal(t, 1, cycles[1].Number)
+	require.Equal(t, config.MatchingSchedule, cycles[1].Schedule)
+	require.ElementsMatch(t, []int{1, 2, 3}, cycles[1].Participants)
+	require.Len(t, cycles[1].Unpaired, 1)
+
+	replies, err = test.bot.ProcessMessage(ctx, 3, "user3", 3, "Cycles")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 3, messagestrings.DefaultReply)
+
+	replies, err = test.bot.ProcessMessage(ctx, 4, config.AdminUser, 4, "Cycles")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 4, "#2 05.07 22:00 UTC, by hand: 2 participants, 1 matches, 0 unpaired\n"+
+		"#1 05.07 21:00 UTC, \"0 0 * * 1\": 3 participants, 1 matches, 1 unpaired")
+}
+
+func TestCoffeeBotMeetingTimeParsing(t *testing.T) {
+	ctx := context.Background()
+	// Sunday, 07:20 in Minsk
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+	_, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+
+	understood := map[string]string{
+		"05.07 15:04":       "05 July в 15:04",
+		"06.07.2020 9:00":   "06 July в 09:00",
+		"15:04":             "05 July в 15:04",
+		"19.30":             "05 July в 19:30",
+		"7:00":              "06 July в 07:00",
+		"7 вечера":          "05 July в 19:00",
+		"в 12 часов":        "05 July в 12:00",
+		"в 7 часов вечера":  "05 July в 19:00",
+		"в час дня":         "05 July в 13:00",
+		"завтра в 19":       "06 July в 19:00",
+		"завтра 19.30":      "06 July в 19:30",
+		"Послезавтра, 8:30": "07 July в 08:30",
+		"пятница 12:30":     "10 July в 12:30",
+		"в воскресенье в 7 утра": "12 July в 07:00",
+		"через 2 часа":           "05 July в 09:20",
+		"через полчаса":          "05 July в 07:50",
+		"tomorrow at 7pm":        "06 July в 19:00",
+		"on fri at 7:30am":       "10 July в 07:30",
+		"in 30 minutes":          "05 July в 07:50",
+		"in an hour":             "05 July в 08:20",
+	}
+	for text, expected := range understood {
+		replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, text)
+		require.NoError(t, err)
+		requireSingleReplyText(t, replies, 1, fmt.Sprintf(messagestrings.ConfirmTimeTemplate, expected+" +03"))
+	}
+
+	for _, text := range []string{"когда-нибудь", "25:00", "31.02 10:00", "завтра", "через часик", "13 вечера", "19 завтра 20"} {
+		replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, text)
+		require.NoError(t, err)
+		requireSingleReplyText(t, replies, 1, messagestrings.CouldNotParseTime)
+	}
+
+	replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, "сегодня в 7")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.TimeInThePast)
+
+	// a date without the year is the next one, even if it was yesterday or earlier today
+	for text, expected := range map[string]time.Time{
+		"04.07 19:00": time.Date(2021, 7, 4, 16, 0, 0, 0, time.UTC),
+		"05.07 7:00":  time.Date(2021, 7, 5, 4, 0, 0, 0, time.UTC),
+		"05.07 7:30":  time.Date(2020, 7, 5, 4, 30, 0, 0, time.UTC),
+		"29.02 10:00": time.Date(2024, 2, 29, 7, 0, 0, 0, time.UTC),
+	} {
+		replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, text)
+		require.NoError(t, err)
+		require.Len(t, replies, 1)
+		// the confirmation button holds the unix time
+		data := replies[0].Markup.Rows[0][0].Data
+		unixTime, err := strconv.ParseInt(data[strings.LastIndex(data, ":")+1:], 10, 64)
+		require.NoError(t, err)
+		require.Equal(t, expected, time.Unix(unixTime, 0).UTC())
+	}
+}
+
+func TestCoffeeBotConfirmMeetingTime(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 12, 30, 12, 0, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, true))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+	_, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+
+	// the meeting is next year
+	replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, "05.01 10:00")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, "Встреча 05 January в 10:00 +03, верно?")
+	keyboard := replies[0].Markup
+	require.True(t, keyboard.Inline)
+	require.Len(t, keyboard.Rows, 1)
+	require.Equal(t, messagestrings.ConfirmTime, keyboard.Rows[0][0].Text)
+	require.Equal(t, messagestrings.RejectTime, keyboard.Rows[0][1].Text)
+
+	callback, err := test.bot.ProcessCallback(ctx, 1, "alice", 1, keyboard.Rows[0][1].Data)
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.TimeRejected, callback.EditedText)
+	requireSingleReplyText(t, callback.Replies, 1, "У тебя встреча с @bob. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04")
+	match, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 1)
+	require.NoError(t, err)
+	require.Nil(t, match.MeetingTime)
+
+	callback, err = test.bot.ProcessCallback(ctx, 1, "alice", 1, keyboard.Rows[0][0].Data)
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.ButtonExpired, callback.Answer)
+
+	replies, err = test.bot.ProcessMessage(ctx, 1, "alice", 1, "05.01 10:00")
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	callback, err = test.bot.ProcessCallback(ctx, 1, "alice", 1, replies[0].Markup.Rows[0][0].Data)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf(messagestrings.ProposedTimeTemplate, "05 January в 10:00 +03"), callback.EditedText)
+	require.Len(t, callback.Replies, 2)
+	require.Equal(t, "Предложили @bob время встречи: 05 January в 10:00 +03. Когда время выберут, придёт сообщение", callback.Replies[0].Text)
+	callback, err = test.bot.ProcessCallback(ctx, 2, "bob", 2, callback.Replies[1].Markup.Rows[0][0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "Встреча с @alice будет 05 January в 10:00 +03", callback.Replies[0].Text)
+
+	match, err = test.matchDAO.FindCurrentMatchForUserID(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, match.MeetingTime.Equal(time.Date(2021, 1, 5, 7, 0, 0, 0, time.UTC)))
+}
+
+func TestCoffeeBotInvitations(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.London, 2, true))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+	match, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 1)
+	require.NoError(t, err)
+
+	_, err = test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.RemindMe)
+	require.NoError(t, err)
+	replies := enterMeetingTime(t, ctx, test.bot, 1, "alice", "06.07 19:00")
+	require.Len(t, replies, 2)
+	for _, reply := range replies {
+		require.Nil(t, reply.Document)
+	}
+
+	// invitations are sent with the meeting details when the time is accepted
+	press := messenger.Press(2, "bob", 42, replies[1].Markup.Rows[0][0].Data)
+	update := <-messenger.Updates()
+	require.NoError(t, test.bot.HandleUpdate(ctx, messenger, update))
+	require.Len(t, messenger.TakeAnswers(), 1)
+	require.Equal(t, press.CallbackID, update.CallbackID)
+	sent := messenger.TakeSent()
+	require.Len(t, sent, 3)
+	require.Equal(t, int64(2), sent[1].ChatID)
+	require.True(t, strings.HasSuffix(sent[1].Text, "Встреча с @alice будет 06 July в 17:00 BST. У @alice (Минск) это 06 July в 19:00 +03"))
+	require.NotNil(t, sent[1].Document)
+	require.Equal(t, "meeting.ics", sent[1].Document.Name)
+	bobInvitation := string(sent[1].Document.Content)
+	require.Contains(t, bobInvitation, "\r\nMETHOD:REQUEST\r\n")
+	require.Contains(t, bobInvitation, "\r\nUID:0-2@randomcoffee\r\n")
+	require.Contains(t, bobInvitation, "\r\nDTSTART:20200706T160000Z\r\n")
+	require.Contains(t, bobInvitation, "\r\nDTEND:20200706T170000Z\r\n")
+	require.Contains(t, bobInvitation, "\r\nSUMMARY:Random Coffee с @alice\r\n")
+	// the links to calls are disabled by default
+	require.NotContains(t, bobInvitation, "\r\nURL:")
+	require.Equal(t, int64(1), sent[2].ChatID)
+	require.Contains(t, string(sent[2].Document.Content), "\r\nUID:0-1@randomcoffee\r\n")
+
+	// the new time replaces the event, the link to the call uses the random room of the match
+	defer func(template string) { config.CallLinkTemplate = template }(config.CallLinkTemplate)
+	config.CallLinkTemplate = "https://meet.example.com/%s"
+	require.Len(t, match.CallRoom, 32)
+	fakeClock.Advance(time.Minute)
+	_, err = test.bot.ProcessMessage(ctx, 1, "alice", 1, messagestrings.ChangeTime)
+	require.NoError(t, err)
+	replies = agreeOnMeetingTime(t, ctx, test.bot, 1, "alice", "07.07 19:00")
+	require.Len(t, replies, 2)
+	aliceInvitation := string(replies[1].Document.Content)
+	require.Contains(t, aliceInvitation, "\r\nUID:0-1@randomcoffee\r\n")
+	require.Contains(t, aliceInvitation, "\r\nDTSTART:20200707T160000Z\r\n")
+	require.Contains(t, aliceInvitation, fmt.Sprintf("\r\nSEQUENCE:%d\r\n", fakeClock.Now().Unix()))
+	require.Contains(t, aliceInvitation, "\r\nURL:https://meet.example.com/"+match.CallRoom+"\r\n")
+	require.NotContains(t, aliceInvitation, match.ID.Hex())
+
+	// the events are cancelled when the match is broken
+	replies, err = test.bot.ProcessMessage(ctx, 2, "bob", 2, messagestrings.StopMeetings)
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+	for _, reply := range replies {
+		require.NotNil(t, reply.Document)
+		cancellation := string(reply.Document.Content)
+		require.Contains(t, cancellation, "\r\nMETHOD:CANCEL\r\n")
+		require.Contains(t, cancellation, fmt.Sprintf("\r\nUID:0-%d@randomcoffee\r\n", reply.ChatID))
+	}
+	require.Equal(t, messagestrings.PartnerRefused, replies[1].Text)
+}
+
+// historyMatcher remembers the history of the last matching and matches nobody
+type historyMatcher struct {
+	history *match.History
+}
+
+func (h *historyMatcher) Match(users []user.User, history *match.History) ([]matcher.Group, []user.User) {
+	h.history = history
+	return nil, users
+}
+
+func TestCoffeeBotFeedback(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+
+	usernames := map[int]string{1: "alice", 2: "bob", 3: "carol", 4: "dave"}
+	for ID, username := range usernames {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, ID, username, messagestrings.Minsk, int64(ID), true))
+	}
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+	require.NoError(t, test.matchDAO.AddMatch(ctx, 3, 4))
+	for _, ID := range []int{1, 3} {
+		_, err := test.bot.ProcessMessage(ctx, ID, usernames[ID], int64(ID), messagestrings.RemindMe)
+		require.NoError(t, err)
+		replies := agreeOnMeetingTime(t, ctx, test.bot, ID, usernames[ID], "05.07 19:00")
+		require.Len(t, replies, 2)
+	}
+	fakeClock.Advance(12 * time.Hour)
+	test.takeReminders(t, 8)
+
+	// the partners are asked how the meeting went a day later
+	fakeClock.Advance(config.FeedbackDelay)
+	require.Len(t, test.queue, 4)
+	for i := 0; i < 4; i++ {
+		r := <-test.queue
+		require.Equal(t, reminder.Feedback, r.Kind)
+		require.NoError(t, test.bot.SendReminder(ctx, messenger, r))
+	}
+	questions := make(map[int64]transport.Message)
+	for _, sent := range messenger.TakeSent() {
+		questions[sent.ChatID] = sent
+	}
+	require.Len(t, questions, 4)
+	require.Equal(t, "Как прошла встреча с @bob? Оцени её от 1 до 5", questions[1].Text)
+	keyboard := questions[1].Keyboard
+	require.True(t, keyboard.Inline)
+	require.Len(t, keyboard.Rows, 2)
+	require.Len(t, keyboard.Rows[0], 5)
+	require.Equal(t, "5", keyboard.Rows[0][4].Text)
+	require.Equal(t, messagestrings.MeetingDidNotHappen, keyboard.Rows[1][0].Text)
+	require.Equal(t, messagestrings.PartnerDidNotCome, keyboard.Rows[1][1].Text)
+
+	// the buttons only work for the participants of the match
+	callback, err := test.bot.ProcessCallback(ctx, 3, "carol", 3, keyboard.Rows[0][4].Data)
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.ButtonExpired, callback.Answer)
+
+	callback, err = test.bot.ProcessCallback(ctx, 1, "alice", 1, keyboard.Rows[1][0].Data)
+	require.NoError(t, err)
+	require.Equal(t, messagestrings.MeetingDidNotHappen, callback.EditedText)
+	requireSingleReplyText(t, callback.Replies, 1, messagestrings.AskFeedbackComment)
+	replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, "Боб не пришёл")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 1, messagestrings.FeedbackCommentSaved)
+	require.Equal(t, test.remindChangeTimeStopMeetingsKeyboard, *replies[0].Markup)
+
+	callback, err = test.bot.ProcessCallback(ctx, 2, "bob", 2, questions[2].Keyboard.Rows[0][3].Data)
+	require.NoError(t, err)
+	require.Equal(t, "Твоя оценка встречи: 4", callback.EditedText)
+	replies, err = test.bot.ProcessMessage(ctx, 2, "bob", 2, messagestrings.Skip)
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.FeedbackCommentSkipped)
+
+	callback, err = test.bot.ProcessCallback(ctx, 3, "carol", 3, questions[3].Keyboard.Rows[0][4].Data)
+	require.NoError(t, err)
+	require.Equal(t, "Твоя оценка встречи: 5", callback.EditedText)
+
+	first, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 1)
+	require.NoError(t, err)
+	answer, err := test.feedback.FindFeedback(ctx, first.ID, 1)
+	require.NoError(t, err)
+	require.False(t, answer.Happened)
+	require.Equal(t, "Боб не пришёл", answer.Comment)
+	answer, err = test.feedback.FindFeedback(ctx, first.ID, 2)
+	require.NoError(t, err)
+	require.True(t, answer.Happened)
+	require.Equal(t, 4, answer.Rating)
+
+	replies, err = test.bot.ProcessMessage(ctx, 5, "eve", 5, "Feedback")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 5, messagestrings.DefaultReply)
+	replies, err = test.bot.ProcessMessage(ctx, 5, config.AdminUser, 5, "Feedback")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 5, "#0: 3 answers, 2 met, 1 did not meet, 1 comments, average rating 4.5")
+
+	// the partners whose meeting did not happen may be matched again
+	recorder := &historyMatcher{}
+	test.bot = coffeebot.NewCoffeeBot(
+		test.userDAO,
+		test.matchDAO,
+		test.reminderDAO,
+		test.stateStore,
+		test.runStore,
+		test.proposals,
+		test.feedback,
+		&fakeClock,
+		recorder,
+		&test.removeMarkup,
+		&test.citiesKeyboard,
+		&test.remindStopMeetingsKeyboard,
+		&test.remindChangeTimeStopMeetingsKeyboard,
+		&test.activateKeyboard,
+		&test.settingsKeyboard,
+		&test.interestsKeyboard,
+	)
+	require.NoError(t, test.bot.MakeMatches(ctx, fakeClock.Now()))
+	_, ok := recorder.history.LastMatchedCycle(1, 2)
+	require.False(t, ok)
+	_, ok = recorder.history.LastMatchedCycle(3, 4)
+	require.True(t, ok)
+}
+
+func TestCoffeeBotReliability(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+	messenger := transport.NewMemory()
+
+	usernames := map[int]string{1: "alice", 2: "bob", 3: "carol", 4: "dave"}
+	for ID, username := range usernames {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, ID, username, messagestrings.Minsk, int64(ID), true))
+	}
+	reliability := func(ID int) user.Reliability {
+		found, err := test.userDAO.FindUserByID(ctx, ID)
+		require.NoError(t, err)
+		return found.Reliability
+	}
+	// meet matches the users in the next cycle, lets the meeting pass and returns the feedback question to the reporter
+	meet := func(reporterID, partnerID int) *transport.Keyboard {
+		require.NoError(t, test.matchDAO.StartMatchingCycle(ctx, match.Cycle{Number: test.matchDAO.MatchingCycle() + 1}))
+		require.NoError(t, test.matchDAO.AddMatch(ctx, reporterID, partnerID))
+		_, err := test.bot.ProcessMessage(ctx, reporterID, usernames[reporterID], int64(reporterID), messagestrings.RemindMe)
+		require.NoError(t, err)
+		meetingTime := fakeClock.Now().Add(2 * time.Hour).In(util.GetLocationForCityOrUTC(messagestrings.Minsk)).Format("02.01 15:04")
+		agreeOnMeetingTime(t, ctx, test.bot, reporterID, usernames[reporterID], meetingTime)
+		fakeClock.Advance(2*time.Hour + config.FeedbackDelay)
+		for len(test.queue) > 0 {
+			r := <-test.queue
+			if r.Kind == reminder.Feedback && r.ChatID == int64(reporterID) {
+				require.NoError(t, test.bot.SendReminder(ctx, messenger, r))
+			}
+		}
+		sent := messenger.TakeSent()
+		require.Len(t, sent, 1)
+		return sent[0].Keyboard
+	}
+	answer := func(reporterID int, button transport.Button) *coffeebot.CallbackReply {
+		callback, err := test.bot.ProcessCallback(ctx, reporterID, usernames[reporterID], int64(reporterID), button.Data)
+		require.NoError(t, err)
+		_, err = test.bot.ProcessMessage(ctx, reporterID, usernames[reporterID], int64(reporterID), messagestrings.Skip)
+		require.NoError(t, err)
+		return callback
+	}
+
+	// a held meeting is counted for the one who tells about it
+	question := meet(1, 3)
+	callback := answer(1, question.Rows[0][4])
+	requireSingleReplyText(t, callback.Replies, 1, messagestrings.AskFeedbackComment)
+	require.Equal(t, user.Reliability{MeetingsHeld: 1}, reliability(1))
+	require.Equal(t, user.Reliability{}, reliability(3))
+
+	question = meet(1, 2)
+	callback = answer(1, question.Rows[1][1])
+	require.Equal(t, messagestrings.PartnerDidNotCome, callback.EditedText)
+	requireSingleReplyText(t, callback.Replies, 1, messagestrings.AskFeedbackComment)
+	require.Equal(t, user.Reliability{NoShows: 1, NoShowsInARow: 1}, reliability(2))
+	require.Equal(t, user.Reliability{MeetingsHeld: 1}, reliability(1))
+
+	// a changed answer is stored but not counted again
+	callback = answer(1, question.Rows[0][2])
+	require.Equal(t, "Твоя оценка встречи: 3", callback.EditedText)
+	require.Equal(t, user.Reliability{NoShows: 1, NoShowsInARow: 1}, reliability(2))
+	require.Equal(t, user.Reliability{MeetingsHeld: 1}, reliability(1))
+
+	// a meeting that did not happen for another reason is nobody's no-show, even if both partners tell so
+	question = meet(3, 4)
+	answer(3, question.Rows[1][0])
+	answer(4, question.Rows[1][0])
+	require.Equal(t, user.Reliability{}, reliability(3))
+	require.Equal(t, user.Reliability{}, reliability(4))
+
+	// a partner who tells that they met takes the no-show back
+	question = meet(4, 3)
+	answer(4, question.Rows[1][1])
+	require.Equal(t, user.Reliability{NoShows: 1, NoShowsInARow: 1}, reliability(3))
+	answer(3, question.Rows[0][4])
+	require.Equal(t, user.Reliability{MeetingsHeld: 1}, reliability(3))
+	require.Equal(t, user.Reliability{}, reliability(4))
+
+	// partners blaming each other are not counted either
+	question = meet(1, 4)
+	answer(1, question.Rows[1][1])
+	require.Equal(t, user.Reliability{NoShows: 1, NoShowsInARow: 1}, reliability(4))
+	answer(4, question.Rows[1][1])
+	require.Equal(t, user.Reliability{}, reliability(4))
+	require.Equal(t, user.Reliability{MeetingsHeld: 1}, reliability(1))
+
+	// the second no-show in a row pauses the user
+	question = meet(3, 2)
+	callback = answer(3, question.Rows[1][1])
+	require.Len(t, callback.Replies, 2)
+	require.Equal(t, messagestrings.AskFeedbackComment, callback.Replies[0].Text)
+	require.Equal(t, int64(2), callback.Replies[1].ChatID)
+	require.Equal(t, messagestrings.PausedForNoShows, callback.Replies[1].Text)
+	require.Equal(t, test.activateKeyboard, *callback.Replies[1].Markup)
+	pausedFor := reliability(2).PausedForMatch
+	require.False(t, pausedFor.IsZero())
+	require.Equal(t, user.Reliability{NoShows: 2, PausedForMatch: pausedFor}, reliability(2))
+	bob, err := test.userDAO.FindUserByID(ctx, 2)
+	require.NoError(t, err)
+	require.False(t, bob.Active)
+
+	// disputing the no-show that paused the user makes them active again
+	callback = answer(2, question.Rows[0][4])
+	require.Len(t, callback.Replies, 4)
+	require.Equal(t, messagestrings.AskFeedbackComment, callback.Replies[0].Text)
+	require.Equal(t, int64(2), callback.Replies[1].ChatID)
+	require.Equal(t, messagestrings.UnpausedAfterDispute, callback.Replies[1].Text)
+	// like after activating, the user is matched with someone left without a partner
+	require.Equal(t, int64(2), callback.Replies[2].ChatID)
+	require.True(t, strings.HasPrefix(callback.Replies[2].Text, "На этой неделе у тебя встреча с @"))
+	require.True(t, strings.HasSuffix(callback.Replies[3].Text, "встреча с @bob"))
+	require.Equal(t, user.Reliability{MeetingsHeld: 1, NoShows: 1}, reliability(2))
+	bob, err = test.userDAO.FindUserByID(ctx, 2)
+	require.NoError(t, err)
+	require.True(t, bob.Active)
+	replies, err := test.bot.ProcessMessage(ctx, 2, "bob", 2, "лапки")
+	require.NoError(t, err)
+	requireSingleReplyText(t, replies, 2, messagestrings.DefaultReply)
+	require.Equal(t, &test.remindStopMeetingsKeyboard, replies[0].Markup)
+
+	// leaving a match before the meeting is a refusal
+	bobsMatch, err := test.matchDAO.FindCurrentMatchForUserID(ctx, 2)
+	require.NoError(t, err)
+	var freeUserIDs []int
+	for _, userID := range []int{1, 3, 4} {
+		if userID != bobsMatch.PartnerIDs()[0] {
+			freeUserIDs = append(freeUserIDs, userID)
+		}
+	}
+	firstID, secondID := freeUserIDs[0], freeUserIDs[1]
+	require.NoError(t, test.matchDAO.AddMatch(ctx, firstID, secondID))
+	expected := reliability(secondID)
+	expected.Refusals++
+	_, err = test.bot.ProcessMessage(ctx, secondID, usernames[secondID], int64(secondID), messagestrings.StopMeetings)
+	require.NoError(t, err)
+	require.Equal(t, expected, reliability(secondID))
+}
+
+func TestCoffeeBotProfile(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	test := newMemoryTestContext()
+	defer test.init(ctx, &fakeClock)()
+
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 1, "alice", messagestrings.Minsk, 1, true))
+	require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "bob", messagestrings.Minsk, 2, false))
+	send := func(text string) []coffeebot.BotReply {
+		replies, err := test.bot.ProcessMessage(ctx, 1, "alice", 1, text)
+		require.NoError(t, err)
+		return replies
+	}
+	profile := func() user.Profile {
+		alice, err := test.userDAO.FindUserByID(ctx, 1)
+		require.NoError(t, err)
+		return alice.Profile
+	}
+
+	replies := send(messagestrings.Profile)
+	requireSingleReplyText(t, replies, 1, messagestrings.AskBio)
+	require.Equal(t, test.removeMarkup, *replies[0].Markup)
+
+	replies = send(strings.Repeat("а", config.MaxBioLength+1))
+	requireSingleReplyText(t, replies, 1, fmt.Sprintf(messagestrings.BioTooLongTemplate, config.MaxBioLength))
+	require.Empty(t, profile().Bio)
+
+	replies = send(" Люблю кофе ")
+	requireSingleReplyText(t, replies, 1, fmt.Sprintf(messagestrings.AskInterestsTemplate, messagestrings.NoInterests))
+	require.Equal(t, test.interestsKeyboard, *replies[0].Markup)
+
+	// tags are toggled and keep the order of the configuration
+	send(config.InterestTags[2])
+	send(config.InterestTags[0])
+	send(config.InterestTags[1])
+	replies = send(config.InterestTags[2])
+	chosen := config.InterestTags[0] + ", " + config.InterestTags[1]
+	requireSingleReplyText(t, replies, 1, fmt.Sprintf(messagestrings.AskInterestsTemplate, chosen))
+	replies = send("не интерес")
+	requireSingleReplyText(t, replies, 1, fmt.Sprintf(messagestrings.AskInterestsTemplate, chosen))
+
+	replies = send(messagestrings.InterestsDone)
+	requireSingleReplyText(t, replies, 1, messagestrings.AskLanguages)
+	replies = send("русский, English,")
+	requireSingleReplyText(t, replies, 1, messagestrings.AskCompany)
+	replies = send(messagestrings.Skip)
+	expected := user.Profile{
+		Bio:       "Люблю кофе",
+		Interests: []string{config.InterestTags[0], config.InterestTags[1]},
+		Languages: []string{"русский", "English"},
+	}
+	require.Equal(t, expected, profile())
+	profileText := "О себе: Люблю кофе\nИнтересы: " + chosen + "\nЯзыки: русский, English"
+	requireSingleReplyText(t, replies, 1, messagestrings.ProfileSaved+"\n\n"+profileText)
+	require.Equal(t, test.remindStopMeetingsKeyboard, *replies[0].Markup)
+
+	// skipped steps keep the values, the clear sign removes them
+	replies = send(messagestrings.Profile)
+	requireSingleReplyText(t, replies, 1, profileText+"\n\n"+messagestrings.AskBio)
+	send(messagestrings.Skip)
+	send(messagestrings.InterestsDone)
+	send(messagestrings.ClearProfileField)
+	send("Яндекс, поиск")
+	expected.Languages = nil
+	expected.Company = "Яндекс, поиск"
+	require.Equal(t, expected, profile())
+
+	// the partner sees the profile in the announcement of the match
+	replies, err := test.bot.ProcessMessage(ctx, 2, "bob", 2, messagestrings.Activate)
+	require.NoError(t, err)
+	require.Len(t, replies, 3)
+	require.Equal(t, int64(2), replies[1].ChatID)
+	require.Equal(t, "На этой неделе у тебя встреча с @alice\n\nНемного о @alice:\nО себе: Люблю кофе\nИнтересы: "+chosen+"\nКомпания или команда: Яндекс, поиск", replies[1].Text)
+	require.Equal(t, int64(1), replies[2].ChatID)
+	require.Equal(t, "На этой неделе у тебя встреча с @bob", replies[2].Text)
+}
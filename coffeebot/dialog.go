@@ -0,0 +1,426 @@
+package coffeebot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"yandexschooldating/config"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/state"
+	"yandexschooldating/transport"
+	"yandexschooldating/user"
+	"yandexschooldating/util"
+
+	"github.com/joomcode/errorx"
+)
+
+// dialogState is a step of the conversation with a user. It is persisted, do not rename existing states
+type dialogState string
+
+const (
+	idleState              dialogState = "idle"
+	meetingScheduledState  dialogState = "meetingScheduled"
+	inactiveState          dialogState = "inactive"
+	settingsState          dialogState = "settings"
+	waitingForCityState    dialogState = "waitingForCity"
+	waitingForDateState    dialogState = "waitingForDate"
+	confirmingDateState    dialogState = "confirmingDate"
+	waitingForCommentState dialogState = "waitingForComment"
+	editingBioState        dialogState = "editingBio"
+	editingInterestsState  dialogState = "editingInterests"
+	editingLanguagesState  dialogState = "editingLanguages"
+	editingCompanyState    dialogState = "editingCompany"
+)
+
+// anyInput is the input of a transition that accepts every text not accepted by other transitions of the state
+const anyInput = ""
+
+// sameState is a transition target meaning that the user stays in the state the transition started from
+const sameState dialogState = "same"
+
+type message struct {
+	userID   int
+	username string
+	chatID   int64
+	text     string
+}
+
+// handler processes a message. It moves the sender to one of the targets of its transition with setState,
+// if it does not, the sender stays in the same state
+type handler func(b *CoffeeBot, ctx context.Context, message message) ([]BotReply, error)
+
+type transition struct {
+	input   string
+	handler handler
+	targets []dialogState
+}
+
+type stateDefinition struct {
+	// keyboard is the name of the markup shown to the user in this state
+	keyboard string
+	// inProgress states wait for the user to enter something. They expire after config.DialogStateTTL
+	// and are not interrupted by other users, see setPartnerState
+	inProgress  bool
+	transitions []transition
+}
+
+func newDialog() map[dialogState]stateDefinition {
+	common := []transition{
+		{"/start", (*CoffeeBot).start, []dialogState{waitingForCityState}},
+		{messagestrings.RemindMe, (*CoffeeBot).remindMe, []dialogState{inactiveState, idleState, waitingForDateState, meetingScheduledState}},
+		{messagestrings.ChangeTime, (*CoffeeBot).changeTime, []dialogState{inactiveState, idleState, waitingForDateState}},
+		{messagestrings.StopMeetings, (*CoffeeBot).stopMeetings, []dialogState{inactiveState}},
+		{messagestrings.Activate, (*CoffeeBot).activate, []dialogState{sameState, idleState}},
+		{messagestrings.Settings, (*CoffeeBot).settings, []dialogState{settingsState}},
+		{messagestrings.PreferOnline, (*CoffeeBot).updateMeetingFormat, []dialogState{idleState, inactiveState}},
+		{messagestrings.PreferLive, (*CoffeeBot).updateMeetingFormat, []dialogState{idleState, inactiveState}},
+		{messagestrings.Profile, (*CoffeeBot).editProfile, []dialogState{editingBioState}},
+		{"MakeMatches", (*CoffeeBot).makeMatchesCommand, []dialogState{sameState, idleState}},
+		{"Failures", (*CoffeeBot).failuresCommand, []dialogState{sameState}},
+		{"Cycles", (*CoffeeBot).cyclesCommand, []dialogState{sameState}},
+		{"Feedback", (*CoffeeBot).feedbackCommand, []dialogState{sameState}},
+	}
+	defaultReply := transition{anyInput, (*CoffeeBot).defaultReply, []dialogState{sameState}}
+	// settled are the states of users who are not entering anything, see settledState
+	settled := []dialogState{idleState, meetingScheduledState, inactiveState}
+	with := func(transitions ...transition) []transition {
+		return append(append([]transition(nil), common...), transitions...)
+	}
+
+	return map[dialogState]stateDefinition{
+		idleState:             {keyboard: remindStopMeetingsKeyboardName, transitions: with(defaultReply)},
+		meetingScheduledState: {keyboard: remindChangeTimeStopMeetingsKeyboardName, transitions: with(defaultReply)},
+		inactiveState:         {keyboard: activateKeyboardName, transitions: with(defaultReply)},
+		settingsState:         {keyboard: settingsKeyboardName, transitions: with(defaultReply)},
+		waitingForCityState: {
+			keyboard:    citiesKeyboardName,
+			inProgress:  true,
+			transitions: with(transition{anyInput, (*CoffeeBot).saveCity, []dialogState{idleState}}),
+		},
+		waitingForDateState: {
+			keyboard:   removeMarkupName,
+			inProgress: true,
+			transitions: with(transition{anyInput, (*CoffeeBot).enterMeetingTime, []dialogState{
+				inactiveState, idleState, waitingForDateState, confirmingDateState,
+			}}),
+		},
+		// the user may type another time instead of confirming the one understood by the bot
+		confirmingDateState: {
+			keyboard:   removeMarkupName,
+			inProgress: true,
+			transitions: with(transition{anyInput, (*CoffeeBot).enterMeetingTime, []dialogState{
+				inactiveState, idleState, waitingForDateState, confirmingDateState,
+			}}),
+		},
+		// the comment to the feedback about a meeting is optional
+		waitingForCommentState: {
+			keyboard:   removeMarkupName,
+			inProgress: true,
+			transitions: with(
+				transition{messagestrings.Skip, (*CoffeeBot).skipFeedbackComment, settled},
+				transition{anyInput, (*CoffeeBot).saveFeedbackComment, settled},
+			),
+		},
+		// every step of the profile keeps the current value on messagestrings.Skip
+		editingBioState: {
+			keyboard:    removeMarkupName,
+			inProgress:  true,
+			transitions: with(transition{anyInput, (*CoffeeBot).saveBio, []dialogState{sameState, editingInterestsState}}),
+		},
+		editingInterestsState: {
+			keyboard:   interestsKeyboardName,
+			inProgress: true,
+			transitions: with(
+				transition{messagestrings.InterestsDone, (*CoffeeBot).finishInterests, []dialogState{editingLanguagesState}},
+				transition{anyInput, (*CoffeeBot).chooseInterest, []dialogState{sameState}},
+			),
+		},
+		editingLanguagesState: {
+			keyboard:    removeMarkupName,
+			inProgress:  true,
+			transitions: with(transition{anyInput, (*CoffeeBot).saveLanguages, []dialogState{editingCompanyState}}),
+		},
+		editingCompanyState: {
+			keyboard:    removeMarkupName,
+			inProgress:  true,
+			transitions: with(transition{anyInput, (*CoffeeBot).saveCompany, settled}),
+		},
+	}
+}
+
+// callback data consists of the action and its argument joined by callbackSeparator
+const (
+	callbackSeparator = ":"
+	timeSlotAction    = "time"
+	confirmTimeAction = "confirm"
+	rejectTimeAction  = "reject"
+	// acceptTimeAction and counterProposeAction answer a proposal of a partner
+	acceptTimeAction     = "accept"
+	counterProposeAction = "counter"
+	// feedbackAction answers the question how the meeting went
+	feedbackAction = "feedback"
+)
+
+// callbackHandler processes a press of an inline button with the argument of the callback data
+type callbackHandler func(b *CoffeeBot, ctx context.Context, message message, argument string) (*CallbackReply, error)
+
+var callbackHandlers = map[string]callbackHandler{
+	timeSlotAction:       (*CoffeeBot).chooseTimeSlot,
+	confirmTimeAction:    (*CoffeeBot).confirmTime,
+	rejectTimeAction:     (*CoffeeBot).rejectTime,
+	acceptTimeAction:     (*CoffeeBot).acceptTime,
+	counterProposeAction: (*CoffeeBot).counterPropose,
+	feedbackAction:       (*CoffeeBot).rateMeeting,
+}
+
+func (b *CoffeeBot) processCallback(ctx context.Context, message message, data string) (*CallbackReply, error) {
+	parts := strings.SplitN(data, callbackSeparator, 2)
+	handler := callbackHandlers[parts[0]]
+	if len(parts) != 2 || handler == nil {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	return handler(b, ctx, message, parts[1])
+}
+
+// chooseTimeSlot proposes the time from the button. Slots are unambiguous, so they are not confirmed.
+// The message keeps its buttons, so that several slots can be proposed
+func (b *CoffeeBot) chooseTimeSlot(ctx context.Context, message message, slot string) (*CallbackReply, error) {
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	location := util.GetLocationForCityOrUTC(thisUser.City)
+	meetingTime, ok := parseMeetingTime(slot, b.clock.Now().In(location))
+	if !ok || !meetingTime.After(b.clock.Now()) {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	replies, err := b.proposeMeetingTime(ctx, message, meetingTime)
+	if err != nil {
+		return nil, err
+	}
+	answer := fmt.Sprintf(messagestrings.ProposedTimeTemplate, meetingTime.In(location).Format(meetingTimeLayout))
+	return &CallbackReply{Answer: answer, Replies: replies}, nil
+}
+
+// confirmTime proposes the time understood by the bot, the argument is its unix time
+func (b *CoffeeBot) confirmTime(ctx context.Context, message message, argument string) (*CallbackReply, error) {
+	meetingTime, ok := b.timeToConfirm(message, argument)
+	if !ok {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := b.proposeMeetingTime(ctx, message, meetingTime)
+	if err != nil {
+		return nil, err
+	}
+	edited := fmt.Sprintf(messagestrings.ProposedTimeTemplate, formatMeetingTime(thisUser.City, meetingTime))
+	return &CallbackReply{EditedText: edited, Replies: replies}, nil
+}
+
+// rejectTime asks for the meeting time again
+func (b *CoffeeBot) rejectTime(ctx context.Context, message message, argument string) (*CallbackReply, error) {
+	if _, ok := b.timeToConfirm(message, argument); !ok {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	replies, err := b.changeTime(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	return &CallbackReply{EditedText: messagestrings.TimeRejected, Replies: replies}, nil
+}
+
+// acceptTime saves one of the times proposed by a partner, the argument is its unix time
+func (b *CoffeeBot) acceptTime(ctx context.Context, message message, argument string) (*CallbackReply, error) {
+	unixTime, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	meetingTime := time.Unix(unixTime, 0)
+	match, partners, replies, err := b.findMatchWithPartners(ctx, message)
+	if err != nil || replies != nil {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired, Replies: replies}, err
+	}
+	pending, err := b.findProposal(ctx, match.ID)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil || pending.ProposerID == message.userID || !pending.Has(meetingTime) {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	replies, err = b.saveMeetingTime(ctx, match, append([]user.User{*thisUser}, partners...), meetingTime)
+	if err != nil {
+		return nil, err
+	}
+	edited := fmt.Sprintf(messagestrings.ChosenTimeTemplate, formatMeetingTime(thisUser.City, meetingTime))
+	return &CallbackReply{EditedText: edited, Replies: replies}, nil
+}
+
+// counterPropose asks for another meeting time instead of the proposed ones, the argument is the ID of the match
+func (b *CoffeeBot) counterPropose(ctx context.Context, message message, argument string) (*CallbackReply, error) {
+	match, partners, replies, err := b.findMatchWithPartners(ctx, message)
+	if err != nil || replies != nil {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired, Replies: replies}, err
+	}
+	if match.ID.Hex() != argument {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	return &CallbackReply{Replies: b.askForMeetingTime(thisUser, partners, message.chatID)}, nil
+}
+
+// timeToConfirm parses the argument of the confirmation buttons, which only work while the user is confirming
+func (b *CoffeeBot) timeToConfirm(message message, argument string) (time.Time, bool) {
+	if b.state[message.userID].dialog != confirmingDateState {
+		return time.Time{}, false
+	}
+	unixTime, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unixTime, 0), true
+}
+
+func (d stateDefinition) findTransition(text string) transition {
+	var result transition
+	for _, transition := range d.transitions {
+		if transition.input == text {
+			return transition
+		}
+		if transition.input == anyInput {
+			result = transition
+		}
+	}
+	return result
+}
+
+func (t transition) allows(from, to dialogState) bool {
+	for _, target := range t.targets {
+		if target == to || (target == sameState && from == to) {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition is a row of the transition table. Input is empty for transitions accepting any text
+type Transition struct {
+	From  string
+	Input string
+	To    []string
+}
+
+// TransitionTable lists every transition of the dialog with sameState replaced by the state it starts from
+func TransitionTable() []Transition {
+	var result []Transition
+	for from, definition := range newDialog() {
+		for _, transition := range definition.transitions {
+			row := Transition{From: string(from), Input: transition.input}
+			for _, target := range transition.targets {
+				if target == sameState {
+					target = from
+				}
+				row.To = append(row.To, string(target))
+			}
+			result = append(result, row)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].From < result[j].From })
+	return result
+}
+
+func (b *CoffeeBot) processMessage(ctx context.Context, message message) ([]BotReply, error) {
+	if len(message.username) == 0 {
+		return []BotReply{{message.chatID, messagestrings.SorryNoUsername, b.markups[removeMarkupName], nil}}, nil
+	}
+
+	// TODO: update username
+
+	from := b.state[message.userID].dialog
+	transition := b.dialog[from].findTransition(message.text)
+	replies, err := transition.handler(b, ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	to := b.state[message.userID].dialog
+	if !transition.allows(from, to) {
+		return nil, errorx.IllegalState.New("transition from %s by %q to %s is not declared", from, message.text, to)
+	}
+	return replies, nil
+}
+
+// loadStates reads the states of the users from the store unless they are already loaded during this request
+func (b *CoffeeBot) loadStates(ctx context.Context, userIDs ...int) error {
+	for _, userID := range userIDs {
+		if b.state[userID] != nil {
+			continue
+		}
+		stored, err := b.stateStore.FindState(ctx, userID)
+		if err != nil {
+			return err
+		}
+		b.state[userID] = &userState{dialog: idleState}
+		if stored != nil {
+			if _, ok := b.dialog[dialogState(stored.Dialog)]; ok {
+				b.state[userID].dialog = dialogState(stored.Dialog)
+			}
+		}
+	}
+	return nil
+}
+
+// saveStates writes the states loaded during the request back to the store and forgets them,
+// so that the next request sees expired dialogs
+func (b *CoffeeBot) saveStates(ctx context.Context) error {
+	states := b.state
+	b.state = make(map[int]*userState)
+	for userID, userState := range states {
+		stored := state.State{UserID: userID, Dialog: string(userState.dialog)}
+		if b.dialog[userState.dialog].inProgress {
+			expireAt := b.clock.Now().Add(config.DialogStateTTL)
+			stored.ExpireAt = &expireAt
+		}
+		err := b.stateStore.SaveState(ctx, stored)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *CoffeeBot) setState(userID int, dialog dialogState) {
+	if b.state[userID] == nil {
+		b.state[userID] = &userState{dialog: dialog}
+	} else {
+		b.state[userID].dialog = dialog
+	}
+}
+
+// setPartnerState moves a user affected by someone else's actions unless they are entering something
+func (b *CoffeeBot) setPartnerState(userID int, dialog dialogState) {
+	if b.state[userID] != nil && b.dialog[b.state[userID].dialog].inProgress {
+		return
+	}
+	b.setState(userID, dialog)
+}
+
+// keyboard returns the markup of the state the user is in
+func (b *CoffeeBot) keyboard(userID int) *transport.Keyboard {
+	if b.state[userID] == nil {
+		b.state[userID] = &userState{dialog: idleState}
+	}
+	return b.markups[b.dialog[b.state[userID].dialog].keyboard]
+}
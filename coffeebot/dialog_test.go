@@ -0,0 +1,99 @@
+package coffeebot_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/coffeebot"
+	"yandexschooldating/config"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/state"
+
+	"github.com/stretchr/testify/require"
+)
+
+type dialogFixture struct {
+	name  string
+	setUp func(t *testing.T, ctx context.Context, test *testContext, clock clock.Clock)
+}
+
+var dialogFixtures = []dialogFixture{
+	{"active user without a match", func(t *testing.T, ctx context.Context, test *testContext, _ clock.Clock) {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 1, config.AdminUser, messagestrings.Minsk, 1, true))
+	}},
+	{"matched user", func(t *testing.T, ctx context.Context, test *testContext, _ clock.Clock) {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 1, config.AdminUser, messagestrings.Minsk, 1, true))
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "partner", messagestrings.Minsk, 2, true))
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 3, "spare", messagestrings.Minsk, 3, true))
+		require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+	}},
+	{"matched user with meeting time", func(t *testing.T, ctx context.Context, test *testContext, clock clock.Clock) {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 1, config.AdminUser, messagestrings.Minsk, 1, true))
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 2, "partner", messagestrings.Minsk, 2, true))
+		require.NoError(t, test.matchDAO.AddMatch(ctx, 1, 2))
+		require.NoError(t, test.matchDAO.UpdateMatchTime(ctx, 1, clock.Now().Add(48*time.Hour)))
+	}},
+	{"inactive user", func(t *testing.T, ctx context.Context, test *testContext, _ clock.Clock) {
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 1, config.AdminUser, messagestrings.Minsk, 1, false))
+		require.NoError(t, test.userDAO.UpsertUser(ctx, 3, "spare", messagestrings.Minsk, 3, true))
+	}},
+}
+
+func TestTransitionTable(t *testing.T) {
+	table := coffeebot.TransitionTable()
+	require.NotEmpty(t, table)
+
+	states := make(map[string]bool)
+	hasAnyInput := make(map[string]bool)
+	for _, row := range table {
+		states[row.From] = true
+		if row.Input == "" {
+			hasAnyInput[row.From] = true
+		}
+		require.NotEmpty(t, row.To, "transition from %s by %q has no targets", row.From, row.Input)
+	}
+	for _, row := range table {
+		for _, to := range row.To {
+			require.True(t, states[to], "transition from %s by %q leads to undeclared state %s", row.From, row.Input, to)
+		}
+	}
+	for from := range states {
+		require.True(t, hasAnyInput[from], "state %s does not accept free text", from)
+	}
+}
+
+func TestDialogFollowsTransitionTable(t *testing.T) {
+	ctx := context.Background()
+	freeTexts := []string{"06.07 9:00", "лапки"}
+
+	for _, row := range coffeebot.TransitionTable() {
+		inputs := []string{row.Input}
+		if row.Input == "" {
+			inputs = freeTexts
+		}
+		for _, input := range inputs {
+			for _, fixture := range dialogFixtures {
+				row, input, fixture := row, input, fixture
+				t.Run(fmt.Sprintf("%s by %q for %s", row.From, input, fixture.name), func(t *testing.T) {
+					fakeClock := clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+					test := newMemoryTestContext()
+					defer test.init(ctx, &fakeClock)()
+					fixture.setUp(t, ctx, &test, &fakeClock)
+					require.NoError(t, test.stateStore.SaveState(ctx, state.State{UserID: 1, Dialog: row.From}))
+
+					replies, err := test.bot.ProcessMessage(ctx, 1, config.AdminUser, 1, input)
+					require.NoError(t, err)
+					require.NotEmpty(t, replies)
+
+					stored, err := test.stateStore.FindState(ctx, 1)
+					require.NoError(t, err)
+					require.NotNil(t, stored)
+					require.Contains(t, row.To, stored.Dialog)
+				})
+			}
+		}
+	}
+}
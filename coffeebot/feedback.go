@@ -0,0 +1,247 @@
+package coffeebot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"yandexschooldating/config"
+	"yandexschooldating/feedback"
+	"yandexschooldating/match"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/transport"
+	"yandexschooldating/user"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// partnerNoShowRating is the rating in the callback data of the answer that the partners did not come,
+// zero is the answer that the meeting did not happen for another reason
+const partnerNoShowRating = -1
+
+// feedbackKeyboard offers to rate the meeting of the match or to tell that it did not happen
+func feedbackKeyboard(matchID primitive.ObjectID) *transport.Keyboard {
+	data := func(rating int) string {
+		return feedbackAction + callbackSeparator + matchID.Hex() + callbackSeparator + strconv.Itoa(rating)
+	}
+	var ratings []transport.Button
+	for rating := 1; rating <= feedback.MaxRating; rating++ {
+		ratings = append(ratings, transport.Button{Text: strconv.Itoa(rating), Data: data(rating)})
+	}
+	return transport.NewInlineKeyboard(ratings, []transport.Button{
+		{Text: messagestrings.MeetingDidNotHappen, Data: data(0)},
+		{Text: messagestrings.PartnerDidNotCome, Data: data(partnerNoShowRating)},
+	})
+}
+
+func formatFeedbackQuestion(partners []user.User) string {
+	return fmt.Sprintf(messagestrings.FeedbackQuestionTemplate, formatUsernames(partners))
+}
+
+func isParticipant(match *match.Match, userID int) bool {
+	for _, ID := range match.UserIDs() {
+		if ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// rateMeeting saves the answer to the feedback question and asks for a comment.
+// The argument is the ID of the match and the rating, zero if the meeting did not happen
+// and partnerNoShowRating if the partners did not come
+func (b *CoffeeBot) rateMeeting(ctx context.Context, message message, argument string) (*CallbackReply, error) {
+	parts := strings.SplitN(argument, callbackSeparator, 2)
+	if len(parts) != 2 {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	matchID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	rating, err := strconv.Atoi(parts[1])
+	if err != nil || rating < partnerNoShowRating || rating > feedback.MaxRating {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+	match, err := b.matchDAO.FindMatchByID(ctx, matchID)
+	if err != nil {
+		return nil, err
+	}
+	if match == nil || !isParticipant(match, message.userID) {
+		return &CallbackReply{Answer: messagestrings.ButtonExpired}, nil
+	}
+
+	answer, err := b.feedback.FindFeedback(ctx, matchID, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	firstAnswer := answer == nil
+	if firstAnswer {
+		answer = &feedback.Feedback{
+			ID:            primitive.NewObjectID(),
+			MatchID:       matchID,
+			UserID:        message.userID,
+			MatchingCycle: match.MatchingCycle,
+		}
+	}
+	answer.Happened = rating > 0
+	answer.PartnerNoShow = rating == partnerNoShowRating
+	answer.Rating = 0
+	if answer.Happened {
+		answer.Rating = rating
+	}
+	answer.UnixTime = b.clock.Now().Unix()
+	err = b.feedback.SaveFeedback(ctx, *answer)
+	if err != nil {
+		return nil, err
+	}
+	// changed answers are not counted again
+	var partnerReplies []BotReply
+	if firstAnswer {
+		partnerReplies, err = b.recordAnswer(ctx, match, *answer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.setState(message.userID, waitingForCommentState)
+	edited := messagestrings.MeetingDidNotHappen
+	switch {
+	case answer.Happened:
+		edited = fmt.Sprintf(messagestrings.FeedbackRatingTemplate, rating)
+	case answer.PartnerNoShow:
+		edited = messagestrings.PartnerDidNotCome
+	}
+	return &CallbackReply{
+		EditedText: edited,
+		Replies:    append([]BotReply{{message.chatID, messagestrings.AskFeedbackComment, b.keyboard(message.userID), nil}}, partnerReplies...),
+	}, nil
+}
+
+// settledState is the state of the user when they are not entering anything
+func (b *CoffeeBot) settledState(ctx context.Context, userID int) (dialogState, error) {
+	user, err := b.findUserByID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if !user.Active {
+		return inactiveState, nil
+	}
+	match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if match != nil && match.MeetingTime != nil {
+		return meetingScheduledState, nil
+	}
+	return idleState, nil
+}
+
+// saveFeedbackComment adds the text to the latest feedback of the user
+func (b *CoffeeBot) saveFeedbackComment(ctx context.Context, message message) ([]BotReply, error) {
+	settled, err := b.settledState(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(message.userID, settled)
+	latest, err := b.feedback.FindLatestFeedback(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return b.defaultReply(ctx, message)
+	}
+	latest.Comment = message.text
+	err = b.feedback.SaveFeedback(ctx, *latest)
+	if err != nil {
+		return nil, err
+	}
+	return []BotReply{{message.chatID, messagestrings.FeedbackCommentSaved, b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) skipFeedbackComment(ctx context.Context, message message) ([]BotReply, error) {
+	settled, err := b.settledState(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(message.userID, settled)
+	return []BotReply{{message.chatID, messagestrings.FeedbackCommentSkipped, b.keyboard(message.userID), nil}}, nil
+}
+
+// findRecentMeetings returns the recent matches except the ones whose meeting did not happen according to
+// one of the participants, so that the participants may be matched again
+func (b *CoffeeBot) findRecentMeetings(ctx context.Context) ([]match.Match, error) {
+	recentMatches, err := b.matchDAO.FindRecentMatches(ctx, config.MatchHistoryCycles)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := b.feedback.FindFeedbackSince(ctx, b.matchDAO.MatchingCycle()-config.MatchHistoryCycles+1)
+	if err != nil {
+		return nil, err
+	}
+	missed := make(map[primitive.ObjectID]bool)
+	for _, answer := range answers {
+		if !answer.Happened {
+			missed[answer.MatchID] = true
+		}
+	}
+	var result []match.Match
+	for _, recent := range recentMatches {
+		if !missed[recent.ID] {
+			result = append(result, recent)
+		}
+	}
+	return result, nil
+}
+
+// formatFeedback summarizes the feedback of every matching cycle, the latest cycle first
+func formatFeedback(answers []feedback.Feedback) string {
+	byCycle := make(map[int][]feedback.Feedback)
+	var cycles []int
+	for _, answer := range answers {
+		if _, ok := byCycle[answer.MatchingCycle]; !ok {
+			cycles = append(cycles, answer.MatchingCycle)
+		}
+		byCycle[answer.MatchingCycle] = append(byCycle[answer.MatchingCycle], answer)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(cycles)))
+
+	var lines []string
+	for _, cycle := range cycles {
+		happened, ratingSum, comments := 0, 0, 0
+		for _, answer := range byCycle[cycle] {
+			if answer.Happened {
+				happened++
+				ratingSum += answer.Rating
+			}
+			if answer.Comment != "" {
+				comments++
+			}
+		}
+		line := fmt.Sprintf("#%d: %d answers, %d met, %d did not meet, %d comments",
+			cycle, len(byCycle[cycle]), happened, len(byCycle[cycle])-happened, comments)
+		if happened > 0 {
+			line += fmt.Sprintf(", average rating %.1f", float64(ratingSum)/float64(happened))
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// feedbackCommand shows the admin how the meetings of the latest matching cycles went
+func (b *CoffeeBot) feedbackCommand(ctx context.Context, message message) ([]BotReply, error) {
+	if message.username != config.AdminUser {
+		return b.defaultReply(ctx, message)
+	}
+	answers, err := b.feedback.FindFeedbackSince(ctx, b.matchDAO.MatchingCycle()-cyclesShown+1)
+	if err != nil {
+		return nil, err
+	}
+	reply := "No feedback"
+	if len(answers) > 0 {
+		reply = formatFeedback(answers)
+	}
+	return []BotReply{{message.chatID, reply, b.keyboard(message.userID), nil}}, nil
+}
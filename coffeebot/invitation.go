@@ -0,0 +1,53 @@
+package coffeebot
+
+import (
+	"fmt"
+	"time"
+
+	"yandexschooldating/calendar"
+	"yandexschooldating/config"
+	"yandexschooldating/match"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/transport"
+	"yandexschooldating/user"
+)
+
+// invitationName is the name of the calendar files sent to the users
+const invitationName = "meeting.ics"
+
+// meetingEvent returns the calendar event of the meeting of the user. A user has one meeting per matching cycle,
+// so the events of a user in a cycle share the UID and replace each other in the calendar
+func (b *CoffeeBot) meetingEvent(match *match.Match, userID int, meetingTime time.Time) calendar.Event {
+	return calendar.Event{
+		UID: fmt.Sprintf("%d-%d@randomcoffee", match.MatchingCycle, userID),
+		// later events must have greater sequence numbers
+		Sequence: b.clock.Now().Unix(),
+		Stamp:    b.clock.Now(),
+		Start:    meetingTime,
+		Duration: config.MeetingDuration,
+	}
+}
+
+// invitation returns the calendar file with the meeting of the participant with the partners
+func (b *CoffeeBot) invitation(match *match.Match, participant *user.User, partners []user.User, meetingTime time.Time) *transport.Document {
+	event := b.meetingEvent(match, participant.ID, meetingTime)
+	event.Summary = fmt.Sprintf(messagestrings.InvitationSummaryTemplate, formatUsernames(partners))
+	event.Description = formatMatchMessageWithTime(participant, partners, meetingTime)
+	if config.CallLinkTemplate != "" && match.CallRoom != "" {
+		event.URL = fmt.Sprintf(config.CallLinkTemplate, match.CallRoom)
+		event.Description += "\n" + fmt.Sprintf(messagestrings.CallLinkTemplate, event.URL)
+	}
+	return &transport.Document{Name: invitationName, Content: event.ICS()}
+}
+
+// cancellation returns the calendar file removing the scheduled meeting of the match, or nil if the meeting
+// is not scheduled or has passed
+func (b *CoffeeBot) cancellation(match *match.Match, userID int) *transport.Document {
+	if match == nil || match.MeetingTime == nil || !match.MeetingTime.After(b.clock.Now()) {
+		return nil
+	}
+	event := b.meetingEvent(match, userID, *match.MeetingTime)
+	event.Summary = messagestrings.CancelledMeetingSummary
+	event.Cancelled = true
+	return &transport.Document{Name: invitationName, Content: event.ICS()}
+}
@@ -0,0 +1,266 @@
+package coffeebot
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dayWords are the words for days relative to today
+var dayWords = map[string]int{
+	"сегодня":     0,
+	"today":       0,
+	"завтра":      1,
+	"tomorrow":    1,
+	"послезавтра": 2,
+}
+
+var weekdayWords = map[string]time.Weekday{
+	"понедельник": time.Monday, "пн": time.Monday, "monday": time.Monday, "mon": time.Monday,
+	"вторник": time.Tuesday, "вт": time.Tuesday, "tuesday": time.Tuesday, "tue": time.Tuesday,
+	"среда": time.Wednesday, "среду": time.Wednesday, "ср": time.Wednesday, "wednesday": time.Wednesday, "wed": time.Wednesday,
+	"четверг": time.Thursday, "чт": time.Thursday, "thursday": time.Thursday, "thu": time.Thursday,
+	"пятница": time.Friday, "пятницу": time.Friday, "пт": time.Friday, "friday": time.Friday, "fri": time.Friday,
+	"суббота": time.Saturday, "субботу": time.Saturday, "сб": time.Saturday, "saturday": time.Saturday, "sat": time.Saturday,
+	"воскресенье": time.Sunday, "вс": time.Sunday, "sunday": time.Sunday, "sun": time.Sunday,
+}
+
+// fillerWords are skipped, as in "в пятницу в 12:30" or "on friday at 7pm"
+var fillerWords = map[string]bool{"в": true, "во": true, "at": true, "on": true}
+
+// hourWords follow the hour, as in "в 12 часов" or "в 7 часов вечера"
+var hourWords = map[string]bool{"час": true, "часа": true, "часов": true, "ч": true}
+
+// durationWords are the units of relative times, as in "через 2 часа" or "in 30 minutes"
+var durationWords = map[string]time.Duration{
+	"час": time.Hour, "часа": time.Hour, "часов": time.Hour, "ч": time.Hour,
+	"hour": time.Hour, "hours": time.Hour, "h": time.Hour,
+	"минуту": time.Minute, "минуты": time.Minute, "минут": time.Minute, "мин": time.Minute,
+	"minute": time.Minute, "minutes": time.Minute, "min": time.Minute,
+	"полчаса": 30 * time.Minute,
+}
+
+// calendarDate is a typed date, year is 0 when it is omitted
+type calendarDate struct {
+	day   int
+	month time.Month
+	year  int
+}
+
+// parseMeetingTime understands the meeting times users type in Russian or English, like "02.01 15:04", "15:04",
+// "19.30", "завтра в 19", "в 12 часов", "пятница 12:30", "через 2 часа", "tomorrow at 7pm" or "in 30 minutes".
+// now must be in the location of the user. Times without a year are the next occurrence after now,
+// so only today or a date with the year may be in the past
+func parseMeetingTime(text string, now time.Time) (time.Time, bool) {
+	text = strings.NewReplacer("ё", "е", ",", " ").Replace(strings.ToLower(text))
+	words := strings.Fields(strings.TrimRight(text, ".!?"))
+	if len(words) > 0 && (words[0] == "через" || words[0] == "in") {
+		duration, ok := parseDuration(words[1:])
+		if !ok {
+			return time.Time{}, false
+		}
+		return now.Add(duration).Truncate(time.Minute), true
+	}
+
+	var date *time.Time
+	var typedDate *calendarDate
+	// dateWord is the typed date, it is the time if no other time follows, as in "19.30"
+	dateWord := ""
+	var weekday *time.Weekday
+	hour, minute := -1, 0
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if fillerWords[word] {
+			continue
+		}
+		noDate := date == nil && typedDate == nil && weekday == nil
+		if days, ok := dayWords[word]; ok && noDate {
+			day := now.AddDate(0, 0, days)
+			date = &day
+			continue
+		}
+		if day, ok := weekdayWords[word]; ok && noDate {
+			weekday = &day
+			continue
+		}
+		if typed, ok := parseDate(word); ok && noDate {
+			typedDate = &typed
+			dateWord = word
+			continue
+		}
+		if hour < 0 && word == "час" {
+			// "в час дня"
+			hour = 1
+			continue
+		}
+		if hour >= 0 && hourWords[word] {
+			continue
+		}
+		if hour >= 0 {
+			// the part of the day after the hour, as in "7 вечера" or "7 pm"
+			var ok bool
+			hour, ok = applyDayPart(hour, word)
+			if !ok {
+				return time.Time{}, false
+			}
+			continue
+		}
+		var ok bool
+		hour, minute, ok = parseClock(word)
+		if !ok {
+			return time.Time{}, false
+		}
+	}
+	if hour < 0 && dateWord != "" {
+		var ok bool
+		hour, minute, ok = parseClock(dateWord)
+		if !ok {
+			return time.Time{}, false
+		}
+		typedDate = nil
+	}
+	if hour < 0 {
+		return time.Time{}, false
+	}
+
+	at := func(day time.Time) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+	}
+	switch {
+	case date != nil:
+		return at(*date), true
+	case typedDate != nil:
+		return typedDate.next(hour, minute, now)
+	case weekday != nil:
+		day := now.AddDate(0, 0, (int(*weekday)-int(now.Weekday())+7)%7)
+		if !at(day).After(now) {
+			day = day.AddDate(0, 0, 7)
+		}
+		return at(day), true
+	default:
+		if !at(now).After(now) {
+			return at(now.AddDate(0, 0, 1)), true
+		}
+		return at(now), true
+	}
+}
+
+// parseDuration parses "2 часа", "час", "an hour" or "полчаса"
+func parseDuration(words []string) (time.Duration, bool) {
+	amount := 1
+	if len(words) == 2 {
+		if words[0] == "a" || words[0] == "an" {
+			words = words[1:]
+		} else {
+			var err error
+			amount, err = strconv.Atoi(words[0])
+			if err != nil || amount <= 0 {
+				return 0, false
+			}
+			words = words[1:]
+		}
+	}
+	if len(words) != 1 {
+		return 0, false
+	}
+	unit, ok := durationWords[words[0]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// parseDate parses "02.01" or "02.01.2021"
+func parseDate(word string) (calendarDate, bool) {
+	parts := strings.Split(word, ".")
+	if len(parts) != 2 && len(parts) != 3 {
+		return calendarDate{}, false
+	}
+	var numbers []int
+	for _, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return calendarDate{}, false
+		}
+		numbers = append(numbers, number)
+	}
+	date := calendarDate{day: numbers[0], month: time.Month(numbers[1])}
+	if date.month < time.January || date.month > time.December || date.day < 1 || date.day > 31 {
+		return calendarDate{}, false
+	}
+	if len(numbers) == 3 {
+		date.year = numbers[2]
+		return date, time.Date(date.year, date.month, date.day, 0, 0, 0, 0, time.UTC).Day() == date.day
+	}
+	// 29.02 is valid in leap years
+	return date, time.Date(2020, date.month, date.day, 0, 0, 0, 0, time.UTC).Day() == date.day
+}
+
+// next returns the date at the time, without the year it is the next occurrence after now
+func (d calendarDate) next(hour, minute int, now time.Time) (time.Time, bool) {
+	if d.year != 0 {
+		return time.Date(d.year, d.month, d.day, hour, minute, 0, 0, now.Location()), true
+	}
+	// 29.02 happens at least every 8 years
+	for year := now.Year(); year <= now.Year()+8; year++ {
+		result := time.Date(year, d.month, d.day, hour, minute, 0, 0, now.Location())
+		if result.Day() == d.day && result.After(now) {
+			return result, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseClock parses "15:04", "19.30", "19", "7pm" or "7:30am"
+func parseClock(word string) (int, int, bool) {
+	dayPart := ""
+	for _, suffix := range []string{"am", "pm"} {
+		if strings.HasSuffix(word, suffix) {
+			dayPart = suffix
+			word = strings.TrimSuffix(word, suffix)
+		}
+	}
+	parts := strings.Split(strings.Replace(word, ".", ":", 1), ":")
+	if len(parts) > 2 || len(parts[0]) == 0 || len(parts[0]) > 2 {
+		return 0, 0, false
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, 0, false
+	}
+	minute := 0
+	if len(parts) == 2 {
+		if len(parts[1]) != 2 {
+			return 0, 0, false
+		}
+		minute, err = strconv.Atoi(parts[1])
+		if err != nil || minute < 0 || minute > 59 {
+			return 0, 0, false
+		}
+	}
+	if dayPart != "" {
+		var ok bool
+		hour, ok = applyDayPart(hour, dayPart)
+		if !ok {
+			return 0, 0, false
+		}
+	}
+	return hour, minute, true
+}
+
+// applyDayPart turns "7" and "вечера" or "pm" into 19
+func applyDayPart(hour int, word string) (int, bool) {
+	switch word {
+	case "am", "утра", "ночи":
+		if hour < 1 || hour > 12 {
+			return 0, false
+		}
+		return hour % 12, true
+	case "pm", "дня", "вечера":
+		if hour < 1 || hour > 12 {
+			return 0, false
+		}
+		return hour%12 + 12, true
+	}
+	return 0, false
+}
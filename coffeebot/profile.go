@@ -0,0 +1,184 @@
+package coffeebot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"yandexschooldating/config"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/user"
+)
+
+// updateProfile applies the update to the profile of the user and returns the updated user
+func (b *CoffeeBot) updateProfile(ctx context.Context, userID int, update func(profile *user.Profile)) (*user.User, error) {
+	user, err := b.findUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	update(&user.Profile)
+	err = b.userDAO.UpdateProfile(ctx, userID, user.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// profileField returns the value of a text field entered by the user, messagestrings.ClearProfileField removes it
+func profileField(text string) string {
+	text = strings.TrimSpace(text)
+	if text == messagestrings.ClearProfileField {
+		return ""
+	}
+	return text
+}
+
+func parseLanguages(text string) []string {
+	var languages []string
+	for _, language := range strings.Split(profileField(text), ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+func isInterestTag(text string) bool {
+	for _, tag := range config.InterestTags {
+		if tag == text {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleInterest adds the tag to the interests or removes it, the interests keep the order of config.InterestTags
+func toggleInterest(interests []string, tag string) []string {
+	chosen := make(map[string]bool)
+	for _, interest := range interests {
+		chosen[interest] = true
+	}
+	chosen[tag] = !chosen[tag]
+	var result []string
+	for _, interest := range config.InterestTags {
+		if chosen[interest] {
+			result = append(result, interest)
+		}
+	}
+	return result
+}
+
+// formatProfile lists the filled fields of the profile
+func formatProfile(profile user.Profile) string {
+	var lines []string
+	if profile.Bio != "" {
+		lines = append(lines, messagestrings.ProfileBio+profile.Bio)
+	}
+	if len(profile.Interests) > 0 {
+		lines = append(lines, messagestrings.ProfileInterests+strings.Join(profile.Interests, ", "))
+	}
+	if len(profile.Languages) > 0 {
+		lines = append(lines, messagestrings.ProfileLanguages+strings.Join(profile.Languages, ", "))
+	}
+	if profile.Company != "" {
+		lines = append(lines, messagestrings.ProfileCompany+profile.Company)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// editProfile starts filling in the profile. Every step can be skipped to keep the current value
+func (b *CoffeeBot) editProfile(ctx context.Context, message message) ([]BotReply, error) {
+	user, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(message.userID, editingBioState)
+	text := messagestrings.AskBio
+	if !user.Profile.IsEmpty() {
+		text = formatProfile(user.Profile) + "\n\n" + text
+	}
+	return []BotReply{{message.chatID, text, b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) saveBio(ctx context.Context, message message) ([]BotReply, error) {
+	if len([]rune(message.text)) > config.MaxBioLength {
+		return []BotReply{{message.chatID, fmt.Sprintf(messagestrings.BioTooLongTemplate, config.MaxBioLength), b.keyboard(message.userID), nil}}, nil
+	}
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	if message.text != messagestrings.Skip {
+		thisUser, err = b.updateProfile(ctx, message.userID, func(profile *user.Profile) { profile.Bio = profileField(message.text) })
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.setState(message.userID, editingInterestsState)
+	return []BotReply{{message.chatID, formatInterestsQuestion(thisUser.Profile), b.keyboard(message.userID), nil}}, nil
+}
+
+func formatInterestsQuestion(profile user.Profile) string {
+	chosen := messagestrings.NoInterests
+	if len(profile.Interests) > 0 {
+		chosen = strings.Join(profile.Interests, ", ")
+	}
+	return fmt.Sprintf(messagestrings.AskInterestsTemplate, chosen)
+}
+
+// chooseInterest toggles the interest from the keyboard, other texts only repeat the question
+func (b *CoffeeBot) chooseInterest(ctx context.Context, message message) ([]BotReply, error) {
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	if isInterestTag(message.text) {
+		thisUser, err = b.updateProfile(ctx, message.userID, func(profile *user.Profile) {
+			profile.Interests = toggleInterest(profile.Interests, message.text)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []BotReply{{message.chatID, formatInterestsQuestion(thisUser.Profile), b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) finishInterests(_ context.Context, message message) ([]BotReply, error) {
+	b.setState(message.userID, editingLanguagesState)
+	return []BotReply{{message.chatID, messagestrings.AskLanguages, b.keyboard(message.userID), nil}}, nil
+}
+
+func (b *CoffeeBot) saveLanguages(ctx context.Context, message message) ([]BotReply, error) {
+	if message.text != messagestrings.Skip {
+		_, err := b.updateProfile(ctx, message.userID, func(profile *user.Profile) { profile.Languages = parseLanguages(message.text) })
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.setState(message.userID, editingCompanyState)
+	return []BotReply{{message.chatID, messagestrings.AskCompany, b.keyboard(message.userID), nil}}, nil
+}
+
+// saveCompany is the last step of filling in the profile, it shows the saved profile
+func (b *CoffeeBot) saveCompany(ctx context.Context, message message) ([]BotReply, error) {
+	thisUser, err := b.findUserByID(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	if message.text != messagestrings.Skip {
+		thisUser, err = b.updateProfile(ctx, message.userID, func(profile *user.Profile) { profile.Company = profileField(message.text) })
+		if err != nil {
+			return nil, err
+		}
+	}
+	settled, err := b.settledState(ctx, message.userID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(message.userID, settled)
+	text := messagestrings.ProfileSaved
+	if !thisUser.Profile.IsEmpty() {
+		text += "\n\n" + formatProfile(thisUser.Profile)
+	}
+	return []BotReply{{message.chatID, text, b.keyboard(message.userID), nil}}, nil
+}
@@ -0,0 +1,158 @@
+package coffeebot
+
+import (
+	"context"
+	"log"
+
+	"yandexschooldating/config"
+	"yandexschooldating/feedback"
+	"yandexschooldating/match"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/user"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// updateReliability applies the update to the reliability record of the user and returns the updated user
+func (b *CoffeeBot) updateReliability(ctx context.Context, userID int, update func(reliability *user.Reliability)) (*user.User, error) {
+	user, err := b.findUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	update(&user.Reliability)
+	err = b.userDAO.UpdateReliability(ctx, userID, user.Reliability)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// recordRefusal counts leaving the match before its meeting against the user
+func (b *CoffeeBot) recordRefusal(ctx context.Context, userID int, match *match.Match) error {
+	if match == nil || (match.MeetingTime != nil && !match.MeetingTime.After(b.clock.Now())) {
+		return nil
+	}
+	_, err := b.updateReliability(ctx, userID, func(reliability *user.Reliability) { reliability.Refusals++ })
+	return err
+}
+
+// disputesNoShow tells if the answer contradicts a no-show reported by a partner: the user either met
+// the partners or tells that they did not come
+func disputesNoShow(answer *feedback.Feedback) bool {
+	return answer != nil && (answer.Happened || answer.PartnerNoShow)
+}
+
+// recordAnswer counts the first answer of the user to the feedback question: a held meeting for the user
+// or a no-show for every partner who does not dispute it. A no-show reported earlier by a partner is taken back
+// if the user disputes it, the user paused because of it is made active again. Partners who missed
+// config.PauseAfterNoShows meetings in a row are paused, the returned replies tell them and their current partners about it
+func (b *CoffeeBot) recordAnswer(ctx context.Context, match *match.Match, answer feedback.Feedback) ([]BotReply, error) {
+	var replies []BotReply
+	for _, partnerID := range match.UserIDs() {
+		if partnerID == answer.UserID {
+			continue
+		}
+		partnerAnswer, err := b.feedback.FindFeedback(ctx, match.ID, partnerID)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case answer.PartnerNoShow && !disputesNoShow(partnerAnswer):
+			pauseReplies, err := b.recordNoShow(ctx, partnerID, match)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, pauseReplies...)
+		case partnerAnswer != nil && partnerAnswer.PartnerNoShow && disputesNoShow(&answer):
+			unpauseReplies, err := b.takeBackNoShow(ctx, answer.UserID, match)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, unpauseReplies...)
+		}
+	}
+	// the held meeting ends the no-shows in a row, including the ones restored by taking back a no-show
+	if answer.Happened {
+		_, err := b.updateReliability(ctx, answer.UserID, func(reliability *user.Reliability) {
+			reliability.MeetingsHeld++
+			reliability.NoShowsInARow = 0
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// takeBackNoShow removes the no-show of the match disputed by the user. If it paused the user, they are made active again
+func (b *CoffeeBot) takeBackNoShow(ctx context.Context, userID int, match *match.Match) ([]BotReply, error) {
+	unpaused := false
+	user, err := b.updateReliability(ctx, userID, func(reliability *user.Reliability) {
+		if reliability.NoShows > 0 {
+			reliability.NoShows--
+		}
+		if reliability.NoShowsInARow > 0 {
+			reliability.NoShowsInARow--
+		}
+		if reliability.PausedForMatch == match.ID {
+			// the no-shows before the disputed one still count
+			reliability.NoShowsInARow = config.PauseAfterNoShows - 1
+			reliability.PausedForMatch = primitive.NilObjectID
+			unpaused = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !unpaused || user.Active {
+		return nil, nil
+	}
+	log.Printf("unpausing user %s (id=%d) after they disputed the no-show", user.Username, user.ID)
+	err = b.loadStates(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return b.reactivate(ctx, user, messagestrings.UnpausedAfterDispute)
+}
+
+// recordNoShow counts the missed meeting of the match against the user and pauses them after config.PauseAfterNoShows in a row
+func (b *CoffeeBot) recordNoShow(ctx context.Context, userID int, match *match.Match) ([]BotReply, error) {
+	paused := false
+	user, err := b.updateReliability(ctx, userID, func(reliability *user.Reliability) {
+		reliability.NoShows++
+		reliability.NoShowsInARow++
+		if config.PauseAfterNoShows > 0 && reliability.NoShowsInARow >= config.PauseAfterNoShows {
+			// the user starts over when they come back
+			reliability.NoShowsInARow = 0
+			reliability.PausedForMatch = match.ID
+			paused = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !paused || !user.Active {
+		return nil, nil
+	}
+	return b.pause(ctx, user)
+}
+
+// pause makes the user who misses meetings inactive and finds a replacement for their current partner
+func (b *CoffeeBot) pause(ctx context.Context, user *user.User) ([]BotReply, error) {
+	log.Printf("pausing user %s (id=%d) after %d no-shows in a row", user.Username, user.ID, config.PauseAfterNoShows)
+	err := b.loadStates(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	b.setState(user.ID, inactiveState)
+	match, err := b.matchDAO.FindCurrentMatchForUserID(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	replies := []BotReply{{user.ChatID, messagestrings.PausedForNoShows, b.keyboard(user.ID), b.cancellation(match, user.ID)}}
+	partnerReplies, err := b.leaveMeetings(ctx, user.ID, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	return append(replies, partnerReplies...), nil
+}
@@ -11,20 +11,59 @@ const (
 	Database     = "yandexdating"
 	MongoTimeout = 30 * time.Second
 
-	SchedulingDay = time.Monday
-	NotifyBefore  = time.Hour
+	// MatchingSchedule is when weekly matching runs, a cron-like spec in ScheduleLocation
+	MatchingSchedule = "0 0 * * 1"
+	// MatchingRetryDelay is how long after a failed matching run it is tried again
+	MatchingRetryDelay = 5 * time.Minute
+	// AnnouncementHour is the local hour in the city of a user at which they learn about their new match
+	AnnouncementHour = 9
+	NotifyBefore     = time.Hour
+	// FeedbackDelay is how long after the meeting its participants are asked how it went
+	FeedbackDelay = 24 * time.Hour
+	// MeetingDuration is the length of meetings in calendar invitations
+	MeetingDuration = time.Hour
+	// ReminderCatchUpWindow is how late a reminder that was due while the bot was down is still delivered after a restart
+	ReminderCatchUpWindow = 30 * time.Minute
 
-	SendMessageRetries = 5
-	// SendMessageRetryTimeoutMs
-	// Yes, this is a timeout in a single-threaded code so
-	// failure to send a message will block the whole bot for SendMessageRetryTimeoutMs milliseconds
-	SendMessageRetryTimeoutMs = 200
+	// DialogStateTTL is how long an unfinished dialog (like entering a city or a meeting time) is remembered
+	DialogStateTTL = 24 * time.Hour
+
+	// MatchHistoryCycles is how many past matching cycles are taken into account to avoid repeated partners
+	MatchHistoryCycles = 12
+	// PauseAfterNoShows is how many meetings in a row a user may miss before they are made inactive, zero disables pausing
+	PauseAfterNoShows = 2
+	// NoShowPenalty and RefusalPenalty lower the weight of every pair of a user in matching for each of their no-shows
+	// and refusals, up to MaxReliabilityPenalty, so that unreliable users are the first to be left without a pair
+	NoShowPenalty         = 100
+	RefusalPenalty        = 50
+	MaxReliabilityPenalty = 400
+	// MaxBioLength is the longest text a user may tell about themselves in their profile, in characters
+	MaxBioLength = 300
+	// MakeTriads enables adding the user left without a pair to one of the pairs when the number of participants is odd
+	MakeTriads = true
+	// MaxOffsetDifference is the largest difference between UTC offsets of users from different cities who can be matched.
+	// Users with nobody that close are matched with the closest candidates instead
+	MaxOffsetDifference = 4 * time.Hour
+
+	// GlobalMessagesPerSecond, ChatMessagesPerSecond and ChatMessagesBurst keep outgoing messages within Telegram limits
+	GlobalMessagesPerSecond = 30
+	ChatMessagesPerSecond   = 1
+	ChatMessagesBurst       = 3
+	// SendMessageInitialBackoff doubles after every failed attempt up to SendMessageMaxBackoff
+	SendMessageInitialBackoff = time.Second
+	SendMessageMaxBackoff     = 10 * time.Minute
+	// SendMessageMaxAttempts is how many times a message is sent before it goes to the dead letters
+	SendMessageMaxAttempts = 10
 
 	AdminUser = "riazanovskiy"
 )
 
 var MongoUri = "mongodb://mongo:27017"
 
+// CallLinkTemplate is filled with the random call room of the match to get the link to the call in calendar invitations,
+// e.g. "https://meet.jit.si/RandomCoffee-%s". Empty disables the links
+var CallLinkTemplate = ""
+
 func loadLocationOrPanic(name string) *time.Location {
 	location, err := time.LoadLocation(name)
 	if err != nil {
@@ -33,6 +72,15 @@ func loadLocationOrPanic(name string) *time.Location {
 	return location
 }
 
+// InterestTags are the interests a user may choose for their profile. They are stored in the db,
+// do not modify tags, only add new ones
+var InterestTags = []string{
+	"Разработка", "Менеджмент", "Дизайн", "Наука", "Стартапы", "Книги",
+	"Кино", "Музыка", "Спорт", "Путешествия", "Игры", "Еда",
+}
+
+var ScheduleLocation = loadLocationOrPanic("Europe/Moscow")
+
 var CitiesLocation = map[string]*time.Location{
 	messagestrings.Moscow:         loadLocationOrPanic("Europe/Moscow"),
 	messagestrings.StPetersburg:   loadLocationOrPanic("Europe/Moscow"),
@@ -0,0 +1,112 @@
+package feedback
+
+import (
+	"context"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxRating is the best rating of a meeting, the worst one is 1
+const MaxRating = 5
+
+// Feedback is the answer of a participant of a match to the question how the meeting went.
+// A participant has at most one feedback per match, answering again replaces it
+type Feedback struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	MatchID       primitive.ObjectID `bson:"matchId"`
+	UserID        int                `bson:"userId"`
+	MatchingCycle int                `bson:"matchingCycle"`
+	Happened      bool               `bson:"happened"`
+	// Rating is zero if the meeting did not happen
+	Rating int `bson:"rating"`
+	// PartnerNoShow means that the meeting did not happen because the partners did not come
+	PartnerNoShow bool   `bson:"partnerNoShow,omitempty"`
+	Comment       string `bson:"comment,omitempty"`
+	UnixTime      int64  `bson:"unixTime"`
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+var FeedbackBSON = struct {
+	ID            string
+	MatchID       string
+	UserID        string
+	MatchingCycle string
+	Happened      string
+	Rating        string
+	PartnerNoShow string
+	Comment       string
+	UnixTime      string
+}{"_id", "matchId", "userId", "matchingCycle", "happened", "rating", "partnerNoShow", "comment", "unixTime"}
+
+type DAO struct {
+	feedback *mongo.Collection
+}
+
+func NewDAO(client *mongo.Client, database string) *DAO {
+	return &DAO{feedback: client.Database(database).Collection("feedback")}
+}
+
+func (m *DAO) findOne(ctx context.Context, filter bson.M, opts ...*options.FindOneOptions) (*Feedback, error) {
+	result := m.feedback.FindOne(ctx, filter, opts...)
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	var feedback Feedback
+	err := result.Decode(&feedback)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode feedback")
+	}
+	return &feedback, nil
+}
+
+func (m *DAO) FindFeedback(ctx context.Context, matchID primitive.ObjectID, userID int) (*Feedback, error) {
+	feedback, err := m.findOne(ctx, bson.M{FeedbackBSON.MatchID: matchID, FeedbackBSON.UserID: userID})
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't find feedback of user %d for match %s", userID, matchID.Hex())
+	}
+	return feedback, nil
+}
+
+// FindLatestFeedback returns the last feedback the user gave
+func (m *DAO) FindLatestFeedback(ctx context.Context, userID int) (*Feedback, error) {
+	opts := options.FindOne().SetSort(bson.M{FeedbackBSON.UnixTime: -1})
+	feedback, err := m.findOne(ctx, bson.M{FeedbackBSON.UserID: userID}, opts)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't find latest feedback of user %d", userID)
+	}
+	return feedback, nil
+}
+
+// FindFeedbackSince returns the feedback for the matches of the matching cycle and of the later ones
+func (m *DAO) FindFeedbackSince(ctx context.Context, matchingCycle int) ([]Feedback, error) {
+	cursor, err := m.feedback.Find(ctx, bson.M{FeedbackBSON.MatchingCycle: bson.M{"$gte": matchingCycle}})
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't find feedback since cycle %d", matchingCycle)
+	}
+	var result []Feedback
+	for cursor.Next(ctx) {
+		var feedback Feedback
+		err = cursor.Decode(&feedback)
+		if err != nil {
+			return nil, errorx.Decorate(err, "can't decode feedback")
+		}
+		result = append(result, feedback)
+	}
+	return result, nil
+}
+
+// SaveFeedback replaces the feedback with the same ID
+func (m *DAO) SaveFeedback(ctx context.Context, feedback Feedback) error {
+	_, err := m.feedback.ReplaceOne(ctx, bson.M{FeedbackBSON.ID: feedback.ID}, feedback, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errorx.Decorate(err, "can't save feedback of user %d for match %s", feedback.UserID, feedback.MatchID.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package feedback_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"yandexschooldating/coffeebot"
+	"yandexschooldating/config"
+	"yandexschooldating/feedback"
+	"yandexschooldating/util"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testStore checks the behaviour that every feedback store implementation must share
+func testStore(t *testing.T, ctx context.Context, store coffeebot.FeedbackStore) {
+	matchID := primitive.NewObjectID()
+	found, err := store.FindFeedback(ctx, matchID, 1)
+	require.NoError(t, err)
+	require.Nil(t, found)
+	found, err = store.FindLatestFeedback(ctx, 1)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	first := feedback.Feedback{ID: primitive.NewObjectID(), MatchID: matchID, UserID: 1, MatchingCycle: 3, Happened: true, Rating: 5, UnixTime: 100}
+	second := feedback.Feedback{ID: primitive.NewObjectID(), MatchID: matchID, UserID: 2, MatchingCycle: 3, PartnerNoShow: true, UnixTime: 101}
+	later := feedback.Feedback{ID: primitive.NewObjectID(), MatchID: primitive.NewObjectID(), UserID: 1, MatchingCycle: 4, Happened: true, Rating: 3, UnixTime: 200}
+	for _, answer := range []feedback.Feedback{first, second, later} {
+		require.NoError(t, store.SaveFeedback(ctx, answer))
+	}
+
+	found, err = store.FindFeedback(ctx, matchID, 2)
+	require.NoError(t, err)
+	require.Equal(t, second, *found)
+	found, err = store.FindLatestFeedback(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, later, *found)
+
+	// saving again replaces the feedback
+	first.Comment = "отлично поболтали"
+	require.NoError(t, store.SaveFeedback(ctx, first))
+	found, err = store.FindFeedback(ctx, matchID, 1)
+	require.NoError(t, err)
+	require.Equal(t, first, *found)
+
+	since, err := store.FindFeedbackSince(ctx, 3)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []feedback.Feedback{first, second, later}, since)
+	since, err = store.FindFeedbackSince(ctx, 4)
+	require.NoError(t, err)
+	require.Equal(t, []feedback.Feedback{later}, since)
+	since, err = store.FindFeedbackSince(ctx, 5)
+	require.NoError(t, err)
+	require.Empty(t, since)
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_feedback"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	dao := feedback.NewDAO(client, testDatabase)
+	testStore(t, ctx, dao)
+
+	err = client.Disconnect(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = dao.FindFeedback(ctx, primitive.NewObjectID(), 1)
+	require.Error(t, err)
+	_, err = dao.FindLatestFeedback(ctx, 1)
+	require.Error(t, err)
+	_, err = dao.FindFeedbackSince(ctx, 0)
+	require.Error(t, err)
+	require.Error(t, dao.SaveFeedback(ctx, feedback.Feedback{ID: primitive.NewObjectID()}))
+}
+
+func TestMemoryDAO(t *testing.T) {
+	testStore(t, context.Background(), feedback.NewMemoryDAO())
+}
@@ -0,0 +1,68 @@
+package feedback
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps feedback in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex    sync.Mutex
+	feedback []Feedback
+}
+
+func NewMemoryDAO() *MemoryDAO {
+	return &MemoryDAO{}
+}
+
+func (m *MemoryDAO) FindFeedback(_ context.Context, matchID primitive.ObjectID, userID int) (*Feedback, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, stored := range m.feedback {
+		if stored.MatchID == matchID && stored.UserID == userID {
+			feedback := stored
+			return &feedback, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryDAO) FindLatestFeedback(_ context.Context, userID int) (*Feedback, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result *Feedback
+	for _, stored := range m.feedback {
+		if stored.UserID == userID && (result == nil || stored.UnixTime >= result.UnixTime) {
+			feedback := stored
+			result = &feedback
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryDAO) FindFeedbackSince(_ context.Context, matchingCycle int) ([]Feedback, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result []Feedback
+	for _, stored := range m.feedback {
+		if stored.MatchingCycle >= matchingCycle {
+			result = append(result, stored)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryDAO) SaveFeedback(_ context.Context, feedback Feedback) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, stored := range m.feedback {
+		if stored.ID == feedback.ID {
+			m.feedback[i] = feedback
+			return nil
+		}
+	}
+	m.feedback = append(m.feedback, feedback)
+	return nil
+}
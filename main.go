@@ -2,70 +2,66 @@ package main
 
 import (
 	"context"
+	"flag"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"strings"
-	"time"
 
 	"yandexschooldating/clock"
 	"yandexschooldating/coffeebot"
 	"yandexschooldating/config"
+	"yandexschooldating/feedback"
 	"yandexschooldating/match"
+	"yandexschooldating/matcher"
+	"yandexschooldating/matchrun"
 	"yandexschooldating/messagestrings"
+	"yandexschooldating/outbox"
+	"yandexschooldating/proposal"
 	"yandexschooldating/reminder"
+	"yandexschooldating/schedule"
+	"yandexschooldating/state"
+	"yandexschooldating/transport"
 	"yandexschooldating/user"
 	"yandexschooldating/util"
+	"yandexschooldating/webhook"
 
 	"github.com/davecgh/go-spew/spew"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/joomcode/errorx"
 )
 
-var DomesticKeyboard = tgbotapi.NewReplyKeyboard(
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.Moscow),
-		tgbotapi.NewKeyboardButton(messagestrings.StPetersburg),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.Minsk),
-		tgbotapi.NewKeyboardButton(messagestrings.Novosibirsk),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.Yekaterinburg),
-		tgbotapi.NewKeyboardButton(messagestrings.NizhnyNovgorod),
-	),
+var DomesticKeyboard = transport.NewKeyboard(
+	[]string{messagestrings.Moscow, messagestrings.StPetersburg},
+	[]string{messagestrings.Minsk, messagestrings.Novosibirsk},
+	[]string{messagestrings.Yekaterinburg, messagestrings.NizhnyNovgorod},
 )
 
-var WorldKeyboard = tgbotapi.NewReplyKeyboard(
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.Moscow),
-		tgbotapi.NewKeyboardButton(messagestrings.Minsk),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.TelAviv),
-		tgbotapi.NewKeyboardButton(messagestrings.Yerevan),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.NewYork),
-		tgbotapi.NewKeyboardButton(messagestrings.Tbilisi),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.London),
-		tgbotapi.NewKeyboardButton(messagestrings.Berlin),
-	),
-	tgbotapi.NewKeyboardButtonRow(
-		tgbotapi.NewKeyboardButton(messagestrings.Zurich),
-		tgbotapi.NewKeyboardButton(messagestrings.Istanbul),
-	),
+var WorldKeyboard = transport.NewKeyboard(
+	[]string{messagestrings.Moscow, messagestrings.Minsk},
+	[]string{messagestrings.TelAviv, messagestrings.Yerevan},
+	[]string{messagestrings.NewYork, messagestrings.Tbilisi},
+	[]string{messagestrings.London, messagestrings.Berlin},
+	[]string{messagestrings.Zurich, messagestrings.Istanbul},
 )
 
 func main() {
 	spew.Config.Indent = ""
 
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: %s bot_token.txt", os.Args[0])
+	webhookURL := flag.String("webhook-url", "", "receive updates with a webhook at this public HTTPS URL instead of long polling")
+	webhookListen := flag.String("webhook-listen", ":8080", "address for the webhook HTTP server")
+	webhookSecretPath := flag.String("webhook-secret", "", "file with the secret token Telegram sends with webhook requests")
+	flag.Usage = func() {
+		log.Printf("Usage: %s [flags] bot_token.txt", os.Args[0])
+		flag.PrintDefaults()
 	}
-	tokenPath := os.Args[1]
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	tokenPath := flag.Arg(0)
 	token, err := ioutil.ReadFile(tokenPath)
 	if err != nil {
 		log.Fatalf("secret token not available %+v", err)
@@ -76,13 +72,16 @@ func main() {
 		log.Fatal(err)
 	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	updates, err := bot.GetUpdatesChan(u)
+	var updates tgbotapi.UpdatesChannel
+	if *webhookURL == "" {
+		updates, err = pollUpdates(bot)
+	} else {
+		updates, err = listenForWebhook(bot, *webhookURL, *webhookListen, *webhookSecretPath)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	telegram := transport.NewTelegram(bot, updates)
 
 	ctx := context.Background()
 	client, err := util.GetMongoClient(ctx, config.MongoUri, config.MongoTimeout)
@@ -99,120 +98,172 @@ func main() {
 	}
 
 	remindersChan := make(chan reminder.Reminder)
-	matchTimerChan := InitMatchTimerChan(realClock)
 
 	remindersDAO := reminder.NewDAO(client, config.Database, remindersChan, realClock)
 
+	stateDAO := state.NewDAO(client, config.Database, realClock)
+	err = stateDAO.EnsureTTLIndex(ctx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	queue := outbox.NewQueue(telegram, outbox.NewDAO(client, config.Database, realClock), remindersDAO, realClock)
+	go queue.Run(ctx)
+
 	err = remindersDAO.PopulateReminderQueue(ctx)
 	if err != nil {
 		log.Panicf("can't restore old timers %+v", err)
 	}
 
-	removeMarkup := tgbotapi.NewRemoveKeyboard(true)
+	matchingSchedule, err := schedule.Parse(config.MatchingSchedule, config.ScheduleLocation)
+	if err != nil {
+		log.Panic(err)
+	}
+	matchingRunner := schedule.NewRunner("matching", matchingSchedule, schedule.NewDAO(client, config.Database), realClock)
+
+	removeMarkup := transport.RemoveKeyboard()
 
 	citiesKeyboard := WorldKeyboard
 
-	remindStopMeetingsKeyboard := tgbotapi.NewReplyKeyboard(
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(messagestrings.RemindMe),
-			tgbotapi.NewKeyboardButton(messagestrings.StopMeetings),
-		),
+	remindStopMeetingsKeyboard := transport.NewKeyboard(
+		[]string{messagestrings.RemindMe, messagestrings.StopMeetings},
+		[]string{messagestrings.Settings},
 	)
 
-	remindChangeTimeStopMeetingsKeyboard := tgbotapi.NewReplyKeyboard(
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(messagestrings.RemindMe),
-			tgbotapi.NewKeyboardButton(messagestrings.ChangeTime),
-			tgbotapi.NewKeyboardButton(messagestrings.StopMeetings),
-		),
+	remindChangeTimeStopMeetingsKeyboard := transport.NewKeyboard(
+		[]string{messagestrings.RemindMe, messagestrings.ChangeTime, messagestrings.StopMeetings},
+		[]string{messagestrings.Settings},
 	)
 
-	activateKeyboard := tgbotapi.NewReplyKeyboard(
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(messagestrings.Activate),
-		),
+	activateKeyboard := transport.NewKeyboard(
+		[]string{messagestrings.Activate},
+		[]string{messagestrings.Settings},
 	)
 
+	settingsKeyboard := transport.NewKeyboard(
+		[]string{messagestrings.PreferOnline, messagestrings.PreferLive},
+	)
+
+	var interestRows [][]string
+	for i := 0; i < len(config.InterestTags); i += 3 {
+		end := i + 3
+		if end > len(config.InterestTags) {
+			end = len(config.InterestTags)
+		}
+		interestRows = append(interestRows, config.InterestTags[i:end])
+	}
+	interestsKeyboard := transport.NewKeyboard(append(interestRows, []string{messagestrings.InterestsDone})...)
+
 	coffeeBot := coffeebot.NewCoffeeBot(
 		userDAO,
 		matchDAO,
 		remindersDAO,
+		stateDAO,
+		matchrun.NewDAO(client, config.Database),
+		proposal.NewDAO(client, config.Database),
+		feedback.NewDAO(client, config.Database),
 		realClock,
+		matcher.NewWeighted(realClock, config.MakeTriads),
 		removeMarkup,
 		citiesKeyboard,
 		remindStopMeetingsKeyboard,
 		remindChangeTimeStopMeetingsKeyboard,
 		activateKeyboard,
+		settingsKeyboard,
+		interestsKeyboard,
 	)
 
+	// a run interrupted before the restart is resumed by the missed scheduled run if there is one
+	resumeRuns := make(chan struct{}, 1)
+	missedRun, err := matchingRunner.MissedRun(ctx)
+	if err != nil {
+		log.Panicf("can't find missed matching runs %+v", err)
+	}
+	if missedRun.IsZero() {
+		resumeRuns <- struct{}{}
+	}
+	err = matchingRunner.Start(ctx)
+	if err != nil {
+		log.Panicf("can't start matching schedule %+v", err)
+	}
+
 	for {
 		select {
-		case update := <-updates:
-			if update.Message == nil {
-				continue
+		case update := <-queue.Updates():
+			err = coffeeBot.HandleUpdate(ctx, queue, update)
+			if err != nil {
+				log.Printf("can't handle update %+v", err)
 			}
-
-			log.Printf("[%s] [%d] [%d] %s %+v", update.Message.From.UserName, update.Message.From.ID, update.Message.Date, update.Message.Text, strings.Replace(spew.Sdump(update), "\n", " ", -1))
-			replies, err := coffeeBot.ProcessMessage(ctx, update.Message.From.ID, update.Message.From.UserName, update.Message.Chat.ID, update.Message.Text)
+		case chatID := <-queue.Unreachable():
+			err = coffeeBot.HandleUnreachableChat(ctx, queue, chatID)
 			if err != nil {
-				log.Printf("can't get reply %+v", err)
-				replies = []coffeebot.BotReply{{ChatID: update.Message.Chat.ID, Text: "Произошла ужасная ошибка, напиши @" + config.AdminUser, Markup: nil}}
+				log.Printf("can't handle unreachable chat %d %+v", chatID, err)
 			}
-			for i, reply := range replies {
-				message := tgbotapi.NewMessage(reply.ChatID, reply.Text)
-				message.ReplyMarkup = reply.Markup
-				if i == 0 && reply.ChatID == update.Message.Chat.ID {
-					message.ReplyToMessageID = update.Message.MessageID
-				}
-				err = sendWithRetry(bot, message)
-				if err != nil {
-					log.Panicf("can't send message %+v", err)
-				}
-				log.Printf("sending %s %+v", message.Text, message)
+		case runTime := <-matchingRunner.Runs():
+			err = coffeeBot.MakeWeeklyMatches(ctx, runTime)
+			if err != nil {
+				log.Printf("can't make matches %+v", err)
+				matchingRunner.Retry(runTime, config.MatchingRetryDelay)
+				continue
 			}
-		case <-matchTimerChan:
-			err = coffeeBot.MakeMatches(ctx, time.Now().Add(9*time.Hour))
+			// if the run is not saved, the schedule repeats it after a restart, but MakeWeeklyMatches
+			// does nothing for a run time that already has a finished run
+			err = matchingRunner.Done(ctx, runTime)
 			if err != nil {
-				log.Panic("can't make matches")
+				log.Printf("can't save matching run %+v", err)
+			}
+		case <-resumeRuns:
+			err = coffeeBot.ResumeMatchingRun(ctx)
+			if err != nil {
+				log.Printf("can't resume matching run %+v", err)
+				realClock.AfterFunc(config.MatchingRetryDelay, func() { resumeRuns <- struct{}{} })
 			}
-			time.AfterFunc(7*24*time.Hour, func() { matchTimerChan <- struct{}{} })
 		case reminder := <-remindersChan:
-			message := tgbotapi.NewMessage(reminder.ChatID, reminder.Text)
-			err = sendWithRetry(bot, message)
+			log.Printf("sending reminder %+v", reminder)
+			err = coffeeBot.SendReminder(ctx, queue, reminder)
 			if err != nil {
-				log.Panicf("can't send message %+v", err)
+				log.Printf("can't send reminder %+v %+v", reminder, err)
 			}
-			log.Printf("sending reminder %+v", message)
 		}
 	}
 }
 
-func sendWithRetry(bot *tgbotapi.BotAPI, message tgbotapi.MessageConfig) error {
-	var err error
-	for i := 0; i < config.SendMessageRetries; i++ {
-		_, err = bot.Send(message)
-		if err == nil {
-			return nil
-		}
-		log.Printf("error sending message: %+v, sleeping and retrying", err)
-		time.Sleep(config.SendMessageRetryTimeoutMs * time.Millisecond)
+func pollUpdates(bot *tgbotapi.BotAPI) (tgbotapi.UpdatesChannel, error) {
+	// Telegram does not return updates with getUpdates while a webhook is set
+	_, err := bot.RemoveWebhook()
+	if err != nil {
+		return nil, err
 	}
-
-	return err
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	return bot.GetUpdatesChan(u)
 }
 
-func ChooseNextMatchTimerDate(clock clock.Clock) time.Time {
-	tomorrow := clock.Now().AddDate(0, 0, 1)
-	date := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 0, 0, 0, 0, tomorrow.Location())
-	for date.Weekday() != config.SchedulingDay {
-		date = date.AddDate(0, 0, 1)
+// listenForWebhook serves plain HTTP on listen, Telegram only sends updates over HTTPS,
+// so TLS must be terminated in front of the bot by a reverse proxy or the hosting at webhookURL
+func listenForWebhook(bot *tgbotapi.BotAPI, webhookURL string, listen string, secretPath string) (tgbotapi.UpdatesChannel, error) {
+	if secretPath == "" {
+		return nil, errorx.IllegalArgument.New("webhook mode requires -webhook-secret")
 	}
-	return date
-}
+	secret, err := ioutil.ReadFile(secretPath)
+	if err != nil {
+		return nil, err
+	}
+	secretToken := strings.TrimSpace(string(secret))
+	if secretToken == "" {
+		return nil, errorx.IllegalArgument.New("webhook secret file %s is empty", secretPath)
+	}
+
+	updates := make(chan tgbotapi.Update, bot.Buffer)
+	server := &http.Server{Addr: listen, Handler: webhook.NewHandler(secretToken, updates)}
+	go func() {
+		log.Panic(server.ListenAndServe())
+	}()
 
-func InitMatchTimerChan(clock clock.Clock) chan struct{} {
-	date := ChooseNextMatchTimerDate(clock)
-	channel := make(chan struct{})
-	time.AfterFunc(date.Sub(clock.Now()), func() { channel <- struct{}{} })
-	return channel
+	err = webhook.SetWebhook(bot, webhookURL, secretToken)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("listening for webhook updates on %s, public URL %s", listen, webhookURL)
+	return updates, nil
 }
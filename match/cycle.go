@@ -0,0 +1,42 @@
+package match
+
+import (
+	"time"
+)
+
+// Cycle is a matching cycle, usually a week. It is stored even if nobody was matched,
+// so that cycle numbers never go back
+type Cycle struct {
+	Number    int       `bson:"_id"`
+	StartTime time.Time `bson:"startTime"`
+	// Schedule is the spec of the schedule that started the cycle, empty if it was started by hand
+	Schedule string `bson:"schedule"`
+	// Participants are the users who were active when the cycle started
+	Participants []int `bson:"participants,omitempty"`
+	// Groups and Unpaired are the outcome of matching
+	Groups   [][]int `bson:"groups,omitempty"`
+	Unpaired []int   `bson:"unpaired,omitempty"`
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+var CycleBSON = struct {
+	Number       string
+	StartTime    string
+	Schedule     string
+	Participants string
+	Groups       string
+	Unpaired     string
+}{"_id", "startTime", "schedule", "participants", "groups", "unpaired"}
+
+// copyCycle makes sure that callers can't modify stored cycles.
+// Empty slices become nil, as they do after a round trip through mongo
+func copyCycle(cycle Cycle) Cycle {
+	cycle.Participants = append([]int(nil), cycle.Participants...)
+	var groups [][]int
+	for _, group := range cycle.Groups {
+		groups = append(groups, append([]int(nil), group...))
+	}
+	cycle.Groups = groups
+	cycle.Unpaired = append([]int(nil), cycle.Unpaired...)
+	return cycle
+}
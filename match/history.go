@@ -0,0 +1,50 @@
+package match
+
+// History remembers the last matching cycle in which every two users were matched
+type History struct {
+	lastCycle   map[int]map[int]int
+	latestCycle int
+}
+
+func NewHistory(matches []Match) *History {
+	history := &History{lastCycle: make(map[int]map[int]int)}
+	for _, match := range matches {
+		userIDs := match.UserIDs()
+		for _, userID := range userIDs {
+			for _, partnerID := range userIDs {
+				if userID != partnerID {
+					history.add(userID, partnerID, match.MatchingCycle)
+				}
+			}
+		}
+		if match.MatchingCycle > history.latestCycle {
+			history.latestCycle = match.MatchingCycle
+		}
+	}
+	return history
+}
+
+func (h *History) add(userID, partnerID, cycle int) {
+	if h.lastCycle[userID] == nil {
+		h.lastCycle[userID] = make(map[int]int)
+	}
+	if last, ok := h.lastCycle[userID][partnerID]; !ok || last < cycle {
+		h.lastCycle[userID][partnerID] = cycle
+	}
+}
+
+// LastMatchedCycle returns the most recent cycle in which the users were matched and false if they have never met
+func (h *History) LastMatchedCycle(userID, partnerID int) (int, bool) {
+	cycle, ok := h.lastCycle[userID][partnerID]
+	return cycle, ok
+}
+
+// CyclesSinceMatched returns 1 if the users were matched during the latest cycle in the history, 2 if the cycle before that, etc.
+// Returns false if they have never met
+func (h *History) CyclesSinceMatched(userID, partnerID int) (int, bool) {
+	cycle, ok := h.lastCycle[userID][partnerID]
+	if !ok {
+		return 0, false
+	}
+	return h.latestCycle - cycle + 1, true
+}
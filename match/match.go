@@ -2,55 +2,122 @@ package match
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"time"
 
 	"yandexschooldating/clock"
 
 	"github.com/joomcode/errorx"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Match struct {
-	FirstID       int        `bson:"firstId"`
-	SecondID      int        `bson:"secondId"`
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	FirstID  int                `bson:"firstId"`
+	SecondID int                `bson:"secondId"`
+	// OtherIDs are the participants besides the first two, only set for groups of three or more
+	OtherIDs      []int      `bson:"otherIds,omitempty"`
 	MatchUnixTime int64      `bson:"matchUnixTime"`
 	MeetingTime   *time.Time `bson:"meetingTime"`
 	Refused       bool       `bson:"refused"`
 	MatchingCycle int        `bson:"matchingCycle"`
+	// CallRoom is the random name of the room for the call of the participants, empty for old matches
+	CallRoom string `bson:"callRoom,omitempty"`
 }
 
 //goland:noinspection GoNameStartsWithPackageName
 var MatchBSON = struct {
+	ID            string
 	FirstID       string
 	SecondID      string
+	OtherIDs      string
 	MatchUnixTime string
 	MeetingTime   string
 	Refused       string
 	MatchingCycle string
+	CallRoom      string
 }{
+	"_id",
 	"firstId",
 	"secondId",
+	"otherIds",
 	"matchUnixTime",
 	"meetingTime",
 	"refused",
 	"matchingCycle",
+	"callRoom",
+}
+
+// NewCallRoom returns a random room name that can't be guessed by anyone outside the match
+func NewCallRoom() (string, error) {
+	room := make([]byte, 16)
+	_, err := rand.Read(room)
+	if err != nil {
+		return "", errorx.Decorate(err, "can't generate call room")
+	}
+	return hex.EncodeToString(room), nil
+}
+
+// PartnerIDs returns all participants except FirstID
+func (m *Match) PartnerIDs() []int {
+	return append([]int{m.SecondID}, m.OtherIDs...)
+}
+
+// UserIDs returns all participants
+func (m *Match) UserIDs() []int {
+	return append([]int{m.FirstID}, m.PartnerIDs()...)
+}
+
+// putFirst swaps participants so that FirstID is the userID
+func (m *Match) putFirst(userID int) {
+	if m.SecondID == userID {
+		m.FirstID, m.SecondID = m.SecondID, m.FirstID
+	}
+	for i, otherID := range m.OtherIDs {
+		if otherID == userID {
+			m.FirstID, m.OtherIDs[i] = m.OtherIDs[i], m.FirstID
+		}
+	}
 }
 
 type DAO struct {
 	matches       *mongo.Collection
+	cycles        *mongo.Collection
 	clock         clock.Clock
 	matchingCycle int
 }
 
 func NewDAO(client *mongo.Client, database string, clock clock.Clock) *DAO {
-	return &DAO{matches: client.Database(database).Collection("matches"), clock: clock, matchingCycle: 0}
+	return &DAO{
+		matches:       client.Database(database).Collection("matches"),
+		cycles:        client.Database(database).Collection("cycles"),
+		clock:         clock,
+		matchingCycle: 0,
+	}
 }
 
 // InitializeMatchingCycle It is most likely a mistake to use MatchDAO without a call to InitializeMatchingCycle
 func (m *DAO) InitializeMatchingCycle(ctx context.Context) error {
-	cursor, err := m.matches.Find(ctx, bson.M{}, options.Find().SetLimit(1).SetSort(bson.M{MatchBSON.MatchingCycle: -1}))
+	cursor, err := m.cycles.Find(ctx, bson.M{}, options.Find().SetLimit(1).SetSort(bson.M{CycleBSON.Number: -1}))
+	if err != nil {
+		return errorx.Decorate(err, "error initializing matching cycle")
+	}
+	m.matchingCycle = 0
+	if cursor.Next(ctx) {
+		var cycle Cycle
+		err = cursor.Decode(&cycle)
+		if err != nil {
+			return errorx.Decorate(err, "can't decode cycle")
+		}
+		m.matchingCycle = cycle.Number
+	}
+
+	// matches made before cycles were stored
+	cursor, err = m.matches.Find(ctx, bson.M{}, options.Find().SetLimit(1).SetSort(bson.M{MatchBSON.MatchingCycle: -1}))
 	if err != nil {
 		return errorx.Decorate(err, "error initializing matching cycle")
 	}
@@ -60,19 +127,51 @@ func (m *DAO) InitializeMatchingCycle(ctx context.Context) error {
 		if err != nil {
 			return errorx.Decorate(err, "can't decode match")
 		}
-		m.matchingCycle = document.MatchingCycle
+		if document.MatchingCycle > m.matchingCycle {
+			m.matchingCycle = document.MatchingCycle
+		}
 	}
 	return nil
 }
 
-func (m *DAO) IncrementMatchingCycle() {
-	m.matchingCycle++
+func (m *DAO) MatchingCycle() int {
+	return m.matchingCycle
+}
+
+// StartMatchingCycle saves the cycle and makes it current. Nothing is saved if a cycle with its number exists,
+// so that starting can be repeated
+func (m *DAO) StartMatchingCycle(ctx context.Context, cycle Cycle) error {
+	_, err := m.cycles.InsertOne(ctx, cycle)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return errorx.Decorate(err, "can't save matching cycle %d", cycle.Number)
+	}
+	m.matchingCycle = cycle.Number
+	return nil
+}
+
+// FindCycles returns at most limit latest cycles, the latest first
+func (m *DAO) FindCycles(ctx context.Context, limit int) ([]Cycle, error) {
+	cursor, err := m.cycles.Find(ctx, bson.M{}, options.Find().SetLimit(int64(limit)).SetSort(bson.M{CycleBSON.Number: -1}))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error finding cycles")
+	}
+	var result []Cycle
+	for cursor.Next(ctx) {
+		var cycle Cycle
+		err = cursor.Decode(&cycle)
+		if err != nil {
+			return nil, errorx.Decorate(err, "can't decode cycle")
+		}
+		result = append(result, cycle)
+	}
+	return result, nil
 }
 
 func (m *DAO) filterBson(userID int) bson.M {
 	return bson.M{"$or": []bson.M{
 		{MatchBSON.FirstID: userID, MatchBSON.MatchingCycle: m.matchingCycle, MatchBSON.Refused: false},
 		{MatchBSON.SecondID: userID, MatchBSON.MatchingCycle: m.matchingCycle, MatchBSON.Refused: false},
+		{MatchBSON.OtherIDs: userID, MatchBSON.MatchingCycle: m.matchingCycle, MatchBSON.Refused: false},
 	}}
 }
 
@@ -87,7 +186,7 @@ func (m *DAO) UpdateMatchTime(ctx context.Context, userID int, meetingTime time.
 	return nil
 }
 
-// FindCurrentMatchForUserID always returns a match with its FirstID set to the userUD
+// FindCurrentMatchForUserID always returns a match with its FirstID set to the userID
 func (m *DAO) FindCurrentMatchForUserID(ctx context.Context, userID int) (*Match, error) {
 	result := m.matches.FindOne(ctx, m.filterBson(userID))
 	if result.Err() == mongo.ErrNoDocuments {
@@ -103,10 +202,24 @@ func (m *DAO) FindCurrentMatchForUserID(ctx context.Context, userID int) (*Match
 		return nil, errorx.Decorate(err, "can't decode match")
 	}
 
-	if match.SecondID == userID {
-		match.FirstID, match.SecondID = match.SecondID, match.FirstID
-	}
+	match.putFirst(userID)
+	return &match, nil
+}
 
+// FindMatchByID finds a match of any cycle, refused or not
+func (m *DAO) FindMatchByID(ctx context.Context, ID primitive.ObjectID) (*Match, error) {
+	result := m.matches.FindOne(ctx, bson.M{MatchBSON.ID: ID})
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find match %s", ID.Hex())
+	}
+	var match Match
+	err := result.Decode(&match)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode match")
+	}
 	return &match, nil
 }
 
@@ -121,38 +234,122 @@ func (m *DAO) checkExistingMatch(ctx context.Context, userID int) error {
 	return nil
 }
 
-func (m *DAO) AddMatch(ctx context.Context, firstID, secondID int) error {
-	err := m.checkExistingMatch(ctx, firstID)
-	if err != nil {
-		return err
+func (m *DAO) AddMatch(ctx context.Context, firstID, secondID int, otherIDs ...int) error {
+	for _, userID := range append([]int{firstID, secondID}, otherIDs...) {
+		err := m.checkExistingMatch(ctx, userID)
+		if err != nil {
+			return err
+		}
 	}
-	err = m.checkExistingMatch(ctx, secondID)
+	callRoom, err := NewCallRoom()
 	if err != nil {
 		return err
 	}
 	match := Match{
+		ID:            primitive.NewObjectID(),
 		FirstID:       firstID,
 		SecondID:      secondID,
+		OtherIDs:      otherIDs,
 		MatchUnixTime: m.clock.Now().Unix(),
 		MatchingCycle: m.matchingCycle,
 		Refused:       false,
+		CallRoom:      callRoom,
 	}
 	_, err = m.matches.InsertOne(ctx, match)
 	return err
 }
 
+// SaveMatch adds the match as is. Nothing happens if a match with its ID exists, so that saving can be repeated
+func (m *DAO) SaveMatch(ctx context.Context, match Match) error {
+	count, err := m.matches.CountDocuments(ctx, bson.M{MatchBSON.ID: match.ID})
+	if err != nil {
+		return errorx.Decorate(err, "can't check for match %s", match.ID.Hex())
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, userID := range match.UserIDs() {
+		err = m.checkExistingMatch(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = m.matches.InsertOne(ctx, match)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return errorx.Decorate(err, "can't save match %s", match.ID.Hex())
+	}
+	return nil
+}
+
+// BreakMatchForUser marks the current match of the user as refused.
+// If there were more than two participants, the rest keep meeting: a new match is created for them
 func (m *DAO) BreakMatchForUser(ctx context.Context, userID int) error {
-	result, err := m.matches.UpdateOne(ctx, m.filterBson(userID), bson.M{"$set": bson.M{MatchBSON.Refused: true}})
+	oldMatch, err := m.FindCurrentMatchForUserID(ctx, userID)
 	if err != nil {
 		return errorx.Decorate(err, "error breaking match")
 	}
+	if oldMatch == nil {
+		return errorx.IllegalArgument.New("error breaking match: match for user %d not found", userID)
+	}
 
+	result, err := m.matches.UpdateOne(ctx, m.filterBson(userID), bson.M{"$set": bson.M{MatchBSON.Refused: true}})
+	if err != nil {
+		return errorx.Decorate(err, "error breaking match")
+	}
 	if result.MatchedCount == 0 {
 		return errorx.IllegalArgument.New("error breaking match: match for user %d not found", userID)
 	}
+
+	if len(oldMatch.OtherIDs) > 0 {
+		// the user who left knows the old room, so the rest of the group gets a new one
+		callRoom, err := NewCallRoom()
+		if err != nil {
+			return err
+		}
+		rest := oldMatch.PartnerIDs()
+		match := Match{
+			ID:            primitive.NewObjectID(),
+			FirstID:       rest[0],
+			SecondID:      rest[1],
+			OtherIDs:      rest[2:],
+			MatchUnixTime: oldMatch.MatchUnixTime,
+			MeetingTime:   oldMatch.MeetingTime,
+			MatchingCycle: oldMatch.MatchingCycle,
+			Refused:       false,
+			CallRoom:      callRoom,
+		}
+		if len(match.OtherIDs) == 0 {
+			match.OtherIDs = nil
+		}
+		_, err = m.matches.InsertOne(ctx, match)
+		if err != nil {
+			return errorx.Decorate(err, "error keeping the rest of the match for user %d", userID)
+		}
+	}
 	return nil
 }
 
+// FindRecentMatches returns matches that were not refused during the last lookBack matching cycles, including the current one
+func (m *DAO) FindRecentMatches(ctx context.Context, lookBack int) ([]Match, error) {
+	cursor, err := m.matches.Find(ctx, bson.M{
+		MatchBSON.MatchingCycle: bson.M{"$gt": m.matchingCycle - lookBack},
+		MatchBSON.Refused:       false,
+	})
+	if err != nil {
+		return nil, errorx.Decorate(err, "error finding recent matches")
+	}
+	var result []Match
+	for cursor.Next(ctx) {
+		var match Match
+		err = cursor.Decode(&match)
+		if err != nil {
+			return nil, errorx.Decorate(err, "can't decode match")
+		}
+		result = append(result, match)
+	}
+	return result, nil
+}
+
 func (m *DAO) GetAllMatchedUsers(ctx context.Context) ([]int, error) {
 	cursor, err := m.matches.Find(ctx, bson.M{MatchBSON.MatchingCycle: m.matchingCycle, MatchBSON.Refused: false})
 	if err != nil {
@@ -165,8 +362,7 @@ func (m *DAO) GetAllMatchedUsers(ctx context.Context) ([]int, error) {
 		if err != nil {
 			return nil, errorx.Decorate(err, "can't decode match")
 		}
-		result = append(result, match.FirstID)
-		result = append(result, match.SecondID)
+		result = append(result, match.UserIDs()...)
 	}
 	return result, nil
 }
@@ -6,30 +6,28 @@ import (
 	"time"
 
 	"yandexschooldating/clock"
+	"yandexschooldating/coffeebot"
 	"yandexschooldating/config"
 	"yandexschooldating/match"
 	"yandexschooldating/util"
 
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func TestDao(t *testing.T) {
-	ctx := context.Background()
-	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
-	if err != nil {
-		panic(err)
-	}
-
-	testDatabase := "test_matches"
-	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
-
-	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
-	clock := &clock.Fake{Current: start}
+type matchDAO interface {
+	coffeebot.MatchDAO
+	InitializeMatchingCycle(ctx context.Context) error
+}
 
-	dao := match.NewDAO(client, testDatabase, clock)
-	err = dao.InitializeMatchingCycle(ctx)
+func startNextCycle(t *testing.T, ctx context.Context, dao matchDAO, clock *clock.Fake) {
+	err := dao.StartMatchingCycle(ctx, match.Cycle{Number: dao.MatchingCycle() + 1, StartTime: clock.Now()})
 	require.NoError(t, err)
+}
 
+// testDAO checks the behaviour that every match DAO implementation must share.
+// reopen must return a DAO over the same matches, as if the bot was restarted
+func testDAO(t *testing.T, ctx context.Context, dao matchDAO, clock *clock.Fake, reopen func() matchDAO) {
 	everyone, err := dao.GetAllMatchedUsers(ctx)
 	require.NoError(t, err)
 	require.Nil(t, everyone)
@@ -41,7 +39,7 @@ func TestDao(t *testing.T) {
 	require.ElementsMatch(t, everyone, []int{2, 3})
 
 	clock.Current = clock.Current.AddDate(0, 0, 7)
-	dao.IncrementMatchingCycle()
+	startNextCycle(t, ctx, dao, clock)
 	err = dao.AddMatch(ctx, 2, 4)
 	require.NoError(t, err)
 	everyone, err = dao.GetAllMatchedUsers(ctx)
@@ -49,7 +47,7 @@ func TestDao(t *testing.T) {
 	require.ElementsMatch(t, everyone, []int{2, 4})
 
 	clock.Current = clock.Current.AddDate(0, 0, 6).Add((60*20 + 31) * time.Minute)
-	dao.IncrementMatchingCycle()
+	startNextCycle(t, ctx, dao, clock)
 	err = dao.AddMatch(ctx, 2, 5)
 	require.NoError(t, err)
 
@@ -58,7 +56,7 @@ func TestDao(t *testing.T) {
 	require.ElementsMatch(t, everyone, []int{2, 5})
 
 	clock.Current = clock.Current.AddDate(0, 0, 7).Add(31 * time.Minute)
-	dao.IncrementMatchingCycle()
+	startNextCycle(t, ctx, dao, clock)
 	err = dao.AddMatch(ctx, 2, 12)
 	require.NoError(t, err)
 	clock.Current = clock.Current.Add(5 * time.Minute)
@@ -85,9 +83,24 @@ func TestDao(t *testing.T) {
 	require.NoError(t, err)
 	require.Nil(t, result)
 
-	dao = match.NewDAO(client, testDatabase, clock)
-	err = dao.InitializeMatchingCycle(ctx)
+	recent, err := dao.FindRecentMatches(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, recent, 2)
+	history := match.NewHistory(recent)
+	cycle, ok := history.LastMatchedCycle(5, 2)
+	require.True(t, ok)
+	require.Equal(t, 2, cycle)
+	cycle, ok = history.LastMatchedCycle(2, 12)
+	require.True(t, ok)
+	require.Equal(t, 3, cycle)
+	_, ok = history.LastMatchedCycle(2, 4)
+	require.False(t, ok)
+
+	recent, err = dao.FindRecentMatches(ctx, 10)
 	require.NoError(t, err)
+	require.Len(t, recent, 4)
+
+	dao = reopen()
 
 	result, err = dao.FindCurrentMatchForUserID(ctx, 2)
 	require.NoError(t, err)
@@ -108,7 +121,7 @@ func TestDao(t *testing.T) {
 	require.NoError(t, err)
 	require.Nil(t, result)
 
-	dao.IncrementMatchingCycle()
+	startNextCycle(t, ctx, dao, clock)
 	result, err = dao.FindCurrentMatchForUserID(ctx, 2)
 	require.NoError(t, err)
 	require.Nil(t, result)
@@ -153,6 +166,7 @@ func TestDao(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, result.MeetingTime)
 	require.Equal(t, meetingTime.Unix(), result.MeetingTime.Unix())
+	brokenID := result.ID
 
 	err = dao.UpdateMatchTime(ctx, 1, meetingTime)
 	require.Error(t, err)
@@ -182,6 +196,16 @@ func TestDao(t *testing.T) {
 	require.NoError(t, err)
 	require.Nil(t, result)
 
+	// refused matches are still found by ID
+	result, err = dao.FindMatchByID(ctx, brokenID)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.True(t, result.Refused)
+	require.ElementsMatch(t, []int{6, 85}, result.UserIDs())
+	result, err = dao.FindMatchByID(ctx, primitive.NewObjectID())
+	require.NoError(t, err)
+	require.Nil(t, result)
+
 	err = dao.AddMatch(ctx, 6, 100)
 	require.NoError(t, err)
 
@@ -212,6 +236,133 @@ func TestDao(t *testing.T) {
 	require.Equal(t, 85, result.SecondID)
 	require.Nil(t, result.MeetingTime)
 
+	err = dao.AddMatch(ctx, 20, 21, 22)
+	require.NoError(t, err)
+
+	err = dao.AddMatch(ctx, 23, 24, 22)
+	require.Error(t, err)
+
+	result, err = dao.FindCurrentMatchForUserID(ctx, 22)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, 22, result.FirstID)
+	require.ElementsMatch(t, []int{20, 21}, result.PartnerIDs())
+	require.Len(t, result.CallRoom, 32)
+	triadRoom := result.CallRoom
+
+	everyone, err = dao.GetAllMatchedUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, everyone, []int{85, 6, 20, 21, 22})
+
+	err = dao.UpdateMatchTime(ctx, 22, meetingTime)
+	require.NoError(t, err)
+
+	err = dao.BreakMatchForUser(ctx, 20)
+	require.NoError(t, err)
+
+	result, err = dao.FindCurrentMatchForUserID(ctx, 20)
+	require.NoError(t, err)
+	require.Nil(t, result)
+
+	result, err = dao.FindCurrentMatchForUserID(ctx, 22)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, 22, result.FirstID)
+	require.Equal(t, 21, result.SecondID)
+	require.Empty(t, result.OtherIDs)
+	require.Equal(t, meetingTime.Unix(), result.MeetingTime.Unix())
+	// the user who left can't join the call of the rest of the group
+	require.Len(t, result.CallRoom, 32)
+	require.NotEqual(t, triadRoom, result.CallRoom)
+
+	everyone, err = dao.GetAllMatchedUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, everyone, []int{85, 6, 21, 22})
+
+	cycle = dao.MatchingCycle()
+	startNextCycle(t, ctx, dao, clock)
+	require.Equal(t, cycle+1, dao.MatchingCycle())
+	saved := match.Match{ID: primitive.NewObjectID(), FirstID: 30, SecondID: 31, OtherIDs: []int{32}, MatchUnixTime: 1, MatchingCycle: cycle + 1}
+	err = dao.SaveMatch(ctx, saved)
+	require.NoError(t, err)
+	err = dao.UpdateMatchTime(ctx, 30, meetingTime)
+	require.NoError(t, err)
+	// saving again keeps the match as it is now
+	err = dao.SaveMatch(ctx, saved)
+	require.NoError(t, err)
+	result, err = dao.FindCurrentMatchForUserID(ctx, 31)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, saved.ID, result.ID)
+	require.Equal(t, int64(1), result.MatchUnixTime)
+	require.ElementsMatch(t, []int{30, 32}, result.PartnerIDs())
+	require.Equal(t, meetingTime.Unix(), result.MeetingTime.Unix())
+
+	err = dao.SaveMatch(ctx, match.Match{ID: primitive.NewObjectID(), FirstID: 33, SecondID: 32, MatchingCycle: cycle + 1})
+	require.Error(t, err)
+	everyone, err = dao.GetAllMatchedUsers(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, everyone, []int{30, 31, 32})
+
+	// a cycle where nobody was matched is not lost after a restart
+	err = dao.StartMatchingCycle(ctx, match.Cycle{
+		Number:       cycle + 2,
+		StartTime:    clock.Now(),
+		Schedule:     "0 0 * * 1",
+		Participants: []int{40},
+		Unpaired:     []int{40},
+	})
+	require.NoError(t, err)
+	dao = reopen()
+	require.Equal(t, cycle+2, dao.MatchingCycle())
+	everyone, err = dao.GetAllMatchedUsers(ctx)
+	require.NoError(t, err)
+	require.Nil(t, everyone)
+
+	// starting a cycle again keeps it as it was
+	err = dao.StartMatchingCycle(ctx, match.Cycle{Number: cycle + 2, StartTime: clock.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	cycles, err := dao.FindCycles(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, cycles, 2)
+	require.Equal(t, cycle+2, cycles[0].Number)
+	require.Equal(t, clock.Now().Unix(), cycles[0].StartTime.Unix())
+	require.Equal(t, "0 0 * * 1", cycles[0].Schedule)
+	require.Equal(t, []int{40}, cycles[0].Participants)
+	require.Nil(t, cycles[0].Groups)
+	require.Equal(t, []int{40}, cycles[0].Unpaired)
+	require.Equal(t, cycle+1, cycles[1].Number)
+	require.Equal(t, "", cycles[1].Schedule)
+
+	cycles, err = dao.FindCycles(ctx, 100)
+	require.NoError(t, err)
+	require.Len(t, cycles, cycle+2)
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_matches"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+	clock := &clock.Fake{Current: start}
+
+	dao := match.NewDAO(client, testDatabase, clock)
+	err = dao.InitializeMatchingCycle(ctx)
+	require.NoError(t, err)
+
+	testDAO(t, ctx, dao, clock, func() matchDAO {
+		dao = match.NewDAO(client, testDatabase, clock)
+		err := dao.InitializeMatchingCycle(ctx)
+		require.NoError(t, err)
+		return dao
+	})
+
 	err = client.Disconnect(ctx)
 	if err != nil {
 		panic(err)
@@ -223,8 +374,7 @@ func TestDao(t *testing.T) {
 	_, err = dao.FindCurrentMatchForUserID(ctx, 6)
 	require.Error(t, err)
 
-	meetingTime = meetingTime.AddDate(0, 0, 1)
-	err = dao.UpdateMatchTime(ctx, 6, meetingTime)
+	err = dao.UpdateMatchTime(ctx, 6, time.Date(2021, 2, 2, 23, 59, 56, 0, time.UTC))
 	require.Error(t, err)
 
 	err = dao.BreakMatchForUser(ctx, 85)
@@ -233,7 +383,29 @@ func TestDao(t *testing.T) {
 	_, err = dao.GetAllMatchedUsers(ctx)
 	require.Error(t, err)
 
+	err = dao.SaveMatch(ctx, match.Match{ID: primitive.NewObjectID(), FirstID: 1, SecondID: 2})
+	require.Error(t, err)
+
+	err = dao.StartMatchingCycle(ctx, match.Cycle{Number: 100})
+	require.Error(t, err)
+
+	_, err = dao.FindCycles(ctx, 10)
+	require.Error(t, err)
+
 	dao = match.NewDAO(client, testDatabase, clock)
 	err = dao.InitializeMatchingCycle(ctx)
 	require.Error(t, err)
 }
+
+func TestMemoryDAO(t *testing.T) {
+	ctx := context.Background()
+	clock := &clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	dao := match.NewMemoryDAO(clock)
+	err := dao.InitializeMatchingCycle(ctx)
+	require.NoError(t, err)
+	testDAO(t, ctx, dao, clock, func() matchDAO {
+		err := dao.InitializeMatchingCycle(ctx)
+		require.NoError(t, err)
+		return dao
+	})
+}
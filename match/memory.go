@@ -0,0 +1,248 @@
+package match
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"yandexschooldating/clock"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps matches in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex         sync.Mutex
+	matches       []Match
+	cycles        []Cycle
+	clock         clock.Clock
+	matchingCycle int
+}
+
+func NewMemoryDAO(clock clock.Clock) *MemoryDAO {
+	return &MemoryDAO{clock: clock, matchingCycle: 0}
+}
+
+// copyMatch makes sure that callers can't modify stored matches.
+// Empty OtherIDs become nil, as they do after a round trip through mongo
+func copyMatch(match Match) Match {
+	match.OtherIDs = append([]int(nil), match.OtherIDs...)
+	if match.MeetingTime != nil {
+		meetingTime := *match.MeetingTime
+		match.MeetingTime = &meetingTime
+	}
+	return match
+}
+
+// InitializeMatchingCycle restores the matching cycle from the stored cycles and matches
+func (m *MemoryDAO) InitializeMatchingCycle(context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.matchingCycle = 0
+	for _, cycle := range m.cycles {
+		if cycle.Number > m.matchingCycle {
+			m.matchingCycle = cycle.Number
+		}
+	}
+	for _, match := range m.matches {
+		if match.MatchingCycle > m.matchingCycle {
+			m.matchingCycle = match.MatchingCycle
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDAO) MatchingCycle() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.matchingCycle
+}
+
+// StartMatchingCycle saves the cycle and makes it current. Nothing is saved if a cycle with its number exists,
+// so that starting can be repeated
+func (m *MemoryDAO) StartMatchingCycle(_ context.Context, cycle Cycle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.matchingCycle = cycle.Number
+	for _, stored := range m.cycles {
+		if stored.Number == cycle.Number {
+			return nil
+		}
+	}
+	m.cycles = append(m.cycles, copyCycle(cycle))
+	return nil
+}
+
+// FindCycles returns at most limit latest cycles, the latest first
+func (m *MemoryDAO) FindCycles(_ context.Context, limit int) ([]Cycle, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result []Cycle
+	for _, cycle := range m.cycles {
+		result = append(result, copyCycle(cycle))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Number > result[j].Number })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// currentMatchIndex returns the index of the current match of the user or -1. The mutex must be held
+func (m *MemoryDAO) currentMatchIndex(userID int) int {
+	for i, match := range m.matches {
+		if match.MatchingCycle != m.matchingCycle || match.Refused {
+			continue
+		}
+		for _, ID := range match.UserIDs() {
+			if ID == userID {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (m *MemoryDAO) UpdateMatchTime(_ context.Context, userID int, meetingTime time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := m.currentMatchIndex(userID)
+	if i < 0 {
+		return errorx.IllegalArgument.New("no current match for user %d", userID)
+	}
+	m.matches[i].MeetingTime = &meetingTime
+	return nil
+}
+
+// FindCurrentMatchForUserID always returns a match with its FirstID set to the userID
+func (m *MemoryDAO) FindCurrentMatchForUserID(_ context.Context, userID int) (*Match, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := m.currentMatchIndex(userID)
+	if i < 0 {
+		return nil, nil
+	}
+	match := copyMatch(m.matches[i])
+	match.putFirst(userID)
+	return &match, nil
+}
+
+func (m *MemoryDAO) FindMatchByID(_ context.Context, ID primitive.ObjectID) (*Match, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, stored := range m.matches {
+		if stored.ID == ID {
+			match := copyMatch(stored)
+			return &match, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryDAO) AddMatch(_ context.Context, firstID, secondID int, otherIDs ...int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, userID := range append([]int{firstID, secondID}, otherIDs...) {
+		if m.currentMatchIndex(userID) >= 0 {
+			return errorx.IllegalArgument.New("match exists for user %d", userID)
+		}
+	}
+	callRoom, err := NewCallRoom()
+	if err != nil {
+		return err
+	}
+	m.matches = append(m.matches, copyMatch(Match{
+		ID:            primitive.NewObjectID(),
+		FirstID:       firstID,
+		SecondID:      secondID,
+		OtherIDs:      otherIDs,
+		MatchUnixTime: m.clock.Now().Unix(),
+		MatchingCycle: m.matchingCycle,
+		Refused:       false,
+		CallRoom:      callRoom,
+	}))
+	return nil
+}
+
+// SaveMatch adds the match as is. Nothing happens if a match with its ID exists, so that saving can be repeated
+func (m *MemoryDAO) SaveMatch(_ context.Context, match Match) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, stored := range m.matches {
+		if stored.ID == match.ID {
+			return nil
+		}
+	}
+	for _, userID := range match.UserIDs() {
+		if m.currentMatchIndex(userID) >= 0 {
+			return errorx.IllegalArgument.New("match exists for user %d", userID)
+		}
+	}
+	m.matches = append(m.matches, copyMatch(match))
+	return nil
+}
+
+// BreakMatchForUser marks the current match of the user as refused.
+// If there were more than two participants, the rest keep meeting: a new match is created for them
+func (m *MemoryDAO) BreakMatchForUser(_ context.Context, userID int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := m.currentMatchIndex(userID)
+	if i < 0 {
+		return errorx.IllegalArgument.New("error breaking match: match for user %d not found", userID)
+	}
+	m.matches[i].Refused = true
+
+	oldMatch := copyMatch(m.matches[i])
+	oldMatch.putFirst(userID)
+	if len(oldMatch.OtherIDs) > 0 {
+		callRoom, err := NewCallRoom()
+		if err != nil {
+			return err
+		}
+		rest := oldMatch.PartnerIDs()
+		match := Match{
+			ID:            primitive.NewObjectID(),
+			FirstID:       rest[0],
+			SecondID:      rest[1],
+			OtherIDs:      rest[2:],
+			MatchUnixTime: oldMatch.MatchUnixTime,
+			MeetingTime:   oldMatch.MeetingTime,
+			MatchingCycle: oldMatch.MatchingCycle,
+			Refused:       false,
+			CallRoom:      callRoom,
+		}
+		if len(match.OtherIDs) == 0 {
+			match.OtherIDs = nil
+		}
+		m.matches = append(m.matches, match)
+	}
+	return nil
+}
+
+// FindRecentMatches returns matches that were not refused during the last lookBack matching cycles, including the current one
+func (m *MemoryDAO) FindRecentMatches(_ context.Context, lookBack int) ([]Match, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result []Match
+	for _, match := range m.matches {
+		if match.MatchingCycle > m.matchingCycle-lookBack && !match.Refused {
+			result = append(result, copyMatch(match))
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryDAO) GetAllMatchedUsers(context.Context) ([]int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result []int
+	for _, match := range m.matches {
+		if match.MatchingCycle == m.matchingCycle && !match.Refused {
+			result = append(result, match.UserIDs()...)
+		}
+	}
+	return result, nil
+}
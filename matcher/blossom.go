@@ -0,0 +1,613 @@
+package matcher
+
+// This is a port of the public domain maximum weighted matching implementation by Joris van Rantwijk
+// (http://jorisvr.nl/article/maximum-matching), which is based on "Efficient Algorithms for Finding Maximum
+// Matching in Graphs" by Zvi Galil, ACM Computing Surveys, 1986. It runs in O(n^3) and only uses integer
+// arithmetic, so the result is exact.
+
+type edge struct {
+	i, j   int
+	weight int64
+}
+
+type blossomState struct {
+	edges          []edge
+	maxCardinality bool
+
+	nvertex int
+	// endpoint[p] is the vertex to which endpoint p is attached, edge k has endpoints 2k and 2k+1
+	endpoint []int
+	// neighbend[v] is the list of remote endpoints of the edges attached to vertex v
+	neighbend [][]int
+	// mate[v] is the remote endpoint of the matched edge of v or -1
+	mate []int
+	// label[b] is 0 for unlabeled, 1 for S-vertex/blossom, 2 for T-vertex/blossom
+	label []int
+	// labelend[b] is the remote endpoint of the edge through which b obtained its label or -1
+	labelend []int
+	// inblossom[v] is the top-level blossom to which vertex v belongs
+	inblossom []int
+	// blossomparent[b] is the smallest blossom containing b or -1 for top-level blossoms
+	blossomparent []int
+	// blossomchilds[b] is the ordered list of sub-blossoms starting with the base
+	blossomchilds [][]int
+	// blossombase[b] is the base vertex of blossom b
+	blossombase []int
+	// blossomendps[b] is the list of endpoints on the edges that connect the sub-blossoms of b
+	blossomendps [][]int
+	// bestedge[b] is the least-slack edge to a different S-blossom or -1
+	bestedge []int
+	// blossombestedges[b] is the list of least-slack edges to neighbouring S-blossoms or nil
+	blossombestedges [][]int
+	unusedblossoms   []int
+	dualvar          []int64
+	allowedge        []bool
+	queue            []int
+}
+
+// maxWeightMatching returns mate, where mate[v] is the vertex matched to v or -1 if v is single.
+// Vertices are numbered from zero, every edge must connect two different vertices.
+// If maxCardinality is set, the matching of maximum weight among the maximum-cardinality ones is returned
+func maxWeightMatching(edges []edge, maxCardinality bool) []int {
+	if len(edges) == 0 {
+		return nil
+	}
+	s := &blossomState{edges: edges, maxCardinality: maxCardinality}
+	s.init()
+	s.run()
+	mate := make([]int, s.nvertex)
+	for v := range mate {
+		mate[v] = -1
+		if s.mate[v] >= 0 {
+			mate[v] = s.endpoint[s.mate[v]]
+		}
+	}
+	return mate
+}
+
+func (s *blossomState) init() {
+	var maxWeight int64
+	for _, e := range s.edges {
+		if e.i >= s.nvertex {
+			s.nvertex = e.i + 1
+		}
+		if e.j >= s.nvertex {
+			s.nvertex = e.j + 1
+		}
+		if e.weight > maxWeight {
+			maxWeight = e.weight
+		}
+	}
+	n := s.nvertex
+
+	s.endpoint = make([]int, 2*len(s.edges))
+	s.neighbend = make([][]int, n)
+	for k, e := range s.edges {
+		s.endpoint[2*k] = e.i
+		s.endpoint[2*k+1] = e.j
+		s.neighbend[e.i] = append(s.neighbend[e.i], 2*k+1)
+		s.neighbend[e.j] = append(s.neighbend[e.j], 2*k)
+	}
+
+	s.mate = filled(n, -1)
+	s.label = make([]int, 2*n)
+	s.labelend = filled(2*n, -1)
+	s.inblossom = make([]int, n)
+	for v := range s.inblossom {
+		s.inblossom[v] = v
+	}
+	s.blossomparent = filled(2*n, -1)
+	s.blossomchilds = make([][]int, 2*n)
+	s.blossombase = filled(2*n, -1)
+	for v := 0; v < n; v++ {
+		s.blossombase[v] = v
+	}
+	s.blossomendps = make([][]int, 2*n)
+	s.bestedge = filled(2*n, -1)
+	s.blossombestedges = make([][]int, 2*n)
+	for b := n; b < 2*n; b++ {
+		s.unusedblossoms = append(s.unusedblossoms, b)
+	}
+	s.dualvar = make([]int64, 2*n)
+	for v := 0; v < n; v++ {
+		s.dualvar[v] = maxWeight
+	}
+	s.allowedge = make([]bool, len(s.edges))
+}
+
+func filled(n, value int) []int {
+	result := make([]int, n)
+	for i := range result {
+		result[i] = value
+	}
+	return result
+}
+
+func (s *blossomState) slack(k int) int64 {
+	e := s.edges[k]
+	return s.dualvar[e.i] + s.dualvar[e.j] - 2*e.weight
+}
+
+func (s *blossomState) blossomLeaves(b int) []int {
+	if b < s.nvertex {
+		return []int{b}
+	}
+	var leaves []int
+	for _, t := range s.blossomchilds[b] {
+		leaves = append(leaves, s.blossomLeaves(t)...)
+	}
+	return leaves
+}
+
+// assignLabel assigns label t to the top-level blossom containing vertex w, coming through an edge from endpoint p
+func (s *blossomState) assignLabel(w, t, p int) {
+	b := s.inblossom[w]
+	s.label[w], s.label[b] = t, t
+	s.labelend[w], s.labelend[b] = p, p
+	s.bestedge[w], s.bestedge[b] = -1, -1
+	if t == 1 {
+		s.queue = append(s.queue, s.blossomLeaves(b)...)
+	} else if t == 2 {
+		base := s.blossombase[b]
+		s.assignLabel(s.endpoint[s.mate[base]], 1, s.mate[base]^1)
+	}
+}
+
+// scanBlossom traces back from vertices v and w to discover either a new blossom or an augmenting path.
+// Returns the base vertex of the new blossom or -1
+func (s *blossomState) scanBlossom(v, w int) int {
+	var path []int
+	base := -1
+	for v != -1 || w != -1 {
+		b := s.inblossom[v]
+		if s.label[b]&4 != 0 {
+			base = s.blossombase[b]
+			break
+		}
+		path = append(path, b)
+		s.label[b] = 5
+		if s.labelend[b] == -1 {
+			v = -1
+		} else {
+			v = s.endpoint[s.labelend[b]]
+			b = s.inblossom[v]
+			v = s.endpoint[s.labelend[b]]
+		}
+		if w != -1 {
+			v, w = w, v
+		}
+	}
+	for _, b := range path {
+		s.label[b] = 1
+	}
+	return base
+}
+
+// addBlossom constructs a new blossom with the given base, containing edge k which connects a pair of S vertices
+func (s *blossomState) addBlossom(base, k int) {
+	v, w := s.edges[k].i, s.edges[k].j
+	bb := s.inblossom[base]
+	bv := s.inblossom[v]
+	bw := s.inblossom[w]
+	b := s.unusedblossoms[len(s.unusedblossoms)-1]
+	s.unusedblossoms = s.unusedblossoms[:len(s.unusedblossoms)-1]
+	s.blossombase[b] = base
+	s.blossomparent[b] = -1
+	s.blossomparent[bb] = b
+
+	var path, endps []int
+	for bv != bb {
+		s.blossomparent[bv] = b
+		path = append(path, bv)
+		endps = append(endps, s.labelend[bv])
+		v = s.endpoint[s.labelend[bv]]
+		bv = s.inblossom[v]
+	}
+	path = append(path, bb)
+	reverse(path)
+	reverse(endps)
+	endps = append(endps, 2*k)
+	for bw != bb {
+		s.blossomparent[bw] = b
+		path = append(path, bw)
+		endps = append(endps, s.labelend[bw]^1)
+		w = s.endpoint[s.labelend[bw]]
+		bw = s.inblossom[w]
+	}
+	s.blossomchilds[b] = path
+	s.blossomendps[b] = endps
+
+	s.label[b] = 1
+	s.labelend[b] = s.labelend[bb]
+	s.dualvar[b] = 0
+	for _, leaf := range s.blossomLeaves(b) {
+		if s.label[s.inblossom[leaf]] == 2 {
+			s.queue = append(s.queue, leaf)
+		}
+		s.inblossom[leaf] = b
+	}
+
+	bestedgeto := filled(2*s.nvertex, -1)
+	for _, child := range path {
+		var nblists [][]int
+		if s.blossombestedges[child] == nil {
+			for _, leaf := range s.blossomLeaves(child) {
+				var nblist []int
+				for _, p := range s.neighbend[leaf] {
+					nblist = append(nblist, p/2)
+				}
+				nblists = append(nblists, nblist)
+			}
+		} else {
+			nblists = [][]int{s.blossombestedges[child]}
+		}
+		for _, nblist := range nblists {
+			for _, edgeIndex := range nblist {
+				i, j := s.edges[edgeIndex].i, s.edges[edgeIndex].j
+				if s.inblossom[j] == b {
+					i, j = j, i
+				}
+				bj := s.inblossom[j]
+				if bj != b && s.label[bj] == 1 && (bestedgeto[bj] == -1 || s.slack(edgeIndex) < s.slack(bestedgeto[bj])) {
+					bestedgeto[bj] = edgeIndex
+				}
+			}
+		}
+		s.blossombestedges[child] = nil
+		s.bestedge[child] = -1
+	}
+	best := make([]int, 0)
+	for _, edgeIndex := range bestedgeto {
+		if edgeIndex != -1 {
+			best = append(best, edgeIndex)
+		}
+	}
+	s.blossombestedges[b] = best
+	s.bestedge[b] = -1
+	for _, edgeIndex := range best {
+		if s.bestedge[b] == -1 || s.slack(edgeIndex) < s.slack(s.bestedge[b]) {
+			s.bestedge[b] = edgeIndex
+		}
+	}
+}
+
+func reverse(values []int) {
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+}
+
+func indexOf(values []int, value int) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// at supports the negative indices used while walking around a blossom
+func at(values []int, i int) int {
+	if i < 0 {
+		i += len(values)
+	}
+	return values[i]
+}
+
+// expandBlossom expands the given top-level blossom
+func (s *blossomState) expandBlossom(b int, endstage bool) {
+	for _, child := range s.blossomchilds[b] {
+		s.blossomparent[child] = -1
+		if child < s.nvertex {
+			s.inblossom[child] = child
+		} else if endstage && s.dualvar[child] == 0 {
+			s.expandBlossom(child, endstage)
+		} else {
+			for _, leaf := range s.blossomLeaves(child) {
+				s.inblossom[leaf] = child
+			}
+		}
+	}
+
+	if !endstage && s.label[b] == 2 {
+		// Relabel the sub-blossoms on the path from the entry child to the base as alternating T and S
+		childs := s.blossomchilds[b]
+		endps := s.blossomendps[b]
+		entrychild := s.inblossom[s.endpoint[s.labelend[b]^1]]
+		j := indexOf(childs, entrychild)
+		var jstep, endptrick int
+		if j&1 != 0 {
+			j -= len(childs)
+			jstep = 1
+			endptrick = 0
+		} else {
+			jstep = -1
+			endptrick = 1
+		}
+		p := s.labelend[b]
+		for j != 0 {
+			s.label[s.endpoint[p^1]] = 0
+			s.label[s.endpoint[at(endps, j-endptrick)^endptrick^1]] = 0
+			s.assignLabel(s.endpoint[p^1], 2, p)
+			s.allowedge[at(endps, j-endptrick)/2] = true
+			j += jstep
+			p = at(endps, j-endptrick) ^ endptrick
+			s.allowedge[p/2] = true
+			j += jstep
+		}
+		bv := at(childs, j)
+		s.label[s.endpoint[p^1]], s.label[bv] = 2, 2
+		s.labelend[s.endpoint[p^1]], s.labelend[bv] = p, p
+		s.bestedge[bv] = -1
+		j += jstep
+		for at(childs, j) != entrychild {
+			bv = at(childs, j)
+			if s.label[bv] == 1 {
+				j += jstep
+				continue
+			}
+			labeled := -1
+			for _, leaf := range s.blossomLeaves(bv) {
+				if s.label[leaf] != 0 {
+					labeled = leaf
+					break
+				}
+			}
+			if labeled != -1 {
+				s.label[labeled] = 0
+				s.label[s.endpoint[s.mate[s.blossombase[bv]]]] = 0
+				s.assignLabel(labeled, 2, s.labelend[labeled])
+			}
+			j += jstep
+		}
+	}
+
+	s.label[b], s.labelend[b] = -1, -1
+	s.blossomchilds[b], s.blossomendps[b] = nil, nil
+	s.blossombase[b] = -1
+	s.blossombestedges[b] = nil
+	s.bestedge[b] = -1
+	s.unusedblossoms = append(s.unusedblossoms, b)
+}
+
+// augmentBlossom swaps matched and unmatched edges on the path inside blossom b from vertex v to the base
+func (s *blossomState) augmentBlossom(b, v int) {
+	t := v
+	for s.blossomparent[t] != b {
+		t = s.blossomparent[t]
+	}
+	if t >= s.nvertex {
+		s.augmentBlossom(t, v)
+	}
+	childs := s.blossomchilds[b]
+	endps := s.blossomendps[b]
+	i := indexOf(childs, t)
+	j := i
+	var jstep, endptrick int
+	if i&1 != 0 {
+		j -= len(childs)
+		jstep = 1
+		endptrick = 0
+	} else {
+		jstep = -1
+		endptrick = 1
+	}
+	for j != 0 {
+		j += jstep
+		t = at(childs, j)
+		p := at(endps, j-endptrick) ^ endptrick
+		if t >= s.nvertex {
+			s.augmentBlossom(t, s.endpoint[p])
+		}
+		j += jstep
+		t = at(childs, j)
+		if t >= s.nvertex {
+			s.augmentBlossom(t, s.endpoint[p^1])
+		}
+		s.mate[s.endpoint[p]] = p ^ 1
+		s.mate[s.endpoint[p^1]] = p
+	}
+	s.blossomchilds[b] = append(append([]int(nil), childs[i:]...), childs[:i]...)
+	s.blossomendps[b] = append(append([]int(nil), endps[i:]...), endps[:i]...)
+	s.blossombase[b] = s.blossombase[s.blossomchilds[b][0]]
+}
+
+// augmentMatching swaps matched and unmatched edges over an alternating path through edge k
+func (s *blossomState) augmentMatching(k int) {
+	starts := [2][2]int{{s.edges[k].i, 2*k + 1}, {s.edges[k].j, 2 * k}}
+	for _, start := range starts {
+		vertex, p := start[0], start[1]
+		for {
+			bs := s.inblossom[vertex]
+			if bs >= s.nvertex {
+				s.augmentBlossom(bs, vertex)
+			}
+			s.mate[vertex] = p
+			if s.labelend[bs] == -1 {
+				break
+			}
+			t := s.endpoint[s.labelend[bs]]
+			bt := s.inblossom[t]
+			vertex = s.endpoint[s.labelend[bt]]
+			j := s.endpoint[s.labelend[bt]^1]
+			if bt >= s.nvertex {
+				s.augmentBlossom(bt, j)
+			}
+			s.mate[j] = s.labelend[bt]
+			p = s.labelend[bt] ^ 1
+		}
+	}
+}
+
+func (s *blossomState) run() {
+	n := s.nvertex
+	for stage := 0; stage < n; stage++ {
+		for i := range s.label {
+			s.label[i] = 0
+			s.bestedge[i] = -1
+		}
+		for b := n; b < 2*n; b++ {
+			s.blossombestedges[b] = nil
+		}
+		for k := range s.allowedge {
+			s.allowedge[k] = false
+		}
+		s.queue = s.queue[:0]
+
+		for v := 0; v < n; v++ {
+			if s.mate[v] == -1 && s.label[s.inblossom[v]] == 0 {
+				s.assignLabel(v, 1, -1)
+			}
+		}
+
+		augmented := false
+		for {
+			for len(s.queue) > 0 && !augmented {
+				v := s.queue[len(s.queue)-1]
+				s.queue = s.queue[:len(s.queue)-1]
+
+				for _, p := range s.neighbend[v] {
+					k := p / 2
+					w := s.endpoint[p]
+					if s.inblossom[v] == s.inblossom[w] {
+						continue
+					}
+					var kslack int64
+					if !s.allowedge[k] {
+						kslack = s.slack(k)
+						if kslack <= 0 {
+							s.allowedge[k] = true
+						}
+					}
+					if s.allowedge[k] {
+						if s.label[s.inblossom[w]] == 0 {
+							s.assignLabel(w, 2, p^1)
+						} else if s.label[s.inblossom[w]] == 1 {
+							base := s.scanBlossom(v, w)
+							if base >= 0 {
+								s.addBlossom(base, k)
+							} else {
+								s.augmentMatching(k)
+								augmented = true
+								break
+							}
+						} else if s.label[w] == 0 {
+							s.label[w] = 2
+							s.labelend[w] = p ^ 1
+						}
+					} else if s.label[s.inblossom[w]] == 1 {
+						b := s.inblossom[v]
+						if s.bestedge[b] == -1 || kslack < s.slack(s.bestedge[b]) {
+							s.bestedge[b] = k
+						}
+					} else if s.label[w] == 0 {
+						if s.bestedge[w] == -1 || kslack < s.slack(s.bestedge[w]) {
+							s.bestedge[w] = k
+						}
+					}
+				}
+			}
+			if augmented {
+				break
+			}
+
+			// No augmenting path found, update the dual variables
+			deltatype := -1
+			var delta int64
+			deltaedge, deltablossom := -1, -1
+
+			if !s.maxCardinality {
+				deltatype = 1
+				delta = s.minVertexDual()
+			}
+			for v := 0; v < n; v++ {
+				if s.label[s.inblossom[v]] == 0 && s.bestedge[v] != -1 {
+					d := s.slack(s.bestedge[v])
+					if deltatype == -1 || d < delta {
+						delta = d
+						deltatype = 2
+						deltaedge = s.bestedge[v]
+					}
+				}
+			}
+			for b := 0; b < 2*n; b++ {
+				if s.blossomparent[b] == -1 && s.label[b] == 1 && s.bestedge[b] != -1 {
+					d := s.slack(s.bestedge[b]) / 2
+					if deltatype == -1 || d < delta {
+						delta = d
+						deltatype = 3
+						deltaedge = s.bestedge[b]
+					}
+				}
+			}
+			for b := n; b < 2*n; b++ {
+				if s.blossombase[b] >= 0 && s.blossomparent[b] == -1 && s.label[b] == 2 && (deltatype == -1 || s.dualvar[b] < delta) {
+					delta = s.dualvar[b]
+					deltatype = 4
+					deltablossom = b
+				}
+			}
+			if deltatype == -1 {
+				// No further improvement possible, max-cardinality optimum reached
+				deltatype = 1
+				delta = s.minVertexDual()
+				if delta < 0 {
+					delta = 0
+				}
+			}
+
+			for v := 0; v < n; v++ {
+				if s.label[s.inblossom[v]] == 1 {
+					s.dualvar[v] -= delta
+				} else if s.label[s.inblossom[v]] == 2 {
+					s.dualvar[v] += delta
+				}
+			}
+			for b := n; b < 2*n; b++ {
+				if s.blossombase[b] >= 0 && s.blossomparent[b] == -1 {
+					if s.label[b] == 1 {
+						s.dualvar[b] += delta
+					} else if s.label[b] == 2 {
+						s.dualvar[b] -= delta
+					}
+				}
+			}
+
+			if deltatype == 1 {
+				break
+			} else if deltatype == 2 {
+				s.allowedge[deltaedge] = true
+				i, j := s.edges[deltaedge].i, s.edges[deltaedge].j
+				if s.label[s.inblossom[i]] == 0 {
+					i, j = j, i
+				}
+				s.queue = append(s.queue, i)
+			} else if deltatype == 3 {
+				s.allowedge[deltaedge] = true
+				s.queue = append(s.queue, s.edges[deltaedge].i)
+			} else if deltatype == 4 {
+				s.expandBlossom(deltablossom, false)
+			}
+		}
+
+		if !augmented {
+			break
+		}
+
+		for b := n; b < 2*n; b++ {
+			if s.blossomparent[b] == -1 && s.blossombase[b] >= 0 && s.label[b] == 1 && s.dualvar[b] == 0 {
+				s.expandBlossom(b, true)
+			}
+		}
+	}
+}
+
+func (s *blossomState) minVertexDual() int64 {
+	result := s.dualvar[0]
+	for v := 1; v < s.nvertex; v++ {
+		if s.dualvar[v] < result {
+			result = s.dualvar[v]
+		}
+	}
+	return result
+}
@@ -0,0 +1,343 @@
+package matcher
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/config"
+	"yandexschooldating/match"
+	"yandexschooldating/user"
+	"yandexschooldating/util"
+)
+
+// Group is the users who meet together during a matching cycle, usually two of them
+type Group []user.User
+
+// Matcher splits active users into groups for the next matching cycle. Users who could not be matched are returned separately
+type Matcher interface {
+	Match(users []user.User, history *match.History) ([]Group, []user.User)
+}
+
+func shuffled(users []user.User) []user.User {
+	result := append([]user.User(nil), users...)
+	rand.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	return result
+}
+
+// offsetDifference returns the absolute difference between UTC offsets of the users' cities, unknown cities are treated as UTC.
+// The second value is false if the timezone of either city is unknown
+func offsetDifference(first, second user.User, now time.Time) (time.Duration, bool) {
+	firstOffset, firstKnown := util.GetUTCOffset(first.City, now)
+	secondOffset, secondKnown := util.GetUTCOffset(second.City, now)
+	difference := firstOffset - secondOffset
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference, firstKnown && secondKnown
+}
+
+// timezoneLimit tells which users are close enough in time to be matched.
+// A user who has nobody within config.MaxOffsetDifference may still meet the candidates with the closest timezone
+type timezoneLimit struct {
+	now time.Time
+	// closest is the smallest offset difference to another user for users who have nobody within the limit
+	closest map[int]time.Duration
+}
+
+func newTimezoneLimit(users []user.User, now time.Time) timezoneLimit {
+	limit := timezoneLimit{now: now, closest: make(map[int]time.Duration)}
+	for i := range users {
+		closest, found := time.Duration(0), false
+		for j := range users {
+			if i == j {
+				continue
+			}
+			difference, known := offsetDifference(users[i], users[j], now)
+			if !known || difference <= config.MaxOffsetDifference {
+				found = false
+				break
+			}
+			if !found || difference < closest {
+				closest, found = difference, true
+			}
+		}
+		if found {
+			limit.closest[users[i].ID] = closest
+		}
+	}
+	return limit
+}
+
+// canMeet is false for users whose cities are more than config.MaxOffsetDifference apart unless one of them has no closer candidate
+func (l timezoneLimit) canMeet(first, second user.User) bool {
+	difference, known := offsetDifference(first, second, l.now)
+	if !known || difference <= config.MaxOffsetDifference {
+		return true
+	}
+	for _, u := range []user.User{first, second} {
+		if closest, stranded := l.closest[u.ID]; stranded && difference <= closest {
+			return true
+		}
+	}
+	return false
+}
+
+// addToBestGroup adds the user to the group with the largest total score of the user with every member.
+// Groups with members who can't meet the user are skipped. Returns false if there was no suitable group
+func addToBestGroup(groups []Group, extra user.User, limit timezoneLimit, score func(first, second user.User) int64) bool {
+	best := -1
+	var bestScore int64
+	for i, group := range groups {
+		var groupScore int64
+		suitable := true
+		for _, member := range group {
+			groupScore += score(extra, member)
+			suitable = suitable && limit.canMeet(extra, member)
+		}
+		if suitable && (best == -1 || groupScore > bestScore) {
+			best, bestScore = i, groupScore
+		}
+	}
+	if best == -1 {
+		return false
+	}
+	groups[best] = append(groups[best], extra)
+	return true
+}
+
+// Greedy pairs users from the same city first and then pairs everyone left by the proximity of their timezones.
+// Remote-first users are always paired regardless of the city.
+// If triads are enabled, the user left without a pair joins one of the pairs
+type Greedy struct {
+	clock  clock.Clock
+	triads bool
+}
+
+func NewGreedy(clock clock.Clock, triads bool) *Greedy {
+	return &Greedy{clock: clock, triads: triads}
+}
+
+func (g *Greedy) Match(users []user.User, history *match.History) ([]Group, []user.User) {
+	limit := newTimezoneLimit(users, g.clock.Now())
+	cities := make(map[string][]user.User)
+	var leftovers []user.User
+	for _, user := range shuffled(users) {
+		if user.RemoteFirst {
+			leftovers = append(leftovers, user)
+		} else {
+			cities[user.City] = append(cities[user.City], user)
+		}
+	}
+
+	var groups []Group
+	for _, cityUsers := range cities {
+		cityGroups, unpaired := pairGreedily(cityUsers, history, limit)
+		groups = append(groups, cityGroups...)
+		leftovers = append(leftovers, unpaired...)
+	}
+
+	leftoverGroups, unpaired := pairGreedily(shuffled(leftovers), history, limit)
+	groups = append(groups, leftoverGroups...)
+	if g.triads && len(unpaired) == 1 && addToBestGroup(groups, unpaired[0], limit, greedyScore(history)) {
+		unpaired = nil
+	}
+	return groups, unpaired
+}
+
+// greedyScore prefers members from the same city first and then the ones never met
+func greedyScore(history *match.History) func(first, second user.User) int64 {
+	return func(first, second user.User) int64 {
+		var score int64
+		if first.City == second.City {
+			score += 2
+		}
+		if _, met := history.LastMatchedCycle(first.ID, second.ID); !met {
+			score++
+		}
+		return score
+	}
+}
+
+// pairGreedily pairs users preferring partners they have never met, then partners with a close timezone, then the ones met longest ago.
+// Users with the fewest unmet partners left are paired first
+func pairGreedily(users []user.User, history *match.History, limit timezoneLimit) ([]Group, []user.User) {
+	remaining := users
+	var pairs []Group
+	var unpaired []user.User
+	for len(remaining) > 0 {
+		chosen, chosenUnmet := 0, len(remaining)
+		for i := range remaining {
+			unmet := 0
+			for j := range remaining {
+				if _, met := history.LastMatchedCycle(remaining[i].ID, remaining[j].ID); i != j && !met && limit.canMeet(remaining[i], remaining[j]) {
+					unmet++
+				}
+			}
+			if unmet < chosenUnmet {
+				chosen, chosenUnmet = i, unmet
+			}
+		}
+		partner := -1
+		for j := range remaining {
+			if j == chosen || !limit.canMeet(remaining[chosen], remaining[j]) {
+				continue
+			}
+			if partner == -1 || isBetterPartner(history, limit.now, remaining[chosen], remaining[j], remaining[partner]) {
+				partner = j
+			}
+		}
+		if partner == -1 {
+			unpaired = append(unpaired, remaining[chosen])
+		} else {
+			pairs = append(pairs, Group{remaining[chosen], remaining[partner]})
+		}
+		var rest []user.User
+		for i := range remaining {
+			if i != chosen && i != partner {
+				rest = append(rest, remaining[i])
+			}
+		}
+		remaining = rest
+	}
+	return pairs, unpaired
+}
+
+func isBetterPartner(history *match.History, now time.Time, chosen, candidate, current user.User) bool {
+	candidateCycle, candidateMet := history.LastMatchedCycle(chosen.ID, candidate.ID)
+	currentCycle, currentMet := history.LastMatchedCycle(chosen.ID, current.ID)
+	if candidateMet != currentMet {
+		return !candidateMet
+	}
+	candidateDifference, _ := offsetDifference(chosen, candidate, now)
+	currentDifference, _ := offsetDifference(chosen, current, now)
+	if candidateDifference != currentDifference {
+		return candidateDifference < currentDifference
+	}
+	return candidateMet && candidateCycle < currentCycle
+}
+
+const (
+	// baseWeight keeps all weights positive so that any pair is better than no pair
+	baseWeight = 2000
+	// sameCityBonus is larger than repeatPenalty: meeting in person is preferred to a fresh partner online
+	sameCityBonus    = 1000
+	remoteFirstBonus = 300
+	repeatPenalty    = 800
+	// hourOffsetPenalty is subtracted for every hour of difference between the users' UTC offsets
+	hourOffsetPenalty = 25
+	// sharedInterestBonus is added for every common interest up to maxSharedInterests
+	sharedInterestBonus = 50
+	maxSharedInterests  = 3
+	// noCommonLanguagePenalty is subtracted when both users listed their languages and none of them is common
+	noCommonLanguagePenalty = 250
+)
+
+// Weighted scores every possible pair and finds the matching of maximum total weight among the ones with the most pairs.
+// Pairs from the same city are preferred, then pairs with a small timezone difference.
+// Users from different cities more than config.MaxOffsetDifference apart are matched only if one of them has no closer candidate.
+// Recent partners are penalized, the penalty fades over config.MatchHistoryCycles cycles.
+// Users who miss meetings are penalized in every pair, so they are the first to be left without a pair.
+// Common interests from the profiles are a small bonus, no common language is a penalty.
+// If triads are enabled, the user left without a pair joins the pair with the best total weight
+type Weighted struct {
+	clock  clock.Clock
+	triads bool
+}
+
+func NewWeighted(clock clock.Clock, triads bool) *Weighted {
+	return &Weighted{clock: clock, triads: triads}
+}
+
+func (w *Weighted) Match(users []user.User, history *match.History) ([]Group, []user.User) {
+	// shuffling makes the choice between equally good matchings random
+	users = shuffled(users)
+	now := w.clock.Now()
+	limit := newTimezoneLimit(users, now)
+
+	var edges []edge
+	for i := range users {
+		for j := i + 1; j < len(users); j++ {
+			if limit.canMeet(users[i], users[j]) {
+				edges = append(edges, edge{i, j, w.pairWeight(users[i], users[j], history, now)})
+			}
+		}
+	}
+	mate := maxWeightMatching(edges, true)
+
+	var groups []Group
+	var unpaired []user.User
+	for i := range users {
+		switch {
+		case i >= len(mate) || mate[i] == -1:
+			unpaired = append(unpaired, users[i])
+		case i < mate[i]:
+			groups = append(groups, Group{users[i], users[mate[i]]})
+		}
+	}
+
+	if w.triads && len(unpaired) == 1 && addToBestGroup(groups, unpaired[0], limit, func(first, second user.User) int64 {
+		return w.pairWeight(first, second, history, now)
+	}) {
+		unpaired = nil
+	}
+	return groups, unpaired
+}
+
+func (w *Weighted) pairWeight(first, second user.User, history *match.History, now time.Time) int64 {
+	weight := int64(baseWeight)
+
+	switch {
+	case first.RemoteFirst && second.RemoteFirst:
+		weight += remoteFirstBonus
+	case !first.RemoteFirst && !second.RemoteFirst && first.City == second.City:
+		weight += sameCityBonus
+	}
+
+	difference, _ := offsetDifference(first, second, now)
+	weight -= int64(difference/time.Minute) * hourOffsetPenalty / 60
+
+	if cycles, met := history.CyclesSinceMatched(first.ID, second.ID); met && cycles <= config.MatchHistoryCycles {
+		weight -= int64(repeatPenalty * (config.MatchHistoryCycles - cycles + 1) / config.MatchHistoryCycles)
+	}
+	weight += profileWeight(first.Profile, second.Profile)
+	return weight - reliabilityPenalty(first) - reliabilityPenalty(second)
+}
+
+func profileWeight(first, second user.Profile) int64 {
+	var weight int64
+	if shared := countCommon(first.Interests, second.Interests); shared < maxSharedInterests {
+		weight += int64(shared * sharedInterestBonus)
+	} else {
+		weight += maxSharedInterests * sharedInterestBonus
+	}
+	if len(first.Languages) > 0 && len(second.Languages) > 0 && countCommon(first.Languages, second.Languages) == 0 {
+		weight -= noCommonLanguagePenalty
+	}
+	return weight
+}
+
+// countCommon counts the values present in both lists ignoring case
+func countCommon(first, second []string) int {
+	values := make(map[string]bool)
+	for _, value := range first {
+		values[strings.ToLower(value)] = true
+	}
+	count := 0
+	for _, value := range second {
+		if values[strings.ToLower(value)] {
+			count++
+			delete(values, strings.ToLower(value))
+		}
+	}
+	return count
+}
+
+func reliabilityPenalty(u user.User) int64 {
+	penalty := int64(config.NoShowPenalty*u.Reliability.NoShows + config.RefusalPenalty*u.Reliability.Refusals)
+	if penalty > config.MaxReliabilityPenalty {
+		return config.MaxReliabilityPenalty
+	}
+	return penalty
+}
@@ -0,0 +1,262 @@
+package matcher_test
+
+import (
+	"testing"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/match"
+	"yandexschooldating/matcher"
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/user"
+
+	"github.com/stretchr/testify/require"
+)
+
+func partnersOf(pairs []matcher.Group) map[int]int {
+	result := make(map[int]int)
+	for _, pair := range pairs {
+		result[pair[0].ID] = pair[1].ID
+		result[pair[1].ID] = pair[0].ID
+	}
+	return result
+}
+
+func requireEveryoneOnce(t *testing.T, users []user.User, pairs []matcher.Group, unpaired []user.User) {
+	seen := make(map[int]int)
+	for _, pair := range pairs {
+		require.NotEqual(t, pair[0].ID, pair[1].ID)
+		seen[pair[0].ID]++
+		seen[pair[1].ID]++
+	}
+	for _, user := range unpaired {
+		seen[user.ID]++
+	}
+	require.Len(t, seen, len(users))
+	for _, user := range users {
+		require.Equal(t, 1, seen[user.ID])
+	}
+	require.LessOrEqual(t, len(unpaired), 1)
+}
+
+func TestMatchers(t *testing.T) {
+	fakeClock := &clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	matchers := map[string]matcher.Matcher{
+		"greedy":   matcher.NewGreedy(fakeClock, false),
+		"weighted": matcher.NewWeighted(fakeClock, false),
+	}
+
+	for name, m := range matchers {
+		t.Run(name+" everyone is paired once", func(t *testing.T) {
+			cities := []string{messagestrings.Moscow, messagestrings.London, messagestrings.Minsk, "Шахты"}
+			var users []user.User
+			for i := 0; i < 23; i++ {
+				users = append(users, user.User{ID: i, City: cities[i%len(cities)], Active: true, RemoteFirst: i%5 == 0})
+				pairs, unpaired := m.Match(users, match.NewHistory(nil))
+				requireEveryoneOnce(t, users, pairs, unpaired)
+			}
+		})
+
+		t.Run(name+" same city first", func(t *testing.T) {
+			users := []user.User{
+				{ID: 1, City: messagestrings.Moscow},
+				{ID: 2, City: messagestrings.London},
+				{ID: 3, City: messagestrings.Moscow},
+				{ID: 4, City: messagestrings.London},
+			}
+			for i := 0; i < 10; i++ {
+				pairs, unpaired := m.Match(users, match.NewHistory(nil))
+				require.Empty(t, unpaired)
+				partners := partnersOf(pairs)
+				require.Equal(t, 3, partners[1])
+				require.Equal(t, 4, partners[2])
+			}
+		})
+
+		t.Run(name+" close timezones", func(t *testing.T) {
+			users := []user.User{
+				{ID: 1, City: messagestrings.Novosibirsk},
+				{ID: 2, City: messagestrings.Berlin},
+				{ID: 3, City: messagestrings.Yekaterinburg},
+				{ID: 4, City: messagestrings.London},
+			}
+			for i := 0; i < 10; i++ {
+				groups, unpaired := m.Match(users, match.NewHistory(nil))
+				require.Empty(t, unpaired)
+				partners := partnersOf(groups)
+				require.Equal(t, 3, partners[1])
+				require.Equal(t, 4, partners[2])
+			}
+		})
+
+		t.Run(name+" far timezones", func(t *testing.T) {
+			users := []user.User{
+				{ID: 1, City: messagestrings.NewYork},
+				{ID: 2, City: messagestrings.Novosibirsk},
+				{ID: 3, City: messagestrings.Yekaterinburg},
+			}
+			for i := 0; i < 10; i++ {
+				groups, unpaired := m.Match(users, match.NewHistory(nil))
+				require.Len(t, groups, 1)
+				require.Len(t, unpaired, 1)
+				require.NotEqual(t, 2, partnersOf(groups)[1])
+			}
+
+			users = append(users, user.User{ID: 4, City: "Шахты"})
+			groups, unpaired := m.Match(users, match.NewHistory(nil))
+			require.Len(t, groups, 2)
+			require.Empty(t, unpaired)
+		})
+
+		t.Run(name+" lone New York user meets the closest candidate", func(t *testing.T) {
+			users := []user.User{
+				{ID: 1, City: messagestrings.NewYork},
+				{ID: 2, City: messagestrings.London},
+				{ID: 3, City: messagestrings.Moscow},
+				{ID: 4, City: messagestrings.Moscow},
+			}
+			for i := 0; i < 10; i++ {
+				groups, unpaired := m.Match(users, match.NewHistory(nil))
+				require.Empty(t, unpaired)
+				require.Equal(t, 2, partnersOf(groups)[1])
+			}
+
+			groups, unpaired := m.Match(users[:1], match.NewHistory(nil))
+			require.Empty(t, groups)
+			require.Len(t, unpaired, 1)
+		})
+
+		t.Run(name+" no repeated partners", func(t *testing.T) {
+			var users []user.User
+			for i := 1; i <= 6; i++ {
+				users = append(users, user.User{ID: i, City: messagestrings.Zurich})
+			}
+			var history []match.Match
+			met := make(map[[2]int]bool)
+			for cycle := 1; cycle <= 3; cycle++ {
+				pairs, unpaired := m.Match(users, match.NewHistory(history))
+				require.Empty(t, unpaired)
+				for _, pair := range pairs {
+					key := [2]int{pair[0].ID, pair[1].ID}
+					if key[0] > key[1] {
+						key[0], key[1] = key[1], key[0]
+					}
+					require.False(t, met[key], "cycle %d repeats %v", cycle, key)
+					met[key] = true
+					history = append(history, match.Match{FirstID: pair[0].ID, SecondID: pair[1].ID, MatchingCycle: cycle})
+				}
+			}
+		})
+	}
+
+	t.Run("weighted pairs remote-first users together", func(t *testing.T) {
+		m := matcher.NewWeighted(fakeClock, false)
+		users := []user.User{
+			{ID: 1, City: messagestrings.Berlin, RemoteFirst: true},
+			{ID: 2, City: messagestrings.Berlin},
+			{ID: 3, City: messagestrings.Zurich, RemoteFirst: true},
+			{ID: 4, City: messagestrings.Zurich},
+		}
+		pairs, unpaired := m.Match(users, match.NewHistory(nil))
+		require.Empty(t, unpaired)
+		partners := partnersOf(pairs)
+		require.Equal(t, 3, partners[1])
+		require.Equal(t, 4, partners[2])
+	})
+
+	t.Run("weighted prefers the partner met longest ago", func(t *testing.T) {
+		m := matcher.NewWeighted(fakeClock, false)
+		users := []user.User{
+			{ID: 1, City: messagestrings.Minsk},
+			{ID: 2, City: messagestrings.Minsk},
+			{ID: 3, City: messagestrings.Minsk},
+			{ID: 4, City: messagestrings.Minsk},
+		}
+		history := match.NewHistory([]match.Match{
+			{FirstID: 1, SecondID: 2, MatchingCycle: 3},
+			{FirstID: 3, SecondID: 4, MatchingCycle: 3},
+			{FirstID: 1, SecondID: 3, MatchingCycle: 2},
+			{FirstID: 2, SecondID: 4, MatchingCycle: 2},
+			{FirstID: 1, SecondID: 4, MatchingCycle: 1},
+			{FirstID: 2, SecondID: 3, MatchingCycle: 1},
+		})
+		pairs, unpaired := m.Match(users, history)
+		require.Empty(t, unpaired)
+		require.Equal(t, 4, partnersOf(pairs)[1])
+	})
+
+	t.Run("weighted leaves unreliable users without a pair", func(t *testing.T) {
+		m := matcher.NewWeighted(fakeClock, false)
+		users := []user.User{
+			{ID: 1, City: messagestrings.Minsk},
+			{ID: 2, City: messagestrings.Minsk, Reliability: user.Reliability{NoShows: 1}},
+			{ID: 3, City: messagestrings.Minsk, Reliability: user.Reliability{Refusals: 1}},
+		}
+		for i := 0; i < 10; i++ {
+			pairs, unpaired := m.Match(users, match.NewHistory(nil))
+			require.Len(t, pairs, 1)
+			require.Len(t, unpaired, 1)
+			require.Equal(t, 2, unpaired[0].ID)
+		}
+	})
+
+	t.Run("weighted prefers common interests and languages", func(t *testing.T) {
+		m := matcher.NewWeighted(fakeClock, false)
+		users := []user.User{
+			{ID: 1, City: messagestrings.Minsk, Profile: user.Profile{Interests: []string{"Книги", "Кино"}, Languages: []string{"Русский"}}},
+			{ID: 2, City: messagestrings.Minsk, Profile: user.Profile{Interests: []string{"Спорт"}, Languages: []string{"English"}}},
+			{ID: 3, City: messagestrings.Minsk, Profile: user.Profile{Interests: []string{"Кино"}}},
+			{ID: 4, City: messagestrings.Minsk, Profile: user.Profile{Interests: []string{"Спорт"}, Languages: []string{"english", "русский"}}},
+		}
+		for i := 0; i < 10; i++ {
+			pairs, unpaired := m.Match(users, match.NewHistory(nil))
+			require.Empty(t, unpaired)
+			require.Len(t, pairs, 2)
+			partners := make(map[int]int)
+			for _, pair := range pairs {
+				partners[pair[0].ID] = pair[1].ID
+				partners[pair[1].ID] = pair[0].ID
+			}
+			require.Equal(t, 3, partners[1])
+			require.Equal(t, 4, partners[2])
+		}
+	})
+
+	t.Run("triads", func(t *testing.T) {
+		triadMatchers := []matcher.Matcher{matcher.NewGreedy(fakeClock, true), matcher.NewWeighted(fakeClock, true)}
+		for _, m := range triadMatchers {
+			users := []user.User{
+				{ID: 1, City: messagestrings.Moscow},
+				{ID: 2, City: messagestrings.Minsk},
+				{ID: 3, City: messagestrings.Moscow},
+				{ID: 4, City: messagestrings.Minsk},
+				{ID: 5, City: messagestrings.Minsk},
+			}
+			groups, unpaired := m.Match(users, match.NewHistory(nil))
+			require.Empty(t, unpaired)
+			require.Len(t, groups, 2)
+			for _, group := range groups {
+				for _, member := range group[1:] {
+					require.Equal(t, group[0].City, member.City)
+				}
+			}
+
+			groups, unpaired = m.Match(users[:1], match.NewHistory(nil))
+			require.Empty(t, groups)
+			require.Len(t, unpaired, 1)
+		}
+	})
+
+	t.Run("single user", func(t *testing.T) {
+		for _, m := range matchers {
+			users := []user.User{{ID: 1, City: messagestrings.Minsk}}
+			pairs, unpaired := m.Match(users, match.NewHistory(nil))
+			require.Empty(t, pairs)
+			require.Equal(t, users, unpaired)
+
+			pairs, unpaired = m.Match(nil, match.NewHistory(nil))
+			require.Empty(t, pairs)
+			require.Empty(t, unpaired)
+		}
+	})
+}
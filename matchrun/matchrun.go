@@ -0,0 +1,130 @@
+package matchrun
+
+import (
+	"context"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type State string
+
+const (
+	// Planned runs are computed and saved, but may be applied only partially
+	Planned State = "planned"
+	// Finished runs are fully applied
+	Finished State = "finished"
+)
+
+// Run is a matching run computed in full before anything is changed. Applying it consists of steps
+// that can be repeated, so a run interrupted by an error or a crash is resumed by applying it again
+type Run struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	MatchingCycle int                `bson:"matchingCycle"`
+	State         State              `bson:"state"`
+	StartUnixTime int64              `bson:"startUnixTime"`
+	// Schedule is the spec of the schedule that started the run, empty if it was started by hand
+	Schedule string `bson:"schedule"`
+	// ScheduledUnixTime is the time of the scheduled run, zero if it was started by hand
+	ScheduledUnixTime int64 `bson:"scheduledUnixTime,omitempty"`
+	// Participants are the users who were active when the run was planned
+	Participants  []int          `bson:"participants"`
+	Groups        []Group        `bson:"groups"`
+	Announcements []Announcement `bson:"announcements"`
+}
+
+// Group is a match to be made
+type Group struct {
+	MatchID primitive.ObjectID `bson:"matchId"`
+	UserIDs []int              `bson:"userIds"`
+}
+
+// Announcement is a reminder telling a user about their new match or that there is none
+type Announcement struct {
+	ReminderID primitive.ObjectID `bson:"reminderId"`
+	// MatchID is zero for users left without a match
+	MatchID  primitive.ObjectID `bson:"matchId"`
+	UserID   int                `bson:"userId"`
+	ChatID   int64              `bson:"chatId"`
+	UnixTime int64              `bson:"unixTime"`
+	Text     string             `bson:"text"`
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+var RunBSON = struct {
+	ID                string
+	MatchingCycle     string
+	State             string
+	StartUnixTime     string
+	Schedule          string
+	ScheduledUnixTime string
+	Participants      string
+	Groups            string
+	Announcements     string
+}{"_id", "matchingCycle", "state", "startUnixTime", "schedule", "scheduledUnixTime", "participants", "groups", "announcements"}
+
+type DAO struct {
+	runs *mongo.Collection
+}
+
+func NewDAO(client *mongo.Client, database string) *DAO {
+	return &DAO{runs: client.Database(database).Collection("matchingRuns")}
+}
+
+// SaveRun saves a planned run
+func (m *DAO) SaveRun(ctx context.Context, run Run) error {
+	_, err := m.runs.InsertOne(ctx, run)
+	if err != nil {
+		return errorx.Decorate(err, "can't save matching run")
+	}
+	return nil
+}
+
+// FindUnfinishedRun returns the latest run that is not finished or nil
+func (m *DAO) FindUnfinishedRun(ctx context.Context) (*Run, error) {
+	result := m.runs.FindOne(ctx, bson.M{RunBSON.State: Planned}, options.FindOne().SetSort(bson.M{RunBSON.StartUnixTime: -1}))
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find unfinished matching run")
+	}
+	var run Run
+	err := result.Decode(&run)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode matching run")
+	}
+	return &run, nil
+}
+
+// FindScheduledRun returns the run of the schedule at the scheduled time or nil
+func (m *DAO) FindScheduledRun(ctx context.Context, schedule string, scheduledUnixTime int64) (*Run, error) {
+	filter := bson.M{RunBSON.Schedule: schedule, RunBSON.ScheduledUnixTime: scheduledUnixTime}
+	result := m.runs.FindOne(ctx, filter, options.FindOne().SetSort(bson.M{RunBSON.StartUnixTime: -1}))
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find matching run of %s at %d", schedule, scheduledUnixTime)
+	}
+	var run Run
+	err := result.Decode(&run)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode matching run")
+	}
+	return &run, nil
+}
+
+func (m *DAO) FinishRun(ctx context.Context, ID primitive.ObjectID) error {
+	result, err := m.runs.UpdateOne(ctx, bson.M{RunBSON.ID: ID}, bson.M{"$set": bson.M{RunBSON.State: Finished}})
+	if err != nil {
+		return errorx.Decorate(err, "can't finish matching run %s", ID.Hex())
+	}
+	if result.MatchedCount == 0 {
+		return errorx.IllegalArgument.New("matching run %s not found", ID.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package matchrun_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"yandexschooldating/coffeebot"
+	"yandexschooldating/config"
+	"yandexschooldating/matchrun"
+	"yandexschooldating/util"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testStore checks the behaviour that every run store implementation must share
+func testStore(t *testing.T, ctx context.Context, store coffeebot.RunStore) {
+	run, err := store.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.Nil(t, run)
+
+	first := matchrun.Run{
+		ID:            primitive.NewObjectID(),
+		MatchingCycle: 1,
+		State:         matchrun.Planned,
+		StartUnixTime: 100,
+		Groups:        []matchrun.Group{{MatchID: primitive.NewObjectID(), UserIDs: []int{1, 2, 3}}},
+		Announcements: []matchrun.Announcement{
+			{ReminderID: primitive.NewObjectID(), UserID: 4, ChatID: 40, UnixTime: 200, Text: "no match"},
+		},
+	}
+	require.NoError(t, store.SaveRun(ctx, first))
+	require.Error(t, store.SaveRun(ctx, first))
+
+	run, err = store.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, run)
+	require.Equal(t, first, *run)
+	run.Groups[0].UserIDs[0] = 5
+
+	second := matchrun.Run{ID: primitive.NewObjectID(), MatchingCycle: 2, State: matchrun.Planned, StartUnixTime: 300}
+	require.NoError(t, store.SaveRun(ctx, second))
+	run, err = store.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.Equal(t, second.ID, run.ID)
+
+	require.NoError(t, store.FinishRun(ctx, second.ID))
+	run, err = store.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.Equal(t, first, *run)
+
+	require.NoError(t, store.FinishRun(ctx, first.ID))
+	require.NoError(t, store.FinishRun(ctx, first.ID))
+	run, err = store.FindUnfinishedRun(ctx)
+	require.NoError(t, err)
+	require.Nil(t, run)
+
+	require.Error(t, store.FinishRun(ctx, primitive.NewObjectID()))
+
+	run, err = store.FindScheduledRun(ctx, "0 0 * * 1", 1000)
+	require.NoError(t, err)
+	require.Nil(t, run)
+	scheduled := matchrun.Run{
+		ID:                primitive.NewObjectID(),
+		MatchingCycle:     3,
+		State:             matchrun.Planned,
+		StartUnixTime:     1100,
+		Schedule:          "0 0 * * 1",
+		ScheduledUnixTime: 1000,
+	}
+	require.NoError(t, store.SaveRun(ctx, scheduled))
+	run, err = store.FindScheduledRun(ctx, "0 0 * * 1", 1000)
+	require.NoError(t, err)
+	require.Equal(t, scheduled, *run)
+	run, err = store.FindScheduledRun(ctx, "0 0 * * 1", 2000)
+	require.NoError(t, err)
+	require.Nil(t, run)
+	run, err = store.FindScheduledRun(ctx, "", 1000)
+	require.NoError(t, err)
+	require.Nil(t, run)
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_matchruns"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	dao := matchrun.NewDAO(client, testDatabase)
+	testStore(t, ctx, dao)
+
+	err = client.Disconnect(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = dao.FindUnfinishedRun(ctx)
+	require.Error(t, err)
+	require.Error(t, dao.SaveRun(ctx, matchrun.Run{ID: primitive.NewObjectID()}))
+	require.Error(t, dao.FinishRun(ctx, primitive.NewObjectID()))
+	_, err = dao.FindScheduledRun(ctx, "", 0)
+	require.Error(t, err)
+}
+
+func TestMemoryDAO(t *testing.T) {
+	testStore(t, context.Background(), matchrun.NewMemoryDAO())
+}
@@ -0,0 +1,84 @@
+package matchrun
+
+import (
+	"context"
+	"sync"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps runs in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex sync.Mutex
+	runs  []Run
+}
+
+func NewMemoryDAO() *MemoryDAO {
+	return &MemoryDAO{}
+}
+
+// copyRun makes sure that callers can't modify stored runs
+func copyRun(run Run) Run {
+	run.Participants = append([]int(nil), run.Participants...)
+	run.Groups = append([]Group(nil), run.Groups...)
+	for i := range run.Groups {
+		run.Groups[i].UserIDs = append([]int(nil), run.Groups[i].UserIDs...)
+	}
+	run.Announcements = append([]Announcement(nil), run.Announcements...)
+	return run
+}
+
+// SaveRun saves a planned run
+func (m *MemoryDAO) SaveRun(_ context.Context, run Run) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, stored := range m.runs {
+		if stored.ID == run.ID {
+			return errorx.IllegalArgument.New("matching run %s exists", run.ID.Hex())
+		}
+	}
+	m.runs = append(m.runs, copyRun(run))
+	return nil
+}
+
+// FindUnfinishedRun returns the latest run that is not finished or nil
+func (m *MemoryDAO) FindUnfinishedRun(context.Context) (*Run, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result *Run
+	for _, run := range m.runs {
+		if run.State == Planned && (result == nil || run.StartUnixTime >= result.StartUnixTime) {
+			found := copyRun(run)
+			result = &found
+		}
+	}
+	return result, nil
+}
+
+// FindScheduledRun returns the run of the schedule at the scheduled time or nil
+func (m *MemoryDAO) FindScheduledRun(_ context.Context, schedule string, scheduledUnixTime int64) (*Run, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result *Run
+	for _, run := range m.runs {
+		if run.Schedule == schedule && run.ScheduledUnixTime == scheduledUnixTime &&
+			(result == nil || run.StartUnixTime >= result.StartUnixTime) {
+			found := copyRun(run)
+			result = &found
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryDAO) FinishRun(_ context.Context, ID primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.runs {
+		if m.runs[i].ID == ID {
+			m.runs[i].State = Finished
+			return nil
+		}
+	}
+	return errorx.IllegalArgument.New("matching run %s not found", ID.Hex())
+}
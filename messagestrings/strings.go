@@ -5,6 +5,11 @@ const (
 	StopMeetings = "Отказаться"
 	ChangeTime   = "Изменить время"
 	Activate     = "Снова участвовать"
+	Settings     = "Настройки"
+	Profile      = "/profile"
+	Skip         = "/skip"
+	PreferOnline = "Предпочитаю онлайн"
+	PreferLive   = "Предпочитаю вживую"
 
 	DefaultReply            = "у меня лапки"
 	GreetingAskCity         = "Привет! В каком городе ты живёшь?"
@@ -12,13 +17,80 @@ const (
 	SorryNoUsername         = "Робот не работает без юзернейма в Телеграме. Установив юзернейм, нажми на /start ещё раз"
 	NoMeetingsThisWeek      = "У тебя нет встречи на эту неделю"
 	CouldNotFindMatch       = "К сожалению, на эту неделю встречи не нашлось"
-	CouldNotParseTime       = "Не получилось распарсить время"
-	ThisWeekMeetingTemplate = "На этой неделе у тебя встреча с @%s"
+	CouldNotParseTime       = "Не получилось понять время. Напиши его, например, так: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04"
+	ThisWeekMeetingTemplate = "На этой неделе у тебя встреча с %s"
 	TimeInThePast           = "Это время уже прошло!"
 	PartnerRefused          = "К сожалению, твой партнёр отказался от встречи"
-	InactiveUser            = "Ты не участвуешь в Random Coffee. Чтобы вернуться, напиши \"" + Activate + "\""
-	AlreadyActive           = "Ты уже участвуешь в Random Coffee"
-	NowActive               = "Теперь ты участвуешь в Random Coffee️"
+	// PartnerLeftGroupTemplate is filled with the username of the one who left and the usernames of the rest
+	PartnerLeftGroupTemplate = "@%s отказался от встречи, но встреча с %s в силе"
+	InactiveUser             = "Ты не участвуешь в Random Coffee. Чтобы вернуться, напиши \"" + Activate + "\""
+	PausedForNoShows         = "Несколько встреч подряд не состоялись, поэтому мы приостановили твоё участие в Random Coffee. Чтобы вернуться, напиши \"" + Activate + "\""
+	UnpausedAfterDispute     = "Ответы о последней встрече не совпали, поэтому пропуск не засчитан и мы вернули тебя в Random Coffee"
+	AlreadyActive            = "Ты уже участвуешь в Random Coffee"
+	NowActive                = "Теперь ты участвуешь в Random Coffee️"
+	// ProfileSummaryTemplate is filled with the username, the city, the participation status and the meeting format
+	ProfileSummaryTemplate = "Твой профиль:\nЮзернейм: @%s\nГород: %s\nУчастие: %s\nФормат встреч: %s"
+	ParticipatingStatus    = "участвуешь"
+	NotParticipatingStatus = "не участвуешь"
+	OnlineFormat           = "предпочитаешь онлайн, пару подберём из любого города"
+	LiveFormat             = "предпочитаешь встречи вживую в своём городе"
+	ChooseMeetingFormat    = "Как тебе удобнее встречаться?"
+	SettingsSaved          = "Настройки сохранены"
+	EditProfileHint        = "Чтобы рассказать о себе партнёрам, нажми " + Profile
+
+	// ClearProfileField is entered to remove a field of the profile
+	ClearProfileField = "-"
+	// ProfileFieldHint explains how to keep or remove a field of the profile
+	ProfileFieldHint   = "Чтобы оставить как есть, нажми " + Skip + ", чтобы стереть, напиши " + ClearProfileField
+	AskBio             = "Коротко расскажи о себе, это увидят твои партнёры. " + ProfileFieldHint
+	BioTooLongTemplate = "Слишком длинно, уложись в %d символов"
+	// AskInterestsTemplate is filled with the chosen interests
+	AskInterestsTemplate = "Выбери свои интересы, повторное нажатие убирает интерес. Сейчас выбрано: %s. Когда закончишь, нажми \"" + InterestsDone + "\""
+	NoInterests          = "ничего"
+	InterestsDone        = "Готово"
+	AskLanguages         = "На каких языках ты говоришь? Напиши их через запятую. " + ProfileFieldHint
+	AskCompany           = "В какой компании или команде ты работаешь? " + ProfileFieldHint
+	ProfileSaved         = "Профиль сохранён"
+	// PartnerProfileTemplate is filled with the username of the partner and their profile
+	PartnerProfileTemplate = "Немного о @%s:\n%s"
+	ProfileBio             = "О себе: "
+	ProfileInterests       = "Интересы: "
+	ProfileLanguages       = "Языки: "
+	ProfileCompany         = "Компания или команда: "
+
+	// AskMeetingTimeTemplate is filled with the usernames of the partners
+	AskMeetingTimeTemplate = "У тебя встреча с %s. Чтобы получить сообщение перед встречей, напиши время встречи, например: завтра в 19, пятница 12:30, через 2 часа или 02.01 15:04"
+	// ConfirmTimeTemplate is filled with the time understood by the bot
+	ConfirmTimeTemplate = "Встреча %s, верно?"
+	ConfirmTime         = "Да"
+	RejectTime          = "Нет, другое время"
+	TimeRejected        = "Время не подтверждено"
+	// ProposalTemplate is filled with the username of the proposer, the proposed times are the buttons
+	ProposalTemplate = "@%s предлагает время встречи. Выбери подходящее или предложи другое"
+	// ProposalSentTemplate is filled with the usernames of the partners and the proposed times
+	ProposalSentTemplate = "Предложили %s время встречи: %s. Когда время выберут, придёт сообщение"
+	// ProposedTimeTemplate is filled with the proposed time
+	ProposedTimeTemplate = "Предложено время: %s"
+	CounterPropose       = "Предложить другое время"
+
+	// InvitationSummaryTemplate is filled with the usernames of the partners
+	InvitationSummaryTemplate = "Random Coffee с %s"
+	CancelledMeetingSummary   = "Встреча Random Coffee отменена"
+	// CallLinkTemplate is filled with the link to the call
+	CallLinkTemplate = "Ссылка на звонок: %s"
+
+	// FeedbackQuestionTemplate is filled with the usernames of the partners, the ratings are the buttons
+	FeedbackQuestionTemplate = "Как прошла встреча с %s? Оцени её от 1 до 5"
+	MeetingDidNotHappen      = "Встреча не состоялась"
+	PartnerDidNotCome        = "Партнёр не пришёл"
+	// FeedbackRatingTemplate is filled with the rating
+	FeedbackRatingTemplate = "Твоя оценка встречи: %d"
+	AskFeedbackComment     = "Спасибо за ответ! Если хочешь, напиши пару слов о встрече. Чтобы пропустить, нажми " + Skip
+	FeedbackCommentSaved   = "Спасибо, мы всё прочитаем"
+	FeedbackCommentSkipped = "Хорошо, спасибо за ответ"
+
+	ButtonExpired      = "Эта кнопка уже не работает"
+	ChosenTimeTemplate = "Время встречи: %s"
 
 	// do not modify city names. they are stored in the db
 
@@ -0,0 +1,70 @@
+package outbox
+
+import "time"
+
+// limiter is a set of token buckets, one per key. Buckets start full
+type limiter struct {
+	perSecond float64
+	burst     float64
+	buckets   map[int64]*bucket
+}
+
+type bucket struct {
+	tokens      float64
+	updated     time.Time
+	pausedUntil time.Time
+}
+
+func newLimiter(perSecond float64, burst int) *limiter {
+	return &limiter{perSecond: perSecond, burst: float64(burst), buckets: make(map[int64]*bucket)}
+}
+
+func (l *limiter) refill(key int64, now time.Time) *bucket {
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	if now.After(b.updated) {
+		b.tokens += now.Sub(b.updated).Seconds() * l.perSecond
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.updated = now
+	}
+	return b
+}
+
+// availableAt returns the earliest time a message for the key can be sent
+func (l *limiter) availableAt(key int64, now time.Time) time.Time {
+	b := l.refill(key, now)
+	result := now
+	if b.tokens < 1 {
+		result = now.Add(time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second)))
+	}
+	if b.pausedUntil.After(result) {
+		result = b.pausedUntil
+	}
+	return result
+}
+
+func (l *limiter) take(key int64, now time.Time) {
+	l.refill(key, now).tokens--
+}
+
+// pause forbids sending for the key until the time, like the messenger asks when rate limits are exceeded
+func (l *limiter) pause(key int64, until time.Time) {
+	b := l.refill(key, until)
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// forgetIdle drops full buckets, they are recreated on demand
+func (l *limiter) forgetIdle(now time.Time) {
+	for key, b := range l.buckets {
+		if now.After(b.pausedUntil) && l.refill(key, now).tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/transport"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps messages in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex       sync.Mutex
+	entries     []Entry
+	deadLetters []DeadLetter
+	clock       clock.Clock
+}
+
+func NewMemoryDAO(clock clock.Clock) *MemoryDAO {
+	return &MemoryDAO{clock: clock}
+}
+
+func (m *MemoryDAO) AddEntry(_ context.Context, message transport.Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries = append(m.entries, Entry{ID: primitive.NewObjectID(), Message: message, NextAttempt: m.clock.Now()})
+	return nil
+}
+
+func (m *MemoryDAO) FindEntries(context.Context) ([]Entry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Entry(nil), m.entries...), nil
+}
+
+func (m *MemoryDAO) RescheduleEntry(_ context.Context, ID primitive.ObjectID, attempts int, nextAttempt time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.entries {
+		if m.entries[i].ID == ID {
+			m.entries[i].Attempts = attempts
+			m.entries[i].NextAttempt = nextAttempt
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDAO) RemoveEntry(_ context.Context, ID primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.entries {
+		if m.entries[i].ID == ID {
+			m.entries = append(m.entries[:i], m.entries[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDAO) AddDeadLetter(_ context.Context, message transport.Message, reason string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deadLetters = append(m.deadLetters, DeadLetter{ID: primitive.NewObjectID(), Message: message, Reason: reason, Time: m.clock.Now()})
+	return nil
+}
+
+func (m *MemoryDAO) FindDeadLetters(context.Context) ([]DeadLetter, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]DeadLetter(nil), m.deadLetters...), nil
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/transport"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Entry is a message waiting for delivery. Entries are delivered in the order of their IDs
+type Entry struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Message     transport.Message  `bson:"message"`
+	Attempts    int                `bson:"attempts"`
+	NextAttempt time.Time          `bson:"nextAttempt"`
+}
+
+var EntryBSON = struct {
+	ID          string
+	Message     string
+	Attempts    string
+	NextAttempt string
+}{"_id", "message", "attempts", "nextAttempt"}
+
+// DeadLetter is a message that will not be delivered, for example because the user blocked the bot
+type DeadLetter struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	Message transport.Message  `bson:"message"`
+	Reason  string             `bson:"reason"`
+	Time    time.Time          `bson:"time"`
+}
+
+var DeadLetterBSON = struct {
+	ID      string
+	Message string
+	Reason  string
+	Time    string
+}{"_id", "message", "reason", "time"}
+
+type DAO struct {
+	entries     *mongo.Collection
+	deadLetters *mongo.Collection
+	clock       clock.Clock
+}
+
+func NewDAO(client *mongo.Client, database string, clock clock.Clock) *DAO {
+	return &DAO{
+		entries:     client.Database(database).Collection("outbox"),
+		deadLetters: client.Database(database).Collection("deadLetters"),
+		clock:       clock,
+	}
+}
+
+// AddEntry saves a message to be delivered right away
+func (m *DAO) AddEntry(ctx context.Context, message transport.Message) error {
+	entry := Entry{ID: primitive.NewObjectID(), Message: message, NextAttempt: m.clock.Now()}
+	_, err := m.entries.InsertOne(ctx, entry)
+	if err != nil {
+		return errorx.Decorate(err, "can't save message to %d", message.ChatID)
+	}
+	return nil
+}
+
+// FindEntries returns all undelivered messages in the order they were added
+func (m *DAO) FindEntries(ctx context.Context) ([]Entry, error) {
+	cursor, err := m.entries.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{EntryBSON.ID: 1}))
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	err = cursor.All(ctx, &entries)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode outbox entries")
+	}
+	return entries, nil
+}
+
+func (m *DAO) RescheduleEntry(ctx context.Context, ID primitive.ObjectID, attempts int, nextAttempt time.Time) error {
+	_, err := m.entries.UpdateOne(ctx, bson.M{EntryBSON.ID: ID}, bson.M{"$set": bson.M{
+		EntryBSON.Attempts:    attempts,
+		EntryBSON.NextAttempt: nextAttempt,
+	}})
+	return err
+}
+
+func (m *DAO) RemoveEntry(ctx context.Context, ID primitive.ObjectID) error {
+	_, err := m.entries.DeleteOne(ctx, bson.M{EntryBSON.ID: ID})
+	return err
+}
+
+func (m *DAO) AddDeadLetter(ctx context.Context, message transport.Message, reason string) error {
+	deadLetter := DeadLetter{ID: primitive.NewObjectID(), Message: message, Reason: reason, Time: m.clock.Now()}
+	_, err := m.deadLetters.InsertOne(ctx, deadLetter)
+	return err
+}
+
+// FindDeadLetters returns the messages that were given up on, oldest first
+func (m *DAO) FindDeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	cursor, err := m.deadLetters.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{DeadLetterBSON.ID: 1}))
+	if err != nil {
+		return nil, err
+	}
+	var deadLetters []DeadLetter
+	err = cursor.All(ctx, &deadLetters)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode dead letters")
+	}
+	return deadLetters, nil
+}
@@ -0,0 +1,315 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/config"
+	"yandexschooldating/outbox"
+	"yandexschooldating/transport"
+	"yandexschooldating/util"
+
+	"github.com/stretchr/testify/require"
+)
+
+type store interface {
+	outbox.Store
+	FindDeadLetters(ctx context.Context) ([]outbox.DeadLetter, error)
+}
+
+// testStore checks the behaviour that every store implementation must share
+func testStore(t *testing.T, ctx context.Context, store store, clock *clock.Fake) {
+	entries, err := store.FindEntries(ctx)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	keyboard := transport.NewInlineKeyboard([]transport.Button{{Text: "06.07 19:00", Data: "time:06.07 19:00"}})
+	require.NoError(t, store.AddEntry(ctx, transport.Message{ChatID: 1, Text: "first", Keyboard: keyboard, ReplyToMessageID: 5}))
+	require.NoError(t, store.AddEntry(ctx, transport.Message{ChatID: 2, Text: "second"}))
+	require.NoError(t, store.AddEntry(ctx, transport.Message{ChatID: 1, Text: "third", EditMessageID: 7}))
+
+	entries, err = store.FindEntries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, transport.Message{ChatID: 1, Text: "first", Keyboard: keyboard, ReplyToMessageID: 5}, entries[0].Message)
+	require.Equal(t, "second", entries[1].Message.Text)
+	require.Equal(t, transport.Message{ChatID: 1, Text: "third", EditMessageID: 7}, entries[2].Message)
+	require.Zero(t, entries[0].Attempts)
+	require.True(t, clock.Now().Equal(entries[0].NextAttempt))
+
+	nextAttempt := clock.Now().Add(time.Minute)
+	require.NoError(t, store.RescheduleEntry(ctx, entries[1].ID, 2, nextAttempt))
+	require.NoError(t, store.RemoveEntry(ctx, entries[0].ID))
+	entries, err = store.FindEntries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "second", entries[0].Message.Text)
+	require.Equal(t, 2, entries[0].Attempts)
+	require.True(t, nextAttempt.Equal(entries[0].NextAttempt))
+	require.Equal(t, "third", entries[1].Message.Text)
+
+	deadLetters, err := store.FindDeadLetters(ctx)
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+	require.NoError(t, store.AddDeadLetter(ctx, entries[0].Message, "blocked"))
+	deadLetters, err = store.FindDeadLetters(ctx)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, entries[0].Message, deadLetters[0].Message)
+	require.Equal(t, "blocked", deadLetters[0].Reason)
+	require.True(t, clock.Now().Equal(deadLetters[0].Time))
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_outbox"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	clock := &clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	testStore(t, ctx, outbox.NewDAO(client, testDatabase, clock), clock)
+}
+
+func TestMemoryDAO(t *testing.T) {
+	clock := &clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	testStore(t, context.Background(), outbox.NewMemoryDAO(clock), clock)
+}
+
+func texts(messages []transport.Message) []string {
+	var result []string
+	for _, message := range messages {
+		result = append(result, fmt.Sprintf("%d:%s", message.ChatID, message.Text))
+	}
+	return result
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+
+	t.Run("Messages are delivered in order within the chat limit", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(clock), nil, clock)
+
+		for i := 1; i <= 5; i++ {
+			require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: fmt.Sprint(i)}))
+		}
+		require.NoError(t, queue.Send(transport.Message{ChatID: 2, Text: "other"}))
+		require.Empty(t, messenger.TakeSent())
+
+		next, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:1", "1:2", "1:3", "2:other"}, texts(messenger.TakeSent()))
+		require.Equal(t, start.Add(time.Second), next)
+
+		clock.Current = next
+		next, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:4"}, texts(messenger.TakeSent()))
+		require.Equal(t, start.Add(2*time.Second), next)
+
+		clock.Current = next
+		next, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:5"}, texts(messenger.TakeSent()))
+		require.True(t, next.IsZero())
+	})
+
+	t.Run("Global limit", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(clock), nil, clock)
+
+		for i := 0; i < config.GlobalMessagesPerSecond+10; i++ {
+			require.NoError(t, queue.Send(transport.Message{ChatID: int64(i + 1), Text: "match"}))
+		}
+		next, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Len(t, messenger.TakeSent(), config.GlobalMessagesPerSecond)
+		require.True(t, next.After(start))
+
+		clock.Current = start.Add(time.Second)
+		next, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Len(t, messenger.TakeSent(), 10)
+		require.True(t, next.IsZero())
+	})
+
+	t.Run("Retry after", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(clock), nil, clock)
+
+		messenger.FailNext(1, transport.RateLimited.New("too many requests").WithProperty(transport.RetryAfter, 5*time.Second))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 2, Text: "second"}))
+
+		next, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Empty(t, messenger.TakeSent())
+		require.Equal(t, start.Add(5*time.Second), next)
+
+		clock.Current = start.Add(4 * time.Second)
+		_, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Empty(t, messenger.TakeSent())
+
+		clock.Current = next
+		next, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:first", "2:second"}, texts(messenger.TakeSent()))
+		require.True(t, next.IsZero())
+	})
+
+	t.Run("Exponential backoff does not delay other chats", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(clock), nil, clock)
+
+		messenger.FailNext(1, errors.New("timeout"), errors.New("timeout"))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "second"}))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 2, Text: "other"}))
+
+		next, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"2:other"}, texts(messenger.TakeSent()))
+		require.Equal(t, start.Add(config.SendMessageInitialBackoff), next)
+
+		clock.Current = next
+		next, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Empty(t, messenger.TakeSent())
+		require.Equal(t, clock.Now().Add(2*config.SendMessageInitialBackoff), next)
+
+		clock.Current = next
+		_, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:first", "1:second"}, texts(messenger.TakeSent()))
+	})
+
+	t.Run("Blocked chats go to dead letters", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		dao := outbox.NewMemoryDAO(clock)
+		queue := outbox.NewQueue(messenger, dao, nil, clock)
+
+		messenger.FailNext(1, transport.Blocked.New("bot was blocked by the user"))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "second"}))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 2, Text: "other"}))
+
+		next, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.True(t, next.IsZero())
+		require.Equal(t, []string{"2:other"}, texts(messenger.TakeSent()))
+
+		entries, err := dao.FindEntries(ctx)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		deadLetters, err := dao.FindDeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 2)
+		require.Equal(t, "first", deadLetters[0].Message.Text)
+		require.Equal(t, "second", deadLetters[1].Message.Text)
+		require.Equal(t, int64(1), <-queue.Unreachable())
+		require.Len(t, queue.Unreachable(), 0)
+	})
+
+	t.Run("Missing chats go to dead letters", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		dao := outbox.NewMemoryDAO(clock)
+		queue := outbox.NewQueue(messenger, dao, nil, clock)
+
+		messenger.FailNext(1, transport.ChatNotFound.New("chat not found"))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		_, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		deadLetters, err := dao.FindDeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+		require.Equal(t, int64(1), <-queue.Unreachable())
+	})
+
+	t.Run("Transient errors are retried", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(clock), nil, clock)
+
+		messenger.FailNext(1, transport.Transient.New("connection reset"))
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		next, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Empty(t, messenger.TakeSent())
+		clock.Current = next
+		_, err = queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:first"}, texts(messenger.TakeSent()))
+		require.Len(t, queue.Unreachable(), 0)
+	})
+
+	t.Run("Messages are given up after max attempts", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		dao := outbox.NewMemoryDAO(clock)
+		queue := outbox.NewQueue(messenger, dao, nil, clock)
+
+		for i := 0; i < config.SendMessageMaxAttempts; i++ {
+			messenger.FailNext(1, errors.New("bad request"))
+		}
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		for i := 0; i < config.SendMessageMaxAttempts; i++ {
+			next, err := queue.Deliver(ctx)
+			require.NoError(t, err)
+			if i < config.SendMessageMaxAttempts-1 {
+				require.False(t, next.IsZero())
+				require.LessOrEqual(t, next.Sub(clock.Now()), config.SendMessageMaxBackoff)
+				clock.Current = next
+			} else {
+				require.True(t, next.IsZero())
+			}
+		}
+		require.Empty(t, messenger.TakeSent())
+		deadLetters, err := dao.FindDeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+		require.Equal(t, "bad request", deadLetters[0].Reason)
+	})
+
+	t.Run("Undelivered messages survive a restart", func(t *testing.T) {
+		clock := &clock.Fake{Current: start}
+		dao := outbox.NewMemoryDAO(clock)
+		queue := outbox.NewQueue(transport.NewMemory(), dao, nil, clock)
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+
+		messenger := transport.NewMemory()
+		queue = outbox.NewQueue(messenger, dao, nil, clock)
+		_, err := queue.Deliver(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1:first"}, texts(messenger.TakeSent()))
+	})
+
+	t.Run("Run delivers in the background", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		clock := &clock.Fake{Current: start}
+		messenger := transport.NewMemory()
+		queue := outbox.NewQueue(messenger, outbox.NewMemoryDAO(clock), nil, clock)
+		go queue.Run(ctx)
+
+		require.NoError(t, queue.Send(transport.Message{ChatID: 1, Text: "first"}))
+		require.Eventually(t, func() bool {
+			return len(messenger.TakeSent()) == 1
+		}, time.Second, time.Millisecond)
+	})
+}
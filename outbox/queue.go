@@ -0,0 +1,256 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/config"
+	"yandexschooldating/reminder"
+	"yandexschooldating/transport"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Store interface {
+	AddEntry(ctx context.Context, message transport.Message) error
+	FindEntries(ctx context.Context) ([]Entry, error)
+	RescheduleEntry(ctx context.Context, ID primitive.ObjectID, attempts int, nextAttempt time.Time) error
+	RemoveEntry(ctx context.Context, ID primitive.ObjectID) error
+	AddDeadLetter(ctx context.Context, message transport.Message, reason string) error
+}
+
+// ReminderStore records the outcome of the delivery of messages with transport.Message.ReminderID
+type ReminderStore interface {
+	UpdateStatus(ctx context.Context, ID primitive.ObjectID, status reminder.Status, reason string) error
+}
+
+// globalKey is the limiter key for the limits of the whole bot
+const globalKey = 0
+
+// Queue is a transport that saves outgoing messages and delivers them in the background within the rate limits.
+// Messages to a chat are delivered in order, a failing chat does not delay the others
+type Queue struct {
+	transport   transport.Transport
+	store       Store
+	reminders   ReminderStore
+	clock       clock.Clock
+	globalLimit *limiter
+	chatLimit   *limiter
+	wake        chan struct{}
+	unreachable chan int64
+}
+
+// NewQueue returns a queue delivering messages with the transport. Reminders may be nil if statuses of reminders
+// are not tracked
+func NewQueue(transport transport.Transport, store Store, reminders ReminderStore, clock clock.Clock) *Queue {
+	return &Queue{
+		transport:   transport,
+		store:       store,
+		reminders:   reminders,
+		clock:       clock,
+		globalLimit: newLimiter(config.GlobalMessagesPerSecond, config.GlobalMessagesPerSecond),
+		chatLimit:   newLimiter(config.ChatMessagesPerSecond, config.ChatMessagesBurst),
+		wake:        make(chan struct{}, 1),
+		unreachable: make(chan int64, 100),
+	}
+}
+
+// Unreachable receives the chats that blocked the bot or do not exist anymore, once per delivery attempt
+func (q *Queue) Unreachable() <-chan int64 {
+	return q.unreachable
+}
+
+func (q *Queue) Updates() <-chan transport.Update {
+	return q.transport.Updates()
+}
+
+// AnswerCallback is not queued, the button shows progress until it is answered
+func (q *Queue) AnswerCallback(callbackID string, text string) error {
+	return q.transport.AnswerCallback(callbackID, text)
+}
+
+// RecordsReminderDelivery tells that the queue updates the status of the reminders it delivers
+func (q *Queue) RecordsReminderDelivery() bool {
+	return q.reminders != nil
+}
+
+// Send saves the message for delivery by Run
+func (q *Queue) Send(message transport.Message) error {
+	err := q.store.AddEntry(context.Background(), message)
+	if err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers messages until the context is done
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		next, err := q.Deliver(ctx)
+		if err != nil {
+			log.Printf("can't deliver messages %+v", err)
+			next = q.clock.Now().Add(config.SendMessageInitialBackoff)
+		}
+		var timeout <-chan time.Time
+		var timer *clock.Timer
+		if !next.IsZero() {
+			timer = q.clock.NewTimer(next.Sub(q.clock.Now()))
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Deliver sends the messages that are due and allowed by the rate limits.
+// It returns the time of the next attempt or zero time if nothing is left
+func (q *Queue) Deliver(ctx context.Context) (time.Time, error) {
+	entries, err := q.store.FindEntries(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := q.clock.Now()
+	q.globalLimit.forgetIdle(now)
+	q.chatLimit.forgetIdle(now)
+
+	var next time.Time
+	postpone := func(at time.Time) {
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	waiting := make(map[int64]bool)
+	unreachable := make(map[int64]bool)
+	for _, entry := range entries {
+		chatID := entry.Message.ChatID
+		if unreachable[chatID] {
+			err = q.deadLetter(ctx, entry, "chat is unreachable")
+			if err != nil {
+				return time.Time{}, err
+			}
+			continue
+		}
+		if waiting[chatID] {
+			continue
+		}
+		at := latest(entry.NextAttempt, q.chatLimit.availableAt(chatID, now), q.globalLimit.availableAt(globalKey, now))
+		if at.After(now) {
+			waiting[chatID] = true
+			postpone(at)
+			continue
+		}
+
+		q.chatLimit.take(chatID, now)
+		q.globalLimit.take(globalKey, now)
+		sendErr := q.transport.Send(entry.Message)
+		switch {
+		case sendErr == nil:
+			err = q.store.RemoveEntry(ctx, entry.ID)
+			q.recordReminder(ctx, entry, reminder.Sent, "")
+		case transport.Unreachable(sendErr):
+			log.Printf("chat %d is unreachable, giving up on its messages %+v", chatID, sendErr)
+			unreachable[chatID] = true
+			err = q.deadLetter(ctx, entry, sendErr.Error())
+			if err == nil {
+				err = q.notifyUnreachable(ctx, chatID)
+			}
+		case errorx.IsOfType(sendErr, transport.RateLimited):
+			retryAfter := retryDelay(sendErr, entry.Attempts+1)
+			log.Printf("rate limited sending to %d, retrying after %s", chatID, retryAfter)
+			q.globalLimit.pause(globalKey, now.Add(retryAfter))
+			waiting[chatID] = true
+			postpone(now.Add(retryAfter))
+			err = q.store.RescheduleEntry(ctx, entry.ID, entry.Attempts+1, now.Add(retryAfter))
+		case entry.Attempts+1 >= config.SendMessageMaxAttempts:
+			log.Printf("giving up sending to %d after %d attempts %+v", chatID, entry.Attempts+1, sendErr)
+			err = q.deadLetter(ctx, entry, sendErr.Error())
+		default:
+			backoff := retryDelay(sendErr, entry.Attempts+1)
+			log.Printf("error sending to %d, retrying after %s %+v", chatID, backoff, sendErr)
+			waiting[chatID] = true
+			postpone(now.Add(backoff))
+			err = q.store.RescheduleEntry(ctx, entry.ID, entry.Attempts+1, now.Add(backoff))
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return next, nil
+}
+
+func (q *Queue) notifyUnreachable(ctx context.Context, chatID int64) error {
+	select {
+	case q.unreachable <- chatID:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) deadLetter(ctx context.Context, entry Entry, reason string) error {
+	err := q.store.AddDeadLetter(ctx, entry.Message, reason)
+	if err != nil {
+		return err
+	}
+	err = q.store.RemoveEntry(ctx, entry.ID)
+	if err != nil {
+		return err
+	}
+	q.recordReminder(ctx, entry, reminder.Failed, reason)
+	return nil
+}
+
+// recordReminder updates the status of the reminder delivered by the entry. Errors are only logged,
+// the delivery itself is already done
+func (q *Queue) recordReminder(ctx context.Context, entry Entry, status reminder.Status, reason string) {
+	if q.reminders == nil || entry.Message.ReminderID.IsZero() {
+		return
+	}
+	err := q.reminders.UpdateStatus(ctx, entry.Message.ReminderID, status, reason)
+	if err != nil {
+		log.Printf("can't record delivery of reminder %s %+v", entry.Message.ReminderID.Hex(), err)
+	}
+}
+
+// retryDelay returns the delay requested by the messenger if any,
+// otherwise an exponential backoff for the number of failed attempts
+func retryDelay(err error, attempts int) time.Duration {
+	retryAfter, ok := transport.RetryAfterOf(err)
+	if ok {
+		return retryAfter
+	}
+	backoff := config.SendMessageInitialBackoff
+	for i := 1; i < attempts && backoff < config.SendMessageMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > config.SendMessageMaxBackoff {
+		backoff = config.SendMessageMaxBackoff
+	}
+	return backoff
+}
+
+func latest(first time.Time, others ...time.Time) time.Time {
+	result := first
+	for _, other := range others {
+		if other.After(result) {
+			result = other
+		}
+	}
+	return result
+}
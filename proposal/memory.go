@@ -0,0 +1,48 @@
+package proposal
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps proposals in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex     sync.Mutex
+	proposals map[primitive.ObjectID]Proposal
+}
+
+func NewMemoryDAO() *MemoryDAO {
+	return &MemoryDAO{proposals: make(map[primitive.ObjectID]Proposal)}
+}
+
+func copyProposal(proposal Proposal) Proposal {
+	proposal.Times = append(proposal.Times[:0:0], proposal.Times...)
+	return proposal
+}
+
+func (m *MemoryDAO) FindProposal(_ context.Context, matchID primitive.ObjectID) (*Proposal, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	proposal, ok := m.proposals[matchID]
+	if !ok {
+		return nil, nil
+	}
+	proposal = copyProposal(proposal)
+	return &proposal, nil
+}
+
+func (m *MemoryDAO) SaveProposal(_ context.Context, proposal Proposal) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.proposals[proposal.MatchID] = copyProposal(proposal)
+	return nil
+}
+
+func (m *MemoryDAO) DeleteProposal(_ context.Context, matchID primitive.ObjectID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.proposals, matchID)
+	return nil
+}
@@ -0,0 +1,79 @@
+package proposal
+
+import (
+	"context"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Proposal holds the meeting times offered by one participant of a match and not accepted yet.
+// A match has at most one proposal, a counter-proposal replaces it
+type Proposal struct {
+	MatchID    primitive.ObjectID `bson:"_id"`
+	ProposerID int                `bson:"proposerId"`
+	Times      []time.Time        `bson:"times"`
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+var ProposalBSON = struct {
+	MatchID    string
+	ProposerID string
+	Times      string
+}{"_id", "proposerId", "times"}
+
+// Has tells whether the time is one of the proposed times
+func (p *Proposal) Has(t time.Time) bool {
+	for _, proposed := range p.Times {
+		if proposed.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type DAO struct {
+	proposals *mongo.Collection
+}
+
+func NewDAO(client *mongo.Client, database string) *DAO {
+	return &DAO{proposals: client.Database(database).Collection("proposals")}
+}
+
+func (m *DAO) FindProposal(ctx context.Context, matchID primitive.ObjectID) (*Proposal, error) {
+	result := m.proposals.FindOne(ctx, bson.M{ProposalBSON.MatchID: matchID})
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find proposal for match %s", matchID.Hex())
+	}
+	var proposal Proposal
+	err := result.Decode(&proposal)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode proposal")
+	}
+	return &proposal, nil
+}
+
+// SaveProposal replaces the proposal of the match
+func (m *DAO) SaveProposal(ctx context.Context, proposal Proposal) error {
+	_, err := m.proposals.ReplaceOne(ctx, bson.M{ProposalBSON.MatchID: proposal.MatchID}, proposal, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errorx.Decorate(err, "can't save proposal for match %s", proposal.MatchID.Hex())
+	}
+	return nil
+}
+
+// DeleteProposal does nothing if the match has no proposal
+func (m *DAO) DeleteProposal(ctx context.Context, matchID primitive.ObjectID) error {
+	_, err := m.proposals.DeleteOne(ctx, bson.M{ProposalBSON.MatchID: matchID})
+	if err != nil {
+		return errorx.Decorate(err, "can't delete proposal for match %s", matchID.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package proposal_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"yandexschooldating/coffeebot"
+	"yandexschooldating/config"
+	"yandexschooldating/proposal"
+	"yandexschooldating/util"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testStore checks the behaviour that every proposal store implementation must share
+func testStore(t *testing.T, ctx context.Context, store coffeebot.ProposalStore) {
+	matchID := primitive.NewObjectID()
+	found, err := store.FindProposal(ctx, matchID)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	evening := time.Date(2020, 7, 6, 16, 0, 0, 0, time.UTC)
+	require.NoError(t, store.SaveProposal(ctx, proposal.Proposal{MatchID: matchID, ProposerID: 1, Times: []time.Time{evening}}))
+	require.NoError(t, store.SaveProposal(ctx, proposal.Proposal{MatchID: primitive.NewObjectID(), ProposerID: 3, Times: []time.Time{evening}}))
+	found, err = store.FindProposal(ctx, matchID)
+	require.NoError(t, err)
+	require.Equal(t, 1, found.ProposerID)
+	require.True(t, found.Has(evening))
+	require.False(t, found.Has(evening.Add(time.Hour)))
+
+	// a counter-proposal replaces the proposal
+	found.ProposerID = 2
+	found.Times = append(found.Times, evening.Add(time.Hour))
+	require.NoError(t, store.SaveProposal(ctx, *found))
+	found, err = store.FindProposal(ctx, matchID)
+	require.NoError(t, err)
+	require.Equal(t, 2, found.ProposerID)
+	require.Len(t, found.Times, 2)
+	require.True(t, found.Has(evening.Add(time.Hour)))
+
+	require.NoError(t, store.DeleteProposal(ctx, matchID))
+	require.NoError(t, store.DeleteProposal(ctx, matchID))
+	found, err = store.FindProposal(ctx, matchID)
+	require.NoError(t, err)
+	require.Nil(t, found)
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_proposals"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	dao := proposal.NewDAO(client, testDatabase)
+	testStore(t, ctx, dao)
+
+	err = client.Disconnect(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = dao.FindProposal(ctx, primitive.NewObjectID())
+	require.Error(t, err)
+	require.Error(t, dao.SaveProposal(ctx, proposal.Proposal{MatchID: primitive.NewObjectID()}))
+	require.Error(t, dao.DeleteProposal(ctx, primitive.NewObjectID()))
+}
+
+func TestMemoryDAO(t *testing.T) {
+	testStore(t, context.Background(), proposal.NewMemoryDAO())
+}
@@ -0,0 +1,122 @@
+package reminder
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"yandexschooldating/clock"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type memoryStorage struct {
+	mutex     sync.Mutex
+	reminders []Reminder
+}
+
+// MemoryDAO has the same semantics as DAO but keeps reminders in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	storage   *memoryStorage
+	scheduler *scheduler
+	clock     clock.Clock
+}
+
+func NewMemoryDAO(queue chan<- Reminder, clock clock.Clock) *MemoryDAO {
+	return &MemoryDAO{storage: &memoryStorage{}, scheduler: newScheduler(queue, clock), clock: clock}
+}
+
+// Restarted returns a DAO over the same reminders with another queue and clock, like the DAO of a restarted bot
+func (m *MemoryDAO) Restarted(queue chan<- Reminder, clock clock.Clock) *MemoryDAO {
+	return &MemoryDAO{storage: m.storage, scheduler: newScheduler(queue, clock), clock: clock}
+}
+
+func (m *MemoryDAO) AddReminder(ctx context.Context, matchID primitive.ObjectID, kind Kind, reminderTime time.Time, chatID int64, text string) error {
+	return m.EnsureReminder(ctx, primitive.NewObjectID(), matchID, kind, reminderTime, chatID, text)
+}
+
+// EnsureReminder adds the reminder unless a reminder with the ID exists, so that adding can be repeated
+func (m *MemoryDAO) EnsureReminder(_ context.Context, ID primitive.ObjectID, matchID primitive.ObjectID, kind Kind, reminderTime time.Time, chatID int64, text string) error {
+	reminder := newReminder(ID, matchID, kind, reminderTime, chatID, text)
+	seconds := reminder.UnixTime - m.clock.Now().Unix()
+	if seconds < 0 {
+		return errorx.IllegalState.New("reminders must be in the future")
+	}
+	log.Printf("saving reminder %+v", reminder)
+	m.storage.mutex.Lock()
+	defer m.storage.mutex.Unlock()
+	for _, stored := range m.storage.reminders {
+		if stored.ID == ID {
+			return nil
+		}
+	}
+	m.storage.reminders = append(m.storage.reminders, reminder)
+	m.scheduler.start(reminder, seconds)
+	return nil
+}
+
+// CancelReminders deletes the pending reminders of the match, of all kinds if none are given
+func (m *MemoryDAO) CancelReminders(_ context.Context, matchID primitive.ObjectID, kinds ...Kind) error {
+	m.scheduler.cancel(matchID, kinds)
+	m.storage.mutex.Lock()
+	defer m.storage.mutex.Unlock()
+	var kept []Reminder
+	for _, reminder := range m.storage.reminders {
+		if reminder.MatchID != matchID || !hasKind(kinds, reminder.Kind) || reminder.Status != Pending {
+			kept = append(kept, reminder)
+		}
+	}
+	m.storage.reminders = kept
+	return nil
+}
+
+// UpdateStatus records the outcome of the delivery of the reminder, reason is empty unless it failed
+func (m *MemoryDAO) UpdateStatus(_ context.Context, ID primitive.ObjectID, status Status, reason string) error {
+	m.storage.mutex.Lock()
+	defer m.storage.mutex.Unlock()
+	for i := range m.storage.reminders {
+		if m.storage.reminders[i].ID == ID {
+			m.storage.reminders[i].Status = status
+			m.storage.reminders[i].Error = reason
+			return nil
+		}
+	}
+	return errorx.IllegalArgument.New("reminder %s not found", ID.Hex())
+}
+
+// FindFailed returns failed and missed reminders due since the given time, the earliest first
+func (m *MemoryDAO) FindFailed(_ context.Context, since time.Time) ([]Reminder, error) {
+	m.storage.mutex.Lock()
+	defer m.storage.mutex.Unlock()
+	var result []Reminder
+	for _, reminder := range m.storage.reminders {
+		if (reminder.Status == Failed || reminder.Status == Missed) && reminder.UnixTime >= since.Unix() {
+			result = append(result, reminder)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].UnixTime < result[j].UnixTime })
+	return result, nil
+}
+
+// PopulateReminderQueue restarts the timers of pending reminders. Reminders due less than
+// config.ReminderCatchUpWindow ago are delivered right away, older ones are marked as missed
+func (m *MemoryDAO) PopulateReminderQueue(context.Context) error {
+	currentTime := m.clock.Now().Unix()
+	m.storage.mutex.Lock()
+	defer m.storage.mutex.Unlock()
+	for i, reminder := range m.storage.reminders {
+		if reminder.Status != Pending {
+			continue
+		}
+		seconds, ok := restoredDelay(reminder, currentTime)
+		if !ok {
+			m.storage.reminders[i].Status = Missed
+			continue
+		}
+		m.scheduler.start(reminder, seconds)
+	}
+	return nil
+}
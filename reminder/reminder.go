@@ -6,79 +6,231 @@ import (
 	"time"
 
 	"yandexschooldating/clock"
+	"yandexschooldating/config"
 
 	"github.com/joomcode/errorx"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kind tells apart reminders of the same match, so that rescheduling a meeting keeps the match announcement
+type Kind string
+
+const (
+	// Announcement tells a user about their new match
+	Announcement Kind = "announcement"
+	// Meeting reminds about the agreed meeting time
+	Meeting Kind = "meeting"
+	// Feedback asks a participant how the meeting went
+	Feedback Kind = "feedback"
+)
+
+// Status tracks the delivery of a reminder
+type Status string
+
+const (
+	Pending Status = "pending"
+	// Queued reminders wait for delivery in the outbox, which records whether they were sent
+	Queued Status = "queued"
+	// Sent reminders are accepted by the messenger
+	Sent   Status = "sent"
+	Failed Status = "failed"
+	// Missed reminders were due while the bot was down for longer than config.ReminderCatchUpWindow
+	Missed Status = "missed"
 )
 
 type Reminder struct {
-	UnixTime int64  `bson:"unixTime"`
-	ChatID   int64  `bson:"chatId"`
-	Text     string `bson:"text"`
+	ID primitive.ObjectID `bson:"_id"`
+	// MatchID is zero for reminders not related to a match
+	MatchID  primitive.ObjectID `bson:"matchId"`
+	Kind     Kind               `bson:"kind"`
+	UnixTime int64              `bson:"unixTime"`
+	ChatID   int64              `bson:"chatId"`
+	Text     string             `bson:"text"`
+	Status   Status             `bson:"status"`
+	// Error is the reason of the last failure
+	Error string `bson:"error,omitempty"`
 }
 
 //goland:noinspection GoNameStartsWithPackageName
 var ReminderBSON = struct {
+	ID       string
+	MatchID  string
+	Kind     string
 	UnixTime string
 	ChatID   string
 	Text     string
-}{"unixTime", "chatId", "text"}
+	Status   string
+	Error    string
+}{"_id", "matchId", "kind", "unixTime", "chatId", "text", "status", "error"}
 
 type DAO struct {
 	reminders *mongo.Collection
-	queue     chan<- Reminder
+	scheduler *scheduler
 	clock     clock.Clock
 }
 
 func NewDAO(client *mongo.Client, database string, queue chan<- Reminder, clock clock.Clock) *DAO {
 	return &DAO{
 		reminders: client.Database(database).Collection("reminders"),
-		queue:     queue,
+		scheduler: newScheduler(queue, clock),
 		clock:     clock,
 	}
 }
 
-func (m *DAO) AddReminder(ctx context.Context, reminderTime time.Time, chatID int64, text string) error {
-	reminder := Reminder{
+func newReminder(ID primitive.ObjectID, matchID primitive.ObjectID, kind Kind, reminderTime time.Time, chatID int64, text string) Reminder {
+	return Reminder{
+		ID:       ID,
+		MatchID:  matchID,
+		Kind:     kind,
 		UnixTime: reminderTime.Unix(),
 		ChatID:   chatID,
 		Text:     text,
+		Status:   Pending,
 	}
+}
+
+func (m *DAO) AddReminder(ctx context.Context, matchID primitive.ObjectID, kind Kind, reminderTime time.Time, chatID int64, text string) error {
+	return m.EnsureReminder(ctx, primitive.NewObjectID(), matchID, kind, reminderTime, chatID, text)
+}
+
+// EnsureReminder adds the reminder unless a reminder with the ID exists, so that adding can be repeated
+func (m *DAO) EnsureReminder(ctx context.Context, ID primitive.ObjectID, matchID primitive.ObjectID, kind Kind, reminderTime time.Time, chatID int64, text string) error {
+	reminder := newReminder(ID, matchID, kind, reminderTime, chatID, text)
 	seconds := reminder.UnixTime - m.clock.Now().Unix()
 	if seconds < 0 {
 		return errorx.IllegalState.New("reminders must be in the future")
 	}
-	m.startTimer(reminder, seconds)
 	log.Printf("saving reminder %+v", reminder)
 	_, err := m.reminders.InsertOne(ctx, reminder)
-	return err
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return errorx.Decorate(err, "can't save reminder")
+	}
+	m.scheduler.start(reminder, seconds)
+	return nil
 }
 
+// CancelReminders deletes the pending reminders of the match, of all kinds if none are given
+func (m *DAO) CancelReminders(ctx context.Context, matchID primitive.ObjectID, kinds ...Kind) error {
+	m.scheduler.cancel(matchID, kinds)
+	filter := bson.M{ReminderBSON.MatchID: matchID, ReminderBSON.Status: Pending}
+	if len(kinds) > 0 {
+		filter[ReminderBSON.Kind] = bson.M{"$in": kinds}
+	}
+	_, err := m.reminders.DeleteMany(ctx, filter)
+	if err != nil {
+		return errorx.Decorate(err, "can't cancel reminders for match %s", matchID.Hex())
+	}
+	return nil
+}
+
+// UpdateStatus records the outcome of the delivery of the reminder, reason is empty unless it failed
+func (m *DAO) UpdateStatus(ctx context.Context, ID primitive.ObjectID, status Status, reason string) error {
+	result, err := m.reminders.UpdateOne(ctx, bson.M{ReminderBSON.ID: ID}, bson.M{"$set": bson.M{
+		ReminderBSON.Status: status,
+		ReminderBSON.Error:  reason,
+	}})
+	if err != nil {
+		return errorx.Decorate(err, "can't update status of reminder %s", ID.Hex())
+	}
+	if result.MatchedCount == 0 {
+		return errorx.IllegalArgument.New("reminder %s not found", ID.Hex())
+	}
+	return nil
+}
+
+// FindFailed returns failed and missed reminders due since the given time, the earliest first
+func (m *DAO) FindFailed(ctx context.Context, since time.Time) ([]Reminder, error) {
+	cursor, err := m.reminders.Find(ctx, bson.M{
+		ReminderBSON.Status:   bson.M{"$in": []Status{Failed, Missed}},
+		ReminderBSON.UnixTime: bson.M{"$gte": since.Unix()},
+	}, options.Find().SetSort(bson.M{ReminderBSON.UnixTime: 1}))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error finding failed reminders")
+	}
+	var result []Reminder
+	for cursor.Next(ctx) {
+		var reminder Reminder
+		err = cursor.Decode(&reminder)
+		if err != nil {
+			return nil, errorx.Decorate(err, "can't decode reminder")
+		}
+		result = append(result, reminder)
+	}
+	return result, nil
+}
+
+// PopulateReminderQueue restarts the timers of pending reminders. Reminders due less than
+// config.ReminderCatchUpWindow ago are delivered right away, older ones are marked as missed
 func (m *DAO) PopulateReminderQueue(ctx context.Context) error {
 	currentTime := m.clock.Now().Unix()
-	cursor, err := m.reminders.Find(ctx, bson.M{ReminderBSON.UnixTime: bson.M{"$gt": currentTime}})
+	err := m.migrateStatuses(ctx, currentTime)
+	if err != nil {
+		return err
+	}
+	cursor, err := m.reminders.Find(ctx, bson.M{ReminderBSON.Status: Pending})
 	if err != nil {
 		return err
 	}
 
+	var missed []primitive.ObjectID
 	for cursor.Next(ctx) {
 		var reminder Reminder
 		err = cursor.Decode(&reminder)
-		log.Printf("restoring reminder %+v", reminder)
 		if err != nil {
 			return errorx.Decorate(err, "can't decode reminder")
 		}
-		seconds := reminder.UnixTime - currentTime
-		if seconds <= 0 {
-			log.Printf("requested timer duration < 0, reminder %+v is lost", reminder)
+		seconds, ok := restoredDelay(reminder, currentTime)
+		if !ok {
+			missed = append(missed, reminder.ID)
 			continue
 		}
-		m.startTimer(reminder, seconds)
+		m.scheduler.start(reminder, seconds)
+	}
+	if len(missed) == 0 {
+		return nil
+	}
+	_, err = m.reminders.UpdateMany(ctx, bson.M{ReminderBSON.ID: bson.M{"$in": missed}}, bson.M{"$set": bson.M{ReminderBSON.Status: Missed}})
+	if err != nil {
+		return errorx.Decorate(err, "can't mark missed reminders")
 	}
 	return nil
 }
 
-func (m *DAO) startTimer(reminder Reminder, seconds int64) {
-	time.AfterFunc(time.Duration(seconds)*time.Second, func() { m.queue <- reminder })
+// migrateStatuses sets the status of reminders saved before statuses were introduced. They were kept after
+// the delivery, so the ones due before config.ReminderCatchUpWindow are sent and the others are pending
+func (m *DAO) migrateStatuses(ctx context.Context, currentTime int64) error {
+	noStatus := bson.M{"$exists": false}
+	catchUpSince := currentTime - int64(config.ReminderCatchUpWindow.Seconds())
+	_, err := m.reminders.UpdateMany(ctx,
+		bson.M{ReminderBSON.Status: noStatus, ReminderBSON.UnixTime: bson.M{"$lt": catchUpSince}},
+		bson.M{"$set": bson.M{ReminderBSON.Status: Sent}})
+	if err != nil {
+		return errorx.Decorate(err, "can't set the status of sent reminders")
+	}
+	_, err = m.reminders.UpdateMany(ctx, bson.M{ReminderBSON.Status: noStatus}, bson.M{"$set": bson.M{ReminderBSON.Status: Pending}})
+	if err != nil {
+		return errorx.Decorate(err, "can't set the status of pending reminders")
+	}
+	return nil
+}
+
+// restoredDelay returns the delay of a pending reminder after a restart or false if it is missed
+func restoredDelay(reminder Reminder, currentTime int64) (int64, bool) {
+	seconds := reminder.UnixTime - currentTime
+	if seconds > 0 {
+		log.Printf("restoring reminder %+v", reminder)
+		return seconds, true
+	}
+	if -seconds <= int64(config.ReminderCatchUpWindow.Seconds()) {
+		log.Printf("catching up on reminder %+v", reminder)
+		return 0, true
+	}
+	log.Printf("reminder %+v is missed", reminder)
+	return 0, false
 }
@@ -6,103 +6,344 @@ import (
 	"time"
 
 	"yandexschooldating/clock"
+	"yandexschooldating/coffeebot"
 	"yandexschooldating/config"
 	"yandexschooldating/reminder"
 	"yandexschooldating/util"
 
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func TestDao_AddReminder(t *testing.T) {
-	ctx := context.Background()
-	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
-	if err != nil {
-		panic(err)
-	}
+type reminderDAO interface {
+	coffeebot.ReminderDAO
+	PopulateReminderQueue(ctx context.Context) error
+}
 
-	testDatabase := "test_reminders"
-	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+// newDAOFunc must return DAOs over the same reminders, as if the bot was restarted
+type newDAOFunc func(queue chan<- reminder.Reminder, clock clock.Clock) reminderDAO
 
-	queue := make(chan reminder.Reminder)
-	start := time.Now()
-	clock := &clock.Fake{Current: start}
+func testAddReminder(t *testing.T, ctx context.Context, newDAO newDAOFunc) reminderDAO {
+	queue := make(chan reminder.Reminder, 10)
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+	fakeClock := &clock.Fake{Current: start}
 
-	dao := reminder.NewDAO(client, testDatabase, queue, clock)
+	dao := newDAO(queue, fakeClock)
 
 	reminderTime := start.Add(time.Second * 4)
-	err = dao.AddReminder(ctx, reminderTime, 42, "bring a towel")
+	err := dao.AddReminder(ctx, primitive.NewObjectID(), reminder.Meeting, reminderTime, 42, "bring a towel")
 	require.NoError(t, err)
 
-	value, ok := <-queue
-	elapsed := time.Since(start)
-	require.True(t, ok)
+	fakeClock.Advance(3 * time.Second)
+	require.True(t, util.IsChannelEmpty(queue))
+	fakeClock.Advance(time.Second)
+	value := <-queue
 	require.Equal(t, int64(42), value.ChatID)
 	require.Equal(t, "bring a towel", value.Text)
 	require.Equal(t, reminderTime.Unix(), value.UnixTime)
-	require.LessOrEqual(t, (3 * time.Second).Nanoseconds(), elapsed.Nanoseconds())
-	require.LessOrEqual(t, elapsed.Nanoseconds(), (5 * time.Second).Nanoseconds())
 
+	fakeClock.Advance(time.Hour)
 	require.True(t, util.IsChannelEmpty(queue))
 
-	err = dao.AddReminder(ctx, time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC), 1, "will never see")
+	err = dao.AddReminder(ctx, primitive.NilObjectID, reminder.Announcement, start, 1, "will never see")
 	require.Error(t, err)
 
-	err = client.Disconnect(ctx)
-	if err != nil {
-		panic(err)
+	// a reminder is ensured only once
+	ID := primitive.NewObjectID()
+	for i := 0; i < 2; i++ {
+		err = dao.EnsureReminder(ctx, ID, primitive.NilObjectID, reminder.Announcement, fakeClock.Now().Add(time.Second), 7, "once")
+		require.NoError(t, err)
 	}
-
-	err = dao.AddReminder(ctx, start.Add(time.Hour), 1, "will never see")
-	require.Error(t, err)
+	fakeClock.Advance(time.Second)
+	require.Len(t, queue, 1)
+	value = <-queue
+	require.Equal(t, ID, value.ID)
+	require.Equal(t, "once", value.Text)
+	return dao
 }
 
-func TestDao_PopulateReminderQueue(t *testing.T) {
-	ctx := context.Background()
-	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
-	if err != nil {
-		panic(err)
-	}
-
-	testDatabase := "test_reminders"
-	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
-
-	queue := make(chan reminder.Reminder)
-	start := time.Now()
-	clock := &clock.Fake{Current: start}
+func testPopulateReminderQueue(t *testing.T, ctx context.Context, newDAO newDAOFunc) reminderDAO {
+	queue := make(chan reminder.Reminder, 10)
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
 
-	dao := reminder.NewDAO(client, testDatabase, queue, clock)
+	dao := newDAO(queue, &clock.Fake{Current: start})
 
 	reminderTime := start.Add(time.Second * 4)
-	err = dao.AddReminder(ctx, reminderTime, 42, "bring a towel")
+	err := dao.AddReminder(ctx, primitive.NewObjectID(), reminder.Meeting, reminderTime, 42, "bring a towel")
 	require.NoError(t, err)
 
-	newQueue := make(chan reminder.Reminder)
-	require.True(t, util.IsChannelEmpty(newQueue))
-	clock.Current = start.Add(2 * time.Second)
-	dao = reminder.NewDAO(client, testDatabase, newQueue, clock)
+	// every restart gets its own clock, so timers of the previous run never fire
+	newQueue := make(chan reminder.Reminder, 10)
+	restarted := &clock.Fake{Current: start.Add(2 * time.Second)}
+	dao = newDAO(newQueue, restarted)
 	require.NoError(t, dao.PopulateReminderQueue(ctx))
 
-	value, ok := <-newQueue
-	elapsed := time.Since(start)
-	require.True(t, ok)
+	restarted.Advance(time.Second)
+	require.True(t, util.IsChannelEmpty(newQueue))
+	restarted.Advance(time.Second)
+	value := <-newQueue
 	require.Equal(t, int64(42), value.ChatID)
 	require.Equal(t, "bring a towel", value.Text)
 	require.Equal(t, reminderTime.Unix(), value.UnixTime)
-	require.LessOrEqual(t, (1 * time.Second).Nanoseconds(), elapsed.Nanoseconds())
-	require.LessOrEqual(t, elapsed.Nanoseconds(), (3 * time.Second).Nanoseconds())
 	require.True(t, util.IsChannelEmpty(newQueue))
+	require.Equal(t, reminder.Pending, value.Status)
+	require.NoError(t, dao.UpdateStatus(ctx, value.ID, reminder.Sent, ""))
 
-	newQueue = make(chan reminder.Reminder)
+	newQueue = make(chan reminder.Reminder, 10)
+	restarted = &clock.Fake{Current: start.Add(5 * time.Second)}
+	dao = newDAO(newQueue, restarted)
+	require.NoError(t, dao.PopulateReminderQueue(ctx))
+	restarted.Advance(time.Hour)
 	require.True(t, util.IsChannelEmpty(newQueue))
-	clock.Current = start.Add(5 * time.Second)
-	dao = reminder.NewDAO(client, testDatabase, newQueue, clock)
+	require.True(t, util.IsChannelEmpty(queue))
+	return dao
+}
+
+func testCancelReminders(t *testing.T, ctx context.Context, newDAO newDAOFunc) reminderDAO {
+	queue := make(chan reminder.Reminder, 10)
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+	fakeClock := &clock.Fake{Current: start}
+
+	dao := newDAO(queue, fakeClock)
+
+	rescheduled := primitive.NewObjectID()
+	broken := primitive.NewObjectID()
+	reminderTime := start.Add(2 * time.Second)
+	require.NoError(t, dao.AddReminder(ctx, rescheduled, reminder.Announcement, reminderTime, 1, "your partner"))
+	require.NoError(t, dao.AddReminder(ctx, rescheduled, reminder.Meeting, reminderTime, 1, "old time"))
+	require.NoError(t, dao.AddReminder(ctx, broken, reminder.Announcement, reminderTime, 2, "your partner"))
+	require.NoError(t, dao.AddReminder(ctx, broken, reminder.Meeting, reminderTime, 2, "old time"))
+
+	require.NoError(t, dao.CancelReminders(ctx, rescheduled, reminder.Meeting))
+	require.NoError(t, dao.AddReminder(ctx, rescheduled, reminder.Meeting, start.Add(3*time.Second), 1, "new time"))
+	require.NoError(t, dao.CancelReminders(ctx, broken))
+	require.NoError(t, dao.CancelReminders(ctx, primitive.NewObjectID()))
+
+	fakeClock.Advance(time.Hour)
+	require.Equal(t, "your partner", (<-queue).Text)
+	require.Equal(t, "new time", (<-queue).Text)
+	require.True(t, util.IsChannelEmpty(queue))
+
+	// cancelled reminders are not restored after a restart either
+	newQueue := make(chan reminder.Reminder, 10)
+	restarted := &clock.Fake{Current: start}
+	dao = newDAO(newQueue, restarted)
+	require.NoError(t, dao.PopulateReminderQueue(ctx))
+	restarted.Advance(time.Hour)
+	require.Equal(t, "your partner", (<-newQueue).Text)
+	require.Equal(t, "new time", (<-newQueue).Text)
+	require.True(t, util.IsChannelEmpty(newQueue))
+
+	// delivered and failed reminders are kept as the record of the delivery
+	finished := primitive.NewObjectID()
+	require.NoError(t, dao.AddReminder(ctx, finished, reminder.Announcement, start.Add(90*time.Minute), 3, "sent"))
+	require.NoError(t, dao.AddReminder(ctx, finished, reminder.Meeting, start.Add(150*time.Minute), 3, "failed"))
+	require.NoError(t, dao.AddReminder(ctx, finished, reminder.Meeting, start.Add(4*time.Hour), 3, "pending"))
+	restarted.Advance(time.Hour)
+	sent := <-newQueue
+	require.Equal(t, "sent", sent.Text)
+	require.NoError(t, dao.UpdateStatus(ctx, sent.ID, reminder.Sent, ""))
+	restarted.Advance(time.Hour)
+	failed := <-newQueue
+	require.Equal(t, "failed", failed.Text)
+	require.NoError(t, dao.UpdateStatus(ctx, failed.ID, reminder.Failed, "chat not found"))
+
+	require.NoError(t, dao.CancelReminders(ctx, finished))
+	require.NoError(t, dao.UpdateStatus(ctx, sent.ID, reminder.Sent, ""))
+	failedReminders, err := dao.FindFailed(ctx, start)
+	require.NoError(t, err)
+	require.Len(t, failedReminders, 1)
+	require.Equal(t, failed.ID, failedReminders[0].ID)
+	restarted.Advance(time.Hour)
+	require.True(t, util.IsChannelEmpty(newQueue))
+	return dao
+}
+
+func testStatuses(t *testing.T, ctx context.Context, newDAO newDAOFunc) reminderDAO {
+	queue := make(chan reminder.Reminder, 10)
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+
+	dao := newDAO(queue, &clock.Fake{Current: start})
+	require.NoError(t, dao.AddReminder(ctx, primitive.NilObjectID, reminder.Announcement, start.Add(time.Hour), 1, "too late"))
+	require.NoError(t, dao.AddReminder(ctx, primitive.NilObjectID, reminder.Announcement, start.Add(2*time.Hour), 2, "caught up"))
+
+	// the bot was down for two hours
+	newQueue := make(chan reminder.Reminder, 10)
+	restarted := &clock.Fake{Current: start.Add(2*time.Hour + config.ReminderCatchUpWindow/2)}
+	dao = newDAO(newQueue, restarted)
+	require.NoError(t, dao.PopulateReminderQueue(ctx))
+	restarted.Advance(0)
+	value := <-newQueue
+	require.Equal(t, "caught up", value.Text)
+	require.Equal(t, reminder.Pending, value.Status)
+	require.NoError(t, dao.UpdateStatus(ctx, value.ID, reminder.Failed, "chat not found"))
+	require.Error(t, dao.UpdateStatus(ctx, primitive.NewObjectID(), reminder.Sent, ""))
+
+	failed, err := dao.FindFailed(ctx, start)
+	require.NoError(t, err)
+	require.Len(t, failed, 2)
+	require.Equal(t, "too late", failed[0].Text)
+	require.Equal(t, reminder.Missed, failed[0].Status)
+	require.Equal(t, "caught up", failed[1].Text)
+	require.Equal(t, reminder.Failed, failed[1].Status)
+	require.Equal(t, "chat not found", failed[1].Error)
+
+	failed, err = dao.FindFailed(ctx, start.Add(90*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	require.Equal(t, "caught up", failed[0].Text)
+
+	// neither missed nor failed reminders are sent again
+	newQueue = make(chan reminder.Reminder, 10)
+	restarted = &clock.Fake{Current: restarted.Now()}
+	dao = newDAO(newQueue, restarted)
 	require.NoError(t, dao.PopulateReminderQueue(ctx))
+	restarted.Advance(time.Hour)
 	require.True(t, util.IsChannelEmpty(newQueue))
+	return dao
+}
 
-	err = client.Disconnect(ctx)
+func newMongoDAOFunc(ctx context.Context) (newDAOFunc, func()) {
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
 	if err != nil {
 		panic(err)
 	}
 
+	testDatabase := "test_reminders"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	newDAO := func(queue chan<- reminder.Reminder, clock clock.Clock) reminderDAO {
+		return reminder.NewDAO(client, testDatabase, queue, clock)
+	}
+	disconnect := func() {
+		err := client.Disconnect(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return newDAO, disconnect
+}
+
+func newMemoryDAOFunc() newDAOFunc {
+	var first *reminder.MemoryDAO
+	return func(queue chan<- reminder.Reminder, clock clock.Clock) reminderDAO {
+		if first == nil {
+			first = reminder.NewMemoryDAO(queue, clock)
+			return first
+		}
+		return first.Restarted(queue, clock)
+	}
+}
+
+func TestDao_AddReminder(t *testing.T) {
+	ctx := context.Background()
+	newDAO, disconnect := newMongoDAOFunc(ctx)
+	dao := testAddReminder(t, ctx, newDAO)
+
+	disconnect()
+
+	err := dao.AddReminder(ctx, primitive.NilObjectID, reminder.Announcement, time.Date(2020, 7, 5, 5, 20, 0, 0, time.UTC), 1, "will never see")
+	require.Error(t, err)
+}
+
+func TestDao_PopulateReminderQueue(t *testing.T) {
+	ctx := context.Background()
+	newDAO, disconnect := newMongoDAOFunc(ctx)
+	dao := testPopulateReminderQueue(t, ctx, newDAO)
+
+	disconnect()
+
 	require.NotNil(t, dao.PopulateReminderQueue(ctx))
 }
+
+func TestDao_PopulateReminderQueueWithoutStatus(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+	testDatabase := "test_reminders"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	// reminders saved before statuses were introduced
+	start := time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)
+	matchID := primitive.NewObjectID()
+	var documents []interface{}
+	for text, reminderTime := range map[string]time.Time{
+		"sent":    start.Add(-time.Hour),
+		"late":    start.Add(-time.Minute),
+		"pending": start.Add(time.Minute),
+	} {
+		documents = append(documents, bson.M{
+			reminder.ReminderBSON.ID:       primitive.NewObjectID(),
+			reminder.ReminderBSON.MatchID:  matchID,
+			reminder.ReminderBSON.Kind:     reminder.Meeting,
+			reminder.ReminderBSON.UnixTime: reminderTime.Unix(),
+			reminder.ReminderBSON.ChatID:   1,
+			reminder.ReminderBSON.Text:     text,
+		})
+	}
+	_, err = client.Database(testDatabase).Collection("reminders").InsertMany(ctx, documents)
+	require.NoError(t, err)
+
+	queue := make(chan reminder.Reminder, 10)
+	fakeClock := &clock.Fake{Current: start}
+	dao := reminder.NewDAO(client, testDatabase, queue, fakeClock)
+	require.NoError(t, dao.PopulateReminderQueue(ctx))
+	fakeClock.Advance(0)
+	require.Equal(t, "late", (<-queue).Text)
+	require.True(t, util.IsChannelEmpty(queue))
+	// the sent reminder is not reported as missed
+	failed, err := dao.FindFailed(ctx, start.Add(-24*time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, failed)
+
+	// the pending reminder can be cancelled like the new ones
+	require.NoError(t, dao.CancelReminders(ctx, matchID, reminder.Meeting))
+	fakeClock.Advance(time.Hour)
+	require.True(t, util.IsChannelEmpty(queue))
+	restarted := reminder.NewDAO(client, testDatabase, queue, fakeClock)
+	require.NoError(t, restarted.PopulateReminderQueue(ctx))
+	fakeClock.Advance(time.Hour)
+	require.True(t, util.IsChannelEmpty(queue))
+
+	require.NoError(t, client.Disconnect(ctx))
+}
+
+func TestDao_CancelReminders(t *testing.T) {
+	ctx := context.Background()
+	newDAO, disconnect := newMongoDAOFunc(ctx)
+	dao := testCancelReminders(t, ctx, newDAO)
+
+	disconnect()
+
+	require.Error(t, dao.CancelReminders(ctx, primitive.NewObjectID()))
+}
+
+func TestDao_Statuses(t *testing.T) {
+	ctx := context.Background()
+	newDAO, disconnect := newMongoDAOFunc(ctx)
+	dao := testStatuses(t, ctx, newDAO)
+
+	disconnect()
+
+	_, err := dao.FindFailed(ctx, time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC))
+	require.Error(t, err)
+}
+
+func TestMemoryDAO_AddReminder(t *testing.T) {
+	testAddReminder(t, context.Background(), newMemoryDAOFunc())
+}
+
+func TestMemoryDAO_PopulateReminderQueue(t *testing.T) {
+	testPopulateReminderQueue(t, context.Background(), newMemoryDAOFunc())
+}
+
+func TestMemoryDAO_CancelReminders(t *testing.T) {
+	testCancelReminders(t, context.Background(), newMemoryDAOFunc())
+}
+
+func TestMemoryDAO_Statuses(t *testing.T) {
+	testStatuses(t, context.Background(), newMemoryDAOFunc())
+}
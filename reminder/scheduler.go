@@ -0,0 +1,73 @@
+package reminder
+
+import (
+	"sync"
+	"time"
+
+	"yandexschooldating/clock"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type scheduled struct {
+	reminder  Reminder
+	timer     *clock.Timer
+	cancelled chan struct{}
+}
+
+// scheduler delivers reminders to the queue on time and keeps their timers so that they can be cancelled
+type scheduler struct {
+	mutex  sync.Mutex
+	queue  chan<- Reminder
+	clock  clock.Clock
+	timers map[primitive.ObjectID]*scheduled
+}
+
+func newScheduler(queue chan<- Reminder, clock clock.Clock) *scheduler {
+	return &scheduler{queue: queue, clock: clock, timers: make(map[primitive.ObjectID]*scheduled)}
+}
+
+func (s *scheduler) start(reminder Reminder, seconds int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry := &scheduled{reminder: reminder, cancelled: make(chan struct{})}
+	entry.timer = s.clock.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		// a reminder cancelled while waiting for the queue is dropped
+		select {
+		case s.queue <- reminder:
+		case <-entry.cancelled:
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.timers[reminder.ID] == entry {
+			delete(s.timers, reminder.ID)
+		}
+	})
+	s.timers[reminder.ID] = entry
+}
+
+// cancel stops the timers of the reminders of the match, of all kinds if none are given
+func (s *scheduler) cancel(matchID primitive.ObjectID, kinds []Kind) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ID, entry := range s.timers {
+		if entry.reminder.MatchID != matchID || !hasKind(kinds, entry.reminder.Kind) {
+			continue
+		}
+		entry.timer.Stop()
+		close(entry.cancelled)
+		delete(s.timers, ID)
+	}
+}
+
+func hasKind(kinds []Kind, kind Kind) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
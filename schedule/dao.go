@@ -0,0 +1,55 @@
+package schedule
+
+import (
+	"context"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Run is the last finished run of a schedule
+type Run struct {
+	Name    string    `bson:"_id"`
+	LastRun time.Time `bson:"lastRun"`
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+var RunBSON = struct {
+	Name    string
+	LastRun string
+}{"_id", "lastRun"}
+
+type DAO struct {
+	runs *mongo.Collection
+}
+
+func NewDAO(client *mongo.Client, database string) *DAO {
+	return &DAO{runs: client.Database(database).Collection("scheduleRuns")}
+}
+
+func (m *DAO) FindLastRun(ctx context.Context, name string) (*time.Time, error) {
+	result := m.runs.FindOne(ctx, bson.M{RunBSON.Name: name})
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find last run of %s", name)
+	}
+	var run Run
+	err := result.Decode(&run)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode run")
+	}
+	return &run.LastRun, nil
+}
+
+func (m *DAO) SaveLastRun(ctx context.Context, name string, lastRun time.Time) error {
+	_, err := m.runs.ReplaceOne(ctx, bson.M{RunBSON.Name: name}, Run{Name: name, LastRun: lastRun}, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errorx.Decorate(err, "can't save last run of %s", name)
+	}
+	return nil
+}
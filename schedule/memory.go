@@ -0,0 +1,34 @@
+package schedule
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps runs in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex sync.Mutex
+	runs  map[string]time.Time
+}
+
+func NewMemoryDAO() *MemoryDAO {
+	return &MemoryDAO{runs: make(map[string]time.Time)}
+}
+
+func (m *MemoryDAO) FindLastRun(_ context.Context, name string) (*time.Time, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lastRun, ok := m.runs[name]
+	if !ok {
+		return nil, nil
+	}
+	return &lastRun, nil
+}
+
+func (m *MemoryDAO) SaveLastRun(_ context.Context, name string, lastRun time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.runs[name] = lastRun
+	return nil
+}
@@ -0,0 +1,88 @@
+package schedule
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"yandexschooldating/clock"
+)
+
+type Store interface {
+	// FindLastRun returns nil if the schedule has never run
+	FindLastRun(ctx context.Context, name string) (*time.Time, error)
+	SaveLastRun(ctx context.Context, name string, lastRun time.Time) error
+}
+
+// Runner tells when it is time for the runs of a schedule. The time of the last finished run is stored,
+// so that after a restart a run missed while the bot was down happens right away and a finished one is not repeated
+type Runner struct {
+	name     string
+	schedule *Schedule
+	store    Store
+	clock    clock.Clock
+	runs     chan time.Time
+}
+
+func NewRunner(name string, schedule *Schedule, store Store, clock clock.Clock) *Runner {
+	// the buffer lets clock.Fake fire the timer before anyone reads the channel
+	return &Runner{name: name, schedule: schedule, store: store, clock: clock, runs: make(chan time.Time, 1)}
+}
+
+// Runs receives the scheduled time of every run. Call Done once the run is finished to get the next one
+// or Retry if it failed
+func (r *Runner) Runs() <-chan time.Time {
+	return r.runs
+}
+
+// Start arms the timer for the first run. The very first start of a schedule waits for its next time,
+// if runs were missed since the last one, a single run happens right away
+func (r *Runner) Start(ctx context.Context) error {
+	missed, err := r.MissedRun(ctx)
+	if err != nil {
+		return err
+	}
+	if !missed.IsZero() {
+		log.Printf("schedule %s missed the run at %s, running now", r.name, missed)
+		r.arm(missed)
+		return nil
+	}
+	r.arm(r.schedule.Next(r.clock.Now()))
+	return nil
+}
+
+// MissedRun returns the scheduled time of the latest run that is due but not done, zero time if there is none.
+// The very first start of a schedule has no missed runs
+func (r *Runner) MissedRun(ctx context.Context) (time.Time, error) {
+	lastRun, err := r.store.FindLastRun(ctx, r.name)
+	if err != nil || lastRun == nil {
+		return time.Time{}, err
+	}
+	now := r.clock.Now()
+	missed := time.Time{}
+	for next := r.schedule.Next(*lastRun); !next.IsZero() && !next.After(now); next = r.schedule.Next(next) {
+		missed = next
+	}
+	return missed, nil
+}
+
+// Done stores the scheduled time of the finished run and arms the timer for the next one
+func (r *Runner) Done(ctx context.Context, scheduled time.Time) error {
+	r.arm(r.schedule.Next(r.clock.Now()))
+	return r.store.SaveLastRun(ctx, r.name, scheduled)
+}
+
+// Retry repeats the failed run after the delay. The run is not stored, so it also happens after a restart
+func (r *Runner) Retry(scheduled time.Time, delay time.Duration) {
+	log.Printf("retrying the run of schedule %s at %s in %s", r.name, scheduled, delay)
+	r.clock.AfterFunc(delay, func() { r.runs <- scheduled })
+}
+
+func (r *Runner) arm(scheduled time.Time) {
+	if scheduled.IsZero() {
+		log.Printf("schedule %s has no next run", r.name)
+		return
+	}
+	log.Printf("next run of schedule %s is at %s", r.name, scheduled)
+	r.clock.AfterFunc(scheduled.Sub(r.clock.Now()), func() { r.runs <- scheduled })
+}
@@ -0,0 +1,135 @@
+package schedule
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Schedule is a cron-like schedule in a timezone. Its spec has the usual five fields:
+// minute, hour, day of month, month and day of week (0 or 7 is Sunday).
+// A field is "*", a number, a range like "1-5" or a comma separated list of those.
+// As in cron, if both day of month and day of week are restricted, a day matching either of them is scheduled
+type Schedule struct {
+	minutes, hours []int
+	days, months   map[int]bool
+	weekdays       map[int]bool
+	// eitherDay is true when neither day field is "*"
+	eitherDay bool
+	location  *time.Location
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse returns the schedule for the spec, for example "0 0 * * 1" is every Monday at midnight
+func Parse(spec string, location *time.Location) (*Schedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, errorx.IllegalArgument.New("schedule %q must have %d fields", spec, len(fields))
+	}
+	var values []map[int]bool
+	for i, part := range parts {
+		value, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, errorx.Decorate(err, "can't parse schedule %q", spec)
+		}
+		values = append(values, value)
+	}
+	if values[4][7] {
+		values[4][0] = true
+	}
+	return &Schedule{
+		minutes:   sorted(values[0]),
+		hours:     sorted(values[1]),
+		days:      values[2],
+		months:    values[3],
+		weekdays:  values[4],
+		eitherDay: parts[2] != "*" && parts[4] != "*",
+		location:  location,
+	}, nil
+}
+
+func parseField(part string, f field) (map[int]bool, error) {
+	result := make(map[int]bool)
+	for _, item := range strings.Split(part, ",") {
+		from, to := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errorx.IllegalArgument.New("bad %s %q", f.name, item)
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errorx.IllegalArgument.New("bad %s %q", f.name, item)
+				}
+			}
+		}
+		if from < f.min || to > f.max || from > to {
+			return nil, errorx.IllegalArgument.New("%s %q is out of range %d-%d", f.name, item, f.min, f.max)
+		}
+		for value := from; value <= to; value++ {
+			result[value] = true
+		}
+	}
+	return result, nil
+}
+
+func sorted(values map[int]bool) []int {
+	var result []int
+	for value := range values {
+		result = append(result, value)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// Location is the timezone the schedule is in
+func (s *Schedule) Location() *time.Location {
+	return s.location
+}
+
+// Next returns the first time of the schedule strictly after the given time or zero time if there is none within a year.
+// Times are wall clock times in the location of the schedule, so runs stay at the same local time across DST changes
+func (s *Schedule) Next(after time.Time) time.Time {
+	local := after.In(s.location)
+	for day := 0; day <= 366; day++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+day, 0, 0, 0, 0, s.location)
+		if !s.months[int(date.Month())] || !s.isScheduledDay(date) {
+			continue
+		}
+		for _, hour := range s.hours {
+			for _, minute := range s.minutes {
+				next := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, s.location)
+				if next.After(after) {
+					return next
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) isScheduledDay(date time.Time) bool {
+	if s.eitherDay {
+		return s.days[date.Day()] || s.weekdays[int(date.Weekday())]
+	}
+	return s.days[date.Day()] && s.weekdays[int(date.Weekday())]
+}
@@ -0,0 +1,205 @@
+package schedule_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/config"
+	"yandexschooldating/schedule"
+	"yandexschooldating/util"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"", "0 0 * *", "0 0 * * 1 2", "60 0 * * 1", "0 24 * * *", "0 0 0 * *", "0 0 * 13 *", "0 0 * * 8", "x 0 * * *", "0 5-3 * * *", "0 1-x * * *", "0 0 * * 1,"} {
+		_, err := schedule.Parse(spec, time.UTC)
+		require.Error(t, err, spec)
+	}
+	s, err := schedule.Parse("30 9,18 * * 1-5", time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, time.UTC, s.Location())
+}
+
+func TestNext(t *testing.T) {
+	weekly, err := schedule.Parse("0 0 * * 1", time.UTC)
+	require.NoError(t, err)
+	next := time.Date(2021, 1, 5, 4, 20, 0, 0, time.UTC)
+	for _, expected := range []time.Time{
+		time.Date(2021, 1, 11, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 18, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 25, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 2, 8, 0, 0, 0, 0, time.UTC),
+	} {
+		next = weekly.Next(next)
+		require.Equal(t, expected, next)
+	}
+
+	sunday, err := schedule.Parse("15 10 * * 7", time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 1, 10, 10, 15, 0, 0, time.UTC), sunday.Next(time.Date(2021, 1, 5, 0, 0, 0, 0, time.UTC)))
+
+	workdays, err := schedule.Parse("30 9,18 * * 1-5", time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 1, 8, 18, 30, 0, 0, time.UTC), workdays.Next(time.Date(2021, 1, 8, 9, 30, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2021, 1, 11, 9, 30, 0, 0, time.UTC), workdays.Next(time.Date(2021, 1, 8, 18, 30, 0, 0, time.UTC)))
+
+	// restricted day of month and day of week are alternatives
+	either, err := schedule.Parse("0 12 13 * 5", time.UTC)
+	require.NoError(t, err)
+	next = time.Date(2021, 1, 5, 4, 20, 0, 0, time.UTC)
+	for _, expected := range []time.Time{
+		time.Date(2021, 1, 8, 12, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 13, 12, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 15, 12, 0, 0, 0, time.UTC),
+	} {
+		next = either.Next(next)
+		require.Equal(t, expected, next)
+	}
+	firstOfMonth, err := schedule.Parse("0 0 1 * *", time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), firstOfMonth.Next(time.Date(2021, 1, 5, 0, 0, 0, 0, time.UTC)))
+
+	leap, err := schedule.Parse("0 0 29 2 *", time.UTC)
+	require.NoError(t, err)
+	require.True(t, leap.Next(time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)).IsZero())
+}
+
+func TestNextInLocation(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	weekly, err := schedule.Parse("0 0 * * 1", moscow)
+	require.NoError(t, err)
+	// Sunday 21:30 UTC is already Monday in Moscow
+	require.Equal(t, time.Date(2021, 1, 18, 0, 0, 0, 0, moscow), weekly.Next(time.Date(2021, 1, 10, 21, 30, 0, 0, time.UTC)))
+
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+	weekly, err = schedule.Parse("0 9 * * 1", london)
+	require.NoError(t, err)
+	// the clocks go forward on 28 March 2021, the run stays at 9:00 local time
+	first := weekly.Next(time.Date(2021, 3, 24, 0, 0, 0, 0, london))
+	require.Equal(t, time.Date(2021, 3, 29, 8, 0, 0, 0, time.UTC), first.UTC())
+	require.Equal(t, 9, first.Hour())
+	require.Equal(t, time.Date(2021, 3, 22, 9, 0, 0, 0, time.UTC), weekly.Next(time.Date(2021, 3, 21, 0, 0, 0, 0, london)).UTC())
+}
+
+func TestRunner(t *testing.T) {
+	ctx := context.Background()
+	weekly, err := schedule.Parse("0 0 * * 1", time.UTC)
+	require.NoError(t, err)
+	store := schedule.NewMemoryDAO()
+	fakeClock := &clock.Fake{Current: time.Date(2021, 1, 5, 4, 20, 0, 0, time.UTC)}
+	monday := time.Date(2021, 1, 11, 0, 0, 0, 0, time.UTC)
+
+	runner := schedule.NewRunner("matching", weekly, store, fakeClock)
+	require.NoError(t, runner.Start(ctx))
+	fakeClock.Set(monday.Add(-time.Second))
+	require.Empty(t, runner.Runs())
+	fakeClock.Set(monday)
+	require.Len(t, runner.Runs(), 1)
+	require.Equal(t, monday, <-runner.Runs())
+	require.NoError(t, runner.Done(ctx, monday))
+	lastRun, err := store.FindLastRun(ctx, "matching")
+	require.NoError(t, err)
+	require.Equal(t, monday, *lastRun)
+
+	// a restart right after the run does not repeat it
+	fakeClock = &clock.Fake{Current: monday.Add(time.Hour)}
+	runner = schedule.NewRunner("matching", weekly, store, fakeClock)
+	require.NoError(t, runner.Start(ctx))
+	fakeClock.Advance(0)
+	require.Empty(t, runner.Runs())
+	fakeClock.Set(monday.AddDate(0, 0, 7))
+	require.Equal(t, monday.AddDate(0, 0, 7), <-runner.Runs())
+
+	// the bot is down for the next two runs and makes up for them with a single run
+	fakeClock = &clock.Fake{Current: monday.AddDate(0, 0, 22)}
+	runner = schedule.NewRunner("matching", weekly, store, fakeClock)
+	require.NoError(t, runner.Start(ctx))
+	fakeClock.Advance(0)
+	require.Len(t, runner.Runs(), 1)
+	require.Equal(t, monday.AddDate(0, 0, 21), <-runner.Runs())
+	require.NoError(t, runner.Done(ctx, monday.AddDate(0, 0, 21)))
+	fakeClock.Advance(0)
+	require.Empty(t, runner.Runs())
+	fakeClock.Set(monday.AddDate(0, 0, 28))
+	require.Equal(t, monday.AddDate(0, 0, 28), <-runner.Runs())
+
+	// a failed run is repeated after the delay and after a restart until it is done
+	require.NoError(t, runner.Done(ctx, monday.AddDate(0, 0, 28)))
+	fakeClock.Set(monday.AddDate(0, 0, 35))
+	require.Equal(t, monday.AddDate(0, 0, 35), <-runner.Runs())
+	runner.Retry(monday.AddDate(0, 0, 35), 5*time.Minute)
+	fakeClock.Advance(5*time.Minute - time.Second)
+	require.Empty(t, runner.Runs())
+	fakeClock.Advance(time.Second)
+	require.Equal(t, monday.AddDate(0, 0, 35), <-runner.Runs())
+	missed, err := runner.MissedRun(ctx)
+	require.NoError(t, err)
+	require.Equal(t, monday.AddDate(0, 0, 35), missed)
+
+	fakeClock = &clock.Fake{Current: monday.AddDate(0, 0, 35).Add(time.Hour)}
+	runner = schedule.NewRunner("matching", weekly, store, fakeClock)
+	require.NoError(t, runner.Start(ctx))
+	fakeClock.Advance(0)
+	require.Equal(t, monday.AddDate(0, 0, 35), <-runner.Runs())
+	require.NoError(t, runner.Done(ctx, monday.AddDate(0, 0, 35)))
+	missed, err = runner.MissedRun(ctx)
+	require.NoError(t, err)
+	require.True(t, missed.IsZero())
+
+	lastRun, err = store.FindLastRun(ctx, "other")
+	require.NoError(t, err)
+	require.Nil(t, lastRun)
+}
+
+// testStore checks the behaviour that every store implementation must share
+func testStore(t *testing.T, ctx context.Context, store schedule.Store) {
+	lastRun, err := store.FindLastRun(ctx, "matching")
+	require.NoError(t, err)
+	require.Nil(t, lastRun)
+
+	monday := time.Date(2021, 1, 11, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, store.SaveLastRun(ctx, "matching", monday))
+	require.NoError(t, store.SaveLastRun(ctx, "other", monday.Add(time.Hour)))
+	lastRun, err = store.FindLastRun(ctx, "matching")
+	require.NoError(t, err)
+	require.NotNil(t, lastRun)
+	require.True(t, monday.Equal(*lastRun))
+
+	require.NoError(t, store.SaveLastRun(ctx, "matching", monday.AddDate(0, 0, 7)))
+	lastRun, err = store.FindLastRun(ctx, "matching")
+	require.NoError(t, err)
+	require.True(t, monday.AddDate(0, 0, 7).Equal(*lastRun))
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_schedules"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	dao := schedule.NewDAO(client, testDatabase)
+	testStore(t, ctx, dao)
+
+	err = client.Disconnect(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = dao.FindLastRun(ctx, "matching")
+	require.Error(t, err)
+	require.Error(t, dao.SaveLastRun(ctx, "matching", time.Now()))
+}
+
+func TestMemoryDAO(t *testing.T) {
+	testStore(t, context.Background(), schedule.NewMemoryDAO())
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"context"
+	"sync"
+
+	"yandexschooldating/clock"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps states in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex  sync.Mutex
+	states map[int]State
+	clock  clock.Clock
+}
+
+func NewMemoryDAO(clock clock.Clock) *MemoryDAO {
+	return &MemoryDAO{states: make(map[int]State), clock: clock}
+}
+
+// FindState returns nil if there is no state for the user or it has expired
+func (m *MemoryDAO) FindState(_ context.Context, userID int) (*State, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state, ok := m.states[userID]
+	if !ok {
+		return nil, nil
+	}
+	if state.expired(m.clock.Now()) {
+		delete(m.states, userID)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (m *MemoryDAO) SaveState(_ context.Context, state State) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.states[state.UserID] = state
+	return nil
+}
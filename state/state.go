@@ -0,0 +1,84 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"yandexschooldating/clock"
+
+	"github.com/joomcode/errorx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// State is the part of a conversation with a user that must survive restarts
+type State struct {
+	UserID int `bson:"_id"`
+	// Dialog is the name of the dialog state the user is in
+	Dialog string `bson:"dialog"`
+	// ExpireAt is only set while a dialog is in progress, the whole state is forgotten after it
+	ExpireAt *time.Time `bson:"expireAt,omitempty"`
+}
+
+//goland:noinspection GoNameStartsWithPackageName
+var StateBSON = struct {
+	UserID   string
+	Dialog   string
+	ExpireAt string
+}{"_id", "dialog", "expireAt"}
+
+func (s *State) expired(now time.Time) bool {
+	return s.ExpireAt != nil && !s.ExpireAt.After(now)
+}
+
+type DAO struct {
+	states *mongo.Collection
+	clock  clock.Clock
+}
+
+func NewDAO(client *mongo.Client, database string, clock clock.Clock) *DAO {
+	return &DAO{states: client.Database(database).Collection("states"), clock: clock}
+}
+
+// EnsureTTLIndex makes mongo remove abandoned dialogs
+func (m *DAO) EnsureTTLIndex(ctx context.Context) error {
+	_, err := m.states.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{StateBSON.ExpireAt: 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return errorx.Decorate(err, "can't create ttl index for states")
+	}
+	return nil
+}
+
+// FindState returns nil if there is no state for the user or it has expired.
+// Expiry is also checked here because mongo removes expired documents only once a minute
+func (m *DAO) FindState(ctx context.Context, userID int) (*State, error) {
+	result := m.states.FindOne(ctx, bson.M{StateBSON.UserID: userID})
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find state for user %d", userID)
+	}
+
+	var state State
+	err := result.Decode(&state)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode state")
+	}
+	if state.expired(m.clock.Now()) {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (m *DAO) SaveState(ctx context.Context, state State) error {
+	_, err := m.states.ReplaceOne(ctx, bson.M{StateBSON.UserID: state.UserID}, state, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errorx.Decorate(err, "can't save state for user %d", state.UserID)
+	}
+	return nil
+}
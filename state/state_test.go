@@ -0,0 +1,108 @@
+package state_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"yandexschooldating/clock"
+	"yandexschooldating/coffeebot"
+	"yandexschooldating/config"
+	"yandexschooldating/state"
+	"yandexschooldating/util"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testStore checks the behaviour that every state store implementation must share
+func testStore(t *testing.T, ctx context.Context, store coffeebot.StateStore, clock *clock.Fake) {
+	result, err := store.FindState(ctx, 1)
+	require.NoError(t, err)
+	require.Nil(t, result)
+
+	expireAt := clock.Now().Add(time.Hour)
+	err = store.SaveState(ctx, state.State{UserID: 1, Dialog: "inactive"})
+	require.NoError(t, err)
+	err = store.SaveState(ctx, state.State{UserID: 2, Dialog: "waitingForCity", ExpireAt: &expireAt})
+	require.NoError(t, err)
+
+	result, err = store.FindState(ctx, 1)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, 1, result.UserID)
+	require.Equal(t, "inactive", result.Dialog)
+	require.Nil(t, result.ExpireAt)
+
+	result, err = store.FindState(ctx, 2)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, "waitingForCity", result.Dialog)
+	require.NotNil(t, result.ExpireAt)
+	require.Equal(t, expireAt.Unix(), result.ExpireAt.Unix())
+
+	clock.Current = clock.Current.Add(time.Hour - time.Second)
+	result, err = store.FindState(ctx, 2)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+
+	clock.Current = clock.Current.Add(time.Second)
+	result, err = store.FindState(ctx, 2)
+	require.NoError(t, err)
+	require.Nil(t, result)
+
+	result, err = store.FindState(ctx, 1)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+
+	expireAt = clock.Now().Add(time.Hour)
+	err = store.SaveState(ctx, state.State{UserID: 1, Dialog: "waitingForDate", ExpireAt: &expireAt})
+	require.NoError(t, err)
+	result, err = store.FindState(ctx, 1)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, "waitingForDate", result.Dialog)
+
+	err = store.SaveState(ctx, state.State{UserID: 1, Dialog: "idle"})
+	require.NoError(t, err)
+	clock.Current = clock.Current.Add(2 * time.Hour)
+	result, err = store.FindState(ctx, 1)
+	require.NoError(t, err)
+	require.NotNil(t, result)
+	require.Equal(t, "idle", result.Dialog)
+	require.Nil(t, result.ExpireAt)
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	testDatabase := "test_states"
+	util.DropTestDatabaseOrPanic(ctx, client, testDatabase)
+
+	clock := &clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	dao := state.NewDAO(client, testDatabase, clock)
+	err = dao.EnsureTTLIndex(ctx)
+	require.NoError(t, err)
+
+	testStore(t, ctx, dao, clock)
+
+	err = client.Disconnect(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = dao.FindState(ctx, 1)
+	require.Error(t, err)
+	err = dao.SaveState(ctx, state.State{UserID: 1})
+	require.Error(t, err)
+	err = dao.EnsureTTLIndex(ctx)
+	require.Error(t, err)
+}
+
+func TestMemoryDAO(t *testing.T) {
+	clock := &clock.Fake{Current: time.Date(2020, 7, 5, 4, 20, 0, 0, time.UTC)}
+	testStore(t, context.Background(), state.NewMemoryDAO(clock), clock)
+}
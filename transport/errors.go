@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Errors classifies failures of Send so that callers can decide whether to retry
+var Errors = errorx.NewNamespace("transport")
+
+var (
+	// Blocked means that the user blocked the bot, messages to the chat will never be delivered
+	Blocked = Errors.NewType("blocked")
+	// ChatNotFound means that the chat does not exist or the bot can't write there
+	ChatNotFound = Errors.NewType("chat_not_found")
+	// RateLimited means that the messenger asks to wait for RetryAfter before sending again
+	RateLimited = Errors.NewType("rate_limited")
+	// Transient is a network or server failure, sending again later is likely to succeed
+	Transient = Errors.NewType("transient")
+)
+
+// Unreachable reports whether the error means that messages to the chat will never be delivered
+func Unreachable(err error) bool {
+	return errorx.IsOfType(err, Blocked) || errorx.IsOfType(err, ChatNotFound)
+}
+
+// RetryAfter is the time.Duration to wait after a RateLimited error
+var RetryAfter = errorx.RegisterProperty("retryAfter")
+
+// RetryAfterOf returns the delay requested by a RateLimited error
+func RetryAfterOf(err error) (time.Duration, bool) {
+	value, ok := errorx.ExtractProperty(err, RetryAfter)
+	if !ok {
+		return 0, false
+	}
+	delay, ok := value.(time.Duration)
+	return delay, ok
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Memory is a transport for tests: updates are scripted with Receive and sent messages are collected
+type Memory struct {
+	mutex         sync.Mutex
+	updates       chan Update
+	sent          []Message
+	answers       []CallbackAnswer
+	failures      map[int64][]error
+	lastMessageID int
+	lastCallback  int
+}
+
+type CallbackAnswer struct {
+	CallbackID string
+	Text       string
+}
+
+func NewMemory() *Memory {
+	return &Memory{updates: make(chan Update, 100), failures: make(map[int64][]error)}
+}
+
+// Receive queues a message from a user in the private chat with the bot
+func (m *Memory) Receive(userID int, username string, text string) Update {
+	m.mutex.Lock()
+	m.lastMessageID++
+	update := Update{
+		UserID:    userID,
+		Username:  username,
+		ChatID:    int64(userID),
+		MessageID: m.lastMessageID,
+		Text:      text,
+	}
+	m.mutex.Unlock()
+
+	m.updates <- update
+	return update
+}
+
+// Press queues a press of an inline button of the message with messageID
+func (m *Memory) Press(userID int, username string, messageID int, data string) Update {
+	m.mutex.Lock()
+	m.lastCallback++
+	update := Update{
+		UserID:       userID,
+		Username:     username,
+		ChatID:       int64(userID),
+		MessageID:    messageID,
+		CallbackID:   strconv.Itoa(m.lastCallback),
+		CallbackData: data,
+	}
+	m.mutex.Unlock()
+
+	m.updates <- update
+	return update
+}
+
+func (m *Memory) Updates() <-chan Update {
+	return m.updates
+}
+
+// FailNext makes the next sends to the chat fail with errs, one error per attempt
+func (m *Memory) FailNext(chatID int64, errs ...error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failures[chatID] = append(m.failures[chatID], errs...)
+}
+
+func (m *Memory) Send(message Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if failures := m.failures[message.ChatID]; len(failures) > 0 {
+		m.failures[message.ChatID] = failures[1:]
+		return failures[0]
+	}
+	m.sent = append(m.sent, message)
+	return nil
+}
+
+func (m *Memory) AnswerCallback(callbackID string, text string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.answers = append(m.answers, CallbackAnswer{callbackID, text})
+	return nil
+}
+
+// TakeAnswers returns the callback answers since the previous call
+func (m *Memory) TakeAnswers() []CallbackAnswer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	answers := m.answers
+	m.answers = nil
+	return answers
+}
+
+// TakeSent returns the messages sent since the previous call
+func (m *Memory) TakeSent() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sent := m.sent
+	m.sent = nil
+	return sent
+}
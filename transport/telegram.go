@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+type Telegram struct {
+	bot     *tgbotapi.BotAPI
+	updates chan Update
+}
+
+// NewTelegram reads updates from a polling or webhook channel of the bot
+func NewTelegram(bot *tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel) *Telegram {
+	t := &Telegram{bot: bot, updates: make(chan Update)}
+	go t.convertUpdates(updates)
+	return t
+}
+
+func (t *Telegram) convertUpdates(updates tgbotapi.UpdatesChannel) {
+	defer close(t.updates)
+	for update := range updates {
+		if update.CallbackQuery != nil {
+			callback := update.CallbackQuery
+			if callback.From == nil || callback.Message == nil || callback.Message.Chat == nil {
+				continue
+			}
+			log.Printf("[%s] [%d] callback %s %+v", callback.From.UserName, callback.From.ID, callback.Data, strings.Replace(spew.Sdump(update), "\n", " ", -1))
+			t.updates <- Update{
+				UserID:       callback.From.ID,
+				Username:     callback.From.UserName,
+				ChatID:       callback.Message.Chat.ID,
+				MessageID:    callback.Message.MessageID,
+				CallbackID:   callback.ID,
+				CallbackData: callback.Data,
+			}
+			continue
+		}
+		if update.Message == nil || update.Message.From == nil || update.Message.Chat == nil {
+			continue
+		}
+		log.Printf("[%s] [%d] [%d] %s %+v", update.Message.From.UserName, update.Message.From.ID, update.Message.Date, update.Message.Text, strings.Replace(spew.Sdump(update), "\n", " ", -1))
+		t.updates <- Update{
+			UserID:    update.Message.From.ID,
+			Username:  update.Message.From.UserName,
+			ChatID:    update.Message.Chat.ID,
+			MessageID: update.Message.MessageID,
+			Text:      update.Message.Text,
+		}
+	}
+}
+
+func (t *Telegram) Updates() <-chan Update {
+	return t.updates
+}
+
+func (t *Telegram) Send(message Message) error {
+	if message.EditMessageID != 0 {
+		edit := tgbotapi.NewEditMessageText(message.ChatID, message.EditMessageID, message.Text)
+		if message.Keyboard != nil && message.Keyboard.Inline {
+			markup := inlineMarkup(message.Keyboard)
+			edit.ReplyMarkup = &markup
+		}
+		return t.send(edit)
+	}
+
+	if message.Document != nil {
+		document := tgbotapi.NewDocumentUpload(message.ChatID, tgbotapi.FileBytes{Name: message.Document.Name, Bytes: message.Document.Content})
+		document.Caption = message.Text
+		document.ReplyToMessageID = message.ReplyToMessageID
+		if message.Keyboard != nil {
+			document.ReplyMarkup = telegramMarkup(message.Keyboard)
+		}
+		return t.send(document)
+	}
+
+	telegramMessage := tgbotapi.NewMessage(message.ChatID, message.Text)
+	telegramMessage.ReplyToMessageID = message.ReplyToMessageID
+	if message.Keyboard != nil {
+		telegramMessage.ReplyMarkup = telegramMarkup(message.Keyboard)
+	}
+	return t.send(telegramMessage)
+}
+
+func (t *Telegram) AnswerCallback(callbackID string, text string) error {
+	_, err := t.bot.AnswerCallbackQuery(tgbotapi.NewCallback(callbackID, text))
+	return err
+}
+
+// send makes a single attempt, retries are up to the caller
+func (t *Telegram) send(message tgbotapi.Chattable) error {
+	_, err := t.bot.Send(message)
+	if err != nil {
+		return classify(err)
+	}
+	log.Printf("sending %+v", message)
+	return nil
+}
+
+// classify maps Telegram errors to Errors. Telegram reports the kind of an error only in its description.
+// Uploads of documents return the description as a plain error, other plain errors are network failures
+func classify(err error) error {
+	var apiError tgbotapi.Error
+	isAPIError := errors.As(err, &apiError)
+	description := strings.ToLower(err.Error())
+	if isAPIError {
+		description = strings.ToLower(apiError.Message)
+	}
+	switch {
+	case apiError.RetryAfter > 0:
+		return RateLimited.Wrap(err, "telegram rate limit").WithProperty(RetryAfter, time.Duration(apiError.RetryAfter)*time.Second)
+	// for example "Forbidden: bot was blocked by the user" or "Forbidden: user is deactivated"
+	case strings.HasPrefix(description, "forbidden"):
+		return Blocked.Wrap(err, "telegram chat blocked the bot")
+	case strings.Contains(description, "chat not found"):
+		return ChatNotFound.Wrap(err, "telegram chat not found")
+	case strings.HasPrefix(description, "internal server error"), strings.Contains(description, "bad gateway"):
+		return Transient.Wrap(err, "telegram server error")
+	case !isAPIError:
+		return Transient.Wrap(err, "telegram request failed")
+	}
+	return err
+}
+
+func telegramMarkup(keyboard *Keyboard) interface{} {
+	if keyboard.Remove {
+		return tgbotapi.NewRemoveKeyboard(true)
+	}
+	if keyboard.Inline {
+		return inlineMarkup(keyboard)
+	}
+	var rows [][]tgbotapi.KeyboardButton
+	for _, row := range keyboard.Rows {
+		var buttons []tgbotapi.KeyboardButton
+		for _, button := range row {
+			buttons = append(buttons, tgbotapi.NewKeyboardButton(button.Text))
+		}
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(buttons...))
+	}
+	return tgbotapi.NewReplyKeyboard(rows...)
+}
+
+func inlineMarkup(keyboard *Keyboard) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, row := range keyboard.Rows {
+		var buttons []tgbotapi.InlineKeyboardButton
+		for _, button := range row {
+			buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(button.Text, button.Data))
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(buttons...))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
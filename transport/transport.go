@@ -0,0 +1,82 @@
+package transport
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// Button is a keyboard button that sends its text when pressed. Buttons of inline keyboards send Data instead
+type Button struct {
+	Text string `bson:"text"`
+	Data string `bson:"data,omitempty"`
+}
+
+// Keyboard is shown to the user instead of the regular keyboard. A keyboard with Remove set hides the previous one.
+// Inline keyboards are attached to the message itself
+type Keyboard struct {
+	Remove bool       `bson:"remove,omitempty"`
+	Inline bool       `bson:"inline,omitempty"`
+	Rows   [][]Button `bson:"rows,omitempty"`
+}
+
+// NewKeyboard returns a keyboard with a row of buttons for every slice of texts
+func NewKeyboard(rows ...[]string) *Keyboard {
+	keyboard := &Keyboard{}
+	for _, row := range rows {
+		var buttons []Button
+		for _, text := range row {
+			buttons = append(buttons, Button{Text: text})
+		}
+		keyboard.Rows = append(keyboard.Rows, buttons)
+	}
+	return keyboard
+}
+
+// NewInlineKeyboard returns a keyboard attached to the message with a row for every slice of buttons
+func NewInlineKeyboard(rows ...[]Button) *Keyboard {
+	return &Keyboard{Inline: true, Rows: rows}
+}
+
+func RemoveKeyboard() *Keyboard {
+	return &Keyboard{Remove: true}
+}
+
+// Update is a text message from a user or a press of an inline button
+type Update struct {
+	UserID   int
+	Username string
+	ChatID   int64
+	// MessageID is the message with the pressed button for callbacks
+	MessageID int
+	Text      string
+	// CallbackID is set when an inline button is pressed, the callback must be answered with AnswerCallback
+	CallbackID   string
+	CallbackData string
+}
+
+type Message struct {
+	ChatID int64  `bson:"chatId"`
+	Text   string `bson:"text"`
+	// Keyboard is left as is when nil
+	Keyboard *Keyboard `bson:"keyboard,omitempty"`
+	// ReplyToMessageID quotes the message with this ID when not zero
+	ReplyToMessageID int `bson:"replyToMessageId,omitempty"`
+	// EditMessageID replaces the text and the inline keyboard of the message with this ID instead of sending a new one
+	EditMessageID int `bson:"editMessageId,omitempty"`
+	// Document is sent with the text as its caption when set
+	Document *Document `bson:"document,omitempty"`
+	// ReminderID links the message to the reminder it delivers, so that queues can record the outcome of the delivery
+	ReminderID primitive.ObjectID `bson:"reminderId,omitempty"`
+}
+
+// Document is a file attached to a message
+type Document struct {
+	Name    string `bson:"name"`
+	Content []byte `bson:"content"`
+}
+
+// Transport delivers messages between the bot and the users of a messenger
+type Transport interface {
+	Updates() <-chan Update
+	// Send makes a single attempt to deliver the message. Failures are classified with Errors when possible
+	Send(message Message) error
+	// AnswerCallback stops the progress indicator of the pressed button, a non-empty text is shown to the user
+	AnswerCallback(callbackID string, text string) error
+}
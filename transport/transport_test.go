@@ -0,0 +1,175 @@
+package transport_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"yandexschooldating/transport"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeyboard(t *testing.T) {
+	keyboard := transport.NewKeyboard([]string{"a", "b"}, []string{"c"})
+	require.Equal(t, &transport.Keyboard{Rows: [][]transport.Button{{{Text: "a"}, {Text: "b"}}, {{Text: "c"}}}}, keyboard)
+	require.Equal(t, &transport.Keyboard{Remove: true}, transport.RemoveKeyboard())
+}
+
+func TestMemory(t *testing.T) {
+	var memory transport.Transport = transport.NewMemory()
+	scripted := memory.(*transport.Memory)
+
+	first := scripted.Receive(1, "alice", "hello")
+	second := scripted.Receive(2, "bob", "hi")
+	require.Equal(t, transport.Update{UserID: 1, Username: "alice", ChatID: 1, MessageID: 1, Text: "hello"}, <-memory.Updates())
+	require.Equal(t, first.MessageID+1, second.MessageID)
+	require.Equal(t, second, <-memory.Updates())
+
+	require.Empty(t, scripted.TakeSent())
+	require.NoError(t, memory.Send(transport.Message{ChatID: 1, Text: "one"}))
+	require.NoError(t, memory.Send(transport.Message{ChatID: 2, Text: "two", Keyboard: transport.RemoveKeyboard()}))
+	require.Equal(t, []transport.Message{
+		{ChatID: 1, Text: "one"},
+		{ChatID: 2, Text: "two", Keyboard: transport.RemoveKeyboard()},
+	}, scripted.TakeSent())
+	require.Empty(t, scripted.TakeSent())
+}
+
+func TestTelegramUpdates(t *testing.T) {
+	updates := make(chan tgbotapi.Update, 3)
+	telegram := transport.NewTelegram(nil, updates)
+
+	updates <- tgbotapi.Update{UpdateID: 1}
+	updates <- tgbotapi.Update{UpdateID: 2, Message: &tgbotapi.Message{
+		MessageID: 7,
+		From:      &tgbotapi.User{ID: 5, UserName: "alice"},
+		Chat:      &tgbotapi.Chat{ID: 50},
+		Text:      "hello",
+	}}
+	close(updates)
+
+	require.Equal(t, transport.Update{UserID: 5, Username: "alice", ChatID: 50, MessageID: 7, Text: "hello"}, <-telegram.Updates())
+	_, ok := <-telegram.Updates()
+	require.False(t, ok)
+}
+
+func TestCallbacks(t *testing.T) {
+	memory := transport.NewMemory()
+	press := memory.Press(1, "alice", 7, "time:06.07 19:00")
+	require.Equal(t, transport.Update{UserID: 1, Username: "alice", ChatID: 1, MessageID: 7, CallbackID: press.CallbackID, CallbackData: "time:06.07 19:00"}, <-memory.Updates())
+	require.NotEqual(t, press.CallbackID, memory.Press(1, "alice", 7, "time:06.07 19:00").CallbackID)
+
+	require.NoError(t, memory.AnswerCallback(press.CallbackID, "done"))
+	require.Equal(t, []transport.CallbackAnswer{{CallbackID: press.CallbackID, Text: "done"}}, memory.TakeAnswers())
+	require.Empty(t, memory.TakeAnswers())
+
+	updates := make(chan tgbotapi.Update, 1)
+	telegram := transport.NewTelegram(nil, updates)
+	updates <- tgbotapi.Update{UpdateID: 3, CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:      "callback",
+		From:    &tgbotapi.User{ID: 5, UserName: "alice"},
+		Message: &tgbotapi.Message{MessageID: 8, Chat: &tgbotapi.Chat{ID: 50}},
+		Data:    "time:06.07 19:00",
+	}}
+	close(updates)
+	require.Equal(t, transport.Update{UserID: 5, Username: "alice", ChatID: 50, MessageID: 8, CallbackID: "callback", CallbackData: "time:06.07 19:00"}, <-telegram.Updates())
+}
+
+func TestNewInlineKeyboard(t *testing.T) {
+	keyboard := transport.NewInlineKeyboard([]transport.Button{{Text: "12:00", Data: "time:12:00"}})
+	require.True(t, keyboard.Inline)
+	require.Equal(t, [][]transport.Button{{{Text: "12:00", Data: "time:12:00"}}}, keyboard.Rows)
+}
+
+func TestErrors(t *testing.T) {
+	err := transport.RateLimited.New("too many requests").WithProperty(transport.RetryAfter, 3*time.Second)
+	retryAfter, ok := transport.RetryAfterOf(errorx.Decorate(err, "can't send"))
+	require.True(t, ok)
+	require.Equal(t, 3*time.Second, retryAfter)
+
+	_, ok = transport.RetryAfterOf(transport.Blocked.New("blocked"))
+	require.False(t, ok)
+
+	memory := transport.NewMemory()
+	memory.FailNext(1, err)
+	require.True(t, errorx.IsOfType(memory.Send(transport.Message{ChatID: 1}), transport.RateLimited))
+	require.NoError(t, memory.Send(transport.Message{ChatID: 1}))
+	require.Len(t, memory.TakeSent(), 1)
+}
+
+type roundTripper func(request *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// newTelegram returns a transport whose sendMessage and sendDocument requests get the response
+func newTelegram(t *testing.T, response string, responseErr error) *transport.Telegram {
+	client := &http.Client{Transport: roundTripper(func(request *http.Request) (*http.Response, error) {
+		body := `{"ok": true, "result": {"id": 1, "is_bot": true, "username": "coffee_bot"}}`
+		if strings.HasSuffix(request.URL.Path, "/sendMessage") || strings.HasSuffix(request.URL.Path, "/sendDocument") {
+			if responseErr != nil {
+				return nil, responseErr
+			}
+			body = response
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	bot, err := tgbotapi.NewBotAPIWithClient("token", client)
+	require.NoError(t, err)
+	return transport.NewTelegram(bot, make(chan tgbotapi.Update))
+}
+
+func TestTelegramErrors(t *testing.T) {
+	message := transport.Message{ChatID: 1, Text: "hello"}
+
+	err := newTelegram(t, `{"ok": true, "result": {"message_id": 3, "chat": {"id": 1}}}`, nil).Send(message)
+	require.NoError(t, err)
+
+	err = newTelegram(t, `{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"}`, nil).Send(message)
+	require.True(t, errorx.IsOfType(err, transport.Blocked))
+	require.True(t, transport.Unreachable(err))
+
+	err = newTelegram(t, `{"ok": false, "error_code": 403, "description": "Forbidden: user is deactivated"}`, nil).Send(message)
+	require.True(t, errorx.IsOfType(err, transport.Blocked))
+
+	err = newTelegram(t, `{"ok": false, "error_code": 400, "description": "Bad Request: chat not found"}`, nil).Send(message)
+	require.True(t, errorx.IsOfType(err, transport.ChatNotFound))
+	require.True(t, transport.Unreachable(err))
+
+	err = newTelegram(t, `{"ok": false, "error_code": 429, "description": "Too Many Requests: retry after 7", "parameters": {"retry_after": 7}}`, nil).Send(message)
+	require.True(t, errorx.IsOfType(err, transport.RateLimited))
+	retryAfter, ok := transport.RetryAfterOf(err)
+	require.True(t, ok)
+	require.Equal(t, 7*time.Second, retryAfter)
+	require.False(t, transport.Unreachable(err))
+
+	err = newTelegram(t, "", errors.New("connection reset by peer")).Send(message)
+	require.True(t, errorx.IsOfType(err, transport.Transient))
+
+	err = newTelegram(t, `{"ok": false, "error_code": 502, "description": "Bad Gateway"}`, nil).Send(message)
+	require.True(t, errorx.IsOfType(err, transport.Transient))
+
+	// uploads report errors without the error code
+	document := transport.Message{ChatID: 1, Text: "invitation", Document: &transport.Document{Name: "invite.ics", Content: []byte("BEGIN:VCALENDAR")}}
+	err = newTelegram(t, `{"ok": true, "result": {"message_id": 3, "chat": {"id": 1}}}`, nil).Send(document)
+	require.NoError(t, err)
+	err = newTelegram(t, `{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"}`, nil).Send(document)
+	require.True(t, errorx.IsOfType(err, transport.Blocked))
+	require.True(t, transport.Unreachable(err))
+	err = newTelegram(t, `{"ok": false, "error_code": 400, "description": "Bad Request: chat not found"}`, nil).Send(document)
+	require.True(t, errorx.IsOfType(err, transport.ChatNotFound))
+	err = newTelegram(t, "", errors.New("connection reset by peer")).Send(document)
+	require.True(t, errorx.IsOfType(err, transport.Transient))
+
+	err = newTelegram(t, `{"ok": false, "error_code": 400, "description": "Bad Request: message text is empty"}`, nil).Send(message)
+	require.Error(t, err)
+	require.False(t, transport.Unreachable(err))
+	require.False(t, errorx.IsOfType(err, transport.Transient))
+}
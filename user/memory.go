@@ -0,0 +1,126 @@
+package user
+
+import (
+	"context"
+	"sync"
+
+	"github.com/joomcode/errorx"
+)
+
+// MemoryDAO has the same semantics as DAO but keeps users in memory. It is safe for concurrent use
+type MemoryDAO struct {
+	mutex sync.Mutex
+	users map[int]User
+	// order keeps insertion order, like a collection scan in mongo does
+	order []int
+}
+
+func NewMemoryDAO() *MemoryDAO {
+	return &MemoryDAO{users: make(map[int]User)}
+}
+
+// copyUser makes sure that callers can't modify stored profiles
+func copyUser(user User) User {
+	user.Profile.Interests = append([]string(nil), user.Profile.Interests...)
+	user.Profile.Languages = append([]string(nil), user.Profile.Languages...)
+	return user
+}
+
+func (m *MemoryDAO) FindActiveUsers(context.Context) ([]User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var result []User
+	for _, ID := range m.order {
+		if m.users[ID].Active {
+			result = append(result, copyUser(m.users[ID]))
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryDAO) FindUserByID(_ context.Context, ID int) (*User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[ID]
+	if !ok {
+		return nil, nil
+	}
+	user = copyUser(user)
+	return &user, nil
+}
+
+func (m *MemoryDAO) FindUserByChatID(_ context.Context, chatID int64) (*User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, ID := range m.order {
+		if m.users[ID].ChatID == chatID {
+			user := copyUser(m.users[ID])
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryDAO) UpsertUser(_ context.Context, ID int, username, city string, chatID int64, active bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[ID]
+	if !ok {
+		user = User{ID: ID, RemoteFirst: false}
+		m.order = append(m.order, ID)
+	}
+	user.Username = username
+	user.City = city
+	user.ChatID = chatID
+	user.Active = active
+	m.users[ID] = user
+	return nil
+}
+
+func (m *MemoryDAO) UpdateActiveStatus(_ context.Context, ID int, active bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[ID]
+	if !ok {
+		return errorx.IllegalArgument.New("error updating active status: user %d not found", ID)
+	}
+	user.Active = active
+	m.users[ID] = user
+	return nil
+}
+
+func (m *MemoryDAO) UpdateRemoteFirst(_ context.Context, ID int, remoteFirst bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[ID]
+	if !ok {
+		return errorx.IllegalArgument.New("error updating remote first: user %d not found", ID)
+	}
+	user.RemoteFirst = remoteFirst
+	m.users[ID] = user
+	return nil
+}
+
+func (m *MemoryDAO) UpdateReliability(_ context.Context, ID int, reliability Reliability) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[ID]
+	if !ok {
+		return errorx.IllegalArgument.New("error updating reliability: user %d not found", ID)
+	}
+	user.Reliability = reliability
+	m.users[ID] = user
+	return nil
+}
+
+func (m *MemoryDAO) UpdateProfile(_ context.Context, ID int, profile Profile) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, ok := m.users[ID]
+	if !ok {
+		return errorx.IllegalArgument.New("error updating profile: user %d not found", ID)
+	}
+	user.Profile = profile
+	m.users[ID] = copyUser(user)
+	return nil
+}
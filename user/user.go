@@ -6,17 +6,20 @@ import (
 	"github.com/joomcode/errorx"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type User struct {
-	ID          int    `bson:"_id"`
-	Username    string `bson:"username"`
-	City        string `bson:"city"`
-	ChatID      int64  `bson:"chatId"`
-	Active      bool   `bson:"active"`
-	RemoteFirst bool   `bson:"remoteFirst"`
+	ID          int         `bson:"_id"`
+	Username    string      `bson:"username"`
+	City        string      `bson:"city"`
+	ChatID      int64       `bson:"chatId"`
+	Active      bool        `bson:"active"`
+	RemoteFirst bool        `bson:"remoteFirst"`
+	Reliability Reliability `bson:"reliability"`
+	Profile     Profile     `bson:"profile"`
 }
 
 //goland:noinspection GoNameStartsWithPackageName
@@ -27,7 +30,36 @@ var UserBSON = struct {
 	ChatID      string
 	Active      string
 	RemoteFirst string
-}{"_id", "username", "city", "chatId", "active", "remoteFirst"}
+	Reliability string
+	Profile     string
+}{"_id", "username", "city", "chatId", "active", "remoteFirst", "reliability", "profile"}
+
+// Profile is what the user tells their partners about themselves. Every field is optional
+type Profile struct {
+	Bio string `bson:"bio,omitempty"`
+	// Interests are from config.InterestTags
+	Interests []string `bson:"interests,omitempty"`
+	Languages []string `bson:"languages,omitempty"`
+	Company   string   `bson:"company,omitempty"`
+}
+
+func (p *Profile) IsEmpty() bool {
+	return p.Bio == "" && len(p.Interests) == 0 && len(p.Languages) == 0 && p.Company == ""
+}
+
+// Reliability counts how the user keeps their meetings
+type Reliability struct {
+	// MeetingsHeld are the meetings the user told happened
+	MeetingsHeld int `bson:"meetingsHeld"`
+	// Refusals are the matches the user left before the meeting
+	Refusals int `bson:"refusals"`
+	// NoShows are the meetings that did not happen according to a partner of the user
+	NoShows int `bson:"noShows"`
+	// NoShowsInARow start over when the user holds a meeting or is paused for missing them
+	NoShowsInARow int `bson:"noShowsInARow"`
+	// PausedForMatch is the match whose no-show paused the user, zero if they are not paused for missing meetings
+	PausedForMatch primitive.ObjectID `bson:"pausedForMatch,omitempty"`
+}
 
 type DAO struct {
 	users *mongo.Collection
@@ -73,16 +105,37 @@ func (m *DAO) FindUserByID(ctx context.Context, ID int) (*User, error) {
 	return &user, nil
 }
 
+func (m *DAO) FindUserByChatID(ctx context.Context, chatID int64) (*User, error) {
+	result := m.users.FindOne(ctx, bson.M{UserBSON.ChatID: chatID})
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	if result.Err() != nil {
+		return nil, errorx.Decorate(result.Err(), "can't find the user for chat %d", chatID)
+	}
+
+	var user User
+	err := result.Decode(&user)
+	if err != nil {
+		return nil, errorx.Decorate(err, "can't decode user")
+	}
+
+	return &user, nil
+}
+
+// UpsertUser keeps the preferences of an existing user, so running /start again does not reset them
 func (m *DAO) UpsertUser(ctx context.Context, ID int, username, city string, chatID int64, active bool) error {
-	user := User{
-		ID:          ID,
-		Username:    username,
-		City:        city,
-		ChatID:      chatID,
-		Active:      active,
-		RemoteFirst: false,
-	}
-	_, err := m.users.UpdateOne(ctx, bson.M{UserBSON.ID: ID}, bson.M{"$set": user}, options.Update().SetUpsert(true))
+	update := bson.M{
+		"$set": bson.M{
+			UserBSON.Username: username,
+			UserBSON.City:     city,
+			UserBSON.ChatID:   chatID,
+			UserBSON.Active:   active,
+		},
+		"$setOnInsert": bson.M{UserBSON.RemoteFirst: false},
+	}
+	_, err := m.users.UpdateOne(ctx, bson.M{UserBSON.ID: ID}, update, options.Update().SetUpsert(true))
 	return err
 }
 
@@ -96,3 +149,36 @@ func (m *DAO) UpdateActiveStatus(ctx context.Context, ID int, active bool) error
 	}
 	return nil
 }
+
+func (m *DAO) UpdateReliability(ctx context.Context, ID int, reliability Reliability) error {
+	result, err := m.users.UpdateOne(ctx, bson.M{UserBSON.ID: ID}, bson.M{"$set": bson.M{UserBSON.Reliability: reliability}})
+	if err != nil {
+		return errorx.Decorate(err, "error updating reliability for user %d", ID)
+	}
+	if result.MatchedCount == 0 {
+		return errorx.IllegalArgument.New("error updating reliability: user %d not found", ID)
+	}
+	return nil
+}
+
+func (m *DAO) UpdateProfile(ctx context.Context, ID int, profile Profile) error {
+	result, err := m.users.UpdateOne(ctx, bson.M{UserBSON.ID: ID}, bson.M{"$set": bson.M{UserBSON.Profile: profile}})
+	if err != nil {
+		return errorx.Decorate(err, "error updating profile for user %d", ID)
+	}
+	if result.MatchedCount == 0 {
+		return errorx.IllegalArgument.New("error updating profile: user %d not found", ID)
+	}
+	return nil
+}
+
+func (m *DAO) UpdateRemoteFirst(ctx context.Context, ID int, remoteFirst bool) error {
+	result, err := m.users.UpdateOne(ctx, bson.M{UserBSON.ID: ID}, bson.M{"$set": bson.M{UserBSON.RemoteFirst: remoteFirst}})
+	if err != nil {
+		return errorx.Decorate(err, "error updating remote first for user %d", ID)
+	}
+	if result.MatchedCount == 0 {
+		return errorx.IllegalArgument.New("error updating remote first: user %d not found", ID)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"yandexschooldating/coffeebot"
 	"yandexschooldating/config"
 	"yandexschooldating/user"
 	"yandexschooldating/util"
@@ -12,15 +13,9 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestDao(t *testing.T) {
-	ctx := context.Background()
-	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
-	if err != nil {
-		panic(err)
-	}
-	dao := user.NewDAO(client, "test")
-
-	err = dao.UpsertUser(ctx, 1, "durov", "Dubai", 1, true)
+// testDAO checks the behaviour that every user DAO implementation must share
+func testDAO(t *testing.T, ctx context.Context, dao coffeebot.UserDAO) {
+	err := dao.UpsertUser(ctx, 1, "durov", "Dubai", 1, true)
 	require.NoError(t, err)
 
 	err = dao.UpsertUser(ctx, 2, "nikolai", "Dubai", 2, false)
@@ -35,6 +30,14 @@ func TestDao(t *testing.T) {
 	require.NotNil(t, nikolai)
 	require.Equal(t, "nikolai", nikolai.Username)
 
+	nikolai, err = dao.FindUserByChatID(ctx, 2)
+	require.NoError(t, err)
+	require.NotNil(t, nikolai)
+	require.Equal(t, 2, nikolai.ID)
+	nonExisting, err = dao.FindUserByChatID(ctx, 5)
+	require.NoError(t, err)
+	require.Nil(t, nonExisting)
+
 	active, err := dao.FindActiveUsers(ctx)
 	require.NoError(t, err)
 	require.Len(t, active, 1)
@@ -56,6 +59,70 @@ func TestDao(t *testing.T) {
 	err = dao.UpdateActiveStatus(ctx, 88, true)
 	require.Error(t, err)
 
+	err = dao.UpdateRemoteFirst(ctx, 1, true)
+	require.NoError(t, err)
+	err = dao.UpsertUser(ctx, 1, "durov", "Dubai", 1, true)
+	require.NoError(t, err)
+	durov, err := dao.FindUserByID(ctx, 1)
+	require.NoError(t, err)
+	require.True(t, durov.RemoteFirst)
+	require.True(t, durov.Active)
+
+	err = dao.UpdateRemoteFirst(ctx, 1, false)
+	require.NoError(t, err)
+	durov, err = dao.FindUserByID(ctx, 1)
+	require.NoError(t, err)
+	require.False(t, durov.RemoteFirst)
+
+	err = dao.UpdateRemoteFirst(ctx, 88, true)
+	require.Error(t, err)
+
+	require.Equal(t, user.Reliability{}, durov.Reliability)
+	reliability := user.Reliability{MeetingsHeld: 3, Refusals: 1, NoShows: 2, NoShowsInARow: 1}
+	err = dao.UpdateReliability(ctx, 1, reliability)
+	require.NoError(t, err)
+	err = dao.UpsertUser(ctx, 1, "durov", "Dubai", 1, true)
+	require.NoError(t, err)
+	durov, err = dao.FindUserByID(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, reliability, durov.Reliability)
+
+	err = dao.UpdateReliability(ctx, 88, reliability)
+	require.Error(t, err)
+
+	require.True(t, durov.Profile.IsEmpty())
+	profile := user.Profile{Bio: "Основатель", Interests: []string{"Путешествия"}, Languages: []string{"русский", "English"}, Company: "Telegram"}
+	err = dao.UpdateProfile(ctx, 1, profile)
+	require.NoError(t, err)
+	err = dao.UpsertUser(ctx, 1, "durov", "Dubai", 1, true)
+	require.NoError(t, err)
+	durov, err = dao.FindUserByID(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, profile, durov.Profile)
+	require.False(t, durov.Profile.IsEmpty())
+	active, err = dao.FindActiveUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, profile, active[0].Profile)
+
+	err = dao.UpdateProfile(ctx, 1, user.Profile{Company: "Telegram"})
+	require.NoError(t, err)
+	durov, err = dao.FindUserByID(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, user.Profile{Company: "Telegram"}, durov.Profile)
+
+	err = dao.UpdateProfile(ctx, 88, profile)
+	require.Error(t, err)
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	client, err := util.GetMongoClient(ctx, config.MongoUri, 2*time.Second)
+	if err != nil {
+		panic(err)
+	}
+	dao := user.NewDAO(client, "test")
+	testDAO(t, ctx, dao)
+
 	err = client.Disconnect(ctx)
 	if err != nil {
 		panic(err)
@@ -63,9 +130,21 @@ func TestDao(t *testing.T) {
 
 	_, err = dao.FindUserByID(ctx, 2)
 	require.Error(t, err)
+	_, err = dao.FindUserByChatID(ctx, 2)
+	require.Error(t, err)
 	_, err = dao.FindActiveUsers(ctx)
 	require.Error(t, err)
 
 	err = dao.UpdateActiveStatus(ctx, 1, false)
 	require.Error(t, err)
+	err = dao.UpdateRemoteFirst(ctx, 1, false)
+	require.Error(t, err)
+	err = dao.UpdateReliability(ctx, 1, user.Reliability{})
+	require.Error(t, err)
+	err = dao.UpdateProfile(ctx, 1, user.Profile{})
+	require.Error(t, err)
+}
+
+func TestMemoryDAO(t *testing.T) {
+	testDAO(t, context.Background(), user.NewMemoryDAO())
 }
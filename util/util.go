@@ -52,3 +52,13 @@ func GetLocationForCityOrUTC(city string) *time.Location {
 	}
 	return time.UTC
 }
+
+// GetUTCOffset returns the UTC offset of the city at the given moment and false if the city timezone is unknown
+func GetUTCOffset(city string, t time.Time) (time.Duration, bool) {
+	location, ok := config.CitiesLocation[city]
+	if !ok {
+		return 0, false
+	}
+	_, offset := t.In(location).Zone()
+	return time.Duration(offset) * time.Second, true
+}
@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/joomcode/errorx"
+)
+
+// SecretTokenHeader is the header in which Telegram sends the secret token passed to setWebhook
+const SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// Handler accepts updates POSTed by Telegram and sends them to the updates channel
+type Handler struct {
+	secretToken string
+	updates     chan<- tgbotapi.Update
+}
+
+// NewHandler creates a handler that accepts requests with the secret token. An empty secret token accepts no requests
+func NewHandler(secretToken string, updates chan<- tgbotapi.Update) *Handler {
+	return &Handler{secretToken: secretToken, updates: updates}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if h.secretToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretTokenHeader)), []byte(h.secretToken)) != 1 {
+		log.Printf("webhook request from %s with wrong secret token", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var update tgbotapi.Update
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		log.Printf("can't decode webhook update %+v", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// SetWebhook limits Telegram to one connection, so it waits for the response before sending the next update
+	// and the updates reach the channel in order
+	select {
+	case h.updates <- update:
+	case <-r.Context().Done():
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetWebhook tells Telegram to send updates to webhookURL along with the secret token.
+// By default Telegram sends updates over up to 40 parallel connections, which may reorder the messages of a chat,
+// and the dialogs depend on their order, so only one connection is allowed.
+// The telegram-bot-api version we use does not know about secret tokens, so the request is made directly
+func SetWebhook(bot *tgbotapi.BotAPI, webhookURL string, secretToken string) error {
+	params := url.Values{}
+	params.Set("url", webhookURL)
+	params.Set("secret_token", secretToken)
+	params.Set("max_connections", "1")
+	_, err := bot.MakeRequest("setWebhook", params)
+	if err != nil {
+		return errorx.Decorate(err, "can't set webhook")
+	}
+	return nil
+}
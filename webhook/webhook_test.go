@@ -0,0 +1,120 @@
+package webhook_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"yandexschooldating/messagestrings"
+	"yandexschooldating/webhook"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/require"
+)
+
+const secretToken = "correct-horse-battery-staple"
+
+func post(handler http.Handler, body []byte, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	if token != "" {
+		request.Header.Set(webhook.SecretTokenHeader, token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestHandler(t *testing.T) {
+	recorded, err := ioutil.ReadFile("testdata/update.json")
+	require.NoError(t, err)
+
+	t.Run("Recorded update", func(t *testing.T) {
+		updates := make(chan tgbotapi.Update, 1)
+		handler := webhook.NewHandler(secretToken, updates)
+
+		response := post(handler, recorded, secretToken)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Len(t, updates, 1)
+
+		update := <-updates
+		require.Equal(t, 873920415, update.UpdateID)
+		require.NotNil(t, update.Message)
+		require.Equal(t, 104728331, update.Message.From.ID)
+		require.Equal(t, "ivan", update.Message.From.UserName)
+		require.Equal(t, int64(104728331), update.Message.Chat.ID)
+		require.Equal(t, messagestrings.RemindMe, update.Message.Text)
+	})
+
+	t.Run("Wrong or missing secret token", func(t *testing.T) {
+		updates := make(chan tgbotapi.Update, 1)
+		handler := webhook.NewHandler(secretToken, updates)
+
+		response := post(handler, recorded, "guess")
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+
+		response = post(handler, recorded, "")
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+		require.Len(t, updates, 0)
+	})
+
+	t.Run("Empty secret token accepts nothing", func(t *testing.T) {
+		updates := make(chan tgbotapi.Update, 1)
+		handler := webhook.NewHandler("", updates)
+
+		response := post(handler, recorded, "")
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+		require.Len(t, updates, 0)
+	})
+
+	t.Run("Malformed update", func(t *testing.T) {
+		updates := make(chan tgbotapi.Update, 1)
+		handler := webhook.NewHandler(secretToken, updates)
+
+		response := post(handler, []byte("{\"update_id\": "), secretToken)
+		require.Equal(t, http.StatusBadRequest, response.Code)
+		require.Len(t, updates, 0)
+	})
+
+	t.Run("Only POST is accepted", func(t *testing.T) {
+		updates := make(chan tgbotapi.Update, 1)
+		handler := webhook.NewHandler(secretToken, updates)
+
+		request := httptest.NewRequest(http.MethodGet, "/webhook", nil)
+		request.Header.Set(webhook.SecretTokenHeader, secretToken)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+		require.Len(t, updates, 0)
+	})
+}
+
+type roundTripper func(request *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestSetWebhook(t *testing.T) {
+	var params url.Values
+	client := &http.Client{Transport: roundTripper(func(request *http.Request) (*http.Response, error) {
+		body := `{"ok": true, "result": {"id": 1, "is_bot": true, "username": "coffee_bot"}}`
+		if strings.HasSuffix(request.URL.Path, "/setWebhook") {
+			require.NoError(t, request.ParseForm())
+			params = request.PostForm
+			body = `{"ok": true, "result": true}`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+	})}
+	bot, err := tgbotapi.NewBotAPIWithClient("token", client)
+	require.NoError(t, err)
+
+	require.NoError(t, webhook.SetWebhook(bot, "https://example.com/telegram", secretToken))
+	require.Equal(t, "https://example.com/telegram", params.Get("url"))
+	require.Equal(t, secretToken, params.Get("secret_token"))
+	// one connection keeps the updates in order
+	require.Equal(t, "1", params.Get("max_connections"))
+}